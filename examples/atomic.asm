@@ -0,0 +1,54 @@
+; Exercises the A extension. A lock and a counter live below the stack pointer.
+
+main:
+    addi        sp, sp, -16
+    mv          s0, sp              ; s0 = lock, s0 + 4 = counter
+    addi        s1, sp, 4
+    li          s2, 5               ; Loop count
+
+loop:
+    ; Acquire the lock
+    li          t0, 1
+acquire:
+    amoswap.w.aq t1, t0, (s0)
+    bne         t1, zero, acquire
+
+    ; Increment the counter with lr/sc
+retry:
+    lr.w        t2, (s1)
+    addi        t2, t2, 1
+    sc.w        t3, t2, (s1)
+    bne         t3, zero, retry
+
+    ; Release the lock
+    amoswap.w.rl zero, zero, 0(s0)
+
+    addi        s2, s2, -1
+    bne         s2, zero, loop
+
+    lw          a0, 4(sp)           ; 5
+
+    ; sc fails after an intervening store to the reserved word
+    lr.w        t0, (s1)
+    sw          zero, 4(sp)
+    li          t1, 42
+    sc.w        a1, t1, (s1)        ; 1, memory stays 0
+    sc.w        a2, t1, (s1)        ; 1, no reservation left
+
+    ; A store to another word keeps the reservation
+    lr.w        t0, (s1)
+    sw          t1, 8(sp)
+    sc.w        a3, t1, (s1)        ; 0, counter = 42
+
+    ; Read-modify-write operations return the old value
+    li          t0, -8
+    amoadd.w    a4, t0, (s1)        ; 42, counter = 34
+    amoxor.w    a5, t0, (s1)        ; 34, counter = 34 ^ -8 = -38
+    amoand.w    a6, t0, (s1)        ; -38, counter = -40
+    amoor.w     a7, s2, (s1)        ; -40, counter = -40
+    amomax.w    s3, s2, (s1)        ; -40, counter = 0
+    amomin.w    s4, t0, (s1)        ; 0, counter = -8
+    amomaxu.w   s5, t1, (s1)        ; -8, counter = -8
+    amominu.w   s6, t1, (s1)        ; -8, counter = 42
+    lw          s7, 4(sp)           ; Used right after the atomic
+    addi        s7, s7, 1           ; 43
@@ -0,0 +1,68 @@
+; Bit manipulation, the Zba, Zbb and Zbs extensions.
+
+main:
+    ; Address generation, index an array of words and doubles
+    li      a0, 256
+    li      a1, 5
+    sh1add  s0, a1, a0          ; 266
+    sh2add  s1, a1, a0          ; 276
+    sh3add  s2, a1, a0          ; 296
+
+    ; Logic with a negated operand
+    li      a2, 240
+    li      a3, 60
+    andn    s3, a2, a3          ; 192
+    orn     s4, a2, a3          ; -61
+    xnor    s5, a2, a3          ; -205
+
+    ; Counting bits
+    li      a4, 1048576         ; 1 << 20
+    clz     s6, a4              ; 11
+    ctz     s7, a4              ; 20
+    clz     t0, zero            ; 32
+    ctz     t1, zero            ; 32
+    li      a5, -16
+    cpop    s8, a5              ; 28
+
+    ; Signed and unsigned minimum and maximum
+    li      a6, -7
+    li      a7, 3
+    min     t2, a6, a7          ; -7
+    max     t3, a6, a7          ; 3
+    minu    t4, a6, a7          ; 3
+    maxu    t5, a6, a7          ; -7
+
+    ; Extensions
+    li      a2, 33023           ; 0x80ff
+    sext.b  t6, a2              ; -1
+    sext.h  s9, a2              ; -32513
+    li      a3, -1
+    zext.h  s10, a3             ; 65535
+
+    ; Rotates, byte reversal and the byte-wise or combine
+    li      a4, -2147483647     ; 0x80000001
+    li      a5, 4
+    rol     s11, a4, a5         ; 24
+    ror     a0, a4, a5          ; 402653184
+    rori    a1, a4, 1           ; -1073741824
+    li      a6, 66051           ; 0x00010203
+    rev8    a2, a6              ; 50462976
+    li      a7, 4096            ; 0x00001000
+    orc.b   a3, a7              ; 65280
+
+    ; Single bits
+    li      a4, 255
+    li      a5, 3
+    bclr    a6, a4, a5          ; 247
+    bext    a7, a4, a5          ; 1
+    binv    s0, a4, a5          ; 247
+    bset    s1, zero, a5        ; 8
+    bclri   s2, a4, 0           ; 254
+    bexti   s3, a4, 8           ; 0
+    binvi   s4, a4, 31          ; -2147483393
+    bseti   s5, a4, 10          ; 1279
+
+    ; Results through memory
+    li      t0, 512
+    sw      s4, 0(t0)
+    sw      a3, 4(t0)
@@ -0,0 +1,84 @@
+; Compressed instructions mixed with regular ones. Compressed instructions
+; take 2 bytes, so labels, jump offsets and return addresses all depend on
+; the sizes of the instructions before them.
+
+handler:
+    csrr    s7, mcause          ; 2, jumped into the middle of an instruction
+    csrw    mepc, ra            ; Return after the jump
+    mret
+
+main:
+    la      t0, handler
+    csrw    mtvec, t0
+
+    ; Fill an array with 10..1
+    c.li    s0, 10
+    li      s1, 256
+fill:
+    c.sw    s0, 0(s1)
+    c.addi  s1, 4
+    c.addi  s0, -1
+    c.bnez  s0, fill
+
+    ; Sum it back, with a regular branch over compressed instructions
+    c.li    a0, 0
+    li      a1, 256
+    c.li    a2, 10
+sum:
+    c.lw    a3, 0(a1)
+    c.add   a0, a3
+    c.addi  a1, 4
+    c.addi  a2, -1
+    bne     a2, zero, sum
+    c.mv    s2, a0              ; 55
+
+    ; c.jal links to the instruction right after the 2 byte jump
+    c.li    a0, 5
+    c.jal   factorial
+    c.mv    s3, a0              ; 120
+
+    ; Stack pointer relative accesses
+    c.addi16sp sp, -16
+    c.swsp  s3, 12(sp)
+    c.lwsp  s4, 12(sp)          ; 120
+    c.addi4spn a5, sp, 12       ; 1020
+    c.lw    a4, 0(a5)           ; 120
+    c.addi16sp sp, 16
+
+    ; Shifts and logic
+    c.lui   a1, 1               ; 4096
+    c.srli  a1, 4               ; 256
+    c.slli  a1, 1               ; 512
+    c.li    a2, 7
+    c.andi  a2, 3               ; 3
+    c.or    a1, a2              ; 515
+    c.li    a3, 15
+    c.xor   a3, a2              ; 12
+    c.sub   a3, a2              ; 9
+    c.srai  a3, 1               ; 4
+    c.and   a3, a1              ; 0
+
+    ; Doubles through memory
+    fcvt.d.w fs0, s3
+    c.fsd   fs0, 0(s1)
+    c.fld   fs1, 0(s1)
+    fcvt.w.d s5, fs1            ; 120
+
+    ; The second half of a 4 byte instruction is not an instruction
+    la      t1, main
+    c.addi  t1, 2
+    c.jalr  t1
+
+    c.nop
+    c.j     end
+
+factorial:
+    c.li    a1, 1
+fact_loop:
+    mul     a1, a1, a0
+    c.addi  a0, -1
+    c.bnez  a0, fact_loop
+    c.mv    a0, a1
+    c.jr    ra
+
+end:
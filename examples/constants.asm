@@ -0,0 +1,43 @@
+; Numeric literals, constant expressions and .equ/.set constants. Every
+; immediate operand and data value can be an expression.
+
+.equ ROWS, 3
+.equ COLS, 4
+.equ ELEM_SIZE, 4
+.equ ROW_SIZE, COLS * ELEM_SIZE
+.set FLAGS, 0b0101 | 1 << 3         ; 13
+
+.data
+; A 3x4 matrix of words, row i is i * 16 + j
+matrix:
+    .word 0x00, 0x01, 0x02, 0x03
+    .word 0x10, 0x11, 0x12, 0x13
+    .word 0x20, 0x21, 0x22, 0x23
+text:
+    .byte 'a', 'b', ';', '\n', '\'', '\x7f', ~'a' & 0xff, 0
+
+.text
+main:
+    la      a0, matrix
+    lw      s0, (1 * COLS + 2) * ELEM_SIZE(a0)  ; matrix[1][2] = 18
+    lw      s1, 2*ROW_SIZE + 3*ELEM_SIZE(a0)    ; matrix[2][3] = 35
+    li      s2, FLAGS
+    li      s3, ROWS * COLS - 1                 ; 11
+    li      s4, 0xdead << 4 >> 8                ; 0xdea = 3562
+    li      s5, -(ROWS - COLS) * -2             ; -2
+    li      s6, ~0x0f & 0xff                    ; 240
+    li      s7, 100 / 7 * 7                     ; 98
+    li      s8, 'A' + 25                        ; 'Z' = 90
+
+    ; Comma-less operands, a sign after a space starts the next operand
+    addi    sp sp -ELEM_SIZE
+    li      t0, 017                             ; Octal, 15
+    sw      t0 0(sp)
+    lw      s9, 0 (sp)
+
+    ; The set constant can be redefined
+    .set FLAGS, FLAGS + 1
+    li      s10, FLAGS                          ; 14
+
+    la      t1, text
+    lbu     s11, 6(t1)                          ; ~'a' & 0xff = 158
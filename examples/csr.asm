@@ -0,0 +1,56 @@
+; Exercises the Zicsr extension and the hardware performance counters.
+; Cycle counts depend on the pipeline configuration, so only values that
+; don't are kept in registers.
+
+main:
+    ; Retired instruction count of a straight-line section
+    rdinstret   t0
+    addi        t1, zero, 1
+    addi        t1, t1, 1
+    addi        t1, t1, 1
+    rdinstret   t2
+    sub         a0, t2, t0          ; 4, the three addi and the first rdinstret
+
+    ; Measure a loop
+    rdcycle     t0
+    li          t1, 10
+loop:
+    addi        t1, t1, -1
+    bne         t1, zero, loop
+    rdcycle     t2
+    sub         t3, t2, t0
+    sltiu       a1, t3, 21          ; 0, the loop takes more than 20 cycles
+    rdtime      t4
+    sltu        a2, t0, t4          ; 1, time keeps going up
+    li          t2, 0               ; Clear the raw counts
+    li          t3, 0
+    li          t4, 0
+
+    ; The upper halves are zero for such a short program
+    rdcycleh    a3
+    rdinstreth  a4
+
+    ; Branch counter, 10 from the loop
+    csrr        a5, hpmcounter4
+
+    ; Machine counters are writable
+    csrw        minstret, zero
+    csrr        a6, minstret        ; 1, only the csrw retired since
+    li          t0, 1000
+    csrw        mcycle, t0
+    csrr        t1, mcycle
+    sltiu       a7, t1, 1000        ; 0
+
+    ; fcsr fields through their CSRs
+    csrrwi      s2, frm, 3          ; 0, rounding mode is now rup
+    csrsi       fflags, 5           ; NX and OF
+    csrrci      s3, fflags, 1       ; 5, leaves OF
+    csrr        s4, fcsr            ; 3 << 5 | 4 = 100
+    li          t0, 1
+    li          t1, 3
+    fcvt.s.w    ft0, t0
+    fcvt.s.w    ft1, t1
+    fdiv.s      ft2, ft0, ft1       ; Rounded up with the dynamic rounding mode
+    fmv.x.w     s5, ft2             ; 0x3eaaaaab = 1051372203
+    csrrw       s6, fcsr, zero      ; 101, NX from the division
+    frcsr       s7                  ; 0
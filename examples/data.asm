@@ -0,0 +1,91 @@
+; Data sections. .data, .rodata and .bss are laid out in the memory from
+; address 0, their labels are addresses loaded with la, or used directly as the
+; immediate of loads and stores in the first 2 KiB.
+;
+; The program copies a string in upper case to a buffer in .bss, sums a
+; table of halfwords and follows a table of pointers to strings.
+
+.data
+counter:    .word 0
+greeting:   .string "Hello, \"RISC-V\"; world!\n"
+    .align 2
+squares:
+    .half 0, 1, 4, 9, 16, 25, 36, 49
+    .half -1, -4
+bytes:      .byte 1, 2, 3, 255, -128
+
+.rodata
+    .align 2
+names:      .word name0, name1, name2   ; Pointers to the names below
+name0:      .asciz "zero"
+name1:      .ascii "one", "\0"
+name2:      .string "tw\157"
+
+.bss
+    .align 3
+upper:      .space 32
+sum:        .zero 4
+
+.text
+; toupper(dst, src), copies the NUL terminated string at src to dst in upper case
+toupper:
+    lbu     t0, 0(a1)
+    li      t1, 97              ; 'a'
+    blt     t0, t1, store
+    li      t1, 122             ; 'z'
+    bgt     t0, t1, store
+    addi    t0, t0, -32
+store:
+    sb      t0, 0(a0)
+    addi    a0, a0, 1
+    addi    a1, a1, 1
+    bne     t0, zero, toupper
+    ret
+
+; strlen(s)
+strlen:
+    mv      t0, a0
+len_loop:
+    lbu     t1, 0(t0)
+    addi    t0, t0, 1
+    bne     t1, zero, len_loop
+    sub     a0, t0, a0
+    addi    a0, a0, -1
+    ret
+
+main:
+    la      a0, upper
+    la      a1, greeting
+    call    toupper
+
+    ; Sum of the halfwords, sign-extended
+    la      t0, squares
+    li      t1, 10
+    li      t2, 0
+sum_loop:
+    lh      t3, 0(t0)
+    add     t2, t2, t3
+    addi    t0, t0, 2
+    addi    t1, t1, -1
+    bne     t1, zero, sum_loop
+    sw      t2, sum             ; 140 - 5 = 135
+
+    ; Length of every name through the pointer table
+    la      s0, names
+    li      s1, 0
+    li      s2, 3
+names_loop:
+    lw      a0, 0(s0)
+    call    strlen
+    add     s1, s1, a0
+    addi    s0, s0, 4
+    addi    s2, s2, -1
+    bne     s2, zero, names_loop   ; s1 = 4 + 3 + 3 = 10
+
+    lw      t0, counter
+    addi    t0, t0, 1
+    sw      t0, counter
+
+    la      t0, bytes
+    lbu     s3, 3(t0)           ; 255
+    lb      s4, 4(t0)           ; -128
@@ -0,0 +1,61 @@
+; Exercises the D extension. Results are stored below the stack pointer.
+
+main:
+    li          t0, 7
+    li          t1, -4
+    fcvt.d.w    fa0, t0             ; 7.0
+    fcvt.d.w    fa1, t1             ; -4.0
+
+    fadd.d      ft0, fa0, fa1       ; 3.0
+    fsub.d      ft1, fa0, fa1       ; 11.0
+    fmul.d      ft2, fa0, fa1       ; -28.0
+    fdiv.d      ft3, fa0, fa1       ; -1.75
+    fsqrt.d     ft4, fa0            ; 2.6457513110645907
+    fmadd.d     ft5, fa0, fa1, ft1  ; 7 * -4 + 11 = -17.0
+    fmsub.d     ft6, fa0, fa1, ft1  ; 7 * -4 - 11 = -39.0
+    fmin.d      ft7, fa0, fa1       ; -4.0
+    fneg.d      ft8, ft3            ; 1.75
+    fabs.d      ft9, fa1            ; 4.0
+
+    addi        sp, sp, -80
+    fsd         ft0, 0(sp)
+    fsd         ft1, 8(sp)
+    fsd         ft2, 16(sp)
+    fsd         ft3, 24(sp)
+    fsd         ft4, 32(sp)
+    fsd         ft5, 40(sp)
+    fsd         ft6, 48(sp)
+    fsd         ft7, 56(sp)
+    fsd         ft8, 64(sp)
+    fsd         ft9, 72(sp)
+
+    ; Load back and use the values right away
+    fld         fs0, 24(sp)
+    fadd.d      fs1, fs0, fs0       ; -3.5
+
+    ; Conversions between precisions, 1/3 is not exact in single precision
+    li          t2, 3
+    fcvt.d.w    fs2, t2
+    fdiv.d      fs3, ft0, fs2       ; 1.0
+    fdiv.d      fs4, fs3, fs2       ; 0.333...
+    fcvt.s.d    fs5, fs4            ; Rounded, inexact
+    fcvt.d.s    fs6, fs5            ; Exact, but differs from fs4
+    feq.d       s2, fs4, fs6        ; 0
+    flt.d       s3, fs4, fs6        ; 1, 1/3 rounds up in single precision
+    fsw         fs5, -4(sp)
+    fsd         fs6, -16(sp)
+
+    ; Conversions to integer
+    fcvt.w.d    a0, ft3             ; -1.75 -> -2 (rne)
+    fcvt.w.d    a1, ft3, rtz        ; -1
+    fcvt.wu.d   a2, ft1             ; 11
+    fcvt.wu.d   a3, ft3, rtz        ; 0, invalid
+    li          t3, -1
+    fcvt.d.wu   fs7, t3             ; 4294967295.0, exact
+    fcvt.w.d    a4, fs7             ; Saturates to 0x7fffffff, invalid
+
+    ; Compares and classification
+    fle.d       s4, fa1, fa0        ; 1
+    fclass.d    s5, fa1             ; negative normal = 2
+    fclass.d    s6, fs5             ; A NaN-boxed single is a quiet NaN as a double = 512
+    frflags     s7                  ; NV and NX
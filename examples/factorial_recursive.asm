@@ -6,7 +6,7 @@ factorial:
         sw      s0,8(sp)
         mv      s0,a0
         addi    a0,a0,-1
-        call    factorial   ; jal ra factorial
+        call    factorial   ; auipc ra + jalr ra
         mul     a0,a0,s0
         lw      ra,12(sp)
         lw      s0,8(sp)
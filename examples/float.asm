@@ -0,0 +1,59 @@
+; Exercises the F extension. Results are stored below the stack pointer.
+
+main:
+    li          t0, 3
+    li          t1, -2
+    fcvt.s.w    fa0, t0             ; 3.0
+    fcvt.s.w    fa1, t1             ; -2.0
+
+    fadd.s      ft0, fa0, fa1       ; 1.0
+    fsub.s      ft1, fa0, fa1       ; 5.0
+    fmul.s      ft2, fa0, fa1       ; -6.0
+    fdiv.s      ft3, fa0, fa1       ; -1.5
+    fsqrt.s     ft4, ft1            ; 2.236068
+    fmadd.s     ft5, fa0, fa1, ft1  ; 3 * -2 + 5 = -1.0
+    fnmsub.s    ft6, fa0, fa1, ft1  ; -(3 * -2) + 5 = 11.0
+    fmin.s      ft7, fa0, fa1       ; -2.0
+    fmax.s      ft8, fa0, fa1       ; 3.0
+    fneg.s      ft9, ft3            ; 1.5
+    fabs.s      ft10, fa1           ; 2.0
+
+    addi        sp, sp, -44
+    fsw         ft0, 0(sp)
+    fsw         ft1, 4(sp)
+    fsw         ft2, 8(sp)
+    fsw         ft3, 12(sp)
+    fsw         ft4, 16(sp)
+    fsw         ft5, 20(sp)
+    fsw         ft6, 24(sp)
+    fsw         ft7, 28(sp)
+    fsw         ft8, 32(sp)
+    fsw         ft9, 36(sp)
+    fsw         ft10, 40(sp)
+
+    ; Load back and use the values right away
+    flw         fs0, 12(sp)
+    fadd.s      fs1, fs0, fs0       ; -3.0
+
+    ; Conversions with explicit and dynamic rounding modes
+    fcvt.w.s    a0, ft3             ; -1.5 -> -2 (rne)
+    fcvt.w.s    a1, ft3, rtz        ; -1
+    fcvt.w.s    a2, ft3, rup        ; -1
+    fcvt.wu.s   a3, ft3, rtz        ; 0, invalid
+    fmv.x.w     a4, fs1             ; 0xc0400000
+
+    ; Compares and classification
+    feq.s       s2, fa0, ft8        ; 1
+    flt.s       s3, fa0, fa1        ; 0
+    fle.s       s4, fa1, fa0        ; 1
+    fclass.s    s5, fa1             ; negative normal = 2
+
+    ; Exception flags and rounding mode
+    frflags     s6                  ; NV from fcvt.wu.s, NX from the conversions and fsqrt
+    fsflags     zero
+    li          t2, 1
+    fsrm        t2                  ; Round towards zero from now on
+    fcvt.w.s    s7, ft9             ; 1.5 -> 1
+    fdiv.s      ft11, fa0, ft0      ; 3.0, exact
+    frflags     s8                  ; NX from the conversion
+    frcsr       s9                  ; rtz with NX = 0x21
@@ -0,0 +1,140 @@
+	.file	"example.c"
+	.option nopic
+	.attribute arch, "rv32i2p1_m2p0_a2p1_f2p2_d2p2_c2p0_zicsr2p0_zifencei2p0"
+	.attribute unaligned_access, 0
+	.attribute stack_align, 16
+# Written after the output of 'riscv32-unknown-elf-gcc -O1 -S' and edited by
+# hand, it has the directives, the relocations and the sections of GCC's
+# output but not all of its code. See llvm.asm for unmodified compiler output.
+# The C program:
+#
+#   const char *msg = "Hello";
+#   int table[5] = {3, 1, 4, 1, 5};
+#   int counter;
+#
+#   int strlen_(const char *s) { int n = 0; while (*s++) n++; return n; }
+#   int sum(int *a, int n) { int s = 0; for (int i = 0; i < n; i++) s += a[i]; return s; }
+#   void delay(int n) { asm volatile("1: addi x10, x10, -1\n bnez x10, 1b" : : "r"(n)); }
+#
+#   int main() {
+#       delay(3);
+#       counter = sum(table, 5) + strlen_(msg);
+#       return counter;
+#   }
+	.text
+	.align	1
+	.globl	strlen_
+	.type	strlen_, @function
+strlen_:
+	lbu	a5,0(a0)
+	beq	a5,zero,.L4
+	mv	a5,a0
+	li	a0,0
+.L3:
+	addi	a0,a0,1
+	addi	a5,a5,1
+	lbu	a4,0(a5)
+	bne	a4,zero,.L3
+	ret
+.L4:
+	li	a0,0
+	ret
+	.size	strlen_, .-strlen_
+	.align	1
+	.globl	sum
+	.type	sum, @function
+sum:
+	ble	a1,zero,.L10
+	mv	a5,a0
+	slli	a1,a1,2
+	add	a1,a0,a1
+	li	a0,0
+.L9:
+	lw	a4,0(a5)
+	add	a0,a0,a4
+	addi	a5,a5,4
+	bne	a5,a1,.L9
+	ret
+.L10:
+	li	a0,0
+	ret
+	.size	sum, .-sum
+	.align	1
+	.globl	delay
+	.type	delay, @function
+delay:
+ #APP
+# 7 "example.c" 1
+	1: addi x10, x10, -1
+ bnez x10, 1b
+# 0 "" 2
+ #NO_APP
+	ret
+	.size	delay, .-delay
+	.section	.text.startup,"ax",@progbits
+	.align	1
+	.globl	main
+	.type	main, @function
+main:
+.LFB3:
+	.cfi_startproc
+	addi	sp,sp,-16
+	.cfi_def_cfa_offset 16
+	sw	ra,12(sp)
+	sw	s0,8(sp)
+	.cfi_offset 1, -4
+	.cfi_offset 8, -8
+	li	a0,3
+	call	delay
+	li	a1,5
+	lui	a0,%hi(table)
+	addi	a0,a0,%lo(table)
+	call	sum
+	mv	s0,a0
+	lui	a5,%hi(msg)
+	lw	a0,%lo(msg)(a5)
+	call	strlen_
+	add	a0,s0,a0
+	lui	a5,%hi(counter)
+	sw	a0,%lo(counter)(a5)
+	lw	ra,12(sp)
+	.cfi_restore 1
+	lw	s0,8(sp)
+	.cfi_restore 8
+	addi	sp,sp,16
+	.cfi_def_cfa_offset 0
+	jr	ra
+	.cfi_endproc
+.LFE3:
+	.size	main, .-main
+	.globl	counter
+	.section	.sbss,"aw",@nobits
+	.align	2
+	.type	counter, @object
+	.size	counter, 4
+counter:
+	.zero	4
+	.globl	table
+	.section	.sdata,"aw"
+	.align	2
+	.type	table, @object
+	.size	table, 20
+table:
+	.word	3
+	.word	1
+	.word	4
+	.word	1
+	.word	5
+	.globl	msg
+	.section	.rodata.str1.4,"aMS",@progbits,1
+	.align	2
+.LC0:
+	.string	"Hello"
+	.section	.sdata
+	.align	2
+	.type	msg, @object
+	.size	msg, 4
+msg:
+	.word	.LC0
+	.ident	"GCC: (g2ee5e430018) 12.2.0"
+	.section	.note.GNU-stack,"",@progbits
@@ -0,0 +1,11 @@
+; Stack helpers, included by macro.asm
+
+.macro push reg, size=4
+    addi    sp, sp, -\size
+    sw      \reg, 0(sp)
+.endm
+
+.macro pop reg, size=4
+    lw      \reg, 0(sp)
+    addi    sp, sp, \size
+.endm
@@ -0,0 +1,101 @@
+; Timer and software interrupts from the CLINT, with mtvec in vectored mode.
+; The timer keeps interrupting a loop that sums into memory, the sum must come
+; out right wherever the interrupts land. Interrupt timing depends on the
+; pipeline configuration, so the handlers only use t0 and t1 and those are
+; cleared at the end.
+;
+; CLINT registers:
+;   msip        33554432 (0x2000000)
+;   mtimecmp    33570816 (0x2004000)
+;   mtime       33603576 (0x200bff8)
+
+vectors:
+    j       exception           ; 0, exceptions
+    addi    zero, zero, 0
+    addi    zero, zero, 0
+    j       software            ; 3, machine software interrupt
+    addi    zero, zero, 0
+    addi    zero, zero, 0
+    addi    zero, zero, 0
+    j       timer               ; 7, machine timer interrupt
+
+exception:
+    csrr    a2, mcause          ; 11
+    csrr    t0, mepc
+    addi    t0, t0, 4
+    csrw    mepc, t0
+    mret
+
+software:
+    csrr    a1, mcause          ; -2147483645, interrupt 3
+    li      t0, 33554432
+    sw      zero, 0(t0)         ; Clear msip
+    addi    s5, s5, 1
+    mret
+
+timer:
+    csrr    a0, mcause          ; -2147483641, interrupt 7
+    addi    s1, s1, 1           ; Ticks
+    li      t0, 33603576
+    lw      t1, 0(t0)           ; mtime
+    addi    t1, t1, 40          ; Next tick in 40 cycles
+    li      t0, 33570816
+    sw      t1, 0(t0)
+    li      t1, 5
+    blt     s1, t1, timer_done
+
+    ; Stop the timer after 5 ticks
+    li      t1, -1
+    sw      t1, 4(t0)           ; mtimecmp high, the timer never fires again
+    li      t1, 128
+    csrc    mie, t1
+timer_done:
+    mret
+
+main:
+    la      t0, vectors
+    ori     t0, t0, 1           ; Vectored mode
+    csrw    mtvec, t0
+
+    ; Exceptions still go to the base
+    ecall
+
+    ; First tick in 40 cycles
+    li      t0, 33570816
+    sw      zero, 4(t0)         ; mtimecmp high
+    li      t1, 33603576
+    lw      t1, 0(t1)
+    addi    t1, t1, 40
+    sw      t1, 0(t0)
+
+    li      t1, 136             ; MTIE | MSIE
+    csrs    mie, t1
+    csrsi   mstatus, 8          ; MIE
+
+    ; Sum 1..100 into memory while the timer interrupts
+    li      s2, 100
+    li      s3, 64              ; Address of the sum
+sum:
+    lw      s4, 0(s3)
+    add     s4, s4, s2
+    sw      s4, 0(s3)
+    addi    s2, s2, -1
+    bne     s2, zero, sum
+
+    ; Wait for the rest of the ticks
+    li      s6, 5
+wait_timer:
+    blt     s1, s6, wait_timer
+
+    ; Raise a software interrupt and wait for it
+    li      s7, 33554432
+    li      s8, 1
+    sw      s8, 0(s7)
+wait_software:
+    beq     s5, zero, wait_software
+
+    csrr    s9, mip             ; 0, nothing is pending
+    csrr    s10, mstatus        ; 136, MIE and MPIE
+
+    li      t0, 0
+    li      t1, 0
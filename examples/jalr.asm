@@ -0,0 +1,47 @@
+; Calls and returns through 'jalr rd, offset(rs1)', the form compilers emit
+; for calls through a pointer and for returns. 'jalr rd, rs1, offset' and
+; 'jalr rd, (rs1)' are the same instruction.
+
+.text
+main:
+        addi    sp, sp, -16
+        sw      ra, 12(sp)
+
+        la      t0, double
+        li      a0, 5
+        jalr    ra, 0(t0)           ; a0 = 5 + 5 + 100
+        mv      s0, a0
+
+        la      t0, table
+        lw      t1, 4(t0)           ; Address of increment
+        li      a0, 41
+        jalr    ra, 0(t1)           ; a0 = 42
+        mv      s1, a0
+
+        ; Skips the first instruction of double
+        la      t0, double
+        li      a0, 7
+        jalr    ra, 4(t0)           ; a0 = 7 + 100
+        mv      s2, a0
+
+        la      t0, increment
+        li      a0, 1
+        jalr    ra, t0, 0           ; a0 = 2
+        jalr    ra, (t0)            ; a0 = 3
+        mv      s3, a0
+
+        lw      ra, 12(sp)
+        addi    sp, sp, 16
+        jalr    zero, 0(ra)
+
+double:
+        add     a0, a0, a0
+        addi    a0, a0, 100
+        jalr    zero, 0(ra)
+
+increment:
+        addi    a0, a0, 1
+        jalr    x0, 0(ra)
+
+.data
+table:      .word double, increment
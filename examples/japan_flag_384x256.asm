@@ -1,24 +1,12 @@
 ; Requires minimum of 384*256*4 = 393,216 Bytes of memory
 
+; Colors are 0xAABBGGRR
+.equ BACKGROUND, 0xFFFFFFFF
+.equ CIRCLE, (255 << 24) | (45 << 16) | (0 << 8) | 255
+
 main:
-    ; Background color
-    li s0, 0 
-    ori s0, s0, 255 ; A
-    slli s0 s0 8
-    ori s0, s0, 255 ; B
-    slli s0 s0 8
-    ori s0, s0, 255 ; G
-    slli s0 s0 8
-    ori s0, s0, 255 ; R
-
-    ; Circle Color
-    ori s1, s1, 255 ; A
-    slli s1 s1 8
-    ori s1, s1, 45 ; B
-    slli s1 s1 8
-    ori s1, s1,  0; G
-    slli s1 s1 8
-    ori s1, s1, 255 ; R
+    li s0, BACKGROUND
+    li s1, CIRCLE
 
     li s2, 384 ; Width
     li s3, 256 ; Height
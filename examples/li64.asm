@@ -0,0 +1,14 @@
+; li in RV64, run with -xlen 64. The values are loaded whole, 32-bit ones
+; with lui and addiw, wider ones with shifts of their upper bits.
+
+main:
+    li      s0, 0x123456789         ; 4886718345
+    li      s1, 0x80000000          ; 2147483648, not sign-extended
+    li      s2, 0xffffffff          ; 4294967295
+    li      s3, -0x80000000         ; -2147483648
+    li      s4, 0x7ffff800          ; 2147481600, lui rounds up to 0x80000
+    li      s5, -0x123456789abcdef  ; -81985529216486895
+    li      s6, 0x7fffffffffffffff  ; 9223372036854775807
+    li      s7, -0x8000000000000000 ; -9223372036854775808
+    li      s8, 0x100000000000      ; 17592186044416, one addi and one slli
+    li      s9, 0x12345678fff       ; 1250999898111, the low part is negative
@@ -0,0 +1,46 @@
+; A program of several files, linked with the files of examples/link/:
+;   go run . -file examples/link.asm examples/link/runtime.asm examples/link/lib.asm
+;
+; Labels are local to their file unless it exports them with .globl, so each
+; file has its own 'loop' and 'done'. .extern declares the labels this file
+; uses from the others.
+
+    .extern sum, max, count, table
+    .globl total
+
+.data
+values:     .word 7, 3, 12, 5, 9, 1
+total:      .word 0
+
+.text
+main:
+        addi    sp, sp, -16
+        sw      ra, 12(sp)
+
+        la      a0, values
+        li      a1, 6
+        call    sum                 ; a0 = 37
+        la      t0, total
+        sw      a0, 0(t0)
+        mv      s0, a0
+
+        la      a0, values
+        li      a1, 6
+        call    max                 ; a0 = 12
+        mv      s1, a0
+
+        ; Uses a data label of lib.asm
+        la      t0, table
+        lw      s2, 8(t0)           ; s2 = 300
+
+        li      t0, 3
+loop:
+        call    count
+        addi    t0, t0, -1
+        bnez    t0, loop
+done:
+        mv      s3, a0              ; s3 = 3, the count of the calls
+
+        lw      ra, 12(sp)
+        addi    sp, sp, 16
+        ret
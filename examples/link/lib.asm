@@ -0,0 +1,19 @@
+; A counter and a table for link.asm. 'calls' is local, the other files
+; reach it through count.
+
+    .globl count
+    .global table
+
+.data
+calls:      .word 0
+
+.rodata
+table:      .word 100, 200, 300
+
+.text
+count:
+        la      t1, calls
+        lw      a0, 0(t1)
+        addi    a0, a0, 1
+        sw      a0, 0(t1)
+        ret
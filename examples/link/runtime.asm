@@ -0,0 +1,32 @@
+; Routines over word arrays for link.asm, the address in a0 and the number
+; of words in a1.
+
+    .globl sum, max
+
+sum:
+        li      t1, 0
+loop:
+        beqz    a1, done
+        lw      t2, 0(a0)
+        add     t1, t1, t2
+        addi    a0, a0, 4
+        addi    a1, a1, -1
+        j       loop
+done:
+        mv      a0, t1
+        ret
+
+max:
+        lw      t1, 0(a0)
+max_loop:
+        beqz    a1, done_max
+        lw      t2, 0(a0)
+        bge     t1, t2, 1f
+        mv      t1, t2
+1:
+        addi    a0, a0, 4
+        addi    a1, a1, -1
+        j       max_loop
+done_max:
+        mv      a0, t1
+        ret
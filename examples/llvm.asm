@@ -0,0 +1,164 @@
+# Unmodified output of 'llc -O1 -mtriple=riscv32 -mattr=+m,+c', only this
+# comment is added. There is no C compiler for RISC-V here, the LLVM IR was
+# written by hand for this C program, with unwind tables for the '.cfi'
+# directives:
+#
+#   typedef int (*op_fn)(int, int);
+#   static int add(int a, int b) { return a + b; }
+#   static int mul(int a, int b) { return a * b; }
+#
+#   op_fn ops[2] = {add, mul};
+#   int values[4] = {3, 1, 4, 1};
+#   int result;
+#
+#   int fold(op_fn f, int *a, int n, int init) {
+#       for (int i = 0; i < n; i++) init = f(init, a[i]);
+#       return init;
+#   }
+#
+#   int main() {
+#       result = fold(ops[0], values, 4, 0) + fold(ops[1], values, 4, 1);
+#       return result;
+#   }
+#
+# The calls through the pointer are 'jalr s2', the returns 'ret'. main
+# returns 21 in a0.
+	.text
+	.attribute	4, 16
+	.attribute	5, "rv32i2p0_m2p0_c2p0"
+	.file	"example.ll"
+	.p2align	1                               # -- Begin function add
+	.type	add,@function
+add:                                    # @add
+	.cfi_startproc
+# %bb.0:                                # %entry
+	add	a0, a0, a1
+	ret
+.Lfunc_end0:
+	.size	add, .Lfunc_end0-add
+	.cfi_endproc
+                                        # -- End function
+	.p2align	1                               # -- Begin function mul
+	.type	mul,@function
+mul:                                    # @mul
+	.cfi_startproc
+# %bb.0:                                # %entry
+	mul	a0, a1, a0
+	ret
+.Lfunc_end1:
+	.size	mul, .Lfunc_end1-mul
+	.cfi_endproc
+                                        # -- End function
+	.globl	fold                            # -- Begin function fold
+	.p2align	1
+	.type	fold,@function
+fold:                                   # @fold
+	.cfi_startproc
+# %bb.0:                                # %entry
+	addi	sp, sp, -16
+	.cfi_def_cfa_offset 16
+	sw	ra, 12(sp)                      # 4-byte Folded Spill
+	sw	s0, 8(sp)                       # 4-byte Folded Spill
+	sw	s1, 4(sp)                       # 4-byte Folded Spill
+	sw	s2, 0(sp)                       # 4-byte Folded Spill
+	.cfi_offset ra, -4
+	.cfi_offset s0, -8
+	.cfi_offset s1, -12
+	.cfi_offset s2, -16
+	blez	a2, .LBB2_3
+# %bb.1:                                # %loop.preheader
+	mv	s0, a2
+	mv	s1, a1
+	mv	s2, a0
+.LBB2_2:                                # %loop
+                                        # =>This Inner Loop Header: Depth=1
+	lw	a1, 0(s1)
+	mv	a0, a3
+	jalr	s2
+	mv	a3, a0
+	addi	s0, s0, -1
+	addi	s1, s1, 4
+	bnez	s0, .LBB2_2
+.LBB2_3:                                # %exit
+	mv	a0, a3
+	lw	ra, 12(sp)                      # 4-byte Folded Reload
+	lw	s0, 8(sp)                       # 4-byte Folded Reload
+	lw	s1, 4(sp)                       # 4-byte Folded Reload
+	lw	s2, 0(sp)                       # 4-byte Folded Reload
+	addi	sp, sp, 16
+	ret
+.Lfunc_end2:
+	.size	fold, .Lfunc_end2-fold
+	.cfi_endproc
+                                        # -- End function
+	.globl	main                            # -- Begin function main
+	.p2align	1
+	.type	main,@function
+main:                                   # @main
+	.cfi_startproc
+# %bb.0:                                # %entry
+	addi	sp, sp, -16
+	.cfi_def_cfa_offset 16
+	sw	ra, 12(sp)                      # 4-byte Folded Spill
+	sw	s0, 8(sp)                       # 4-byte Folded Spill
+	sw	s1, 4(sp)                       # 4-byte Folded Spill
+	.cfi_offset ra, -4
+	.cfi_offset s0, -8
+	.cfi_offset s1, -12
+	lui	s1, %hi(ops)
+	lw	a0, %lo(ops)(s1)
+	lui	a1, %hi(values)
+	addi	s0, a1, %lo(values)
+	li	a2, 4
+	mv	a1, s0
+	li	a3, 0
+	call	fold
+	addi	a1, s1, %lo(ops)
+	lw	a1, 4(a1)
+	mv	s1, a0
+	li	a2, 4
+	li	a3, 1
+	mv	a0, a1
+	mv	a1, s0
+	call	fold
+	add	a0, a0, s1
+	lui	a1, %hi(result)
+	sw	a0, %lo(result)(a1)
+	lw	ra, 12(sp)                      # 4-byte Folded Reload
+	lw	s0, 8(sp)                       # 4-byte Folded Reload
+	lw	s1, 4(sp)                       # 4-byte Folded Reload
+	addi	sp, sp, 16
+	ret
+.Lfunc_end3:
+	.size	main, .Lfunc_end3-main
+	.cfi_endproc
+                                        # -- End function
+	.type	ops,@object                     # @ops
+	.section	.sdata,"aw",@progbits
+	.globl	ops
+	.p2align	2
+ops:
+	.word	add
+	.word	mul
+	.size	ops, 8
+
+	.type	values,@object                  # @values
+	.data
+	.globl	values
+	.p2align	2
+values:
+	.word	3                               # 0x3
+	.word	1                               # 0x1
+	.word	4                               # 0x4
+	.word	1                               # 0x1
+	.size	values, 16
+
+	.type	result,@object                  # @result
+	.section	.sbss,"aw",@nobits
+	.globl	result
+	.p2align	2
+result:
+	.word	0                               # 0x0
+	.size	result, 4
+
+	.section	".note.GNU-stack","",@progbits
@@ -0,0 +1,50 @@
+; Macros, repetitions, conditional assembly and includes. They are expanded
+; before the program is parsed.
+
+.include "include/stack.asm"
+
+.equ N, 4
+.equ UNROLL, 1
+
+; sum_to(reg, n), reg = 1 + 2 + ... + n. The loop label is local to each
+; expansion.
+.macro sum_to reg, n
+    li      \reg, 0
+    li      t0, \n
+loop:
+    add     \reg, \reg, t0
+    addi    t0, t0, -1
+    bne     t0, zero, loop
+.endm
+
+.text
+main:
+    sum_to  s0, 10                  ; 55
+    sum_to  s1 N                    ; 10, arguments can be separated with spaces
+
+    li      a0, 7
+    li      a1, 9
+    push    a0
+    push    a1, 8                   ; Takes 8 bytes
+    pop     a0, 8                   ; 9
+    pop     a1                      ; 7
+
+    ; s2 = 2^N
+    li      s2, 1
+.if UNROLL
+.rept N
+    slli    s2, s2, 1
+.endr
+.else
+    li      t0, N
+shift:
+    slli    s2, s2, 1
+    addi    t0, t0, -1
+    bne     t0, zero, shift
+.endif
+
+.if N >= 8
+    li      s3, 1
+.else
+    li      s3, 2                   ; 2
+.endif
@@ -0,0 +1,30 @@
+; Exercises the M extension, including the corner cases of division.
+
+main:
+    li      t0, -7
+    li      t1, 2
+    li      t2, 0
+    li      t3, -2147483648
+    li      t4, -1
+
+    ; High half of the products
+    mulh    a0, t0, t1      ; -14 >> 32 = -1
+    mulhu   a1, t0, t1      ; (0xfffffff9 * 2) >> 32 = 1
+    mulhsu  a2, t0, t1      ; -1
+    mulhu   a3, t4, t4      ; 0xfffffffe
+
+    ; Regular division
+    div     a4, t0, t1      ; -3, rounds towards zero
+    rem     a5, t0, t1      ; -1
+    divu    a6, t0, t1      ; 0x7ffffffc
+    remu    a7, t0, t1      ; 1
+
+    ; Division by zero
+    div     s0, t0, t2      ; -1
+    divu    s1, t0, t2      ; 0xffffffff
+    rem     s2, t0, t2      ; -7
+    remu    s3, t0, t2      ; -7
+
+    ; Signed overflow
+    div     s4, t3, t4      ; -2147483648
+    rem     s5, t3, t4      ; 0
@@ -0,0 +1,116 @@
+; User, supervisor and machine mode with physical memory protection.
+; Machine mode sets up PMP and delegation, then drops to supervisor mode,
+; which drops to user mode. The ecalls from user mode, load access faults and
+; the supervisor software interrupt go to the supervisor handler, everything
+; else goes to the machine handler. Both handlers record the cause and the
+; trap value, then skip the faulting instruction.
+;
+; PMP entries, the lowest numbered one that matches is used:
+;   0   1020..1023, locked with no permissions, machine mode can't use it either
+;   1   512..767, read only
+;   2   everything else, read, write and execute
+
+m_handler:
+    csrr    t0, mcause
+    sw      t0, 0(s0)
+    csrr    t0, mtval
+    sw      t0, 4(s0)
+    addi    s0, s0, 8
+    csrr    t0, mepc
+    addi    t0, t0, 4
+    csrw    mepc, t0
+    mret
+
+s_handler:
+    csrr    t0, scause
+    sw      t0, 0(s1)
+    csrr    t0, stval
+    sw      t0, 4(s1)
+    addi    s1, s1, 8
+    csrr    t0, scause
+    blt     t0, zero, s_interrupt
+
+    csrr    t0, sepc
+    addi    t0, t0, 4
+    csrw    sepc, t0
+    sret
+
+s_interrupt:
+    ; Interrupts return to the interrupted instruction
+    csrci   sip, 2
+    sret
+
+user:
+    li      a3, 600
+    lw      a2, 0(a3)           ; 77, after the supervisor software interrupt
+    sw      a2, 0(a3)           ; 7, read only
+    csrr    a4, mstatus         ; 2, machine mode CSR
+    ecall                       ; 8, delegated
+    li      a3, 1020
+    lw      a5, 0(a3)           ; 5, delegated
+    li      a6, 1
+    jal     zero, end
+
+supervisor:
+    li      a3, 600
+    lw      s4, 0(a3)           ; 77
+    sw      s4, 0(a3)           ; 7, read only
+    ecall                       ; 9
+    csrr    s5, sstatus         ; 0
+
+    ; Raise the software interrupt, it is not taken in supervisor mode
+    ; while SIE is clear, but it is always taken in user mode.
+    csrsi   sip, 2
+
+    la      t0, user
+    csrw    sepc, t0
+    sret                        ; SPP is user mode
+
+main:
+    la      t0, m_handler
+    csrw    mtvec, t0
+    la      t0, s_handler
+    csrw    stvec, t0
+    li      s0, 64              ; Machine trap records
+    li      s1, 128             ; Supervisor trap records
+
+    li      t0, 288             ; Ecall from user mode and load access faults
+    csrw    medeleg, t0
+    li      t0, 2               ; Supervisor software interrupt
+    csrw    mideleg, t0
+    csrw    mie, t0
+
+    li      t0, 77
+    li      t1, 600
+    sw      t0, 0(t1)
+
+    li      t0, 255             ; 1020 >> 2
+    csrw    pmpaddr0, t0
+    li      t0, 159             ; 512 >> 2 | (256 / 8 - 1)
+    csrw    pmpaddr1, t0
+    li      t0, -1
+    csrw    pmpaddr2, t0
+
+    ; L NA4, R NAPOT, RWX NAPOT
+    li      t0, 2038160
+    csrw    pmpcfg0, t0
+
+    ; Locked entries can't be changed
+    csrw    pmpaddr0, zero
+    li      t0, 2038016
+    csrw    pmpcfg0, t0
+    csrr    a0, pmpcfg0         ; 2038160
+    csrr    a1, pmpaddr0        ; 255
+
+    li      t1, 1020
+    sw      t0, 0(t1)           ; 7, locked
+
+    la      t0, supervisor
+    csrw    mepc, t0
+    li      t0, 2048            ; MPP = S
+    csrw    mstatus, t0
+    li      t0, 0
+    li      t1, 0
+    mret
+
+end:
@@ -0,0 +1,49 @@
+; Relocations and pseudo instructions expanding to more than one instruction.
+; '%hi' and '%lo' split an absolute address, '%pcrel_hi' and '%pcrel_lo' an
+; address relative to the auipc. la, call and tail use pc-relative pairs, li
+; with a large value or a label uses lui and addi.
+
+.data
+    .space 2048                 ; Puts table out of reach of a 12-bit immediate
+table:      .word 10, 20, 30, 40
+result:     .word 0
+
+.text
+main:
+    ; Absolute address, the upper part is rounded up for the negative %lo
+    lui     a0, %hi(table)
+    lw      s0, %lo(table)(a0)          ; 10
+    lw      s1, %lo(table + 12)(a0)     ; 40
+
+    ; Relative to the auipc at the label
+here:
+    auipc   a1, %pcrel_hi(table + 4)
+    lw      s2, %pcrel_lo(here)(a1)     ; 20
+
+    la      a2, table
+    lw      s3, 8(a2)                   ; 30
+
+    li      s4, 0x12345678
+    li      s5, 0x7ffff800              ; The inverse is loaded then inverted
+    li      s6, -4096                   ; lui only
+    li      s7, table                   ; 2048
+    lui     s8, 0xfffff                 ; -4096
+
+    li      s9, 0
+    li      a0, 5
+    call    twice                       ; a0 = 20
+    lui     t0, %hi(result)
+    sw      a0, %lo(result)(t0)
+    j       end
+
+; twice(x), calls itself once through tail with the doubled value
+twice:
+    slli    a0, a0, 1
+    bne     s9, zero, twice_done
+    li      s9, 1
+    tail    twice
+twice_done:
+    ret
+
+end:
+    lw      s10, 16(a2)                 ; 20
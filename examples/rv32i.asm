@@ -0,0 +1,43 @@
+; Exercises the RV32I instructions that are not covered by the other examples.
+
+main:
+    li      t0, -8
+    li      t1, 3
+
+    ; Register shifts, only the low 5 bits of rs2 are used
+    sll     a0, t0, t1      ; a0 = -64
+    srl     a1, t0, t1      ; a1 = 0x1fffffff
+    sra     a2, t0, t1      ; a2 = -1
+    li      t2, 35
+    sll     a3, t1, t2      ; a3 = 3 << 3 = 24
+    srai    a4, t0, 1       ; a4 = -4
+
+    ; Signed and unsigned compares
+    slt     s0, t0, t1      ; -8 < 3  -> 1
+    sltu    s1, t0, t1      ; 0xfffffff8 < 3 -> 0
+    slti    s2, t1, 4       ; 1
+    sltiu   s3, t1, -1      ; 3 < 0xffffffff -> 1
+
+    ; Zero and sign extending loads
+    addi    sp, sp, -4
+    sw      t0, 0(sp)
+    lb      s4, 0(sp)       ; -8
+    lbu     s5, 0(sp)       ; 248
+    lh      s6, 0(sp)       ; -8
+    lhu     s7, 0(sp)       ; 65528
+    fence
+
+    ; Unsigned branches
+    li      s8, 0
+    bltu    t1, t0, .L1     ; taken
+    addi    s8, s8, 1
+.L1:
+    bgeu    t1, t0, .L2     ; not taken
+    addi    s8, s8, 2
+.L2:
+    bgeu    t0, t1, .L3     ; taken
+    addi    s8, s8, 4
+.L3:
+    sw      s8, -4(sp)
+    ecall
+    li      s9, 1           ; never executed
@@ -0,0 +1,58 @@
+; RV64I, run with -xlen 64. Registers are 64 bits wide, the word
+; instructions operate on the low 32 bits and sign-extend the result.
+
+main:
+    ; Build a wide value with shifts, li loads it whole too, see li64.asm
+    li      a0, 1
+    slli    a0, a0, 40
+    addi    a0, a0, 5           ; 1099511627781
+
+    ; Double word and unsigned word loads and stores
+    li      t0, 256
+    sd      a0, 0(t0)
+    ld      s0, 0(t0)           ; 1099511627781
+    lw      s1, 0(t0)           ; 5
+    lw      s2, 4(t0)           ; 256
+    li      a1, -1
+    sw      a1, 8(t0)
+    lw      s3, 8(t0)           ; -1
+    lwu     s4, 8(t0)           ; 4294967295
+
+    ; Word instructions wrap at 32 bits
+    li      a2, 2147483647
+    addi    s5, a2, 1           ; 2147483648
+    addiw   s6, a2, 1           ; -2147483648
+    addw    s7, a2, a2          ; -2
+    sext.w  s8, s4              ; -1
+    slliw   s9, a2, 1           ; -2
+    srliw   s10, a1, 28         ; 15
+    sraiw   s11, s5, 31         ; -1
+    li      a3, 7
+    mulw    a4, a2, a3          ; 2147483641
+    divw    a5, s6, a1          ; -2147483648, overflow
+    remuw   a6, a1, a3          ; 3, 4294967295 % 7
+    negw    a7, s6              ; -2147483648
+
+    ; Full width shifts, comparisons and multiplication
+    srli    t1, a1, 32          ; 4294967295
+    srai    t2, a1, 32          ; -1
+    mulhu   t3, a1, a1          ; -2
+    sltu    t4, s5, a1          ; 1
+    sllw    t5, a0, a3          ; 640
+    clz     t6, a0              ; 23
+
+    ; INT_MIN / -1 at 64 bits
+    li      t0, -2147483648
+    slli    t0, t0, 32
+    div     a3, t0, a1          ; -9223372036854775808
+    rem     a4, t0, a1          ; 0
+
+    ; misa reports a 64-bit machine
+    csrr    a5, misa
+    srli    a5, a5, 62          ; 2
+
+    li      t0, 256
+    sd      t0, 16(t0)
+    sd      a3, 24(t0)
+    rev8    a6, a0              ; 360287970189705216
+    sd      a6, 32(t0)
@@ -0,0 +1,56 @@
+; Self-modifying code, run with -von-neumann. The code is encoded into the
+; memory from address 0 and fetched from there, so the stores below change
+; the instructions. fence.i makes sure the pipeline fetches them again.
+
+.data
+; Jump table built in data, filled with the addresses of the cases at run time
+table:  .word 0, 0, 0
+
+.text
+main:
+    ; Patch the immediate of 'addi a0, zero, 1' at 'patched' to 42
+    la      t0, patched
+    lw      t1, 0(t0)
+    li      t2, 0x000fffff      ; Keep everything but the immediate
+    and     t1, t1, t2
+    li      t2, 42
+    slli    t2, t2, 20
+    or      t1, t1, t2
+    sw      t1, 0(t0)
+    fence.i
+patched:
+    addi    a0, zero, 1         ; Runs as 'addi a0, zero, 42'
+
+    ; Copy the instruction at 'template' over the nop at 'slot'
+    la      t0, template
+    lw      t1, 0(t0)
+    la      t0, slot
+    sw      t1, 0(t0)
+    fence.i
+slot:
+    nop                         ; Runs as 'addi a1, a1, 7'
+
+    ; Fill the jump table and jump through its second entry, the cases
+    ; return from main
+    la      t0, table
+    la      t1, case0
+    sw      t1, 0(t0)
+    la      t1, case1
+    sw      t1, 4(t0)
+    la      t1, case2
+    sw      t1, 8(t0)
+    lw      t1, 4(t0)
+    jr      t1
+
+case0:
+    li      a2, 100
+    ret
+case1:
+    li      a2, 200
+    ret
+case2:
+    li      a2, 300
+    ret
+
+template:
+    addi    a1, a1, 7
@@ -0,0 +1,64 @@
+; Machine mode traps. Every exception goes to the handler, which records
+; mcause and mtval, then resumes two instructions after the faulting one.
+; The instruction right after each fault must never take effect.
+
+handler:
+    csrr    t0, mcause
+    sw      t0, 0(s0)
+    csrr    t0, mtval
+    sw      t0, 4(s0)
+    addi    s0, s0, 8
+    addi    s1, s1, 1           ; Number of traps taken
+    csrr    s2, mstatus         ; 6144, MPP = M and interrupts disabled
+    csrr    t0, mepc
+    addi    t0, t0, 8           ; Skip the faulting and the next instruction
+    csrw    mepc, t0
+    mret
+
+main:
+    la      t0, handler         ; Address of the handler
+    csrw    mtvec, t0
+    li      s0, 64              ; Trap records go here
+
+    ecall                       ; 11
+    addi    s3, s3, 1
+
+    ebreak                      ; 3, mtval is the pc of the ebreak
+    addi    s3, s3, 1
+
+    li      s4, 5               ; Older than the fault, must complete
+    li      t1, 2
+    lw      t2, 0(t1)           ; 4, misaligned load
+    csrwi   mscratch, 1
+
+    li      t1, -4
+    sw      t1, 0(t1)           ; 7, out of bound store
+    sw      t1, 0(zero)
+
+    csrw    mhartid, t1         ; 2, mhartid is read-only
+    addi    s3, s3, 1
+
+    li      t1, 2
+    amoadd.w t2, t1, (t1)       ; 6, misaligned atomic
+    addi    s3, s3, 1
+
+    li      t1, -8
+    lw      t2, 0(t1)           ; 5, out of bound load
+    addi    s3, s3, 1
+
+    li      t1, 3
+    lw      t2, 0(t1)           ; 4, misaligned load right before a taken branch
+    beq     zero, zero, skip
+    addi    s5, s5, 1           ; Runs after the handler returns
+skip:
+
+    csrr    a0, mscratch        ; 0
+    csrr    a1, mcause          ; 4
+    csrr    a2, mstatus         ; 128, mret sets MPIE and leaves MPP at U
+    csrr    a3, misa            ; RV32IMAFDCBVSU
+    csrr    a4, mhartid         ; 0
+
+    ; Without a handler ecall stops the machine
+    csrwi   mtvec, 0
+    ecall
+    addi    s3, s3, 1
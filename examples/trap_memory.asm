@@ -0,0 +1,56 @@
+; Machine mode traps of code fetched from the memory, run with -von-neumann.
+; The handler records mcause and mtval, then resumes after the faulting
+; instruction, or at ra when the fetch itself failed.
+
+.data
+records:    .space 48
+; An ecall and a 'ret', run from the data
+code:       .word 0x00000073, 0x00008067
+
+.text
+handler:
+    csrr    t0, mcause
+    sw      t0, 0(s0)
+    csrr    t1, mtval
+    sw      t1, 4(s0)
+    addi    s0, s0, 8
+    addi    s1, s1, 1           ; Number of traps taken
+
+    csrr    t1, mepc
+    addi    t1, t1, 4           ; Skip the faulting instruction
+    li      t2, 1
+    bne     t0, t2, resume
+    mv      t1, ra              ; The pc is not in the memory, return to the caller
+resume:
+    csrw    mepc, t1
+    mret
+
+main:
+    mv      s7, ra
+    la      t0, handler
+    csrw    mtvec, t0
+    la      s0, records
+
+    ecall                       ; 11
+    addi    s3, s3, 1
+
+    ; Overwrite the next instruction with an illegal one
+    la      t0, illegal
+    li      t1, -1
+    sw      t1, 0(t0)
+    fence.i
+illegal:
+    addi    s3, s3, 1           ; 2, mtval is 0xffffffff
+    addi    s4, s4, 1
+
+    li      t0, -8
+    jalr    ra, 0(t0)           ; 1, mtval is the pc
+    addi    s5, s5, 1
+
+    la      t0, code
+    jalr    ra, 0(t0)           ; 11, the ecall of the data
+    addi    s6, s6, 1
+
+    csrr    a0, mcause          ; 11
+    csrr    a1, mepc            ; After the ecall of the data
+    jr      s7
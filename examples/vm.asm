@@ -0,0 +1,116 @@
+; Sv32 virtual memory. Machine mode builds the page tables, then drops to
+; supervisor mode with mret. The handler records mcause and mtval, sets the
+; dirty bit on store page faults and retries the store.
+; Needs at least 16384 bytes of memory.
+;
+; Page tables:
+;   root   4096    [0] 4 MiB megapage, identity mapped
+;                  [1] points to the table at 8192
+;   8192           [0] 4194304 -> 12288, read/write
+;                  [1] 4198400 -> 12288, read/write, not dirty
+; 8388608 and above are not mapped.
+
+handler:
+    csrr    t0, mcause
+    sw      t0, 0(s0)
+    csrr    t0, mtval
+    sw      t0, 4(s0)
+    addi    s0, s0, 8
+    csrr    t1, mepc
+
+    csrr    t2, mcause
+    li      t0, 12
+    beq     t0, t2, fetch_fault
+    csrr    t2, mtval
+    li      t0, 4198404         ; Only the store to the page that is not dirty is retried
+    beq     t0, t2, dirty
+
+    ; Skip the faulting instruction
+    addi    t1, t1, 4
+    csrw    mepc, t1
+    li      t2, 0
+    mret
+
+dirty:
+    ; Set the dirty bit of the second page and retry the store
+    li      t0, 8196
+    lw      t1, 0(t0)
+    ori     t1, t1, 128
+    sw      t1, 0(t0)
+    sfence.vma
+    li      t2, 0
+    mret
+
+fetch_fault:
+    ; Return to the caller of the unmapped code
+    csrw    mepc, ra
+    li      t2, 0
+    mret
+
+supervisor:
+    ; The handler uses the t registers, the a registers hold the addresses
+    li      a0, 4194304
+    li      a1, 42
+    sw      a1, 0(a0)
+    lw      s1, 0(a0)           ; 42
+
+    ; Both pages map the same physical page
+    li      a0, 4198400
+    lw      s2, 0(a0)           ; 42
+    sw      a1, 4(a0)           ; 15, not dirty yet, retried by the handler
+    lw      s3, 4(a0)           ; 42
+
+    li      a0, 8388608
+    lw      s4, 0(a0)           ; 13, not mapped
+    sw      a1, 0(a0)           ; 15, not mapped
+
+    jalr    ra, a0, 0           ; 12, not mapped
+
+    csrr    s5, mstatus         ; 2, machine mode CSR
+    csrr    s6, sstatus         ; 0
+    csrr    s7, satp            ; -2147483647, Sv32 and the root at 4096
+
+    sfence.vma
+    ecall                       ; 9, from supervisor mode
+    addi    s8, s8, 1           ; 1, runs after the handler returns
+
+    li      t0, 0
+    li      t1, 0
+    li      ra, 0
+    jal     zero, end
+
+main:
+    la      t0, handler
+    csrw    mtvec, t0
+    li      s0, 64              ; Trap records go here
+
+    ; Identity mapped megapage: V R W X A D
+    li      t0, 4096
+    li      t1, 207
+    sw      t1, 0(t0)
+
+    ; Pointer to the second level table, ppn 2
+    li      t1, 2049
+    sw      t1, 4(t0)
+
+    ; 4 KiB pages to ppn 3: V R W A D, and V R W A
+    li      t0, 8192
+    li      t1, 3271
+    sw      t1, 0(t0)
+    li      t1, 3143
+    sw      t1, 4(t0)
+
+    ; Sv32, root table at ppn 1
+    li      t0, -2147483647
+    csrw    satp, t0
+
+    ; mret to supervisor mode
+    la      t0, supervisor
+    csrw    mepc, t0
+    li      t0, 2048            ; MPP = S
+    csrw    mstatus, t0
+    li      t0, 0
+    li      t1, 0
+    mret
+
+end:
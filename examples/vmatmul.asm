@@ -0,0 +1,142 @@
+; Matrix multiplication with the vector extension, C = A * B for 6x6 matrices
+; of words. Each row of C is the sum of the rows of B scaled by the elements
+; of A, computed with vmacc.vx. The columns are split into strips of vl
+; elements, with VLEN=128 there are 4 words in a register so each row takes
+; two strips. Try -vlen and -vlanes to see how the cycles change.
+;
+; Then the diagonal of C is computed again as dot products, a row of A times
+; a column of B loaded with a strided load, summed with a reduction.
+;
+; Memory:
+;   64    A, A[k] = k + 1
+;   208   B, B[k] = 36 - k
+;   352   C
+;   496   diagonal of C
+;   520   |A[0][j] - B[5][j]|, with a masked negation
+
+; vmatmul(n, m, p, A, B, C), A is n x m and B is m x p
+vmatmul:
+    slli    t1, a2, 2           ; Row size of B and C in bytes
+row:
+    mv      t2, a2              ; Columns left
+    mv      t3, a4              ; Column j of B
+    mv      t4, a5              ; Column j of the row of C
+strip:
+    vsetvli t5, t2, e32, m1, ta, ma
+    vmv.v.i v1, 0
+    mv      t6, a3              ; A[i][k]
+    mv      a6, t3              ; B[k][j]
+    mv      a7, a1
+inner:
+    lw      t0, 0(t6)
+    vle32.v v2, (a6)
+    vmacc.vx v1, t0, v2         ; C[i][j..] += A[i][k] * B[k][j..]
+    addi    t6, t6, 4
+    add     a6, a6, t1
+    addi    a7, a7, -1
+    bne     a7, zero, inner
+
+    vse32.v v1, (t4)
+    sub     t2, t2, t5
+    slli    t0, t5, 2
+    add     t3, t3, t0
+    add     t4, t4, t0
+    bne     t2, zero, strip
+
+    mv      a3, t6              ; t6 is past the row of A, at the next one
+    add     a5, a5, t1
+    addi    a0, a0, -1
+    bne     a0, zero, row
+    ret
+
+; vdot(x, y, n, stride) returns the dot product of n words at x and n words
+; stride bytes apart at y
+vdot:
+    vsetvli t0, a2, e32, m1, ta, ma
+    vmv.s.x v3, zero            ; The sum is kept in v3[0]
+dot:
+    vsetvli t0, a2, e32, m1, ta, ma
+    vle32.v v4, (a0)
+    vlse32.v v5, (a1), a3
+    vmul.vv v4, v4, v5
+    vredsum.vs v3, v4, v3       ; v3[0] += sum(v4)
+    slli    t1, t0, 2
+    add     a0, a0, t1
+    mul     t1, t0, a3
+    add     a1, a1, t1
+    sub     a2, a2, t0
+    bne     a2, zero, dot
+    vmv.x.s a0, v3
+    ret
+
+main:
+    li      s0, 64              ; A
+    li      s1, 208             ; B
+    li      s2, 352             ; C
+    li      s3, 496             ; Diagonal
+
+    ; Fill A and B
+    li      t0, 36
+    mv      t1, s0
+    mv      t2, s1
+    li      t3, 0
+    li      t5, 36
+fill:
+    vsetvli t4, t0, e32, m1, ta, ma
+    vid.v   v8
+    vadd.vx v8, v8, t3          ; k
+    vadd.vi v9, v8, 1
+    vse32.v v9, (t1)
+    vrsub.vx v9, v8, t5
+    vse32.v v9, (t2)
+    add     t3, t3, t4
+    sub     t0, t0, t4
+    slli    t6, t4, 2
+    add     t1, t1, t6
+    add     t2, t2, t6
+    bne     t0, zero, fill
+
+    li      a0, 6
+    li      a1, 6
+    li      a2, 6
+    mv      a3, s0
+    mv      a4, s1
+    mv      a5, s2
+    call    vmatmul
+
+    ; Diagonal, C[i][i] = A[i][:] . B[:][i]
+    li      s4, 0
+diagonal:
+    li      t0, 24
+    mul     a0, s4, t0
+    add     a0, a0, s0
+    slli    a1, s4, 2
+    add     a1, a1, s1
+    li      a2, 6
+    li      a3, 24
+    call    vdot
+    slli    t0, s4, 2
+    add     t0, t0, s3
+    sw      a0, 0(t0)
+    addi    s4, s4, 1
+    li      t0, 6
+    bne     s4, t0, diagonal
+
+    ; |A[0][j] - B[5][j]|, the negative differences are negated under a mask
+    li      t0, 6
+    vsetvli t0, t0, e32, m2, ta, ma
+    vle32.v v4, (s0)
+    addi    t1, s1, 120
+    vle32.v v6, (t1)
+    vsub.vv v4, v4, v6
+    vmslt.vx v0, v4, zero
+    vrsub.vi v4, v4, 0, v0.t
+    li      t1, 520
+    vse32.v v4, (t1)
+
+    vredmax.vs v8, v4, v4
+    vmv.x.s s5, v8              ; 5
+    csrr    s6, vl              ; 6
+    csrr    s7, vlenb           ; 16
+    lw      s8, 352(zero)       ; C[0][0] = 1 * 36 + 2 * 30 + ... + 6 * 6 = 336
+    lw      s9, 496(zero)       ; 336
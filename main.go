@@ -1,11 +1,16 @@
 package main
 
 import (
+	"debug/elf"
 	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/AkifSahn/risc-vm/rest"
 	"github.com/AkifSahn/risc-vm/vm"
@@ -18,12 +23,21 @@ func main() {
 	serve := flag.Bool("serve", false, "start the REST API server.")
 	port := flag.String("port", "8080", "server port.")
 
-	filename := flag.String("file", "", "assembly file to run.")
+	filename := flag.String("file", "", "assembly file or ELF executable to run. More assembly files to link with it can follow the flags.")
 
 	branch_prediction := flag.Bool("bp", true, "Enable/disable branch prediction.")
 	forwarding := flag.Bool("forwarding", true, "Enable/disable data forwarding.")
 
 	mem_size := flag.Uint("mem", MEM_SIZE, "Simulator memory size in bytes.")
+	xlen := flag.Int("xlen", vm.DEFAULT_XLEN, "Width of the integer registers, 32 or 64.")
+
+	tlb_entries := flag.Int("tlb", vm.DEFAULT_TLB_ENTRIES, "Number of TLB entries.")
+	walk_latency := flag.Int("walk-latency", vm.DEFAULT_TLB_WALK_LATENCY, "Cycles per page table read on a TLB miss.")
+
+	vlen := flag.Int("vlen", vm.DEFAULT_VLEN, "Bits in a vector register, a power of two.")
+	vector_lanes := flag.Int("vlanes", vm.DEFAULT_VECTOR_LANES, "Vector elements processed per cycle.")
+
+	von_neumann := flag.Bool("von-neumann", false, "Encode the code into the memory and fetch it from there, so that stores to the code take effect.")
 
 	list_cycles := flag.Bool("list-cycles", false, "List cycle-by-cycle stages.")
 
@@ -32,6 +46,15 @@ func main() {
 
 	dump_memory := flag.Bool("dump-memory", false, "Dump memory to the stdout. Disables the statistics print.")
 
+	output := flag.String("o", "", "Assemble the file to machine code and write it to this file instead of running it. The data follows the code there, the simulator keeps it at address 0, so the data labels have other addresses than in a run of the file.")
+	format := flag.String("format", "elf", "Format of the -o output: bin, elf or elf-rel.")
+	listing := flag.String("listing", "", "Write the machine code next to the source lines to this file instead of running it.")
+
+	disasm := flag.Bool("disasm", false, "Disassemble the file, an ELF executable or a flat binary, instead of running it.")
+	disasm_range := flag.String("range", "", "Address range of -disasm, like 0x100:0x200. The end can be left out.")
+	disasm_base := flag.Uint("base", 0, "Address of the first byte of a flat binary for -disasm, 0x4 for the ones written with '-format bin'.")
+	disasm_mem := flag.String("disasm-mem", "", "Disassemble this memory range after the run, like 0x0:0x100.")
+
 	flag.Parse()
 
 	if *run_tests {
@@ -53,12 +76,37 @@ func main() {
 		flag.Usage()
 		return
 	}
+	filenames := append([]string{*filename}, flag.Args()...)
+
+	if *disasm {
+		err := disassembleFile(*filename, *xlen, *disasm_base, *disasm_range)
+		if err != nil {
+			fmt.Printf("Failed to disassemble '%s': %s\n", *filename, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *output != "" || *listing != "" {
+		err := assembleProgram(filenames, *xlen, *output, *format, *listing)
+		if err != nil {
+			fmt.Printf("Failed to assemble '%s': %s\n", *filename, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 
 	config, err := vm.CreateConfig(uint32(*mem_size), STACK_SIZE, 2, *forwarding, *branch_prediction)
 	if err != nil {
 		fmt.Printf("Configuration error: %s\n", err.Error())
 		os.Exit(1)
 	}
+	config.Xlen = *xlen
+	config.Tlb_entries = *tlb_entries
+	config.Tlb_walk_latency = *walk_latency
+	config.Vlen = *vlen
+	config.Vector_lanes = *vector_lanes
+	config.Von_neumann = *von_neumann
 
 	machine, err := vm.CreateVm(*config)
 	if err != nil {
@@ -66,7 +114,13 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = machine.LoadProgramFromFile(*filename)
+	if !isElfFile(*filename) {
+		err = machine.LoadProgramFromFiles(filenames)
+	} else if len(filenames) > 1 {
+		err = fmt.Errorf("ELF executables can't be linked with other files")
+	} else {
+		err = machine.LoadProgramFromELF(*filename)
+	}
 	if err != nil {
 		log.Printf("Failed to load program from '%s': %s\n", *filename, err.Error())
 		os.Exit(1)
@@ -114,7 +168,130 @@ func main() {
 		}
 	}
 
+	if *disasm_mem != "" {
+		start, end, err := parseRange(*disasm_mem)
+		if err == nil && end == 0 {
+			err = fmt.Errorf("the range has no end")
+		}
+		var lines []vm.Disasm_Line
+		if err == nil {
+			lines, err = machine.Disassemble(start, end)
+		}
+		if err != nil {
+			fmt.Printf("Failed to disassemble the memory: %s\n", err.Error())
+			os.Exit(1)
+		}
+		vm.WriteDisassembly(os.Stdout, lines)
+		return
+	}
+
 	machine.DumpRegisters(vm.DUMP_DEC)
+	machine.DumpFpRegisters()
+	if machine.Dm.N_vector_insts > 0 {
+		machine.DumpVectorRegisters()
+	}
 	machine.DumpStack(vm.DUMP_DEC)
 	machine.Dm.PrintDiagnostics()
 }
+
+// Reports whether the file starts with the ELF magic number.
+func isElfFile(filename string) bool {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(elf.ELFMAG))
+	_, err = io.ReadFull(f, magic)
+	return err == nil && string(magic) == elf.ELFMAG
+}
+
+// Writes the machine code of the program to output in the given format, and
+// its listing.
+func assembleProgram(filenames []string, xlen int, output string, format string, listing string) error {
+	object, err := vm.AssembleFiles(filenames, xlen)
+	if err != nil {
+		return err
+	}
+
+	if output != "" {
+		if len(object.Data_addresses) > 0 {
+			fmt.Printf("Warning: The data labels have other addresses than in the simulator, the values of their addresses differ at %s\n", strings.Join(object.Data_addresses, ", "))
+		}
+
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		switch format {
+		case "bin":
+			err = object.WriteBinary(f)
+		case "elf":
+			err = object.WriteElf(f, false)
+		case "elf-rel":
+			err = object.WriteElf(f, true)
+		default:
+			err = fmt.Errorf("unknown output format '%s', expected bin, elf or elf-rel", format)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if listing != "" {
+		f, err := os.Create(listing)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return object.WriteListing(f)
+	}
+
+	return nil
+}
+
+// Parses an address range like '0x100:0x200', the end is 0 if it is left
+// out.
+func parseRange(s string) (uint32, uint32, error) {
+	start_str, end_str, _ := strings.Cut(s, ":")
+
+	start, err := strconv.ParseUint(start_str, 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range start '%s'", start_str)
+	}
+	if end_str == "" {
+		return uint32(start), 0, nil
+	}
+
+	end, err := strconv.ParseUint(end_str, 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range end '%s'", end_str)
+	}
+	return uint32(start), uint32(end), nil
+}
+
+// Prints the instructions of an ELF executable or a flat binary loaded at
+// base in the given address range.
+func disassembleFile(filename string, xlen int, base uint, addr_range string) error {
+	if base > math.MaxUint32 {
+		return fmt.Errorf("invalid base %#x, addresses have 32 bits", base)
+	}
+
+	var start, end uint32
+	if addr_range != "" {
+		var err error
+		if start, end, err = parseRange(addr_range); err != nil {
+			return err
+		}
+	}
+
+	lines, err := vm.DisassembleFile(filename, xlen, uint32(base), start, end)
+	if err != nil {
+		return err
+	}
+	return vm.WriteDisassembly(os.Stdout, lines)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"strconv"
 
 	"github.com/AkifSahn/risc-vm/vm"
@@ -23,6 +24,7 @@ func SetupRoutes() *http.ServeMux {
 	mux.HandleFunc("POST /api/session/{id}/load_program", withSessionMiddleware(loadProgramHandler))
 	mux.HandleFunc("POST /api/session/{id}/update_config", withSessionMiddleware(updateConfigHandler))
 	mux.HandleFunc("POST /api/session/{id}/step", withSessionMiddleware(stepProgramHandler))
+	mux.HandleFunc("GET /api/session/{id}/disasm", withSessionMiddleware(disassembleHandler))
 
 	mux.HandleFunc("GET /api/instructions", getInstructionList)
 
@@ -44,7 +46,9 @@ func newSessionHandler(w http.ResponseWriter, r *http.Request) {
 	config, err := vm.CreateConfig(req.MemorySize, req.MemorySize, req.PredictorBit, req.Forwarding, req.PredictorBit > 0)
 	if err != nil {
 		writeJSON(w, http.StatusBadRequest, GenericResponse{"", nil, err.Error()})
+		return
 	}
+	config.Von_neumann = req.VonNeumann
 
 	id, err := newSession(*config)
 	if err != nil {
@@ -86,18 +90,32 @@ func loadProgramHandler(w http.ResponseWriter, r *http.Request, session *vm.Vm)
 
 	// Reset the vm and reload the program given
 	session.Reset(session.Config)
-	err := session.LoadProgramFromStr(req.ProgramStr)
+	var err error
+	if len(req.Files) > 0 {
+		// The names only tell the files apart in the error messages, they are
+		// not paths on the server and the files can't include others
+		files := make([]vm.Source_File, len(req.Files))
+		for i, file := range req.Files {
+			name := file.Name
+			if name != "" {
+				name = filepath.Base(name)
+			}
+			files[i] = vm.Source_File{Name: name, Content: file.ProgramStr}
+		}
+		err = session.LoadProgramFromSources(files)
+	} else {
+		err = session.LoadProgramFromStr(req.ProgramStr)
+	}
 	if err != nil {
 		s := fmt.Sprintf("Failed to parse: %v", err.Error())
 		writeJSON(w, http.StatusBadRequest, GenericResponse{"", nil, s})
 		return
 	}
 
-	prog_str := session.GetProgramStr()
 	data := struct {
 		Program []string `json:"program"`
 	}{
-		Program: prog_str[1:],
+		Program: session.GetProgramStr(),
 	}
 
 	writeJSON(w, http.StatusOK, GenericResponse{"OK", data, ""})
@@ -116,6 +134,7 @@ func updateConfigHandler(w http.ResponseWriter, r *http.Request, session *vm.Vm)
 		writeJSON(w, http.StatusBadRequest, GenericResponse{"", nil, s})
 		return
 	}
+	config.Von_neumann = req.VonNeumann
 
 	session.Reset(*config)
 
@@ -152,6 +171,33 @@ func stepProgramHandler(w http.ResponseWriter, r *http.Request, session *vm.Vm)
 	writeJSON(w, http.StatusOK, GenericResponse{"OK", states, ""})
 }
 
+// GET /api/session/{id}/disasm?start&end
+//
+// Disassembles the memory of the session from 'start' up to 'end'. The
+// addresses can be given in hex, like 0x100.
+func disassembleHandler(w http.ResponseWriter, r *http.Request, session *vm.Vm) {
+	params := r.URL.Query()
+	start, err := strconv.ParseUint(params.Get("start"), 0, 32)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, GenericResponse{"", nil, "Url parameter 'start' is not an address!"})
+		return
+	}
+	end, err := strconv.ParseUint(params.Get("end"), 0, 32)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, GenericResponse{"", nil, "Url parameter 'end' is not an address!"})
+		return
+	}
+
+	lines, err := session.Disassemble(uint32(start), uint32(end))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, GenericResponse{"", nil, err.Error()})
+		return
+	}
+
+	data := DisassemblyResponse{Lines: lines}
+	writeJSON(w, http.StatusOK, GenericResponse{"OK", data, ""})
+}
+
 // --------- Instruction Handlers ---------
 
 func getInstructionList(w http.ResponseWriter, r *http.Request) {
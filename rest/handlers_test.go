@@ -0,0 +1,101 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AkifSahn/risc-vm/vm"
+)
+
+// Sends the request to the routes and decodes the response into data.
+func request(t *testing.T, mux *http.ServeMux, method, url string, body any, data any) int {
+	t.Helper()
+
+	var b bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&b).Encode(body)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(method, url, &b))
+
+	if data != nil {
+		resp := GenericResponse{Data: data}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+	return w.Code
+}
+
+func TestDisassembleHandler(t *testing.T) {
+	mux := SetupRoutes()
+
+	var session NewSessionResponse
+	config := UpdateConfigRequest{MemorySize: 1024, PredictorBit: 2, Forwarding: true, VonNeumann: true}
+	if code := request(t, mux, "POST", "/api/session/new", config, &session); code != http.StatusOK {
+		t.Fatalf("New session: status %d", code)
+	}
+	prefix := "/api/session/" + session.Id
+
+	program := LoadProgramRequest{ProgramStr: "main:\naddi a0, zero, 5\njalr zero, 0(ra)\nc.addi a0, 1\n"}
+	if code := request(t, mux, "POST", prefix+"/load_program", program, nil); code != http.StatusOK {
+		t.Fatalf("Load program: status %d", code)
+	}
+
+	var disasm DisassemblyResponse
+	if code := request(t, mux, "GET", prefix+"/disasm?start=0x4&end=14", nil, &disasm); code != http.StatusOK {
+		t.Fatalf("Disassemble: status %d", code)
+	}
+	want := []vm.Disasm_Line{
+		{Addr: 4, Code: 0x00500513, Size: 4, Label: "main", Text: "addi a0, zero, 5"},
+		{Addr: 8, Code: 0x00008067, Size: 4, Text: "jalr zero, 0(ra)"},
+		{Addr: 12, Code: 0x0505, Size: 2, Text: "addi a0, a0, 1"},
+	}
+	if len(disasm.Lines) != len(want) {
+		t.Fatalf("Lines %+v, want %+v", disasm.Lines, want)
+	}
+	for i := range want {
+		if disasm.Lines[i] != want[i] {
+			t.Errorf("Line %+v, want %+v", disasm.Lines[i], want[i])
+		}
+	}
+
+	for _, url := range []string{prefix + "/disasm?start=x&end=8", prefix + "/disasm?start=4", prefix + "/disasm?start=4&end=0x10000"} {
+		if code := request(t, mux, "GET", url, nil, nil); code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want %d", url, code, http.StatusBadRequest)
+		}
+	}
+	if code := request(t, mux, "GET", "/api/session/none/disasm?start=0&end=4", nil, nil); code != http.StatusNotFound {
+		t.Errorf("Unknown session: status %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+// Files sent to the server can't include the files of the server, even with
+// a path as their name.
+func TestLoadProgramInclude(t *testing.T) {
+	mux := SetupRoutes()
+
+	var session NewSessionResponse
+	config := UpdateConfigRequest{MemorySize: 1024, PredictorBit: 2, Forwarding: true}
+	if code := request(t, mux, "POST", "/api/session/new", config, &session); code != http.StatusOK {
+		t.Fatalf("New session: status %d", code)
+	}
+
+	for _, name := range []string{"", "/etc/x.asm", "../vm/x.asm"} {
+		program := LoadProgramRequest{Files: []ProgramFile{{Name: name, ProgramStr: ".include \"passwd\"\nmain:\nret\n"}}}
+		resp := GenericResponse{}
+		w := httptest.NewRecorder()
+		var b bytes.Buffer
+		json.NewEncoder(&b).Encode(program)
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/api/session/"+session.Id+"/load_program", &b))
+		json.NewDecoder(w.Body).Decode(&resp)
+
+		if w.Code != http.StatusBadRequest || !strings.Contains(resp.Error, "'.include' can only be used in programs read from a file") {
+			t.Errorf("Name '%s': status %d, error '%s'", name, w.Code, resp.Error)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package rest
 
 type LoadProgramRequest struct {
+	ProgramStr string        `json:"program_str"`
+	Files      []ProgramFile `json:"files"` // Linked together instead of program_str when given
+}
+
+type ProgramFile struct {
+	Name       string `json:"name"`
 	ProgramStr string `json:"program_str"`
 }
 
@@ -8,4 +14,5 @@ type UpdateConfigRequest struct {
 	MemorySize   uint32 `json:"memory_size"`
 	PredictorBit uint8  `json:"predictor_bit"`
 	Forwarding   bool   `json:"forwarding"`
+	VonNeumann   bool   `json:"von_neumann"`
 }
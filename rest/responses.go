@@ -24,3 +24,7 @@ type ProgramResponse struct {
 type ListInstructionsResponse struct {
 	Instructions []string `json:"instructions"`
 }
+
+type DisassemblyResponse struct {
+	Lines []vm.Disasm_Line `json:"lines"`
+}
@@ -0,0 +1,146 @@
+package vm
+
+import (
+	"math/bits"
+)
+
+// Core local interruptor, the timer and software interrupt device. Its
+// registers are mapped outside the memory, at the same addresses as on most
+// RISC-V boards.
+const (
+	CLINT_BASE uint32 = 0x2000000
+	CLINT_SIZE uint32 = 0x10000
+
+	// Register offsets from the base
+	CLINT_MSIP     uint32 = 0x0    // Bit 0 raises the software interrupt
+	CLINT_MTIMECMP uint32 = 0x4000 // 64-bit, the timer interrupt is pending while mtime >= mtimecmp
+	CLINT_MTIME    uint32 = 0xbff8 // 64-bit, counts up once per cycle
+)
+
+// Interrupt bits of mie and mip, also the interrupt cause numbers
+const (
+	MIP_SSIP uint32 = 1 << 1 // Supervisor software interrupt
+	MIP_MSIP uint32 = 1 << 3 // Machine software interrupt
+	MIP_STIP uint32 = 1 << 5 // Supervisor timer interrupt
+	MIP_MTIP uint32 = 1 << 7 // Machine timer interrupt
+)
+
+// Interrupts in the order they are taken when several are pending
+var interruptPriority = []struct {
+	bit  uint32
+	name string
+}{
+	{MIP_MSIP, "Machine software interrupt"},
+	{MIP_MTIP, "Machine timer interrupt"},
+	{MIP_SSIP, "Supervisor software interrupt"},
+	{MIP_STIP, "Supervisor timer interrupt"},
+}
+
+// mcause has the top bit set for interrupts
+const CAUSE_INTERRUPT uint32 = 1 << 31
+
+type Clint struct {
+	Msip     uint32
+	Mtimecmp uint64
+
+	// Writes to mtime are kept as an offset from the cycle count
+	_mtime_offset uint64
+}
+
+// Returns the CLINT in its reset state. mtimecmp starts at its maximum, so
+// that enabling the timer interrupt does not fire it right away.
+func defaultClint() Clint {
+	return Clint{
+		Mtimecmp: ^uint64(0),
+	}
+}
+
+func isClintAddr(addr uint32) bool {
+	return CLINT_BASE <= addr && addr-CLINT_BASE < CLINT_SIZE
+}
+
+// Returns the current value of mtime, driven by the cycle counter.
+func (v *Vm) mtime() uint64 {
+	return uint64(v.Dm.N_cycle) - v.Clint._mtime_offset
+}
+
+// Reads n bytes of the CLINT registers starting at the given offset. Unused
+// addresses read as zero.
+func (v *Vm) clintRead(offset uint32, n uint8) uint64 {
+	var u uint64
+	for i := range uint32(n) {
+		var reg uint64
+		var shift uint32
+		switch off := offset + i; {
+		case off-CLINT_MSIP < 4:
+			reg, shift = uint64(v.Clint.Msip), off-CLINT_MSIP
+		case off-CLINT_MTIMECMP < 8:
+			reg, shift = v.Clint.Mtimecmp, off-CLINT_MTIMECMP
+		case off-CLINT_MTIME < 8:
+			reg, shift = v.mtime(), off-CLINT_MTIME
+		default:
+			continue
+		}
+		u |= uint64(byte(reg>>(shift*8))) << (i * 8)
+	}
+	return u
+}
+
+// Writes the lowest n bytes of data to the CLINT registers starting at the
+// given offset. Writes to unused addresses are ignored.
+func (v *Vm) clintWrite(data uint64, offset uint32, n uint8) {
+	for i := range uint32(n) {
+		b := uint64(byte(data >> (i * 8)))
+		switch off := offset + i; {
+		case off-CLINT_MSIP < 4:
+			// Only bit 0 is implemented
+			if off == CLINT_MSIP {
+				v.Clint.Msip = uint32(b & 1)
+			}
+		case off-CLINT_MTIMECMP < 8:
+			shift := (off - CLINT_MTIMECMP) * 8
+			v.Clint.Mtimecmp = v.Clint.Mtimecmp&^(0xff<<shift) | b<<shift
+		case off-CLINT_MTIME < 8:
+			shift := (off - CLINT_MTIME) * 8
+			mtime := v.mtime()&^(0xff<<shift) | b<<shift
+			v.Clint._mtime_offset = uint64(v.Dm.N_cycle) - mtime
+		}
+	}
+}
+
+// Returns the value of mip. The machine bits follow the CLINT registers, the
+// supervisor bits are written by software.
+func (v *Vm) mip() uint32 {
+	mip := v.Csrs.Mip
+	if v.Clint.Msip&1 != 0 {
+		mip |= MIP_MSIP
+	}
+	if v.mtime() >= v.Clint.Mtimecmp {
+		mip |= MIP_MTIP
+	}
+	return mip
+}
+
+// Returns the interrupt that should be taken now, or nil if there is none.
+// An interrupt is always enabled in a privilege level below the one that
+// handles it, and only if MIE or SIE is set in the same level.
+func (v *Vm) pendingInterrupt() *Exception {
+	pending := v.mip() & v.Csrs.Mie
+	status := v.Csrs.Mstatus
+
+	var enabled uint32
+	if v.Priv < PRIV_M || status&MSTATUS_MIE != 0 {
+		enabled |= pending &^ v.Csrs.Mideleg
+	}
+	if v.Priv < PRIV_S || (v.Priv == PRIV_S && status&MSTATUS_SIE != 0) {
+		enabled |= pending & v.Csrs.Mideleg
+	}
+
+	for _, irq := range interruptPriority {
+		if enabled&irq.bit != 0 {
+			code := uint32(bits.TrailingZeros32(irq.bit))
+			return newException(CAUSE_INTERRUPT|code, 0, "%s", irq.name)
+		}
+	}
+	return nil
+}
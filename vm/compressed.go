@@ -0,0 +1,235 @@
+package vm
+
+import (
+	"fmt"
+)
+
+// RV32C, the compressed instructions. Each one is a 2 byte encoding of a
+// common instruction, with smaller immediates and, for most of them, only the
+// registers x8-x15 (f8-f15). They are expanded to the instruction they stand
+// for when parsed, the pipeline only sees the size difference.
+
+// The instruction each compressed one expands to
+var compressedBaseOp = map[Inst_Op]Inst_Op{
+	Inst_C_addi4spn: Inst_Addi,
+	Inst_C_fld:      Inst_Fld,
+	Inst_C_lw:       Inst_Lw,
+	Inst_C_flw:      Inst_Flw,
+	Inst_C_fsd:      Inst_Fsd,
+	Inst_C_sw:       Inst_Sw,
+	Inst_C_fsw:      Inst_Fsw,
+	Inst_C_nop:      Inst_Addi,
+	Inst_C_addi:     Inst_Addi,
+	Inst_C_jal:      Inst_Jal,
+	Inst_C_li:       Inst_Addi,
+	Inst_C_addi16sp: Inst_Addi,
+	Inst_C_lui:      Inst_Lui,
+	Inst_C_srli:     Inst_Srli,
+	Inst_C_srai:     Inst_Srai,
+	Inst_C_andi:     Inst_Andi,
+	Inst_C_sub:      Inst_Sub,
+	Inst_C_xor:      Inst_Xor,
+	Inst_C_or:       Inst_Or,
+	Inst_C_and:      Inst_And,
+	Inst_C_j:        Inst_Jal,
+	Inst_C_beqz:     Inst_Beq,
+	Inst_C_bnez:     Inst_Bne,
+	Inst_C_slli:     Inst_Slli,
+	Inst_C_fldsp:    Inst_Fld,
+	Inst_C_lwsp:     Inst_Lw,
+	Inst_C_flwsp:    Inst_Flw,
+	Inst_C_jr:       Inst_Jalr,
+	Inst_C_mv:       Inst_Add,
+	Inst_C_ebreak:   Inst_Ebreak,
+	Inst_C_jalr:     Inst_Jalr,
+	Inst_C_add:      Inst_Add,
+	Inst_C_fsdsp:    Inst_Fsd,
+	Inst_C_swsp:     Inst_Sw,
+	Inst_C_fswsp:    Inst_Fsw,
+}
+
+func (inst Instruction) isCompressed() bool {
+	return _Inst_C_start < inst.Op && inst.Op < _Inst_C_end
+}
+
+// Reports whether the jump or branch offset can be encoded in the compressed
+// form of the given instruction, 'jal' or a branch.
+func compressedOffsetFits(op Inst_Op, offset int32) bool {
+	if offset%2 != 0 {
+		return false
+	}
+	if op == Inst_Jal {
+		return -2048 <= offset && offset < 2048
+	}
+	return -256 <= offset && offset < 256
+}
+
+// Returns an error unless the immediate is in [lo, hi] and a multiple of align.
+func checkCompressedImm(imm, lo, hi, align int32) error {
+	if imm < lo || imm > hi || imm%align != 0 {
+		if align > 1 {
+			return fmt.Errorf("immediate '%d' must be a multiple of %d in [%d, %d]", imm, align, lo, hi)
+		}
+		return fmt.Errorf("immediate '%d' must be in [%d, %d]", imm, lo, hi)
+	}
+	return nil
+}
+
+// Returns an error unless every register fits in the 3-bit register fields,
+// which hold x8-x15 or f8-f15.
+func checkCompressedRegs(regs ...int32) error {
+	for _, r := range regs {
+		if r < 8 || r > 15 {
+			return fmt.Errorf("register '%d' must be one of x8-x15 or f8-f15", r)
+		}
+	}
+	return nil
+}
+
+// Expands a compressed instruction to the instruction it stands for. The
+// operands are written as in the RISC-V manual, loads and stores keep their
+// 'offset(base)' layout. Returns an error if the operands can't be encoded
+// in 2 bytes.
+func expandCompressedInstruction(c Instruction) (Instruction, error) {
+	sp := int32(abiToRegNum["sp"])
+	op := compressedBaseOp[c.Op]
+
+	var inst Instruction
+	var err error
+	switch c.Op {
+	/* Loads and stores, rd', offset(rs1') */
+	case Inst_C_lw, Inst_C_flw, Inst_C_sw, Inst_C_fsw:
+		if err = checkCompressedRegs(c.Rd, c.Rs2); err == nil {
+			err = checkCompressedImm(c.Rs1, 0, 124, 4)
+		}
+		inst = newInstruction(op, c.Rd, c.Rs1, c.Rs2)
+	case Inst_C_fld, Inst_C_fsd:
+		if err = checkCompressedRegs(c.Rd, c.Rs2); err == nil {
+			err = checkCompressedImm(c.Rs1, 0, 248, 8)
+		}
+		inst = newInstruction(op, c.Rd, c.Rs1, c.Rs2)
+
+	/* Stack pointer relative loads and stores, rd, offset(sp) */
+	case Inst_C_lwsp, Inst_C_flwsp, Inst_C_swsp, Inst_C_fswsp:
+		if c.Rs2 != sp {
+			err = fmt.Errorf("the base register must be sp")
+		} else if c.Op == Inst_C_lwsp && c.Rd == 0 {
+			err = fmt.Errorf("the destination can't be x0")
+		} else {
+			err = checkCompressedImm(c.Rs1, 0, 252, 4)
+		}
+		inst = newInstruction(op, c.Rd, c.Rs1, c.Rs2)
+	case Inst_C_fldsp, Inst_C_fsdsp:
+		if c.Rs2 != sp {
+			err = fmt.Errorf("the base register must be sp")
+		} else {
+			err = checkCompressedImm(c.Rs1, 0, 504, 8)
+		}
+		inst = newInstruction(op, c.Rd, c.Rs1, c.Rs2)
+
+	/* Immediates, rd, imm */
+	case Inst_C_nop:
+		inst = newInstruction(op, 0, 0, 0)
+	case Inst_C_addi:
+		err = checkCompressedImm(c.Rs1, -32, 31, 1)
+		inst = newInstruction(op, c.Rd, c.Rd, c.Rs1)
+	case Inst_C_li:
+		err = checkCompressedImm(c.Rs1, -32, 31, 1)
+		inst = newInstruction(op, c.Rd, 0, c.Rs1)
+	case Inst_C_addi16sp: // c.addi16sp sp, imm
+		if c.Rd != sp {
+			err = fmt.Errorf("the destination must be sp")
+		} else if c.Rs1 == 0 {
+			err = fmt.Errorf("the immediate can't be zero")
+		} else {
+			err = checkCompressedImm(c.Rs1, -512, 496, 16)
+		}
+		inst = newInstruction(op, sp, sp, c.Rs1)
+	case Inst_C_addi4spn: // c.addi4spn rd', sp, imm
+		if c.Rs1 != sp {
+			err = fmt.Errorf("the source must be sp")
+		} else if err = checkCompressedRegs(c.Rd); err == nil {
+			err = checkCompressedImm(c.Rs2, 4, 1020, 4)
+		}
+		inst = newInstruction(op, c.Rd, sp, c.Rs2)
+	case Inst_C_lui:
+		// The immediate is bits 17..12 of the value, lui takes the value itself
+		if c.Rd == 0 || c.Rd == sp {
+			err = fmt.Errorf("the destination can't be x0 or sp")
+		} else if c.Rs1 == 0 {
+			err = fmt.Errorf("the immediate can't be zero")
+		} else {
+			err = checkCompressedImm(c.Rs1, -32, 31, 1)
+		}
+		inst = newInstruction(op, c.Rd, c.Rs1<<12, 0)
+	case Inst_C_slli:
+		err = checkCompressedImm(c.Rs1, 0, 31, 1)
+		inst = newInstruction(op, c.Rd, c.Rd, c.Rs1)
+	case Inst_C_srli, Inst_C_srai:
+		if err = checkCompressedRegs(c.Rd); err == nil {
+			err = checkCompressedImm(c.Rs1, 0, 31, 1)
+		}
+		inst = newInstruction(op, c.Rd, c.Rd, c.Rs1)
+	case Inst_C_andi:
+		if err = checkCompressedRegs(c.Rd); err == nil {
+			err = checkCompressedImm(c.Rs1, -32, 31, 1)
+		}
+		inst = newInstruction(op, c.Rd, c.Rd, c.Rs1)
+
+	/* Registers, rd, rs2 */
+	case Inst_C_sub, Inst_C_xor, Inst_C_or, Inst_C_and:
+		err = checkCompressedRegs(c.Rd, c.Rs1)
+		inst = newInstruction(op, c.Rd, c.Rd, c.Rs1)
+	case Inst_C_mv:
+		// With x0 as the source these are the encodings of c.jr and c.jalr
+		if c.Rs1 == 0 {
+			err = fmt.Errorf("the source can't be x0")
+		}
+		inst = newInstruction(op, c.Rd, 0, c.Rs1)
+	case Inst_C_add:
+		if c.Rs1 == 0 {
+			err = fmt.Errorf("the source can't be x0")
+		}
+		inst = newInstruction(op, c.Rd, c.Rd, c.Rs1)
+
+	/* Jumps and branches, the offsets are checked again once the labels are known */
+	case Inst_C_j:
+		inst = newInstruction(op, 0, c.Rd, 0)
+	case Inst_C_jal:
+		inst = newInstruction(op, 1, c.Rd, 0)
+	case Inst_C_jr:
+		if c.Rd == 0 {
+			err = fmt.Errorf("the jump register can't be x0")
+		}
+		inst = newInstruction(op, 0, c.Rd, 0)
+	case Inst_C_jalr:
+		if c.Rd == 0 {
+			err = fmt.Errorf("the jump register can't be x0")
+		}
+		inst = newInstruction(op, 1, c.Rd, 0)
+	case Inst_C_beqz, Inst_C_bnez: // c.beqz rs1', offset
+		err = checkCompressedRegs(c.Rd)
+		inst = newInstruction(op, c.Rd, 0, c.Rs1)
+
+	case Inst_C_ebreak:
+		inst = newInstruction(op, 0, 0, 0)
+	default:
+		return c, fmt.Errorf("'%s' is not a compressed instruction", opcodeName(c.Op))
+	}
+
+	if err == nil {
+		if offset := inst.Rs1; op == Inst_Jal && !compressedOffsetFits(op, offset) {
+			err = fmt.Errorf("jump offset '%d' must be even and in [-2048, 2046]", offset)
+		} else if offset := inst.Rs2; (op == Inst_Beq || op == Inst_Bne) && !compressedOffsetFits(op, offset) {
+			err = fmt.Errorf("branch offset '%d' must be even and in [-256, 254]", offset)
+		}
+	}
+
+	if err != nil {
+		return c, fmt.Errorf("Invalid operands for '%s': %v", opcodeName(c.Op), err)
+	}
+
+	inst.Compressed = true
+	inst._c_op = c.Op
+	return inst, nil
+}
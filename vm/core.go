@@ -1,18 +1,21 @@
 package vm
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math/bits"
 )
 
 const (
 	STALL_RAW uint8 = 1 << iota
 	STALL_BRANCH
+	STALL_WALK // The fetch is waiting for a page walk
 )
 
 const WORD_SIZE = 4 // In bytes
 
 type Register struct {
-	Data int32
+	Data int64 // Sign-extended from XLEN bits
 	// This is not bool because there can be multiple instructions with same destination register
 	// And one register may free it when it is actually not free.
 	// So, instead of true/false, we count how many instructions still want to write to this
@@ -20,6 +23,11 @@ type Register struct {
 	Busy int32
 }
 
+type Fp_Register struct {
+	Data uint64 // Raw bits, single precision values are NaN-boxed
+	Busy int32  // Same as Register.Busy
+}
+
 type Pipeline_Buffer struct {
 	pc    uint32
 	inst  Instruction
@@ -39,11 +47,18 @@ type Control_Buffer struct {
 }
 
 type Vm_Config struct {
+	Xlen               int    // Width of the integer registers, XLEN_32 or XLEN_64
 	Mem_size           uint32 // In bytes
 	Stack_size         uint32 // In bytes
 	Bp_nbit            uint8  // Branch predictor bit size
 	Forwarding_enabled bool
 	Bp_enabled         bool
+	Fp_latency         Fp_Latency // Execute cycles of the FP instructions
+	Tlb_entries        int        // At least one
+	Tlb_walk_latency   int        // Cycles per page table read on a TLB miss
+	Vlen               int        // Bits in a vector register
+	Vector_lanes       int        // Vector elements processed per cycle
+	Von_neumann        bool       // Assembled programs are encoded into the memory, see loadObject
 }
 
 // func CreateConfig(mem_size, stack_size uint32, bp_nbit uint8, forwarding, branch_prediction bool) (*Vm_Config, error) {
@@ -64,11 +79,17 @@ func CreateConfig(mem_size, stack_size uint32, bp_nbit uint8, forwarding, branch
 	}
 
 	return &Vm_Config{
+		Xlen:               DEFAULT_XLEN,
 		Mem_size:           mem_size,
 		Stack_size:         stack_size,
 		Bp_nbit:            bp_nbit,
 		Forwarding_enabled: forwarding,
 		Bp_enabled:         branch_prediction,
+		Fp_latency:         DefaultFpLatency(),
+		Tlb_entries:        DEFAULT_TLB_ENTRIES,
+		Tlb_walk_latency:   DEFAULT_TLB_WALK_LATENCY,
+		Vlen:               DEFAULT_VLEN,
+		Vector_lanes:       DEFAULT_VECTOR_LANES,
 	}, nil
 }
 
@@ -80,15 +101,30 @@ type Vm struct {
 
 	_pc_init uint32
 	Pc       uint32
-	program  []Instruction
-
-	Registers [32]Register
-	Memory    []byte
+	Priv     uint32        // Current privilege level
+	program  []Instruction // nil if the instructions are decoded from Memory, see fetchFromMemory
+	_data    []byte        // Initial memory contents of the program, from address 0
+	_code    [2]uint32     // Address range of the instructions in Memory, if they are decoded from there
+
+	Symbols []Symbol // Labels of the program in Memory by address, for debugging
+
+	Registers  [32]Register
+	FRegisters [32]Fp_Register
+	Fcsr       uint32 // Floating point control and status register
+	VRegisters []byte // The 32 vector registers, VLEN bits each, see vectorGroup
+	VBusy      int32  // Same as Register.Busy, for the whole vector register file
+	Vl         uint32 // Number of elements vector instructions work on
+	Vtype      uint32 // Element width and register grouping, see vsetvli
+	Csrs       Csr_File
+	Clint      Clint
+	Tlb        Tlb
+	Memory     []byte
 
 	// Memory and register diff arrays holding the updated addr/idx for memory cells and registers for the last cycle.
 	// This is useful when we only want to know which memory cells and registers are changed in a cycle.
-	Memory_diff_addr  []uint32
-	Register_diff_idx []uint8
+	Memory_diff_addr   []uint32
+	Register_diff_idx  []uint8
+	FRegister_diff_idx []uint8
 
 	_control_buff [2]Control_Buffer
 	_fd_buff      [2]Pipeline_Buffer
@@ -103,6 +139,19 @@ type Vm struct {
 	// Each stall is same in principle, but their cause may be different.
 	_stall_map byte
 
+	// Index of the instruction at every halfword of the program, see SetProgram
+	_program_slots []int32
+
+	// Cycles left in the page walk of the fetch, see STALL_WALK
+	_walk_remaining int
+
+	// Reservation set of the last 'lr', a word sized region starting at the address.
+	_reservation       uint32
+	_reservation_valid bool
+
+	// Values written to the machine counter CSRs are kept as an offset from the real count.
+	_counter_offset [32]uint64
+
 	Runtime_error error
 
 	Halted bool // Only gets set when the program is fully stopped and no longer executing.
@@ -110,36 +159,85 @@ type Vm struct {
 }
 
 func CreateVm(config Vm_Config) (*Vm, error) {
+	if config.Xlen != XLEN_32 && config.Xlen != XLEN_64 {
+		return nil, fmt.Errorf("Invalid XLEN '%d', it must be %d or %d.\n", config.Xlen, XLEN_32, XLEN_64)
+	}
+	if config.Tlb_entries < 1 {
+		return nil, fmt.Errorf("Invalid TLB size '%d', the TLB must have at least one entry.\n", config.Tlb_entries)
+	}
+	if config.Tlb_walk_latency < 0 {
+		return nil, fmt.Errorf("Invalid page walk latency '%d'.\n", config.Tlb_walk_latency)
+	}
+	if config.Vlen < VLEN_MIN || config.Vlen > VLEN_MAX || config.Vlen&(config.Vlen-1) != 0 {
+		return nil, fmt.Errorf("Invalid VLEN '%d', it must be a power of two in [%d, %d].\n", config.Vlen, VLEN_MIN, VLEN_MAX)
+	}
+	if config.Vector_lanes < 1 {
+		return nil, fmt.Errorf("Invalid number of vector lanes '%d', there must be at least one.\n", config.Vector_lanes)
+	}
+
 	vm := Vm{
 		program: make([]Instruction, 0),
 		Memory:  make([]byte, config.Mem_size),
-		Dm:      CreateDiagnosticsManager(),
-		Bp:      create_predictor(config.Bp_nbit),
-		Config:  config,
+		// 32 registers of VLEN bits
+		VRegisters: make([]byte, 4*config.Vlen),
+		Vtype:      VTYPE_VILL,
+		Dm:         CreateDiagnosticsManager(),
+		Bp:         create_predictor(config.Bp_nbit),
+		Tlb:        createTlb(config.Tlb_entries),
+		Priv:       PRIV_M,
+		Config:     config,
 	}
 
 	vm.Dm.Forwarding_enabled = config.Forwarding_enabled
 	vm.Dm.Bp_enabled = config.Bp_enabled
 
 	// Initialize stack pointer to the MAX_ADDR
-	vm.Registers[abiToRegNum["sp"]].Data = int32(config.Mem_size)
+	vm.Registers[abiToRegNum["sp"]].Data = int64(config.Mem_size)
 
-	// Fill the instCycleTable to default values
-	vm._instCycleTable = map[Inst_Op]int{
-		Inst_Mul: 3,
-		Inst_Div: 3,
-		Inst_Rem: 3,
-	}
+	vm.Csrs = defaultCsrFile()
+	vm.Clint = defaultClint()
+	vm.fillInstCycleTable()
 
 	return &vm, nil
 }
 
+// Fills the instCycleTable to default values, FP latencies are taken from the config
+// and the ones of custom instructions from their registration.
+func (v *Vm) fillInstCycleTable() {
+	v._instCycleTable = map[Inst_Op]int{
+		Inst_Mul:    3,
+		Inst_Mulh:   3,
+		Inst_Mulhsu: 3,
+		Inst_Mulhu:  3,
+		Inst_Div:    3,
+		Inst_Divu:   3,
+		Inst_Rem:    3,
+		Inst_Remu:   3,
+		Inst_Mulw:   3,
+		Inst_Divw:   3,
+		Inst_Divuw:  3,
+		Inst_Remw:   3,
+		Inst_Remuw:  3,
+	}
+
+	for op, n := range v.Config.Fp_latency.cycleTable() {
+		v._instCycleTable[op] = n
+	}
+
+	registryLock.RLock()
+	for i, ci := range customInstructions {
+		v._instCycleTable[_Inst_Custom_start+Inst_Op(i+1)] = ci.Latency
+	}
+	registryLock.RUnlock()
+}
+
 func (v *Vm) Reset(config Vm_Config) {
 	// I don't know if this is a good way to reset the vm.
 	// We'll see...
 
 	v.Dm = Diagnostics_Manager{}
 	v.Bp.Reset(config.Bp_nbit)
+	v.Tlb = createTlb(config.Tlb_entries)
 	v.cycle_info = Cycle_Info{}
 
 	// Reset the config to the given config
@@ -147,20 +245,33 @@ func (v *Vm) Reset(config Vm_Config) {
 
 	v.Dm.Forwarding_enabled = v.Config.Forwarding_enabled
 	v.Dm.Bp_enabled = v.Config.Bp_enabled
+	v.fillInstCycleTable()
 
 	// We don't touch the program that is currently running, we just reset the
 	// pc value to the entry address for the program
-	v.SetProgram(v.program, v._pc_init)
+	v.SetProgram(v.program, v._data, v._pc_init)
 	v.Registers = [32]Register{}
+	v.FRegisters = [32]Fp_Register{}
+	v.Fcsr = 0
+	v.VRegisters = make([]byte, 4*v.Config.Vlen)
+	v.VBusy = 0
+	v.Vl = 0
+	v.Vtype = VTYPE_VILL
+	v.Csrs = defaultCsrFile()
+	v.Clint = defaultClint()
+	v.Priv = PRIV_M
 
 	// Clear the memory and registers
 	v.Memory_diff_addr = v.Memory_diff_addr[:0]
 	v.Register_diff_idx = v.Register_diff_idx[:0]
+	v.FRegister_diff_idx = v.FRegister_diff_idx[:0]
 
 	// Reset the sp
-	v.Registers[abiToRegNum["sp"]].Data = int32(v.Config.Mem_size)
+	v.Registers[abiToRegNum["sp"]].Data = int64(v.Config.Mem_size)
 
 	v._stall_map = 0
+	v._reservation_valid = false
+	v._counter_offset = [32]uint64{}
 	v._halt = false
 	v.Halted = false
 
@@ -169,38 +280,112 @@ func (v *Vm) Reset(config Vm_Config) {
 	v.shiftPipelineBuffers()
 }
 
-// Returns an error if a parsing error occurs
+// Returns an error if a parsing error occurs or the data doesn't fit in the memory
 func (v *Vm) LoadProgramFromFile(fileName string) error {
-	program, entry_index, err := ParseProgramFromFile(fileName)
+	return v.LoadProgramFromFiles([]string{fileName})
+}
 
-	if err == nil {
-		v.SetProgram(program, entry_index*4)
+func (v *Vm) LoadProgramFromStr(program_str string) error {
+	return v.LoadProgramFromSources([]Source_File{{"", program_str, false}})
+}
+
+// Loads a program of several files linked together, see link.go.
+func (v *Vm) LoadProgramFromFiles(fileNames []string) error {
+	files, err := readSourceFiles(fileNames)
+	if err != nil {
+		return err
 	}
 
-	return err
+	return v.LoadProgramFromSources(files)
 }
 
-func (v *Vm) LoadProgramFromStr(program_str string) error {
-	program, entry_index, err := ParseProgramFromString(program_str)
+func (v *Vm) LoadProgramFromSources(files []Source_File) error {
+	if v.Config.Von_neumann {
+		object, err := AssembleSources(files, v.Config.Xlen)
+		if err != nil {
+			return err
+		}
+		return v.loadObject(object)
+	}
+
+	program, data, entry_pc, err := ParseProgramFromSources(files, v.Config.Xlen)
 
 	if err == nil {
-		v.SetProgram(program, entry_index*4)
+		err = v.SetProgram(program, data, entry_pc)
+		v.Symbols = nil
 	}
 
 	return err
 }
 
-func (v *Vm) SetProgram(program []Instruction, entry_pc uint32) {
+// Loads the segments of an ELF executable into the memory, the instructions
+// are fetched and decoded from there.
+func (v *Vm) LoadProgramFromELF(fileName string) error {
+	exe, err := readElfExecutable(fileName, v.Config.Xlen, v.Config.Mem_size)
+	if err != nil {
+		return err
+	}
+
+	if err := v.SetProgram(nil, exe.image, exe.entry); err != nil {
+		return err
+	}
+	v.Symbols = exe.symbols
+	v.Dm.Program_size = exe.n_insts
+	v._code = exe.code
+
+	return nil
+}
+
+// Copies the machine code and the data of the assembled program into the
+// memory, see Object. The instructions are fetched and decoded from the
+// memory, so stores to the code change the instructions fetched after them,
+// see Inst_Fence_i, and the pc can go anywhere in the memory.
+func (v *Vm) loadObject(object *Object) error {
+	if err := v.SetProgram(nil, object.image(), object.Entry); err != nil {
+		return err
+	}
+	v.Symbols = nil
+	for _, sym := range object.Symbols {
+		v.Symbols = append(v.Symbols, Symbol{sym.Name, sym.Addr})
+	}
+	v.Dm.Program_size = uint(len(object.Lines))
+	text := object.Sections[SECTION_TEXT]
+	v._code = [2]uint32{text.Addr, text.Addr + text.Size}
+
+	return nil
+}
+
+// Sets the program and copies its data to the start of the memory. Without
+// a program the instructions are fetched from the memory, data holds the code.
+func (v *Vm) SetProgram(program []Instruction, data []byte, entry_pc uint32) error {
+	if uint64(len(data)) > uint64(len(v.Memory)) {
+		return fmt.Errorf("The data sections take %d bytes, the memory has only %d", len(data), len(v.Memory))
+	}
+	copy(v.Memory, data)
+
+	v._data = data
 	v._pc_init = entry_pc
 	v.Pc = entry_pc
 	v.program = program
 
+	// Instructions are 2 or 4 bytes, every halfword of the program maps to
+	// the instruction starting there, or -1 for the upper half of a 4 byte one.
+	v._program_slots = v._program_slots[:0]
+	for i, inst := range program {
+		v._program_slots = append(v._program_slots, int32(i))
+		if !inst.Compressed {
+			v._program_slots = append(v._program_slots, -1)
+		}
+	}
+
 	// Reset the Diagnostics_Manager
 	v.Dm.Program_size = uint(len(program))
 	v.Dm.N_cycle = 0
 	v.Dm.N_stalls = 0
 	v.Dm.N_fetched = 0
 	v.Dm.N_retired = 0
+
+	return nil
 }
 
 // This function checks if a register at decode stage can be forwarded later on.
@@ -209,27 +394,27 @@ func (v *Vm) checkRegisterForwardDecode(reg int32) bool {
 		return true
 	}
 
+	// The vector register file is read in execute, after its writer has left
+	if reg == VECTOR_REG_INDEX {
+		return false
+	}
+
 	// If forwarding is not enabled, well we can't forward
 	if !v.Config.Forwarding_enabled {
 		return false
 	}
 
-	half_inst := v._dx_buff[1].inst
-	full_inst := v._xm_buff[1].inst // Enabled if and only if can't forward from inst_s1
+	half := v._dx_buff[1]
+	full := v._xm_buff[1] // Enabled if and only if can't forward from inst_s1
 
-	// Check if bypass source instructions actually write to a register
-	if half_inst._fmt == Fmt_R || half_inst._fmt == Fmt_I || half_inst._fmt == Fmt_U || half_inst._fmt == Fmt_J {
-		// Compare the destination register with given source register
-		if !half_inst.isLoad() && half_inst.Rd == reg {
-			return true
-		}
+	// Compare the destination register of bypass source instructions with given source register.
+	// The nearest writer has the newest value, if it is a load the value is not ready yet.
+	if half.valid && half.inst.getDestRegister() == reg {
+		return !half.inst.isMemoryResult()
 	}
 
-	if full_inst._fmt == Fmt_R || full_inst._fmt == Fmt_I || full_inst._fmt == Fmt_U || full_inst._fmt == Fmt_J {
-		// Compare the destination register with
-		if !full_inst.isLoad() && full_inst.Rd == reg {
-			return true
-		}
+	if full.valid && full.inst.getDestRegister() == reg {
+		return !full.inst.isMemoryResult()
 	}
 
 	return false
@@ -237,8 +422,8 @@ func (v *Vm) checkRegisterForwardDecode(reg int32) bool {
 
 // Gets the given register value from bypass.
 // If register number don't match, returns (-1, false).
-func (v *Vm) getRegValueFromBypass(reg int32) (int32, bypass_type, bool) {
-	if reg <= 0 {
+func (v *Vm) getRegValueFromBypass(reg int32) (int64, bypass_type, bool) {
+	if reg <= 0 || reg == VECTOR_REG_INDEX {
 		return -1, 0, false
 	}
 
@@ -246,22 +431,23 @@ func (v *Vm) getRegValueFromBypass(reg int32) (int32, bypass_type, bool) {
 		return -1, 0, false
 	}
 
-	half_inst := v._xm_buff[1].inst
-	full_inst := v._mw_buff[1].inst // Enabled only if we can't forward from inst_s1
+	half := v._xm_buff[1]
+	full := v._mw_buff[1] // Enabled only if we can't forward from inst_s1
 
-	// Check if bypass source instructions actually write to a register
-	if half_inst._fmt == Fmt_R || half_inst._fmt == Fmt_I || half_inst._fmt == Fmt_U || half_inst._fmt == Fmt_J {
-		// Compare the destination register with given source register
-		if !half_inst.isLoad() && half_inst.Rd == reg {
-			return half_inst._result, BYPASS_XM, true
+	// Compare the destination register of bypass source instructions with given source register.
+	// Only the nearest writer can be forwarded, decode has stalled if it is a load.
+	if half.valid && half.inst.getDestRegister() == reg {
+		if half.inst.isMemoryResult() {
+			return -1, 0, false
 		}
+		return half.inst._result, BYPASS_XM, true
 	}
 
-	if full_inst._fmt == Fmt_R || full_inst._fmt == Fmt_I || full_inst._fmt == Fmt_U || full_inst._fmt == Fmt_J {
-		// Compare the destination register with
-		if !full_inst.isLoad() && full_inst.Rd == reg {
-			return full_inst._result, BYPASS_MW, true
+	if full.valid && full.inst.getDestRegister() == reg {
+		if full.inst.isMemoryResult() {
+			return -1, 0, false
 		}
+		return full.inst._result, BYPASS_MW, true
 	}
 
 	return -1, 0, false
@@ -276,9 +462,9 @@ func (v *Vm) shouldStallDecode(inst Instruction) bool {
 		return true
 	}
 
-	rs1, rs2 := inst.getSourceRegisters()
+	rs1, rs2, rs3 := inst.getSourceRegisters()
 	if rs1 > 0 {
-		if v.Registers[rs1].Busy > 0 {
+		if *v.busyCounter(rs1) > 0 {
 			// FIX: Checking the inst.Op == Inst_Store is not a good approach
 			// We need this check because the first source is not an ALU input and can't be forwarded
 			if inst.isStore() || !v.checkRegisterForwardDecode(rs1) {
@@ -287,9 +473,9 @@ func (v *Vm) shouldStallDecode(inst Instruction) bool {
 		}
 	}
 
-	if rs2 > 0 {
-		if v.Registers[rs2].Busy > 0 {
-			if !v.checkRegisterForwardDecode(rs2) {
+	for _, rs := range []int32{rs2, rs3} {
+		if rs > 0 && *v.busyCounter(rs) > 0 {
+			if !v.checkRegisterForwardDecode(rs) {
 				return true
 			}
 		}
@@ -298,6 +484,50 @@ func (v *Vm) shouldStallDecode(inst Instruction) bool {
 	return false
 }
 
+// Returns the busy counter of the register with the given index.
+func (v *Vm) busyCounter(reg int32) *int32 {
+	if reg == VECTOR_REG_INDEX {
+		return &v.VBusy
+	}
+	if reg >= FP_REG_OFFSET {
+		return &v.FRegisters[reg-FP_REG_OFFSET].Busy
+	}
+	return &v.Registers[reg].Busy
+}
+
+// Reads the register with the given index, FP registers are read as their raw bits.
+// Reading no register(-1) or the vector registers returns 0.
+func (v *Vm) readRegister(reg int32) int64 {
+	switch {
+	case reg < 0 || reg == VECTOR_REG_INDEX:
+		return 0
+	case reg >= FP_REG_OFFSET:
+		return int64(v.FRegisters[reg-FP_REG_OFFSET].Data)
+	default:
+		return v.Registers[reg].Data
+	}
+}
+
+func (v *Vm) writeRegister(reg int32, data int64) {
+	if reg >= FP_REG_OFFSET {
+		v.FRegisters[reg-FP_REG_OFFSET].Data = uint64(data)
+	} else {
+		v.Registers[reg].Data = v.sext(data)
+	}
+	v.recordRegisterDiff(reg)
+}
+
+func (v *Vm) recordRegisterDiff(reg int32) {
+	if reg == VECTOR_REG_INDEX {
+		return
+	}
+	if reg >= FP_REG_OFFSET {
+		v.FRegister_diff_idx = append(v.FRegister_diff_idx, uint8(reg-FP_REG_OFFSET))
+	} else {
+		v.Register_diff_idx = append(v.Register_diff_idx, uint8(reg))
+	}
+}
+
 // flushes the IF/ID and ID/EX pipeline buffers
 func (v *Vm) flush() {
 	// If we are flushing an 'end' instruction, reverse the halt since the
@@ -315,10 +545,14 @@ func (v *Vm) flush() {
 
 	// We also should decrement the busy flag of the 'rd' register if it was set.
 	d_inst := v._dx_buff[1].inst
-	if d_inst._fmt == Fmt_R || d_inst._fmt == Fmt_I || d_inst._fmt == Fmt_U || d_inst._fmt == Fmt_J {
-		v.Registers[d_inst.Rd].Busy -= 1
+	if rd := d_inst.getDestRegister(); v._dx_buff[1].valid && rd >= 0 {
+		*v.busyCounter(rd) -= 1
 	}
 
+	// The instruction that was stalling in decode is flushed too, so it can no
+	// longer hold the pipeline.
+	v._stall_map &= ^STALL_RAW
+
 	// Drain IF/ID and ID/EX pipeline buffers
 	v._fd_buff[0].valid = false
 	v._fd_buff[1].valid = false
@@ -326,19 +560,69 @@ func (v *Vm) flush() {
 	v._dx_buff[1].valid = false
 }
 
+// Invalidates every instruction younger than the one in writeback, releasing
+// the destination registers they have marked as busy.
+func (v *Vm) squashYounger() {
+	for _, buff := range []*Pipeline_Buffer{&v._dx_buff[1], &v._xm_buff[1]} {
+		if rd := buff.inst.getDestRegister(); buff.valid && rd >= 0 {
+			*v.busyCounter(rd) -= 1
+		}
+	}
+
+	v._fd_buff[1].valid = false
+	v._dx_buff[1].valid = false
+	v._xm_buff[1].valid = false
+	v._stall_map = 0
+
+	// Only the fetch stage requests a halt before this point, for an
+	// instruction that is now squashed.
+	v._halt = false
+}
+
 func (v *Vm) run_fetch() {
-	var inst Instruction
-	if v.Pc/4 < uint32(v.Dm.Program_size) {
-		inst = v.program[v.Pc/4]
-	} else {
-		// End of the program, set _halt as true so that execution stops when
-		// the pipeline is drained. Also, decrement the fetched instruction
-		// counter by 1, we don't count this as a fetch
+	// A TLB miss stalls the fetch for the page walk, the TLB hits when it is retried
+	pc, walk, exc := v.translate(v.Pc, ACCESS_FETCH)
+	if walk > 0 && exc == nil {
+		v._walk_remaining = walk
+		v._stall_map |= STALL_WALK
 		v.Dm.N_fetched -= 1
-		v._halt = true
 		return
 	}
 
+	if exc == nil && !v.pmpAllows(pc, 4, ACCESS_FETCH, v.Priv) {
+		exc = accessFault(ACCESS_FETCH, v.Pc, "denied by physical memory protection")
+	}
+
+	var inst Instruction
+	if exc == nil && v.program == nil {
+		inst, exc = v.fetchFromMemory(pc)
+	} else if exc == nil {
+		index, in_program := v.programIndex(pc)
+		if !in_program {
+			// End of the program, set _halt as true so that execution stops when
+			// the pipeline is drained. Also, decrement the fetched instruction
+			// counter by 1, we don't count this as a fetch
+			v.Dm.N_fetched -= 1
+			v._halt = true
+			return
+		}
+
+		// Jumping into the middle of an instruction would decode its upper half
+		if index < 0 {
+			exc = newException(CAUSE_ILLEGAL_INSTRUCTION, 0, "Illegal instruction: '%v' is in the middle of an instruction", v.Pc)
+		} else {
+			inst = v.program[index]
+		}
+	}
+
+	if exc != nil {
+		// A nop stands in for the instruction that could not be fetched, and
+		// raises the fault when it reaches writeback.
+		inst = newInstruction(Inst_Addi, 0, 0, 0)
+		inst._fmt = Fmt_I
+		inst.raise(exc)
+	}
+
 	if inst.Op == Inst_End {
 		v.Dm.N_fetched -= 1
 		v._halt = true
@@ -395,7 +679,39 @@ func (v *Vm) run_fetch() {
 	v._fd_buff[0].pc = v.Pc
 	v._fd_buff[0].valid = true
 
-	v.Pc += 4
+	v.Pc += inst.size()
+}
+
+// Returns the index of the instruction at the address, or -1 if the address
+// is in the middle of an instruction. Returns false past the end of the program.
+func (v *Vm) programIndex(pc uint32) (int, bool) {
+	slot := pc / 2
+	if slot >= uint32(len(v._program_slots)) {
+		return 0, false
+	}
+	return int(v._program_slots[slot]), true
+}
+
+// Reads and decodes the instruction at the physical address. Zeros decode
+// as the End instruction, a jump to zeroed memory stops the program.
+func (v *Vm) fetchFromMemory(addr uint32) (Instruction, *Exception) {
+	if uint64(addr)+2 > uint64(len(v.Memory)) {
+		return Instruction{}, accessFault(ACCESS_FETCH, addr, "outside the memory")
+	}
+
+	word := uint32(binary.LittleEndian.Uint16(v.Memory[addr:]))
+	if instructionSize(uint16(word)) == 4 {
+		if uint64(addr)+4 > uint64(len(v.Memory)) {
+			return Instruction{}, accessFault(ACCESS_FETCH, addr, "outside the memory")
+		}
+		word = binary.LittleEndian.Uint32(v.Memory[addr:])
+	}
+
+	inst, err := DecodeInstruction(word, v.Config.Xlen)
+	if err != nil {
+		return inst, newException(CAUSE_ILLEGAL_INSTRUCTION, word, "Illegal instruction at '%#x': %v", v.Pc, err)
+	}
+	return inst, nil
 }
 
 func (v *Vm) run_decode() {
@@ -415,50 +731,37 @@ func (v *Vm) run_decode() {
 	// Update the cyle info
 	v.cycle_info.Stage_pcs[1] = pc
 
-	switch inst._fmt {
-	case Fmt_R:
-		inst._s1 = v.Registers[inst.Rs1].Data
-		inst._s2 = v.Registers[inst.Rs2].Data
-
-		// Set the destination register as busy
-		v.Registers[inst.Rd].Busy++
-		v.Register_diff_idx = append(v.Register_diff_idx, uint8(inst.Rd))
-	case Fmt_I:
-		// In load, immediate is placed in a different position so we check it explicitly.
-		if inst.isLoad() {
-			inst._imm = inst.Rs1
-			inst._s1 = v.Registers[inst.Rs2].Data
-		} else {
-			inst._s1 = v.Registers[inst.Rs1].Data
-			inst._imm = inst.Rs2
-		}
-
-		// Set the destination register as busy
-		v.Registers[inst.Rd].Busy++
-		v.Register_diff_idx = append(v.Register_diff_idx, uint8(inst.Rd))
-	case Fmt_S: // sw s1 imm(s2) = mem[rf(s2) + imm] <- s1
-		inst._s1 = v.Registers[inst.Rd].Data
-		inst._imm = inst.Rs1
-		inst._s2 = v.Registers[inst.Rs2].Data
-	case Fmt_B:
-		inst._s1 = v.Registers[inst.Rd].Data
-		inst._s2 = v.Registers[inst.Rs1].Data
-		inst._imm = inst.Rs2
-	case Fmt_U:
-		inst._imm = inst.Rs1
-		v.Registers[inst.Rd].Busy++
-		v.Register_diff_idx = append(v.Register_diff_idx, uint8(inst.Rd))
-	case Fmt_J:
-		inst._imm = inst.Rs1
-		v.Registers[inst.Rd].Busy++
-		v.Register_diff_idx = append(v.Register_diff_idx, uint8(inst.Rd))
+	// Read the sources from the register file, the sw in 'sw s1 imm(s2)' reads
+	// s1 into _s1 and s2 into _s2. See getSourceRegisters for other formats.
+	rs1, rs2, rs3 := inst.getSourceRegisters()
+	inst._s1 = v.readRegister(rs1)
+	inst._s2 = v.readRegister(rs2)
+	inst._s3 = v.readRegister(rs3)
+	inst._imm = inst.getImmediate()
+
+	// Set the destination register as busy
+	if rd := inst.getDestRegister(); rd >= 0 {
+		*v.busyCounter(rd) += 1
+		v.recordRegisterDiff(rd)
+	}
+
+	// Interrupts are taken between instructions. The instruction leaving
+	// decode is the oldest one that has no side effects yet, so it takes the
+	// interrupt instead of executing. The ones ahead of it complete first.
+	if irq := v.pendingInterrupt(); irq != nil {
+		inst.raise(irq)
 	}
 
 	// Well, for indirect unconditional branches. We don't know the inst._imm
 	// yet, so do it in decode stage.
-	if inst.isUnconditionalBranch() {
+	if inst.isUnconditionalBranch() && inst._exception == nil {
 		if inst.Op == Inst_Jal {
-			v.Pc = uint32(int32(pc) + inst._imm)
+			target := uint32(int32(pc) + inst._imm)
+			if target%2 != 0 {
+				inst.raise(misalignedFetch(target))
+			} else {
+				v.Pc = target
+			}
 		}
 	}
 
@@ -474,6 +777,15 @@ func (v *Vm) run_execute() {
 	// Update the cyle info
 	v.cycle_info.Stage_pcs[2] = pc
 
+	// The instruction ahead of this one is going to trap, this one is squashed
+	// when it does. Pass it along without executing it, so that it can not
+	// write a CSR or redirect the pc. The same goes for an instruction that
+	// already faulted.
+	if v.olderRedirectPending() || inst._exception != nil {
+		v._xm_buff[0] = v._dx_buff[1]
+		return
+	}
+
 	// Get the source values either from bypass or use the one loaded from RF
 	// If this is a multi-cycle execute instruction, we need to get the ALU
 	// inputs in the first cycle!!
@@ -481,9 +793,9 @@ func (v *Vm) run_execute() {
 		var ok bool
 		var t bypass_type
 
-		var s1, s2 int32
+		var s1, s2, s3 int64
 
-		rs1, rs2 := inst.getAluInputRegisters()
+		rs1, rs2, rs3 := inst.getAluInputRegisters()
 
 		s1, t, ok = v.getRegValueFromBypass(rs1)
 		if !ok {
@@ -498,11 +810,47 @@ func (v *Vm) run_execute() {
 			s2 = inst._s2
 		}
 
+		// Update cycle info
+		v.cycle_info.S2_bypass_status = t
+
+		s3, t, ok = v.getRegValueFromBypass(rs3)
+		if !ok {
+			s3 = inst._s3
+		}
+
 		inst._s1 = s1
 		inst._s2 = s2
+		inst._s3 = s3
 
 		// Update cycle info
-		v.cycle_info.S2_bypass_status = t
+		v.cycle_info.S3_bypass_status = t
+
+		if inst.isRv64() && v.Config.Xlen != XLEN_64 {
+			inst.raise(newException(CAUSE_ILLEGAL_INSTRUCTION, 0, "Illegal instruction: '%s' needs XLEN=64",
+				opcodeName(inst.Op)))
+		}
+
+		// Translate the address of memory accesses, a TLB miss keeps the
+		// instruction in this stage for the page walk.
+		if (inst.isLoad() || inst.isStore() || inst.isAtomic()) && inst._exception == nil {
+			vaddr := v.zext(inst.memoryAddress())
+			if vaddr>>32 != 0 {
+				inst.raise(addressOutOfRange(inst.accessType(), vaddr))
+			} else {
+				paddr, walk, exc := v.translate(uint32(vaddr), inst.accessType())
+				if exc != nil {
+					inst.raise(exc)
+				}
+				inst._paddr = paddr
+				inst._ex_remaining += walk
+			}
+		}
+
+		// Vector instructions stay here longer for their elements, which can
+		// bring _ex_remaining back to _ex_total. They are only set up once.
+		if inst.isVector() && inst._vec == nil && inst._exception == nil {
+			v.issueVector(&inst)
+		}
 	}
 
 	inst._ex_remaining--
@@ -520,56 +868,205 @@ func (v *Vm) run_execute() {
 	var branch_target uint32
 	var branch_taken bool
 
+	// Integer values are kept sign-extended from XLEN bits, the result is
+	// truncated to XLEN bits after the switch. See xlen.go.
 	s1, s2 := inst._s1, inst._s2
+	imm := int64(inst._imm)
+	var result int64
 
 	switch inst.Op {
 	/* R-Type */
 	case Inst_Add:
-		inst._result = s1 + s2
+		result = s1 + s2
 	case Inst_Sub:
-		inst._result = s1 - s2
+		result = s1 - s2
 	case Inst_Mul:
-		inst._result = s1 * s2
+		result = s1 * s2
+	case Inst_Mulh:
+		result = v.mulh(s1, s2, true, true)
+	case Inst_Mulhsu:
+		result = v.mulh(s1, s2, true, false)
+	case Inst_Mulhu:
+		result = v.mulh(s1, s2, false, false)
+
+	// Division never traps in RISC-V, division by zero and the
+	// 'INT_MIN / -1' overflow have results defined by the spec.
 	case Inst_Div:
-		inst._result = s1 / s2
+		if s2 == 0 {
+			result = -1
+		} else {
+			result = s1 / s2 // 'INT_MIN / -1' overflows to INT_MIN once truncated
+		}
+	case Inst_Divu:
+		if s2 == 0 {
+			result = -1 // All bits set
+		} else {
+			result = int64(v.zext(s1) / v.zext(s2))
+		}
 	case Inst_Rem:
-		inst._result = s1 % s2
+		if s2 == 0 {
+			result = s1
+		} else if s2 == -1 {
+			result = 0 // Also for the 'INT_MIN / -1' overflow
+		} else {
+			result = s1 % s2
+		}
+	case Inst_Remu:
+		if s2 == 0 {
+			result = s1
+		} else {
+			result = int64(v.zext(s1) % v.zext(s2))
+		}
 	case Inst_Xor:
-		inst._result = s1 ^ s2
+		result = s1 ^ s2
 	case Inst_Or:
-		inst._result = s1 | s2
+		result = s1 | s2
 	case Inst_And:
-		inst._result = s1 & s2
+		result = s1 & s2
+	case Inst_Sll: // Only the low log2(XLEN) bits of rs2 are the shift amount
+		result = s1 << v.shamt(s2)
+	case Inst_Srl:
+		result = int64(v.zext(s1) >> v.shamt(s2))
+	case Inst_Sra:
+		result = s1 >> v.shamt(s2)
+	case Inst_Slt:
+		result = boolToInt64(s1 < s2)
+	case Inst_Sltu: // Sign-extended values compare the same as the XLEN bit ones
+		result = boolToInt64(uint64(s1) < uint64(s2))
+
+	/* Bit manipulation */
+	case Inst_Sh1add:
+		result = s2 + s1<<1
+	case Inst_Sh2add:
+		result = s2 + s1<<2
+	case Inst_Sh3add:
+		result = s2 + s1<<3
+	case Inst_Andn:
+		result = s1 &^ s2
+	case Inst_Orn:
+		result = s1 | ^s2
+	case Inst_Xnor:
+		result = ^(s1 ^ s2)
+	case Inst_Clz:
+		result = v.clz(s1)
+	case Inst_Ctz:
+		result = v.ctz(s1)
+	case Inst_Cpop:
+		result = int64(bits.OnesCount64(v.zext(s1)))
+	case Inst_Max:
+		result = max(s1, s2)
+	case Inst_Maxu:
+		result = int64(max(uint64(s1), uint64(s2)))
+	case Inst_Min:
+		result = min(s1, s2)
+	case Inst_Minu:
+		result = int64(min(uint64(s1), uint64(s2)))
+	case Inst_Sext_b:
+		result = int64(int8(s1))
+	case Inst_Sext_h:
+		result = int64(int16(s1))
+	case Inst_Zext_h:
+		result = int64(uint16(s1))
+	case Inst_Rol:
+		result = v.rotate(s1, v.shamt(s2))
+	case Inst_Ror:
+		result = v.rotate(s1, -v.shamt(s2))
+	case Inst_Orc_b:
+		result = v.orcB(s1)
+	case Inst_Rev8:
+		result = v.rev8(s1)
+	case Inst_Bclr:
+		result = s1 &^ (1 << v.shamt(s2))
+	case Inst_Bext:
+		result = s1 >> v.shamt(s2) & 1
+	case Inst_Binv:
+		result = s1 ^ 1<<v.shamt(s2)
+	case Inst_Bset:
+		result = s1 | 1<<v.shamt(s2)
+
+	/* RV64 word instructions */
+	case Inst_Addw, Inst_Subw, Inst_Sllw, Inst_Srlw, Inst_Sraw, Inst_Mulw, Inst_Divw, Inst_Divuw,
+		Inst_Remw, Inst_Remuw, Inst_Addiw, Inst_Slliw, Inst_Srliw, Inst_Sraiw:
+		result = executeWord(inst)
 
 	/* I-Type */
 	case Inst_Addi:
-		inst._result = s1 + inst._imm
+		result = s1 + imm
 	case Inst_Subi:
-		inst._result = s1 - inst._imm
+		result = s1 - imm
 	case Inst_Xori:
-		inst._result = s1 ^ inst._imm
+		result = s1 ^ imm
 	case Inst_Ori:
-		inst._result = s1 | inst._imm
+		result = s1 | imm
 	case Inst_Andi:
-		inst._result = s1 & inst._imm
-	case Inst_Lw, Inst_Lh, Inst_Lb: // load
-		addr := s1 + inst._imm
-		inst._result = addr
+		result = s1 & imm
+	case Inst_Lw, Inst_Lh, Inst_Lb, Inst_Lhu, Inst_Lbu, Inst_Flw, Inst_Fld, Inst_Ld, Inst_Lwu: // load
+		result = int64(inst._paddr) // Translated in the first cycle
 	case Inst_Jalr:
-		inst._result = int32(pc)
+		result = int64(pc + inst.size()) // Same link as 'jal'
 		branch_taken = true
-		branch_target = uint32(s1 + inst._imm)
-	case Inst_Slli: // rd = rs1 << imm[0:4]
-		inst._result = int32(uint32(s1) << inst._imm)
+		target := v.zext(s1+imm) &^ 1
+		if target>>32 != 0 {
+			inst.raise(addressOutOfRange(ACCESS_FETCH, target))
+		}
+		branch_target = uint32(target)
+	case Inst_Slli: // rd = rs1 << imm[0:log2(XLEN)]
+		result = s1 << v.shamt(imm)
 	case Inst_Srli:
-		inst._result = int32(uint32(s1) >> inst._imm)
+		result = int64(v.zext(s1) >> v.shamt(imm))
 	case Inst_Srai:
-		inst._result = s1 << inst._imm
+		result = s1 >> v.shamt(imm)
+	case Inst_Slti:
+		result = boolToInt64(s1 < imm)
+	case Inst_Sltiu: // The immediate is sign-extended first, then compared as unsigned
+		result = boolToInt64(uint64(s1) < uint64(imm))
+	case Inst_Rori:
+		result = v.rotate(s1, -v.shamt(imm))
+	case Inst_Bclri:
+		result = s1 &^ (1 << v.shamt(imm))
+	case Inst_Bexti:
+		result = s1 >> v.shamt(imm) & 1
+	case Inst_Binvi:
+		result = s1 ^ 1<<v.shamt(imm)
+	case Inst_Bseti:
+		result = s1 | 1<<v.shamt(imm)
+	case Inst_Csrrw, Inst_Csrrs, Inst_Csrrc, Inst_Csrrwi, Inst_Csrrsi, Inst_Csrrci:
+		// Performed here so that FP instructions behind see the new fcsr
+		v.executeCsr(&inst)
+	case Inst_Ecall:
+		// The cause tells the privilege level it was made from
+		inst.raise(newException(CAUSE_ECALL_U+v.Priv, 0, "Environment call from %s mode", privName(v.Priv)))
+	case Inst_Ebreak:
+		inst.raise(newException(CAUSE_BREAKPOINT, pc, "Breakpoint at '%v'", pc))
+	case Inst_Mret:
+		// Handled at writeback, but only machine mode may use it
+		if v.Priv != PRIV_M {
+			inst.raise(newException(CAUSE_ILLEGAL_INSTRUCTION, 0, "Illegal instruction: 'mret' outside machine mode"))
+		}
+	case Inst_Sret:
+		if v.Priv < PRIV_S {
+			inst.raise(newException(CAUSE_ILLEGAL_INSTRUCTION, 0, "Illegal instruction: 'sret' in user mode"))
+		}
+	case Inst_Fence:
+		// Memory accesses are already performed in program order by the
+		// pipeline, so fence has nothing to do.
+	case Inst_Fence_i:
+		// The instructions behind are fetched again below, see Inst_Fence_i
 
 	/* S-Type */
-	case Inst_Sw, Inst_Sh, Inst_Sb: // Store word
-		addr := s2 + inst._imm // In bytes
-		inst._result = addr    // Each memory cell holds one byte
+	case Inst_Sw, Inst_Sh, Inst_Sb, Inst_Fsw, Inst_Fsd, Inst_Sd: // Store word
+		result = int64(inst._paddr) // In bytes, each memory cell holds one byte
+
+	/* Atomics, the memory stage reads and writes the address */
+	case Inst_Lr_w, Inst_Sc_w, Inst_Amoswap_w, Inst_Amoadd_w, Inst_Amoxor_w, Inst_Amoand_w,
+		Inst_Amoor_w, Inst_Amomin_w, Inst_Amomax_w, Inst_Amominu_w, Inst_Amomaxu_w:
+		result = int64(inst._paddr)
+
+	case Inst_Sfence_vma:
+		// Handled at writeback
+		if v.Priv < PRIV_S {
+			inst.raise(newException(CAUSE_ILLEGAL_INSTRUCTION, 0, "Illegal instruction: 'sfence.vma' in user mode"))
+		}
 
 	/* B-Type */
 	case Inst_Beq:
@@ -592,19 +1089,57 @@ func (v *Vm) run_execute() {
 			branch_taken = true
 			branch_target = uint32(int32(pc) + inst._imm)
 		}
+	case Inst_Bltu:
+		if uint64(s1) < uint64(s2) {
+			branch_taken = true
+		}
+		branch_target = uint32(int32(pc) + inst._imm)
+	case Inst_Bgeu:
+		if uint64(s1) >= uint64(s2) {
+			branch_taken = true
+		}
+		branch_target = uint32(int32(pc) + inst._imm)
 
 	/* J-Type */
 	case Inst_Jal: // Jump And Link
-		inst._result = int32(pc + 4) // store the next instruction
+		result = int64(pc + inst.size()) // store the next instruction
 		branch_taken = true
 		branch_target = uint32(int32(pc) + inst._imm)
 
 	/* U-Type */
 	case Inst_Lui:
-		inst._result = inst._imm
+		result = imm
 	case Inst_Auipc:
 		// TODO: check if the immediate value is aligned or not
-		inst._result = int32(pc) + inst._imm
+		result = int64(pc) + imm
+
+	default:
+		if inst.isFp() {
+			v.executeFp(&inst)
+		} else if inst.isVector() {
+			v.executeVector(&inst)
+		} else if inst.isCustom() {
+			result = executeCustom(inst)
+		}
+	}
+
+	if !inst.isFp() && !inst.isCsr() && !inst.isVector() {
+		inst._result = v.sext(result)
+	}
+
+	// A taken branch to a misaligned address faults instead of jumping.
+	// Compressed instructions make every even address aligned.
+	if branch_taken && branch_target%2 != 0 {
+		inst.raise(misalignedFetch(branch_target))
+	}
+
+	// A faulting instruction does not redirect the pc, the trap will. Any
+	// stall it caused is released when the younger instructions are squashed.
+	if inst._exception != nil {
+		v._xm_buff[0].inst = inst
+		v._xm_buff[0].pc = pc
+		v._xm_buff[0].valid = true
+		return
 	}
 
 	if inst.isConditionalBranch() {
@@ -628,11 +1163,19 @@ func (v *Vm) run_execute() {
 				v._control_buff[0].branch_target = branch_target
 			} else {
 				// Fetch the next instruction
-				v._control_buff[0].branch_target = pc + 4
+				v._control_buff[0].branch_target = pc + inst.size()
 			}
 		}
 	}
 
+	// The instructions behind fence.i may have been fetched before the stores
+	// ahead wrote the memory. They are flushed and fetched again, the stores
+	// are done by then since the memory stage runs before this one.
+	if inst.Op == Inst_Fence_i {
+		v._control_buff[0].flags |= CONTROL_BRANCH | CONTROL_FLUSH
+		v._control_buff[0].branch_target = pc + inst.size()
+	}
+
 	// Inst_Jalr is an indirect, conditional branch operation.
 	// If there was a stall, dissolve the stall, update the pc and save the target pc to the BTB.
 	// If there was no stall, we don't need to do anything.
@@ -665,57 +1208,111 @@ func (v *Vm) run_execute() {
 	v._xm_buff[0].valid = true
 }
 
-func (v *Vm) memoryWrite(data int32, addr uint32, n uint8) {
+// Returns the exception an access of n bytes at the physical address addr
+// raises, or nil if the access is aligned, allowed by PMP and inside the
+// memory. Stores and atomics raise the store causes, loads the load causes.
+func (v *Vm) checkAccess(addr uint32, n uint8, access Access_Type) *Exception {
+	store := access == ACCESS_STORE
 	if addr%uint32(n) != 0 {
-		err := fmt.Errorf("Illegal write attempt to unaligned memory address:"+
+		if store {
+			return newException(CAUSE_MISALIGNED_STORE, addr, "Illegal write attempt to unaligned memory address:"+
+				"'%v'. Must align by '%v'", addr, n)
+		}
+		return newException(CAUSE_MISALIGNED_LOAD, addr, "Illegal read attempt from unaligned memory address:"+
 			"'%v'. Must align by '%v'", addr, n)
-		v.Runtime_error = err
+	}
 
-		// v._halt = true
-		return
+	if !v.pmpAllows(addr, n, access, v.dataPrivilege()) {
+		return accessFault(access, addr, "denied by physical memory protection")
 	}
 
-	u := uint32(data)
-	for i := range uint32(n) {
-		// Check if addr+i is out of bounds
-		// We are not checking addr + i < 0 because addr is unsigned and negative values wrap around.
-		if addr+i >= v.Config.Mem_size {
-			err := fmt.Errorf("Illegal write attempt to out of bound memory address:"+
+	if isClintAddr(addr) {
+		return nil
+	}
+
+	// Check the whole access, so that an access that crosses the end of
+	// memory does not leave a partial write behind.
+	if uint64(addr)+uint64(n) > uint64(v.Config.Mem_size) {
+		if store {
+			return newException(CAUSE_STORE_ACCESS, addr, "Illegal write attempt to out of bound memory address:"+
 				"'%v'. Maximum writeable memory address is '%v'!", addr, v.Config.Mem_size-1)
-			v.Runtime_error = err
-			return
 		}
+		return newException(CAUSE_LOAD_ACCESS, addr, "Illegal read attempt from out of bound memory address:"+
+			"'%v'. Maximum readable memory address is '%v'!", addr, v.Config.Mem_size-1)
+	}
 
+	return nil
+}
+
+// Writes the lowest n bytes of data, n can be 1, 2, 4 or 8.
+// Nothing is written if the access faults.
+func (v *Vm) memoryWrite(data int64, addr uint32, n uint8) *Exception {
+	if exc := v.checkAccess(addr, n, ACCESS_STORE); exc != nil {
+		return exc
+	}
+
+	if isClintAddr(addr) {
+		v.clintWrite(uint64(data), addr-CLINT_BASE, n)
+		return nil
+	}
+
+	// Any store to the reserved word makes the next 'sc' fail
+	if v._reservation_valid && addr < v._reservation+4 && v._reservation < addr+uint32(n) {
+		v._reservation_valid = false
+	}
+
+	u := uint64(data)
+	for i := range uint32(n) {
 		v.Memory[addr+i] = byte(u)
 		u >>= 8
 
 		v.Memory_diff_addr = append(v.Memory_diff_addr, uint32(addr+i))
 	}
+	return nil
 }
 
-func (v *Vm) memoryRead(addr uint32, n uint8) int32 {
-	if addr%uint32(n) != 0 {
-		err := fmt.Errorf("Illegal read attempt from unaligned memory address:"+
-			"'%v'. Must align by '%v'", addr, n)
-		v.Runtime_error = err
+// Reads n bytes, n can be 1, 2, 4 or 8. The value is zero-extended.
+func (v *Vm) memoryRead(addr uint32, n uint8) (uint64, *Exception) {
+	if exc := v.checkAccess(addr, n, ACCESS_LOAD); exc != nil {
+		return 0, exc
+	}
 
-		v._halt = true
-		return 0
+	if isClintAddr(addr) {
+		return v.clintRead(addr-CLINT_BASE, n), nil
 	}
 
-	var u uint32
+	var u uint64
 	for i := range uint32(n) {
-		if addr+i >= v.Config.Mem_size {
-			err := fmt.Errorf("Illegal read attempt from out of bound memory address:"+
-				"'%v'. Maximum readable memory address is '%v'!", addr, v.Config.Mem_size-1)
-			v.Runtime_error = err
-			return 0
-		}
-
-		u |= uint32(v.Memory[addr+i]) << (i * 8)
+		u |= uint64(v.Memory[addr+i]) << (i * 8)
 	}
 
-	return int32(u)
+	return u, nil
+}
+
+// Returns the value an atomic memory operation writes back to memory.
+func amoResult(op Inst_Op, old, src int32) int32 {
+	switch op {
+	case Inst_Amoswap_w:
+		return src
+	case Inst_Amoadd_w:
+		return old + src
+	case Inst_Amoxor_w:
+		return old ^ src
+	case Inst_Amoand_w:
+		return old & src
+	case Inst_Amoor_w:
+		return old | src
+	case Inst_Amomin_w:
+		return min(old, src)
+	case Inst_Amomax_w:
+		return max(old, src)
+	case Inst_Amominu_w:
+		return int32(min(uint32(old), uint32(src)))
+	case Inst_Amomaxu_w:
+		return int32(max(uint32(old), uint32(src)))
+	default:
+		return old
+	}
 }
 
 func (v *Vm) run_memory() {
@@ -725,41 +1322,107 @@ func (v *Vm) run_memory() {
 	// Update the cycle info
 	v.cycle_info.Stage_pcs[3] = pc
 
+	// A faulting instruction does not access memory
+	if inst._exception != nil {
+		v._mw_buff[0] = v._xm_buff[1]
+		return
+	}
+
 	// Memory layout is little-endian
 	// b3 b2 b1 b0
+	var exc *Exception
+	var data uint64
+	addr := uint32(inst._result)
+
 	switch inst.Op {
-	case Inst_Sw: // Store word
-		addr := uint32(inst._result)
-		data := inst._s1
-		v.memoryWrite(data, addr, 4)
+	case Inst_Sw, Inst_Fsw: // Store word
+		exc = v.memoryWrite(inst._s1, addr, 4)
+
+	case Inst_Fsd, Inst_Sd: // Store double word
+		exc = v.memoryWrite(inst._s1, addr, 8)
 
 	case Inst_Sh: // Store half
-		addr := uint32(inst._result)
-		data := inst._s1
-		v.memoryWrite(data, addr, 2)
+		exc = v.memoryWrite(inst._s1, addr, 2)
 
 	case Inst_Sb: // Store byte
-		addr := uint32(inst._result)
-		data := inst._s1
-		v.memoryWrite(data, addr, 1)
+		exc = v.memoryWrite(inst._s1, addr, 1)
 
 	case Inst_Lw: // Load word
-		addr := uint32(inst._result)
-		data := v.memoryRead(addr, 4)
+		data, exc = v.memoryRead(addr, 4)
+		inst._result = int64(int32(data))
+
+	case Inst_Flw: // Load FP word, NaN-boxed into the FP register
+		data, exc = v.memoryRead(addr, 4)
+		inst._result = int64(data | FP_NAN_BOX)
+
+	case Inst_Fld, Inst_Ld: // Load double word
+		data, exc = v.memoryRead(addr, 8)
+		inst._result = int64(data)
+
+	case Inst_Lwu: // Load word, zero-extended
+		data, exc = v.memoryRead(addr, 4)
+		inst._result = int64(uint32(data))
+
+	case Inst_Lh: // Load half, sign-extended
+		data, exc = v.memoryRead(addr, 2)
+		inst._result = int64(int16(data))
+
+	case Inst_Lb: // Load byte, sign-extended
+		data, exc = v.memoryRead(addr, 1)
+		inst._result = int64(int8(data))
+
+	case Inst_Lhu: // Load half, zero-extended
+		data, exc = v.memoryRead(addr, 2)
+		inst._result = int64(uint16(data))
+
+	case Inst_Lbu: // Load byte, zero-extended
+		data, exc = v.memoryRead(addr, 1)
+		inst._result = int64(uint8(data))
+
+	case Inst_Lr_w: // Load word and reserve it
+		data, exc = v.memoryRead(addr, 4)
+		inst._result = int64(int32(data))
+		if exc == nil {
+			v._reservation = addr
+			v._reservation_valid = true
+		}
+
+	case Inst_Sc_w: // Store word if the reservation still holds, rd = 0 on success
+		// A misaligned or out of bound 'sc' faults even if it would fail
+		if exc = v.checkAccess(addr, 4, ACCESS_STORE); exc != nil {
+			break
+		}
+
+		if v._reservation_valid && v._reservation == addr {
+			v.memoryWrite(inst._s1, addr, 4)
+			inst._result = 0
+		} else {
+			inst._result = 1
+		}
 
-		inst._result = data
+		// The reservation is consumed whether or not the store succeeds
+		v._reservation_valid = false
 
-	case Inst_Lh: // Load half
-		addr := uint32(inst._result)
-		data := v.memoryRead(addr, 2)
+	case Inst_Amoswap_w, Inst_Amoadd_w, Inst_Amoxor_w, Inst_Amoand_w, Inst_Amoor_w,
+		Inst_Amomin_w, Inst_Amomax_w, Inst_Amominu_w, Inst_Amomaxu_w:
+		// Atomics raise the store causes for the read too
+		if exc = v.checkAccess(addr, 4, ACCESS_STORE); exc != nil {
+			break
+		}
 
-		inst._result = data
+		data, _ = v.memoryRead(addr, 4)
+		old := int32(data)
+		v.memoryWrite(int64(amoResult(inst.Op, old, int32(inst._s1))), addr, 4)
+		inst._result = int64(old)
 
-	case Inst_Lb: // Load byte
-		addr := uint32(inst._result)
-		data := v.memoryRead(addr, 1)
+	default:
+		if inst.isVectorLoad() || inst.isVectorStore() {
+			exc = v.vectorMemoryAccess(&inst)
+		}
+	}
 
-		inst._result = data
+	if exc != nil {
+		inst.raise(exc)
 	}
 
 	v._mw_buff[0].inst = inst
@@ -771,24 +1434,44 @@ func (v *Vm) run_writeback() {
 	inst := v._mw_buff[1].inst
 	pc := v._mw_buff[1].pc
 
-	// Update the cycle info and diagnostics
+	// Update the cycle info
 	v.cycle_info.Stage_pcs[4] = pc
-	v.Dm.N_retired += 1
 
-	// We don't want to writeback if instruction type is S
-	if inst._fmt == Fmt_R || inst._fmt == Fmt_I || inst._fmt == Fmt_U || inst._fmt == Fmt_J {
+	// We don't want to writeback if the instruction has no destination, like S and B types
+	rd := inst.getDestRegister()
+	if rd >= 0 {
 		// set the destination register as free
-		v.Registers[inst.Rd].Busy--
+		*v.busyCounter(rd) -= 1
+	}
 
-		// We don't allow writes to x0 register
-		if inst.Rd == 0 {
-			return
-		}
+	// A faulting instruction does not retire and does not write its result,
+	// everything younger is squashed and the pc goes to the trap handler.
+	if inst._exception != nil {
+		v.takeTrap(inst._exception, pc)
+		return
+	}
+
+	v.Dm.N_retired += 1
 
-		v.Registers[inst.Rd].Data = inst._result
-		v.Register_diff_idx = append(v.Register_diff_idx, uint8(inst.Rd))
+	switch inst.Op {
+	case Inst_Mret:
+		v.returnFromTrap()
+	case Inst_Sret:
+		v.returnFromSupervisorTrap()
+	case Inst_Sfence_vma:
+		v.fenceVma(inst, pc)
+	}
+
+	if inst.isVector() {
+		v.Dm.countVector(inst)
 	}
 
+	// We don't allow writes to x0 register
+	if rd == VECTOR_REG_INDEX {
+		v.writeVectorResult(inst)
+	} else if rd > 0 {
+		v.writeRegister(rd, inst._result)
+	}
 }
 
 func (v *Vm) run_control() {
@@ -828,6 +1511,7 @@ func (v *Vm) ExecuteCycle() {
 	// Clear the memory and register diff
 	v.Memory_diff_addr = v.Memory_diff_addr[:0]
 	v.Register_diff_idx = v.Register_diff_idx[:0]
+	v.FRegister_diff_idx = v.FRegister_diff_idx[:0]
 
 	v.run_control()
 
@@ -847,7 +1531,21 @@ func (v *Vm) ExecuteCycle() {
 		v.run_decode()
 	}
 
-	if v.Pc/4 <= uint32(v.Dm.Program_size) && !v._halt && v._stall_map == 0 {
+	// A branch resolved in execute this cycle redirects the pc and flushes
+	// the front end. Fetching now would be wasted, and the prediction of the
+	// fetched instruction could override the resolved target.
+	redirected := v._control_buff[0].flags&CONTROL_FLUSH != 0
+
+	// Count down the page walk of the fetch
+	if v._stall_map&STALL_WALK != 0 {
+		v._walk_remaining--
+		if v._walk_remaining <= 0 {
+			v._stall_map &= ^STALL_WALK
+		}
+	}
+
+	// The fetch stage halts the machine when the pc leaves the program
+	if !v._halt && v._stall_map == 0 && !redirected {
 		v.Dm.N_fetched++
 
 		v.run_fetch()
@@ -870,6 +1568,10 @@ func (v *Vm) ExecuteCycle() {
 		if v.cycle_info.S2_bypass_status != 0 {
 			v.Dm.N_forwards++
 		}
+
+		if v.cycle_info.S3_bypass_status != 0 {
+			v.Dm.N_forwards++
+		}
 	}
 
 	v.shiftPipelineBuffers()
@@ -914,3 +1616,10 @@ func (v *Vm) shiftPipelineBuffers() {
 	v._control_buff[1] = v._control_buff[0]
 	v._control_buff[0] = Control_Buffer{}
 }
+
+func boolToInt64(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
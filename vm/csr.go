@@ -0,0 +1,576 @@
+package vm
+
+import (
+	"fmt"
+)
+
+// Addresses of the implemented control and status registers
+const (
+	CSR_FFLAGS uint32 = 0x001
+	CSR_FRM    uint32 = 0x002
+	CSR_FCSR   uint32 = 0x003
+
+	// Supervisor mode
+	CSR_SSTATUS  uint32 = 0x100 // Restricted view of mstatus
+	CSR_SIE      uint32 = 0x104 // Delegated bits of mie
+	CSR_STVEC    uint32 = 0x105
+	CSR_SSCRATCH uint32 = 0x140
+	CSR_SEPC     uint32 = 0x141
+	CSR_SCAUSE   uint32 = 0x142
+	CSR_STVAL    uint32 = 0x143
+	CSR_SIP      uint32 = 0x144 // Delegated bits of mip
+	CSR_SATP     uint32 = 0x180 // Address translation and protection
+
+	// Machine trap setup and handling
+	CSR_MSTATUS  uint32 = 0x300
+	CSR_MISA     uint32 = 0x301
+	CSR_MEDELEG  uint32 = 0x302
+	CSR_MIDELEG  uint32 = 0x303
+	CSR_MIE      uint32 = 0x304
+	CSR_MTVEC    uint32 = 0x305
+	CSR_MSCRATCH uint32 = 0x340
+	CSR_MEPC     uint32 = 0x341
+	CSR_MCAUSE   uint32 = 0x342
+	CSR_MTVAL    uint32 = 0x343
+	CSR_MIP      uint32 = 0x344
+
+	// Machine information registers, all read-only
+	CSR_MVENDORID uint32 = 0xf11
+	CSR_MARCHID   uint32 = 0xf12
+	CSR_MIMPID    uint32 = 0xf13
+	CSR_MHARTID   uint32 = 0xf14
+
+	// Machine counters, these are writable
+	CSR_MCYCLE       uint32 = 0xb00
+	CSR_MINSTRET     uint32 = 0xb02
+	CSR_MHPMCOUNTER3 uint32 = 0xb03 // Up to mhpmcounter31 at 0xb1f
+	CSR_MCYCLEH      uint32 = 0xb80
+	CSR_MINSTRETH    uint32 = 0xb82
+
+	// Read-only shadows of the machine counters
+	CSR_CYCLE       uint32 = 0xc00
+	CSR_TIME        uint32 = 0xc01
+	CSR_INSTRET     uint32 = 0xc02
+	CSR_HPMCOUNTER3 uint32 = 0xc03 // Up to hpmcounter31 at 0xc1f
+	CSR_CYCLEH      uint32 = 0xc80
+	CSR_TIMEH       uint32 = 0xc81
+	CSR_INSTRETH    uint32 = 0xc82
+)
+
+// Offset of the upper halves of the 64-bit counters from the lower ones
+const CSR_COUNTER_HIGH = 0x80
+
+// Counters 3 and up count these events. Counters without an event always read zero.
+const (
+	HPM_STALLS  = 3 // Cycles with a stalled pipeline
+	HPM_BRANCH  = 4 // Conditional branches executed
+	HPM_MISPRED = 5 // Mispredicted branches
+	HPM_FORWARD = 6 // Operands taken from the bypass network
+	HPM_FETCHED = 7 // Instructions fetched, including the flushed ones
+)
+
+// Extensions reported by misa, one bit per letter
+const MISA_EXTENSIONS = "IMAFDCBVSU"
+
+// CSRs that are plain state, the counters and fcsr are kept elsewhere.
+type Csr_File struct {
+	Mstatus  uint32
+	Mie      uint32
+	Mtvec    uint32
+	Mscratch uint32
+	Mepc     uint32
+	Mcause   uint32
+	Mtval    uint32
+	Medeleg  uint32
+	Mideleg  uint32
+	Mip      uint32 // The bits software can write, see mip()
+
+	Stvec    uint32
+	Sscratch uint32
+	Sepc     uint32
+	Scause   uint32
+	Stval    uint32
+	Satp     uint32
+
+	Pmpcfg  [PMP_ENTRIES]uint8
+	Pmpaddr [PMP_ENTRIES]uint32
+}
+
+// Bits of mstatus that software can write, MPP is checked separately
+const MSTATUS_WRITABLE = MSTATUS_SIE | MSTATUS_MIE | MSTATUS_SPIE | MSTATUS_MPIE | MSTATUS_SPP |
+	MSTATUS_MPRV | MSTATUS_SUM | MSTATUS_MXR
+
+// Bits of mstatus that are visible through sstatus
+const SSTATUS_MASK = MSTATUS_SIE | MSTATUS_SPIE | MSTATUS_SPP | MSTATUS_SUM | MSTATUS_MXR
+
+// Interrupts that can be enabled, and the ones supervisor mode can handle.
+// The machine interrupts come from the CLINT, the supervisor ones are raised
+// by software through mip.
+const (
+	MIE_WRITABLE     = MIP_SSIP | MIP_MSIP | MIP_STIP | MIP_MTIP
+	MIDELEG_WRITABLE = MIP_SSIP | MIP_STIP
+)
+
+// Exceptions that can be delegated, all but the machine mode ecall
+const MEDELEG_WRITABLE uint32 = 1<<CAUSE_MISALIGNED_FETCH | 1<<CAUSE_FETCH_ACCESS | 1<<CAUSE_ILLEGAL_INSTRUCTION |
+	1<<CAUSE_BREAKPOINT | 1<<CAUSE_MISALIGNED_LOAD | 1<<CAUSE_LOAD_ACCESS | 1<<CAUSE_MISALIGNED_STORE |
+	1<<CAUSE_STORE_ACCESS | 1<<CAUSE_ECALL_U | 1<<CAUSE_ECALL_S | 1<<CAUSE_FETCH_PAGE_FAULT |
+	1<<CAUSE_LOAD_PAGE_FAULT | 1<<CAUSE_STORE_PAGE_FAULT
+
+// Returns the CSRs in their reset state.
+func defaultCsrFile() Csr_File {
+	return Csr_File{
+		Mstatus: PRIV_M << MSTATUS_MPP_SHIFT,
+	}
+}
+
+// Unsupported trap vector modes fall back to direct.
+func legalTvec(data uint32) uint32 {
+	if data&MTVEC_MODE_MASK > MTVEC_MODE_VECTORED {
+		data &^= MTVEC_MODE_MASK
+	}
+	return data
+}
+
+// Returns the value of misa, a 32-bit machine with the extensions in MISA_EXTENSIONS.
+func misaValue() uint32 {
+	value := uint32(1) << 30
+	for _, c := range MISA_EXTENSIONS {
+		value |= 1 << (c - 'A')
+	}
+	return value
+}
+
+var csrNames = map[string]uint32{
+	"fflags":    CSR_FFLAGS,
+	"frm":       CSR_FRM,
+	"fcsr":      CSR_FCSR,
+	"sstatus":   CSR_SSTATUS,
+	"sie":       CSR_SIE,
+	"stvec":     CSR_STVEC,
+	"sscratch":  CSR_SSCRATCH,
+	"sepc":      CSR_SEPC,
+	"scause":    CSR_SCAUSE,
+	"stval":     CSR_STVAL,
+	"sip":       CSR_SIP,
+	"satp":      CSR_SATP,
+	"mstatus":   CSR_MSTATUS,
+	"misa":      CSR_MISA,
+	"medeleg":   CSR_MEDELEG,
+	"mideleg":   CSR_MIDELEG,
+	"mie":       CSR_MIE,
+	"mtvec":     CSR_MTVEC,
+	"mscratch":  CSR_MSCRATCH,
+	"mepc":      CSR_MEPC,
+	"mcause":    CSR_MCAUSE,
+	"mtval":     CSR_MTVAL,
+	"mip":       CSR_MIP,
+	"mvendorid": CSR_MVENDORID,
+	"marchid":   CSR_MARCHID,
+	"mimpid":    CSR_MIMPID,
+	"mhartid":   CSR_MHARTID,
+	"mcycle":    CSR_MCYCLE,
+	"minstret":  CSR_MINSTRET,
+	"mcycleh":   CSR_MCYCLEH,
+	"minstreth": CSR_MINSTRETH,
+	"cycle":     CSR_CYCLE,
+	"time":      CSR_TIME,
+	"instret":   CSR_INSTRET,
+	"cycleh":    CSR_CYCLEH,
+	"timeh":     CSR_TIMEH,
+	"instreth":  CSR_INSTRETH,
+	"vl":        CSR_VL,
+	"vtype":     CSR_VTYPE,
+	"vlenb":     CSR_VLENB,
+}
+
+func init() {
+	for i := uint32(3); i < 32; i++ {
+		csrNames[fmt.Sprintf("hpmcounter%d", i)] = CSR_HPMCOUNTER3 + i - 3
+		csrNames[fmt.Sprintf("hpmcounter%dh", i)] = CSR_HPMCOUNTER3 + i - 3 + CSR_COUNTER_HIGH
+		csrNames[fmt.Sprintf("mhpmcounter%d", i)] = CSR_MHPMCOUNTER3 + i - 3
+		csrNames[fmt.Sprintf("mhpmcounter%dh", i)] = CSR_MHPMCOUNTER3 + i - 3 + CSR_COUNTER_HIGH
+	}
+	for i := range uint32(PMP_ENTRIES) {
+		if i%4 == 0 {
+			csrNames[fmt.Sprintf("pmpcfg%d", i/4)] = CSR_PMPCFG0 + i/4
+		}
+		csrNames[fmt.Sprintf("pmpaddr%d", i)] = CSR_PMPADDR0 + i
+	}
+}
+
+// Returns the name of the CSR, or its address if it has no name.
+func csrName(addr uint32) string {
+	for name, a := range csrNames {
+		if a == addr {
+			return name
+		}
+	}
+	return fmt.Sprintf("%#x", addr)
+}
+
+// CSRs with both of the top address bits set are read-only.
+func csrIsReadOnly(addr uint32) bool {
+	return addr>>10 == 0b11
+}
+
+// Returns the lowest privilege level that can access the CSR, encoded in
+// bits 8 and 9 of the address.
+func csrPrivilege(addr uint32) uint32 {
+	return (addr >> 8) & 3
+}
+
+// Returns the counter number(0 = cycle, 1 = time, 2 = instret, 3..31 =
+// hpmcounter) and whether the address is the upper half of a counter.
+func csrCounter(addr uint32) (int, bool, bool) {
+	for _, base := range []uint32{CSR_MCYCLE, CSR_CYCLE} {
+		n, high := int(addr-base), false
+		if addr >= base+CSR_COUNTER_HIGH {
+			n, high = int(addr-base-CSR_COUNTER_HIGH), true
+		}
+
+		// There is no machine mode time counter, time is memory mapped
+		if n < 0 || n >= 32 || (base == CSR_MCYCLE && n == 1) {
+			continue
+		}
+		return n, high, true
+	}
+	return 0, false, false
+}
+
+// Returns the raw 64-bit value of a counter, as counted by the diagnostics manager.
+func (v *Vm) counterValue(n int) uint64 {
+	dm := &v.Dm
+	switch n {
+	case 0:
+		return uint64(dm.N_cycle)
+	case 1: // Shadow of the memory mapped mtime
+		return v.mtime()
+	case 2:
+		// The instruction in the memory stage is older than the one reading
+		// the counter but has not retired yet.
+		retired := uint64(dm.N_retired)
+		if v._xm_buff[1].valid {
+			retired++
+		}
+		return retired
+	case HPM_STALLS:
+		return uint64(dm.N_stalls)
+	case HPM_BRANCH:
+		return uint64(dm.N_branch)
+	case HPM_MISPRED:
+		return uint64(dm.N_mispred)
+	case HPM_FORWARD:
+		return uint64(dm.N_forwards)
+	case HPM_FETCHED:
+		return uint64(dm.N_fetched)
+	default:
+		return 0
+	}
+}
+
+// Reads a CSR. Returns an error if the CSR does not exist.
+func (v *Vm) csrRead(addr uint32) (uint32, error) {
+	switch addr {
+	case CSR_FFLAGS:
+		return v.Fcsr & FCSR_FFLAGS_MASK, nil
+	case CSR_FRM:
+		return (v.Fcsr & FCSR_FRM_MASK) >> FCSR_FRM_SHIFT, nil
+	case CSR_FCSR:
+		return v.Fcsr, nil
+	case CSR_SSTATUS:
+		return v.Csrs.Mstatus & SSTATUS_MASK, nil
+	case CSR_SIE:
+		return v.Csrs.Mie & v.Csrs.Mideleg, nil
+	case CSR_STVEC:
+		return v.Csrs.Stvec, nil
+	case CSR_SSCRATCH:
+		return v.Csrs.Sscratch, nil
+	case CSR_SEPC:
+		return v.Csrs.Sepc, nil
+	case CSR_SCAUSE:
+		return v.Csrs.Scause, nil
+	case CSR_STVAL:
+		return v.Csrs.Stval, nil
+	case CSR_SIP:
+		return v.mip() & v.Csrs.Mideleg, nil
+	case CSR_SATP:
+		return v.Csrs.Satp, nil
+	case CSR_MSTATUS:
+		return v.Csrs.Mstatus, nil
+	case CSR_MISA:
+		return misaValue(), nil
+	case CSR_MEDELEG:
+		return v.Csrs.Medeleg, nil
+	case CSR_MIDELEG:
+		return v.Csrs.Mideleg, nil
+	case CSR_MIE:
+		return v.Csrs.Mie, nil
+	case CSR_MIP:
+		return v.mip(), nil
+	case CSR_MTVEC:
+		return v.Csrs.Mtvec, nil
+	case CSR_MSCRATCH:
+		return v.Csrs.Mscratch, nil
+	case CSR_MEPC:
+		return v.Csrs.Mepc, nil
+	case CSR_MCAUSE:
+		return v.Csrs.Mcause, nil
+	case CSR_MTVAL:
+		return v.Csrs.Mtval, nil
+	case CSR_MVENDORID, CSR_MARCHID, CSR_MIMPID, CSR_MHARTID:
+		return 0, nil
+	case CSR_VL:
+		return v.Vl, nil
+	case CSR_VTYPE:
+		return v.Vtype, nil
+	case CSR_VLENB:
+		return uint32(v.Config.Vlen / 8), nil
+	}
+
+	if n, high, ok := csrCounter(addr); ok {
+		// Writes to the machine counters are kept as an offset, so that the
+		// diagnostics still show the real numbers.
+		value := v.counterValue(n) - v._counter_offset[n]
+		if high {
+			return uint32(value >> 32), nil
+		}
+		return uint32(value), nil
+	}
+
+	if i, ok := pmpCfgIndex(addr); ok {
+		return v.Csrs.pmpcfgRead(i), nil
+	}
+	if i, ok := pmpAddrIndex(addr); ok {
+		return v.Csrs.Pmpaddr[i], nil
+	}
+
+	return 0, fmt.Errorf("Illegal instruction: unknown CSR '%#x'", addr)
+}
+
+// Writes a CSR. Returns an error if the CSR does not exist or is read-only.
+func (v *Vm) csrWrite(addr uint32, data uint32) error {
+	if csrIsReadOnly(addr) {
+		return fmt.Errorf("Illegal instruction: write to read-only CSR '%s'", csrName(addr))
+	}
+
+	switch addr {
+	case CSR_FFLAGS:
+		v.Fcsr = v.Fcsr&^FCSR_FFLAGS_MASK | data&FCSR_FFLAGS_MASK
+		return nil
+	case CSR_FRM:
+		v.Fcsr = v.Fcsr&^FCSR_FRM_MASK | (data<<FCSR_FRM_SHIFT)&FCSR_FRM_MASK
+		return nil
+	case CSR_FCSR:
+		v.Fcsr = data & FCSR_MASK
+		return nil
+	case CSR_SSTATUS:
+		v.Csrs.Mstatus = v.Csrs.Mstatus&^SSTATUS_MASK | data&SSTATUS_MASK
+		return nil
+	case CSR_SIE:
+		deleg := v.Csrs.Mideleg
+		v.Csrs.Mie = v.Csrs.Mie&^deleg | data&deleg
+		return nil
+	case CSR_STVEC:
+		v.Csrs.Stvec = legalTvec(data)
+		return nil
+	case CSR_SSCRATCH:
+		v.Csrs.Sscratch = data
+		return nil
+	case CSR_SEPC:
+		v.Csrs.Sepc = data &^ 1
+		return nil
+	case CSR_SCAUSE:
+		v.Csrs.Scause = data
+		return nil
+	case CSR_STVAL:
+		v.Csrs.Stval = data
+		return nil
+	case CSR_SIP:
+		// Supervisor mode can only raise and clear its own software interrupt
+		mask := MIP_SSIP & v.Csrs.Mideleg
+		v.Csrs.Mip = v.Csrs.Mip&^mask | data&mask
+		return nil
+	case CSR_SATP:
+		// Sv32 does not exist in RV64, and there is no Sv39, satp stays Bare
+		if v.Config.Xlen == XLEN_64 {
+			return nil
+		}
+		// There are no address space identifiers, the ASID field reads as zero
+		v.Csrs.Satp = data & (SATP_MODE_SV32 | SATP_PPN_MASK)
+		return nil
+	case CSR_MSTATUS:
+		v.Csrs.Mstatus = v.Csrs.Mstatus&^MSTATUS_WRITABLE | data&MSTATUS_WRITABLE
+
+		// MPP only holds the implemented privilege levels, others are ignored
+		switch mpp := (data & MSTATUS_MPP) >> MSTATUS_MPP_SHIFT; mpp {
+		case PRIV_U, PRIV_S, PRIV_M:
+			v.Csrs.Mstatus = v.Csrs.Mstatus&^MSTATUS_MPP | mpp<<MSTATUS_MPP_SHIFT
+		}
+		return nil
+	case CSR_MISA:
+		// The extensions can not be turned off, writes are ignored
+		return nil
+	case CSR_MEDELEG:
+		v.Csrs.Medeleg = data & MEDELEG_WRITABLE
+		return nil
+	case CSR_MIDELEG:
+		v.Csrs.Mideleg = data & MIDELEG_WRITABLE
+		return nil
+	case CSR_MIE:
+		v.Csrs.Mie = data & MIE_WRITABLE
+		return nil
+	case CSR_MIP:
+		// The machine bits are driven by the CLINT, software can't change them
+		v.Csrs.Mip = data & (MIP_SSIP | MIP_STIP)
+		return nil
+	case CSR_MTVEC:
+		v.Csrs.Mtvec = legalTvec(data)
+		return nil
+	case CSR_MSCRATCH:
+		v.Csrs.Mscratch = data
+		return nil
+	case CSR_MEPC:
+		// Instructions are 2 byte aligned, the low bit is always zero
+		v.Csrs.Mepc = data &^ 1
+		return nil
+	case CSR_MCAUSE:
+		v.Csrs.Mcause = data
+		return nil
+	case CSR_MTVAL:
+		v.Csrs.Mtval = data
+		return nil
+	}
+
+	if n, high, ok := csrCounter(addr); ok {
+		raw := v.counterValue(n)
+		value := raw - v._counter_offset[n]
+		if high {
+			value = value&0xffffffff | uint64(data)<<32
+		} else {
+			value = value&^0xffffffff | uint64(data)
+		}
+		v._counter_offset[n] = raw - value
+		return nil
+	}
+
+	if i, ok := pmpCfgIndex(addr); ok {
+		v.Csrs.pmpcfgWrite(i, data)
+		return nil
+	}
+	if i, ok := pmpAddrIndex(addr); ok {
+		v.Csrs.pmpaddrWrite(i, data)
+		return nil
+	}
+
+	return fmt.Errorf("Illegal instruction: unknown CSR '%#x'", addr)
+}
+
+// Fields of mstatus and sstatus that only exist in RV64, the XLEN of user
+// and supervisor mode. They can't be changed.
+const (
+	MSTATUS_UXL_64 uint64 = 2 << 32
+	MSTATUS_SXL_64 uint64 = 2 << 34
+)
+
+// Reads a CSR as an XLEN bit value. The CSRs are kept as 32-bit values, in
+// RV64 they are zero-extended except for the causes, whose interrupt bit moves
+// to the top. misa and the status registers get their RV64 fields, and the
+// counters are read whole, their upper half CSRs only exist in RV32.
+func (v *Vm) csrReadXlen(addr uint32) (uint64, error) {
+	if v.Config.Xlen == XLEN_32 {
+		value, err := v.csrRead(addr)
+		return uint64(int64(int32(value))), err
+	}
+
+	if n, high, ok := csrCounter(addr); ok {
+		if high {
+			return 0, fmt.Errorf("Illegal instruction: CSR '%s' only exists in RV32", csrName(addr))
+		}
+		return v.counterValue(n) - v._counter_offset[n], nil
+	}
+
+	value, err := v.csrRead(addr)
+	switch addr {
+	case CSR_MISA:
+		return 2<<62 | uint64(value&^(3<<30)), err
+	case CSR_MSTATUS:
+		return uint64(value) | MSTATUS_UXL_64 | MSTATUS_SXL_64, err
+	case CSR_SSTATUS:
+		return uint64(value) | MSTATUS_UXL_64, err
+	case CSR_MCAUSE, CSR_SCAUSE:
+		return uint64(int64(int32(value))), err
+	case CSR_VTYPE:
+		return uint64(value&^VTYPE_VILL) | uint64(value>>31)<<63, err
+	}
+	return uint64(value), err
+}
+
+// Writes a CSR with an XLEN bit value, the counterpart of csrReadXlen.
+func (v *Vm) csrWriteXlen(addr uint32, data uint64) error {
+	if v.Config.Xlen == XLEN_64 {
+		if n, high, ok := csrCounter(addr); ok && !high && !csrIsReadOnly(addr) {
+			v._counter_offset[n] = v.counterValue(n) - data
+			return nil
+		}
+
+		switch addr {
+		case CSR_MCAUSE, CSR_SCAUSE:
+			data = data&0x7fffffff | data>>63<<31
+		}
+	}
+
+	return v.csrWrite(addr, uint32(data))
+}
+
+// Executes a CSR instruction, the old value of the CSR is written into inst._result.
+func (v *Vm) executeCsr(inst *Instruction) {
+	addr := uint32(inst._imm) & 0xfff
+
+	// The immediate forms take a 5-bit unsigned immediate instead of rs1
+	var src uint64
+	if inst.hasCsrImmediate() {
+		src = uint64(inst.Rs2) & 0x1f
+	} else {
+		src = uint64(inst._s1)
+	}
+
+	// csrrs and csrrc with x0 or a zero immediate only read the CSR, so they
+	// can be used on read-only CSRs.
+	write := true
+	switch inst.Op {
+	case Inst_Csrrs, Inst_Csrrc, Inst_Csrrsi, Inst_Csrrci:
+		write = inst.Rs2 != 0
+	}
+
+	if csrPrivilege(addr) > v.Priv {
+		inst.raise(newException(CAUSE_ILLEGAL_INSTRUCTION, 0,
+			"Illegal instruction: CSR '%s' is not accessible from %s mode", csrName(addr), privName(v.Priv)))
+		return
+	}
+
+	old, err := v.csrReadXlen(addr)
+	if err != nil {
+		inst.raise(newException(CAUSE_ILLEGAL_INSTRUCTION, 0, "%v", err))
+		return
+	}
+
+	if write {
+		var data uint64
+		switch inst.Op {
+		case Inst_Csrrw, Inst_Csrrwi:
+			data = src
+		case Inst_Csrrs, Inst_Csrrsi:
+			data = old | src
+		case Inst_Csrrc, Inst_Csrrci:
+			data = old &^ src
+		}
+
+		if err := v.csrWriteXlen(addr, data); err != nil {
+			inst.raise(newException(CAUSE_ILLEGAL_INSTRUCTION, 0, "%v", err))
+			return
+		}
+	}
+
+	inst._result = int64(old)
+}
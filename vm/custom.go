@@ -0,0 +1,128 @@
+package vm
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Custom instructions, registered from Go code in the custom-0 and custom-1
+// major opcodes that the base ISA leaves to extensions. Each one has a
+// mnemonic, an operand format, a function computing its result from the
+// source values and an execute latency. Once registered, they are parsed and
+// executed like the built-in ones, with the usual hazard and forwarding
+// logic. They only read and write integer registers.
+//
+// The registry is shared by every Vm, instructions should be registered before
+// programs using them are parsed and before the Vm is created, which reads
+// the latencies.
+
+// Major opcodes reserved for custom instructions
+type Custom_Space uint8
+
+const (
+	CUSTOM_0 Custom_Space = 0b0001011
+	CUSTOM_1 Custom_Space = 0b0101011
+)
+
+// Computes the result of a custom instruction. s1, s2 and s3 are the values
+// of rs1, rs2 and rs3, in the I format s2 is the immediate and s3 is zero.
+// Values are sign-extended from XLEN bits, and so is the result.
+type Custom_Semantics func(s1, s2, s3 int64) int64
+
+type Custom_Instruction struct {
+	Mnemonic string
+	Space    Custom_Space
+	Fmt      Inst_Fmt // Fmt_R 'rd, rs1, rs2', Fmt_I 'rd, rs1, imm' or Fmt_R4 'rd, rs1, rs2, rs3'
+	Funct3   uint8
+	Funct7   uint8 // Only for Fmt_R, Fmt_R4 keeps rs3 in its upper bits and only has 2 bits
+	Execute  Custom_Semantics
+	Latency  int // Execute cycles, at least one
+}
+
+// Registered custom instructions, the one with opcode _Inst_Custom_start + 1 + i is at i.
+var customInstructions []Custom_Instruction
+
+// Guards customInstructions and the mnemonics of opcodeToStringMap and
+// stringToOpcodeMap, the instructions can be registered while the server runs
+// programs.
+var registryLock sync.RWMutex
+
+// Registers a custom instruction and returns its opcode. Returns an error if
+// the mnemonic is taken or the encoding overlaps a registered instruction. An
+// I or R4 format instruction takes its whole funct3, R format instructions
+// with the same funct3 are told apart by funct7.
+func RegisterCustomInstruction(ci Custom_Instruction) (Inst_Op, error) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, taken := stringToOpcodeMap[ci.Mnemonic]; ci.Mnemonic == "" || taken {
+		return _Inst_Unknown, fmt.Errorf("Invalid custom instruction mnemonic '%s', it is empty or taken", ci.Mnemonic)
+	}
+	if ci.Space != CUSTOM_0 && ci.Space != CUSTOM_1 {
+		return _Inst_Unknown, fmt.Errorf("Invalid opcode '%#b' for '%s', it must be custom-0 or custom-1", ci.Space, ci.Mnemonic)
+	}
+	if ci.Execute == nil {
+		return _Inst_Unknown, fmt.Errorf("Custom instruction '%s' has no semantic function", ci.Mnemonic)
+	}
+	if ci.Latency < 1 {
+		return _Inst_Unknown, fmt.Errorf("Invalid latency '%d' for '%s', it must be at least 1", ci.Latency, ci.Mnemonic)
+	}
+	if ci.Funct3 > 7 {
+		return _Inst_Unknown, fmt.Errorf("Invalid funct3 '%d' for '%s'", ci.Funct3, ci.Mnemonic)
+	}
+
+	switch ci.Fmt {
+	case Fmt_R:
+		if ci.Funct7 > 127 {
+			return _Inst_Unknown, fmt.Errorf("Invalid funct7 '%d' for '%s'", ci.Funct7, ci.Mnemonic)
+		}
+	case Fmt_R4:
+		if ci.Funct7 > 3 {
+			return _Inst_Unknown, fmt.Errorf("Invalid funct2 '%d' for '%s'", ci.Funct7, ci.Mnemonic)
+		}
+	case Fmt_I:
+	default:
+		return _Inst_Unknown, fmt.Errorf("Unsupported format for custom instruction '%s', it must be R, I or R4", ci.Mnemonic)
+	}
+
+	for _, other := range customInstructions {
+		if other.Space != ci.Space || other.Funct3 != ci.Funct3 {
+			continue
+		}
+		if ci.Fmt != Fmt_R || other.Fmt != Fmt_R || other.Funct7 == ci.Funct7 {
+			return _Inst_Unknown, fmt.Errorf("Encoding of custom instruction '%s' overlaps '%s'", ci.Mnemonic, other.Mnemonic)
+		}
+	}
+
+	customInstructions = append(customInstructions, ci)
+	op := _Inst_Custom_start + Inst_Op(len(customInstructions))
+
+	opcodeToStringMap[op] = ci.Mnemonic
+	stringToOpcodeMap[ci.Mnemonic] = op
+
+	return op, nil
+}
+
+func (inst Instruction) isCustom() bool {
+	return inst.Op > _Inst_Custom_start
+}
+
+// Returns the registered custom instruction, the instruction must be one.
+func customInstruction(op Inst_Op) Custom_Instruction {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return customInstructions[op-_Inst_Custom_start-1]
+}
+
+// Returns the result of a custom instruction, the operands must be read.
+func executeCustom(inst Instruction) int64 {
+	ci := customInstruction(inst.Op)
+	switch ci.Fmt {
+	case Fmt_I:
+		return ci.Execute(inst._s1, int64(inst._imm), 0)
+	case Fmt_R4:
+		return ci.Execute(inst._s1, inst._s2, inst._s3)
+	default:
+		return ci.Execute(inst._s1, inst._s2, 0)
+	}
+}
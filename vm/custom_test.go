@@ -0,0 +1,140 @@
+package vm
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The registry is shared, the instructions of the tests are registered once
+var registerTestCustom = sync.OnceValue(func() error {
+	for _, ci := range testCustomInstructions {
+		if _, err := RegisterCustomInstruction(ci); err != nil {
+			return err
+		}
+	}
+	return nil
+})
+
+var testCustomInstructions = []Custom_Instruction{
+	{"tmac", CUSTOM_0, Fmt_R4, 0, 1, func(s1, s2, s3 int64) int64 { return s1*s2 + s3 }, 3},
+	{"tshl4", CUSTOM_0, Fmt_R, 1, 0, func(s1, s2, s3 int64) int64 { return s1<<4 | s2 }, 2},
+	{"tdiff", CUSTOM_0, Fmt_R, 1, 1, func(s1, s2, s3 int64) int64 { return s1 - s2 }, 2},
+	{"tmuli", CUSTOM_1, Fmt_I, 0, 0, func(s1, s2, s3 int64) int64 { return s1 * s2 }, 4},
+}
+
+// Each custom instruction is followed by one using its result, which must
+// wait for the latency of the custom one with and without forwarding.
+func TestCustomInstructionHazards(t *testing.T) {
+	if err := registerTestCustom(); err != nil {
+		t.Fatal(err)
+	}
+
+	program := `
+main:
+    li      a0, 7
+    li      a1, 5
+    li      a2, 3
+    tmac    a3, a0, a1, a2
+    add     a4, a3, a3
+    tshl4   a5, a0, a1
+    sub     a6, a5, a0
+    tdiff   t0, a5, a1
+    add     t1, t0, t0
+    tmuli   a7, a5, -10
+    add     s2, a7, a7
+    tmac    s3, a7, a0, a5
+    tmuli   s4, s3, 2
+    ret
+`
+	want := map[string]int64{
+		"a3": 38, "a4": 76, "a5": 117, "a6": 110, "t0": 112, "t1": 224,
+		"a7": -1170, "s2": -2340, "s3": -8073, "s4": -16146,
+	}
+
+	for _, forwarding := range []bool{false, true} {
+		for _, bp := range []bool{false, true} {
+			cfg, _ := CreateConfig(1024, 200, 2, forwarding, bp)
+			v, err := CreateVm(*cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := v.LoadProgramFromStr(program); err != nil {
+				t.Fatal(err)
+			}
+			v.RunPipelined()
+
+			for name, value := range want {
+				reg := slices.Index(regNames[:], name)
+				if v.Registers[reg].Data != value {
+					t.Errorf("Forwarding %v, BP %v: %s is %d, want %d", forwarding, bp, name, v.Registers[reg].Data, value)
+				}
+			}
+		}
+	}
+}
+
+func TestRegisterCustomInstructionErrors(t *testing.T) {
+	if err := registerTestCustom(); err != nil {
+		t.Fatal(err)
+	}
+
+	execute := func(s1, s2, s3 int64) int64 { return 0 }
+	tests := []struct {
+		ci   Custom_Instruction
+		want string
+	}{
+		{Custom_Instruction{"tmac", CUSTOM_1, Fmt_R, 7, 0, execute, 1}, "empty or taken"},
+		{Custom_Instruction{"add", CUSTOM_1, Fmt_R, 7, 0, execute, 1}, "empty or taken"},
+		{Custom_Instruction{"tsame", CUSTOM_0, Fmt_R, 1, 1, execute, 1}, "overlaps 'tdiff'"},
+		{Custom_Instruction{"tsamei", CUSTOM_0, Fmt_I, 1, 0, execute, 1}, "overlaps 'tshl4'"},
+		{Custom_Instruction{"tsamer4", CUSTOM_0, Fmt_R4, 0, 2, execute, 1}, "overlaps 'tmac'"},
+		{Custom_Instruction{"tunder", CUSTOM_0, Fmt_R, 0, 5, execute, 1}, "overlaps 'tmac'"},
+		{Custom_Instruction{"tfunct7", CUSTOM_1, Fmt_R, 5, 128, execute, 1}, "Invalid funct7"},
+		{Custom_Instruction{"tfunct2", CUSTOM_1, Fmt_R4, 5, 4, execute, 1}, "Invalid funct2"},
+		{Custom_Instruction{"tfunct3", CUSTOM_1, Fmt_R, 8, 0, execute, 1}, "Invalid funct3"},
+		{Custom_Instruction{"tspace", Custom_Space(OPCODE_OP), Fmt_R, 5, 0, execute, 1}, "custom-0 or custom-1"},
+		{Custom_Instruction{"tlatency", CUSTOM_1, Fmt_R, 5, 0, execute, 0}, "at least 1"},
+		{Custom_Instruction{"texecute", CUSTOM_1, Fmt_R, 5, 0, nil, 1}, "no semantic function"},
+	}
+	for _, test := range tests {
+		_, err := RegisterCustomInstruction(test.ci)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("'%s': error '%v', want '%s'", test.ci.Mnemonic, err, test.want)
+		}
+	}
+}
+
+// Instructions are registered while other programs are parsed and run, run
+// with -race.
+func TestRegisterCustomInstructionConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ci := Custom_Instruction{fmt.Sprintf("tconc%d", i), CUSTOM_1, Fmt_R, 3, uint8(i), func(s1, s2, s3 int64) int64 { return s1 }, 1}
+			if _, err := RegisterCustomInstruction(ci); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			cfg, _ := CreateConfig(1024, 200, 2, true, true)
+			v, err := CreateVm(*cfg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if err := v.LoadProgramFromStr("main:\naddi a0, zero, 1\nret\n"); err != nil {
+				t.Error(err)
+				return
+			}
+			v.RunPipelined()
+			v.Disassemble(0, 16)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,469 @@
+package vm
+
+import (
+	"fmt"
+	"math/bits"
+	"slices"
+)
+
+// Decoding of the machine code, the reverse of encodeInstruction. The fields
+// of a word are put back in the layout of the parser, so that the decoded
+// instructions execute like the parsed ones. Compressed instructions decode
+// to the instruction they expand to. A zero halfword, which is an illegal
+// instruction, decodes as the End instruction.
+
+type decode_entry struct {
+	op    Inst_Op
+	match uint32
+	mask  uint32 // Bits outside the operand fields of the layout
+	enc   inst_encoding
+}
+
+// Built-in instructions by XLEN, the ones with more fixed bits come first
+var decodeTables = map[int][]decode_entry{}
+
+func init() {
+	for _, xlen := range []int{XLEN_32, XLEN_64} {
+		decodeTables[xlen] = buildDecodeTable(xlen)
+	}
+}
+
+// Returns the bits of the operand fields of the layout.
+func operandFields(enc inst_encoding, xlen int) uint32 {
+	const (
+		rd  = 0x1f << 7
+		rs1 = 0x1f << 15
+		rs2 = 0x1f << 20
+		rm  = 0x7 << 12
+		imm = 0xfff << 20
+	)
+
+	switch enc.layout {
+	case ENC_R:
+		return rd | rs1 | rs2
+	case ENC_R_UNARY, ENC_FCSR:
+		return rd | rs1
+	case ENC_R_RM:
+		return rd | rs1 | rs2 | rm
+	case ENC_R_UNARY_RM:
+		return rd | rs1 | rm
+	case ENC_R4: // rs3 is in bits 31..27
+		return rd | rs1 | rs2 | rm | 0x1f<<27
+	case ENC_I, ENC_LOAD, ENC_CSR:
+		return rd | rs1 | imm
+	case ENC_SHIFT: // shamt has 6 bits in RV64, except for the word shifts
+		if xlen == XLEN_64 && enc.match&0x7f == OPCODE_OP_IMM {
+			return rd | rs1 | 0x3f<<20
+		}
+		return rd | rs1 | rs2
+	case ENC_STORE, ENC_B:
+		return 0xfe000f80 | rs1 | rs2
+	case ENC_J, ENC_U:
+		return 0xfffff000 | rd
+	case ENC_AMO: // The aq and rl bits are ignored
+		return rd | rs1 | rs2 | 0x3<<25
+	case ENC_LR:
+		return rd | rs1 | 0x3<<25
+	case ENC_FENCE: // The fm, rs1 and rd fields are ignored
+		return imm | rs1 | rd
+	case ENC_SFENCE:
+		return rs1 | rs2
+	case ENC_VSETVLI:
+		return rd | rs1 | 0x7ff<<20
+	case ENC_VMEM:
+		return rd | rs1 | 1<<25
+	case ENC_VMEM_STRIDED, ENC_V, ENC_V_MACC:
+		return rd | rs1 | rs2 | 1<<25
+	case ENC_V_SCALAR:
+		return rd | rs1 | 1<<25
+	case ENC_V_TO_SCALAR:
+		return rd | rs2 | 1<<25
+	case ENC_V_DEST:
+		return rd | 1<<25
+	}
+	return 0
+}
+
+func buildDecodeTable(xlen int) []decode_entry {
+	var table []decode_entry
+	for op := range encodingTable {
+		if xlen == XLEN_32 && newInstruction(op, 0, 0, 0).isRv64() {
+			continue
+		}
+
+		enc, _ := lookupEncoding(op, xlen)
+		mask := ^operandFields(enc, xlen)
+
+		// The CSR reads of the FP pseudo instructions have rs1 zero
+		if op == Inst_Frcsr || op == Inst_Frrm || op == Inst_Frflags {
+			mask |= 0x1f << 15
+		}
+		table = append(table, decode_entry{op, enc.match, mask, enc})
+	}
+
+	slices.SortFunc(table, func(a, b decode_entry) int {
+		if n := bits.OnesCount32(b.mask) - bits.OnesCount32(a.mask); n != 0 {
+			return n
+		}
+		return int(a.op) - int(b.op)
+	})
+	return table
+}
+
+// Sign-extends the low n bits of v.
+func signExtend(v uint32, n uint) int32 {
+	return int32(v<<(32-n)) >> (32 - n)
+}
+
+// Returns the size of the instruction starting with the given halfword, 2 or 4.
+func instructionSize(half uint16) uint32 {
+	if half&0b11 == 0b11 {
+		return 4
+	}
+	return 2
+}
+
+// Returns the instruction encoded in the word, compressed ones are in the
+// low 16 bits. Returns an error if the word is not a valid instruction.
+func DecodeInstruction(word uint32, xlen int) (Instruction, error) {
+	var inst Instruction
+	var err error
+	switch {
+	case word&0xffff == 0:
+		inst = newInstruction(Inst_End, 0, 0, 0)
+	case instructionSize(uint16(word)) == 2:
+		inst, err = decodeCompressed(uint16(word), xlen)
+	default:
+		inst, err = decodeWord(word, xlen)
+	}
+	if err != nil {
+		return inst, err
+	}
+
+	inst._fmt = getInstructionFmt(inst)
+	return inst, nil
+}
+
+func decodeWord(word uint32, xlen int) (Instruction, error) {
+	var entry *decode_entry
+	table := decodeTables[xlen]
+	for i := range table {
+		if word&table[i].mask == table[i].match {
+			entry = &table[i]
+			break
+		}
+	}
+	if entry == nil {
+		return decodeCustom(word)
+	}
+
+	rd := int32(field(word, 11, 7))
+	rs1 := int32(field(word, 19, 15))
+	rs2 := int32(field(word, 24, 20))
+	immI := signExtend(field(word, 31, 20), 12)
+	immS := signExtend(field(word, 31, 25)<<5|field(word, 11, 7), 12)
+
+	inst := newInstruction(entry.op, 0, 0, 0)
+	switch entry.enc.layout {
+	case ENC_NONE:
+	case ENC_R:
+		inst.Rd, inst.Rs1, inst.Rs2 = rd, rs1, rs2
+	case ENC_R_UNARY, ENC_FCSR:
+		inst.Rd, inst.Rs1 = rd, rs1
+	case ENC_R_RM, ENC_R_UNARY_RM, ENC_R4:
+		inst.Rd, inst.Rs1 = rd, rs1
+		if entry.enc.layout != ENC_R_UNARY_RM {
+			inst.Rs2 = rs2
+		}
+		if entry.enc.layout == ENC_R4 {
+			inst.Rs3 = int32(field(word, 31, 27))
+		}
+		rm := uint8(field(word, 14, 12))
+		if rm == 5 || rm == 6 {
+			return inst, fmt.Errorf("invalid rounding mode '%d'", rm)
+		}
+		if usesRoundingMode(inst.Op) {
+			inst.Rm = rm
+		}
+	case ENC_I:
+		inst.Rd, inst.Rs1, inst.Rs2 = rd, rs1, immI
+	case ENC_SHIFT:
+		shamt := field(word, 25, 20)
+		if entry.mask&(1<<25) != 0 {
+			shamt &= 0x1f
+		}
+		inst.Rd, inst.Rs1, inst.Rs2 = rd, rs1, int32(shamt)
+	case ENC_LOAD:
+		inst.Rd, inst.Rs1, inst.Rs2 = rd, immI, rs1
+	case ENC_STORE:
+		inst.Rd, inst.Rs1, inst.Rs2 = rs2, immS, rs1
+	case ENC_B:
+		off := field(word, 31, 31)<<12 | field(word, 7, 7)<<11 | field(word, 30, 25)<<5 | field(word, 11, 8)<<1
+		inst.Rd, inst.Rs1, inst.Rs2 = rs1, rs2, signExtend(off, 13)
+	case ENC_J:
+		off := field(word, 31, 31)<<20 | field(word, 19, 12)<<12 | field(word, 20, 20)<<11 | field(word, 30, 21)<<1
+		inst.Rd, inst.Rs1 = rd, signExtend(off, 21)
+	case ENC_U:
+		inst.Rd, inst.Rs1 = rd, int32(word&0xfffff000)
+	case ENC_CSR:
+		inst.Rd, inst.Rs1, inst.Rs2 = rd, int32(field(word, 31, 20)), rs1
+	case ENC_AMO:
+		inst.Rd, inst.Rs1, inst.Rs2 = rd, rs2, rs1
+	case ENC_LR:
+		inst.Rd, inst.Rs2 = rd, rs1
+	case ENC_FENCE:
+		inst.Rs2 = int32(field(word, 27, 20))
+	case ENC_SFENCE:
+		inst.Rs1, inst.Rs2 = rs1, rs2
+	case ENC_VSETVLI:
+		inst.Rd, inst.Rs1, inst.Rs2 = rd, rs1, int32(field(word, 30, 20))
+	case ENC_VMEM:
+		inst.Rd, inst.Rs1 = rd, rs1
+	case ENC_VMEM_STRIDED, ENC_V_MACC:
+		inst.Rd, inst.Rs1, inst.Rs2 = rd, rs1, rs2
+	case ENC_V: // vs2 goes into Rs1, see vecOperandTable
+		inst.Rd, inst.Rs1, inst.Rs2 = rd, rs2, vectorOperand(entry.op, word)
+	case ENC_V_SCALAR:
+		inst.Rd, inst.Rs1 = rd, vectorOperand(entry.op, word)
+	case ENC_V_TO_SCALAR:
+		inst.Rd, inst.Rs1 = rd, rs2
+	case ENC_V_DEST:
+		inst.Rd = rd
+	}
+
+	if inst.isVector() && inst.Op != Inst_Vsetvli {
+		inst.Masked = field(word, 25, 25) == 0
+	}
+	if inst.isVector() {
+		if err := checkVectorOperands(inst); err != nil {
+			return inst, err
+		}
+	}
+
+	return inst, nil
+}
+
+// Returns the vs1, rs1 or immediate field of a vector instruction, the
+// immediates are signed except for the shift amounts.
+func vectorOperand(op Inst_Op, word uint32) int32 {
+	v := field(word, 19, 15)
+	if field(word, 14, 12) != VFUNCT3_OPIVI {
+		return int32(v)
+	}
+
+	switch vecElementOp(op) {
+	case Inst_Vsll_vv, Inst_Vsrl_vv, Inst_Vsra_vv:
+		return int32(v)
+	}
+	return signExtend(v, 5)
+}
+
+// Decodes a registered custom instruction, see encodeCustom.
+func decodeCustom(word uint32) (Instruction, error) {
+	space := Custom_Space(field(word, 6, 0))
+	funct3 := uint8(field(word, 14, 12))
+
+	// The registered instructions are never changed, only appended to
+	registryLock.RLock()
+	custom := customInstructions
+	registryLock.RUnlock()
+
+	for i, ci := range custom {
+		if ci.Space != space || ci.Funct3 != funct3 {
+			continue
+		}
+
+		inst := newInstruction(_Inst_Custom_start+Inst_Op(i+1), int32(field(word, 11, 7)), int32(field(word, 19, 15)), 0)
+		switch ci.Fmt {
+		case Fmt_I:
+			inst.Rs2 = signExtend(field(word, 31, 20), 12)
+		case Fmt_R4:
+			if uint8(field(word, 26, 25)) != ci.Funct7 {
+				continue
+			}
+			inst.Rs2, inst.Rs3 = int32(field(word, 24, 20)), int32(field(word, 31, 27))
+		default:
+			if uint8(field(word, 31, 25)) != ci.Funct7 {
+				continue
+			}
+			inst.Rs2 = int32(field(word, 24, 20))
+		}
+		return inst, nil
+	}
+
+	return Instruction{}, fmt.Errorf("unknown instruction '%08x'", word)
+}
+
+// Decodes a 16-bit instruction to the one it expands to, see
+// expandCompressedInstruction. The RV64 forms of the FP loads and stores and
+// of c.jal are the 64-bit loads and stores and c.addiw.
+func decodeCompressed(half uint16, xlen int) (Instruction, error) {
+	c := uint32(half)
+	sp := int32(abiToRegNum["sp"])
+	rv64 := xlen == XLEN_64
+
+	// The 3-bit register fields hold x8-x15
+	rd_c := int32(field(c, 4, 2)) + 8
+	rs1_c := int32(field(c, 9, 7)) + 8
+	rd := int32(field(c, 11, 7))
+	rs2 := int32(field(c, 6, 2))
+	imm6 := signExtend(field(c, 12, 12)<<5|field(c, 6, 2), 6)
+	shamt := int32(field(c, 12, 12)<<5 | field(c, 6, 2))
+
+	// Offsets of the loads and stores with the x8-x15 registers, by access size
+	uimm4 := int32(field(c, 12, 10)<<3 | field(c, 6, 6)<<2 | field(c, 5, 5)<<6)
+	uimm8 := int32(field(c, 12, 10)<<3 | field(c, 6, 5)<<6)
+
+	var inst Instruction
+	illegal := false
+	switch field(c, 1, 0)<<3 | field(c, 15, 13) {
+	/* Quadrant 0 */
+	case 0b00_000: // c.addi4spn
+		imm := int32(field(c, 12, 11)<<4 | field(c, 10, 7)<<6 | field(c, 6, 6)<<2 | field(c, 5, 5)<<3)
+		illegal = imm == 0
+		inst = newInstruction(Inst_Addi, rd_c, sp, imm)
+		inst._c_op = Inst_C_addi4spn
+	case 0b00_001:
+		inst = newInstruction(Inst_Fld, rd_c, uimm8, rs1_c)
+	case 0b00_010:
+		inst = newInstruction(Inst_Lw, rd_c, uimm4, rs1_c)
+	case 0b00_011:
+		if rv64 {
+			inst = newInstruction(Inst_Ld, rd_c, uimm8, rs1_c)
+		} else {
+			inst = newInstruction(Inst_Flw, rd_c, uimm4, rs1_c)
+		}
+	case 0b00_101:
+		inst = newInstruction(Inst_Fsd, rd_c, uimm8, rs1_c)
+	case 0b00_110:
+		inst = newInstruction(Inst_Sw, rd_c, uimm4, rs1_c)
+	case 0b00_111:
+		if rv64 {
+			inst = newInstruction(Inst_Sd, rd_c, uimm8, rs1_c)
+		} else {
+			inst = newInstruction(Inst_Fsw, rd_c, uimm4, rs1_c)
+		}
+
+	/* Quadrant 1 */
+	case 0b01_000: // c.addi, c.nop
+		inst = newInstruction(Inst_Addi, rd, rd, imm6)
+		inst._c_op = Inst_C_addi
+	case 0b01_001:
+		if rv64 { // c.addiw
+			illegal = rd == 0
+			inst = newInstruction(Inst_Addiw, rd, rd, imm6)
+		} else {
+			inst = newInstruction(Inst_Jal, 1, compressedJumpOffset(c), 0)
+		}
+	case 0b01_010: // c.li
+		inst = newInstruction(Inst_Addi, rd, 0, imm6)
+		inst._c_op = Inst_C_li
+	case 0b01_011:
+		if rd == sp { // c.addi16sp
+			imm := signExtend(field(c, 12, 12)<<9|field(c, 6, 6)<<4|field(c, 5, 5)<<6|field(c, 4, 3)<<7|field(c, 2, 2)<<5, 10)
+			illegal = imm == 0
+			inst = newInstruction(Inst_Addi, sp, sp, imm)
+			inst._c_op = Inst_C_addi16sp
+		} else { // c.lui
+			illegal = imm6 == 0
+			inst = newInstruction(Inst_Lui, rd, imm6<<12, 0)
+		}
+	case 0b01_100:
+		switch field(c, 11, 10) {
+		case 0b00:
+			inst = newInstruction(Inst_Srli, rs1_c, rs1_c, shamt)
+		case 0b01:
+			inst = newInstruction(Inst_Srai, rs1_c, rs1_c, shamt)
+		case 0b10:
+			inst = newInstruction(Inst_Andi, rs1_c, rs1_c, imm6)
+		case 0b11:
+			if field(c, 12, 12) == 0 {
+				op := [4]Inst_Op{Inst_Sub, Inst_Xor, Inst_Or, Inst_And}[field(c, 6, 5)]
+				inst = newInstruction(op, rs1_c, rs1_c, rd_c)
+			} else { // c.subw, c.addw
+				illegal = !rv64 || field(c, 6, 6) == 1
+				inst = newInstruction([2]Inst_Op{Inst_Subw, Inst_Addw}[field(c, 5, 5)], rs1_c, rs1_c, rd_c)
+			}
+		}
+		if inst.Op == Inst_Srli || inst.Op == Inst_Srai {
+			illegal = !rv64 && shamt >= 32
+		}
+	case 0b01_101: // c.j
+		inst = newInstruction(Inst_Jal, 0, compressedJumpOffset(c), 0)
+	case 0b01_110, 0b01_111: // c.beqz, c.bnez
+		off := signExtend(field(c, 12, 12)<<8|field(c, 11, 10)<<3|field(c, 6, 5)<<6|field(c, 4, 3)<<1|field(c, 2, 2)<<5, 9)
+		op := Inst_Beq
+		if field(c, 13, 13) == 1 {
+			op = Inst_Bne
+		}
+		inst = newInstruction(op, rs1_c, 0, off)
+
+	/* Quadrant 2 */
+	case 0b10_000: // c.slli
+		illegal = !rv64 && shamt >= 32
+		inst = newInstruction(Inst_Slli, rd, rd, shamt)
+	case 0b10_001: // c.fldsp
+		imm := int32(field(c, 12, 12)<<5 | field(c, 6, 5)<<3 | field(c, 4, 2)<<6)
+		inst = newInstruction(Inst_Fld, rd, imm, sp)
+	case 0b10_010: // c.lwsp
+		imm := int32(field(c, 12, 12)<<5 | field(c, 6, 4)<<2 | field(c, 3, 2)<<6)
+		illegal = rd == 0
+		inst = newInstruction(Inst_Lw, rd, imm, sp)
+	case 0b10_011:
+		if rv64 { // c.ldsp
+			imm := int32(field(c, 12, 12)<<5 | field(c, 6, 5)<<3 | field(c, 4, 2)<<6)
+			illegal = rd == 0
+			inst = newInstruction(Inst_Ld, rd, imm, sp)
+		} else { // c.flwsp
+			imm := int32(field(c, 12, 12)<<5 | field(c, 6, 4)<<2 | field(c, 3, 2)<<6)
+			inst = newInstruction(Inst_Flw, rd, imm, sp)
+		}
+	case 0b10_100:
+		switch {
+		case field(c, 12, 12) == 0 && rs2 == 0: // c.jr
+			illegal = rd == 0
+			inst = newInstruction(Inst_Jalr, 0, rd, 0)
+		case field(c, 12, 12) == 0: // c.mv
+			inst = newInstruction(Inst_Add, rd, 0, rs2)
+			inst._c_op = Inst_C_mv
+		case rd == 0 && rs2 == 0:
+			inst = newInstruction(Inst_Ebreak, 0, 0, 0)
+		case rs2 == 0: // c.jalr
+			inst = newInstruction(Inst_Jalr, 1, rd, 0)
+		default: // c.add
+			inst = newInstruction(Inst_Add, rd, rd, rs2)
+			inst._c_op = Inst_C_add
+		}
+	case 0b10_101: // c.fsdsp
+		imm := int32(field(c, 12, 10)<<3 | field(c, 9, 7)<<6)
+		inst = newInstruction(Inst_Fsd, rs2, imm, sp)
+	case 0b10_110: // c.swsp
+		imm := int32(field(c, 12, 9)<<2 | field(c, 8, 7)<<6)
+		inst = newInstruction(Inst_Sw, rs2, imm, sp)
+	case 0b10_111:
+		if rv64 { // c.sdsp
+			imm := int32(field(c, 12, 10)<<3 | field(c, 9, 7)<<6)
+			inst = newInstruction(Inst_Sd, rs2, imm, sp)
+		} else { // c.fswsp
+			imm := int32(field(c, 12, 9)<<2 | field(c, 8, 7)<<6)
+			inst = newInstruction(Inst_Fsw, rs2, imm, sp)
+		}
+
+	default:
+		illegal = true
+	}
+
+	if illegal {
+		return Instruction{}, fmt.Errorf("unknown compressed instruction '%04x'", half)
+	}
+
+	inst.Compressed = true
+	return inst, nil
+}
+
+// Returns the offset of c.j and c.jal.
+func compressedJumpOffset(c uint32) int32 {
+	off := field(c, 12, 12)<<11 | field(c, 11, 11)<<4 | field(c, 10, 9)<<8 | field(c, 8, 8)<<10 |
+		field(c, 7, 7)<<6 | field(c, 6, 6)<<7 | field(c, 5, 3)<<1 | field(c, 2, 2)<<5
+	return signExtend(off, 12)
+}
@@ -2,6 +2,7 @@ package vm
 
 import (
 	"fmt"
+	"math"
 	"os"
 )
 
@@ -26,6 +27,7 @@ type Cycle_Info struct {
 	Stalled          bool        `json:"stalled"`
 	S1_bypass_status bypass_type `json:"s1_bypass"`
 	S2_bypass_status bypass_type `json:"s2_bypass"`
+	S3_bypass_status bypass_type `json:"s3_bypass"`
 }
 
 type Diagnostics_Manager struct {
@@ -37,6 +39,17 @@ type Diagnostics_Manager struct {
 	N_forwards   uint
 	N_branch     uint
 	N_mispred    uint
+	N_traps      uint // Including the interrupts
+	N_interrupts uint
+
+	N_tlb_hits    uint
+	N_tlb_misses  uint
+	N_page_walks  uint
+	N_walk_cycles uint // Stall cycles spent walking the page table
+
+	N_vector_insts    uint // Retired vector instructions, other than vsetvli
+	N_vector_elements uint // Elements they processed, vl of each
+	N_vector_cycles   uint // Execute cycles they spent on their elements
 
 	Cycle_infos []Cycle_Info
 
@@ -67,6 +80,16 @@ func (dm *Diagnostics_Manager) CalculatePredictionAccuracy() uint {
 	return 0
 }
 
+// Returns the average number of elements the vector unit processed per cycle
+// it was busy.
+func (dm *Diagnostics_Manager) CalculateVectorThroughput() float32 {
+	if dm.N_vector_cycles == 0 {
+		return 0
+	}
+
+	return float32(dm.N_vector_elements) / float32(dm.N_vector_cycles)
+}
+
 func (dm *Diagnostics_Manager) PrintDiagnostics() {
 	fmt.Println("--- Diagnostics ---")
 	fmt.Printf("%-30s %d\n", "Program size:", dm.Program_size)
@@ -76,6 +99,18 @@ func (dm *Diagnostics_Manager) PrintDiagnostics() {
 	fmt.Printf("%-30s %d\n", "Cycles:", dm.N_cycle)
 	fmt.Printf("%-30s %d\n", "Stalls:", dm.N_stalls)
 	fmt.Printf("%-30s %d\n", "Forwards:", dm.N_forwards)
+	fmt.Printf("%-30s %d\n", "Traps:", dm.N_traps)
+	fmt.Printf("%-30s %d\n", "Interrupts:", dm.N_interrupts)
+
+	fmt.Printf("%-30s %d\n", "TLB hits:", dm.N_tlb_hits)
+	fmt.Printf("%-30s %d\n", "TLB misses:", dm.N_tlb_misses)
+	fmt.Printf("%-30s %d\n", "Page walks:", dm.N_page_walks)
+	fmt.Printf("%-30s %d\n", "Page walk cycles:", dm.N_walk_cycles)
+
+	fmt.Printf("%-30s %d\n", "Vector instructions:", dm.N_vector_insts)
+	fmt.Printf("%-30s %d\n", "Vector elements:", dm.N_vector_elements)
+	fmt.Printf("%-30s %d\n", "Vector cycles:", dm.N_vector_cycles)
+	fmt.Printf("%-30s %.2f\n", "Vector elements per cycle:", dm.CalculateVectorThroughput())
 
 	fmt.Printf("%-30s %v%%\n", "prediction accuracy:", dm.CalculatePredictionAccuracy())
 
@@ -87,6 +122,18 @@ func (dm *Diagnostics_Manager) PrintDiagnostics() {
 }
 
 func (v *Vm) PrintRegister(reg_str string) {
+	if fp_num, ok := fpAbiToRegNum[reg_str]; ok {
+		reg := v.FRegisters[fp_num]
+
+		status := "free"
+		if reg.Busy > 0 {
+			status = "busy"
+		}
+
+		fmt.Printf("%s -> %s (%s)\n", reg_str, fpValueStr(reg.Data), status)
+		return
+	}
+
 	reg_num, ok := abiToRegNum[reg_str]
 	if !ok {
 		fmt.Fprintf(os.Stderr, "Invalid register name: '%s'", reg_str)
@@ -124,6 +171,49 @@ func (v *Vm) DumpRegisters(format Dump_Format) {
 	fmt.Println("------------")
 }
 
+func (v *Vm) DumpFpRegisters() {
+	fmt.Println("------------")
+	fmt.Printf("FP Register Dump: fcsr = %#x\n", v.Fcsr)
+	for i, reg := range v.FRegisters {
+		status := "free"
+		if reg.Busy > 0 {
+			status = "busy"
+		}
+
+		fmt.Printf("\033[0;33m%2d\033[0m = %s (%s) (%#.16x)\n", i, fpValueStr(reg.Data), status, reg.Data)
+	}
+	fmt.Println("------------")
+}
+
+// Dumps the vector registers as elements of the current SEW, or as 32-bit
+// elements while vtype is illegal.
+func (v *Vm) DumpVectorRegisters() {
+	sew, _, _, ok := v.vtypeSettings(v.Vtype)
+	if !ok {
+		sew = 32
+	}
+
+	fmt.Println("------------")
+	fmt.Printf("Vector Register Dump: vl = %d, SEW = %d, VLEN = %d\n", v.Vl, sew, v.Config.Vlen)
+	for i := range int32(32) {
+		group := v.vectorGroup(i, 1)
+		fmt.Printf("\033[0;33m%2d\033[0m =", i)
+		for j := range v.Config.Vlen / sew {
+			fmt.Printf(" %d", readElement(group, j, sew))
+		}
+		fmt.Println()
+	}
+	fmt.Println("------------")
+}
+
+// Formats the value of an FP register, NaN-boxed values are shown as single precision.
+func fpValueStr(bits uint64) string {
+	if bits&FP_NAN_BOX == FP_NAN_BOX {
+		return fmt.Sprintf("%g (s)", math.Float32frombits(uint32(bits)))
+	}
+	return fmt.Sprintf("%g (d)", math.Float64frombits(bits))
+}
+
 func (v *Vm) DumpMemory(start, end uint32, format Dump_Format) {
 	var val int32
 
@@ -147,7 +237,7 @@ func (v *Vm) DumpMemory(start, end uint32, format Dump_Format) {
 
 		}
 
-		if v.Registers[abiToRegNum["sp"]].Data == int32(i) {
+		if v.Registers[abiToRegNum["sp"]].Data == int64(i) {
 			fmt.Print(" <- \033[0;31mSP\033[0m")
 		}
 		fmt.Println()
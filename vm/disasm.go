@@ -0,0 +1,177 @@
+package vm
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Disassembly of machine code, in memory or in a file. Every instruction is
+// decoded from its address and printed with Str. The words that don't decode
+// are printed as data, so that the rest can still be read. Branch and jump
+// targets are given as addresses and labels next to the instructions.
+
+type Disasm_Line struct {
+	Addr   uint32 `json:"addr"`
+	Code   uint32 `json:"code"` // The low 16 bits for compressed instructions
+	Size   uint32 `json:"size"`
+	Label  string `json:"label,omitempty"` // Symbol at the address
+	Text   string `json:"text"`
+	Target string `json:"target,omitempty"` // Address and label of a branch or jump target
+}
+
+// Disassembles the memory from start up to end, labelled with the symbols of
+// the loaded ELF file.
+func (v *Vm) Disassemble(start, end uint32) ([]Disasm_Line, error) {
+	if start >= end || uint64(end) > uint64(len(v.Memory)) {
+		return nil, fmt.Errorf("Invalid range %#x-%#x, the memory has %d bytes", start, end, len(v.Memory))
+	}
+
+	return disassemble(v.Memory[start:end], start, v.Config.Xlen, v.Symbols), nil
+}
+
+// Disassembles the executable segments of an ELF file, or a flat binary
+// loaded at base, which is TEXT_BASE for the ones of WriteBinary. Only the
+// instructions from start up to end are given, an end of 0 is the end of the
+// file.
+func DisassembleFile(filename string, xlen int, base, start, end uint32) ([]Disasm_Line, error) {
+	if end == 0 {
+		end = ^uint32(0)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read file '%v': %v", filename, err.Error())
+	}
+
+	if !strings.HasPrefix(string(data), elf.ELFMAG) {
+		if uint64(base)+uint64(len(data)) > 1<<32 {
+			return nil, fmt.Errorf("The %d bytes of '%v' don't fit in the address space from %#x", len(data), filename, base)
+		}
+		start, end = max(start, base), min(end, base+uint32(len(data)))
+		if start >= end {
+			return nil, fmt.Errorf("Invalid range %#x-%#x, the file has %d bytes from %#x", start, end, len(data), base)
+		}
+		return disassemble(data[start-base:end-base], start, xlen, nil), nil
+	}
+
+	f, err := openElfExecutable(filename, xlen)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	symbols, err := elfSymbols(f, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []Disasm_Line
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Flags&elf.PF_X == 0 {
+			continue
+		}
+
+		lo, hi := max(uint64(start), prog.Vaddr), min(uint64(end), prog.Vaddr+prog.Filesz)
+		if lo >= hi {
+			continue
+		}
+		code := make([]byte, hi-lo)
+		if _, err := prog.ReadAt(code, int64(lo-prog.Vaddr)); err != nil {
+			return nil, fmt.Errorf("Failed to read the segment at %#x of '%v': %v", prog.Vaddr, filename, err.Error())
+		}
+		lines = append(lines, disassemble(code, uint32(lo), xlen, symbols)...)
+	}
+	return lines, nil
+}
+
+func disassemble(code []byte, addr uint32, xlen int, symbols []Symbol) []Disasm_Line {
+	labels := make(map[uint32]string, len(symbols))
+	for _, sym := range symbols {
+		if _, ok := labels[sym.Addr]; !ok {
+			labels[sym.Addr] = sym.Name
+		}
+	}
+
+	var lines []Disasm_Line
+	for i := 0; i < len(code); {
+		line := Disasm_Line{Addr: addr + uint32(i), Label: labels[addr+uint32(i)]}
+
+		switch {
+		case len(code)-i < 2:
+			line.Code, line.Size = uint32(code[i]), 1
+			line.Text = fmt.Sprintf(".byte 0x%02x", line.Code)
+		case instructionSize(binary.LittleEndian.Uint16(code[i:])) == 4 && len(code)-i < 4:
+			line.Code, line.Size = uint32(binary.LittleEndian.Uint16(code[i:])), 2
+			line.Text = fmt.Sprintf(".half 0x%04x", line.Code)
+		default:
+			line.Size = instructionSize(binary.LittleEndian.Uint16(code[i:]))
+			line.Code = uint32(binary.LittleEndian.Uint16(code[i:]))
+			if line.Size == 4 {
+				line.Code = binary.LittleEndian.Uint32(code[i:])
+			}
+
+			inst, err := DecodeInstruction(line.Code, xlen)
+			if err != nil {
+				line.Text = fmt.Sprintf(".word 0x%08x", line.Code)
+				if line.Size == 2 {
+					line.Text = fmt.Sprintf(".half 0x%04x", line.Code)
+				}
+				break
+			}
+
+			line.Text = inst.Str()
+			if offset, ok := inst.branchOffset(); ok {
+				target := uint32(int32(line.Addr) + offset)
+				line.Target = fmt.Sprintf("%#x", target)
+				if label, ok := labels[target]; ok {
+					line.Target += fmt.Sprintf(" <%s>", label)
+				}
+			}
+		}
+
+		lines = append(lines, line)
+		i += int(line.Size)
+	}
+
+	return lines
+}
+
+// Returns the offset of the target of a branch or jal from its address.
+func (inst Instruction) branchOffset() (int32, bool) {
+	switch {
+	case inst._fmt == Fmt_B:
+		return inst.Rs2, true
+	case inst._fmt == Fmt_J:
+		return inst.Rs1, true
+	}
+	return 0, false
+}
+
+// Writes the lines like the listing, with the labels on their own lines.
+func WriteDisassembly(w io.Writer, lines []Disasm_Line) error {
+	var b strings.Builder
+
+	for _, line := range lines {
+		if line.Label != "" {
+			fmt.Fprintf(&b, "\n%08x <%s>:\n", line.Addr, line.Label)
+		}
+
+		code := fmt.Sprintf("%08x", line.Code)
+		if line.Size < 4 {
+			code = fmt.Sprintf("%0*x%*s", line.Size*2, line.Code, 8-line.Size*2, "")
+		}
+
+		text := line.Text
+		if line.Target != "" {
+			text = fmt.Sprintf("%-32s ; %s", text, line.Target)
+		}
+		fmt.Fprintf(&b, "%08x  %s  %s\n", line.Addr, code, text)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
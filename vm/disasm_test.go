@@ -0,0 +1,217 @@
+package vm
+
+import (
+	"flag"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files of testdata with the current output.")
+
+// Decodes words of every instruction with random operands, encodes them back
+// and decodes them again. Both decodings must be the same instruction, and
+// printing it with Str must give a line the parser reads back as it. Every
+// instruction must be decoded from some of the words.
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for _, xlen := range []int{XLEN_32, XLEN_64} {
+		seen := make(map[Inst_Op]bool)
+		for _, entry := range decodeTables[xlen] {
+			for i := range 200 {
+				word := entry.match
+				if i > 0 {
+					word |= rng.Uint32() &^ entry.mask
+				}
+
+				// Some operands are reserved, like v0 as the destination of a
+				// masked vector instruction
+				inst, err := DecodeInstruction(word, xlen)
+				if err != nil {
+					continue
+				}
+				seen[inst.Op] = true
+
+				code, err := encodeInstruction(inst, xlen)
+				if err != nil {
+					t.Errorf("xlen %d: '%s' from %#08x doesn't encode: %v", xlen, inst.Str(), word, err)
+					continue
+				}
+				again, err := DecodeInstruction(code, xlen)
+				if err != nil || again != inst {
+					t.Errorf("xlen %d: %#08x decodes to '%s', its encoding %#08x to '%s'", xlen, word, inst.Str(), code, again.Str())
+					continue
+				}
+
+				checkParsedStr(t, inst, xlen)
+			}
+		}
+
+		for _, entry := range decodeTables[xlen] {
+			if !seen[entry.op] {
+				t.Errorf("xlen %d: '%s' is never decoded", xlen, opcodeName(entry.op))
+			}
+		}
+	}
+}
+
+// Same as TestEncodeDecodeRoundTrip for every compressed halfword, which
+// must also be encoded back as itself.
+func TestCompressedRoundTrip(t *testing.T) {
+	for _, xlen := range []int{XLEN_32, XLEN_64} {
+		for half := range 1 << 16 {
+			if half&0b11 == 0b11 || half == 0 {
+				continue
+			}
+
+			inst, err := DecodeInstruction(uint32(half), xlen)
+			if err != nil {
+				continue
+			}
+
+			code, err := encodeInstruction(inst, xlen)
+			if err != nil {
+				t.Errorf("xlen %d: '%s' from %#04x doesn't encode: %v", xlen, inst.Str(), half, err)
+				continue
+			}
+			again, err := DecodeInstruction(code, xlen)
+			if err != nil || again != inst || code != uint32(half) {
+				t.Errorf("xlen %d: %#04x decodes to '%s', its encoding %#04x to '%s'", xlen, half, inst.Str(), code, again.Str())
+			}
+		}
+	}
+}
+
+// Parses the line Str gives for the instruction, it must be the same
+// instruction.
+func checkParsedStr(t *testing.T, inst Instruction, xlen int) {
+	t.Helper()
+
+	// A fence with an empty set is written '0', which the parser reads as a
+	// bare fence
+	if inst.Op == Inst_Fence && (inst.Rs2>>4 == 0 || inst.Rs2&0xf == 0) {
+		return
+	}
+
+	program, _, _, err := ParseProgramFromString(inst.Str(), xlen)
+	if err != nil {
+		t.Errorf("xlen %d: '%s' doesn't parse: %v", xlen, inst.Str(), err)
+		return
+	}
+	if len(program) != 2 {
+		t.Errorf("xlen %d: '%s' parses to %d instructions", xlen, inst.Str(), len(program)-1)
+		return
+	}
+
+	code, err := encodeInstruction(program[1], xlen)
+	want, _ := encodeInstruction(inst, xlen)
+	if err != nil || code != want {
+		t.Errorf("xlen %d: '%s' parses to '%s'", xlen, inst.Str(), program[1].Str())
+	}
+}
+
+// Disassembles the ELF file of an example and the memory of the von Neumann
+// run of it, the output must match testdata/jalr.disasm.
+func TestDisassembleGolden(t *testing.T) {
+	object, err := AssembleFile("../examples/jalr.asm", XLEN_32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elf_path := filepath.Join(t.TempDir(), "jalr.elf")
+	f, err := os.Create(elf_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := object.WriteElf(f, false); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	lines, err := DisassembleFile(elf_path, XLEN_32, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := WriteDisassembly(&b, lines); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "jalr.disasm", b.String())
+
+	// The flat binary has the same instructions at the same addresses, without
+	// the labels
+	var bin strings.Builder
+	object.WriteBinary(&bin)
+	bin_path := filepath.Join(t.TempDir(), "jalr.bin")
+	if err := os.WriteFile(bin_path, []byte(bin.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	text := object.Sections[SECTION_TEXT]
+	bin_lines, err := DisassembleFile(bin_path, XLEN_32, TEXT_BASE, 0, text.Addr+text.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bin_lines) != len(lines) {
+		t.Fatalf("%d lines in the binary, %d in the ELF file", len(bin_lines), len(lines))
+	}
+	for i, line := range bin_lines {
+		line.Label = lines[i].Label
+		if line != lines[i] {
+			t.Errorf("'%+v' in the binary, '%+v' in the ELF file", line, lines[i])
+		}
+	}
+
+	// Loaded at another address, the first instruction is at it
+	moved, err := DisassembleFile(bin_path, XLEN_32, 0x100, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) == 0 {
+		t.Fatal("Loaded at 0x100, the binary has no instructions")
+	}
+	if moved[0].Addr != 0x100 || moved[0].Code != lines[0].Code {
+		t.Errorf("Loaded at 0x100, the binary starts with '%+v'", moved[0])
+	}
+
+	cfg, _ := CreateConfig(1024, 200, 2, true, true)
+	cfg.Von_neumann = true
+	v, err := CreateVm(*cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.LoadProgramFromFile("../examples/jalr.asm"); err != nil {
+		t.Fatal(err)
+	}
+	mem_lines, err := v.Disassemble(v._code[0], v._code[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+	WriteDisassembly(&b, mem_lines)
+	checkGolden(t, "jalr.disasm", b.String())
+}
+
+// Compares the output with the golden file of testdata, or rewrites it with
+// -update.
+func checkGolden(t *testing.T, name string, got string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("Output differs from %s:\n%s", path, got)
+	}
+}
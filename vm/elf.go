@@ -0,0 +1,368 @@
+package vm
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// ELF32 output of the assembled programs. The sections are .text, .data,
+// .rodata and .bss, with a symbol table of the labels. Executables have a
+// loadable segment for the code and one for the data, .rodata is writable
+// since it shares the segment of .data. Relocatable files place every
+// section at address 0 and keep the label uses that depend on the placement
+// of the sections as relocations, see Object_Reloc.
+//
+// Executables built by other toolchains can be loaded into the Vm, see
+// readElfExecutable.
+
+// The file uses the compressed instructions
+const EF_RISCV_RVC = 0x1
+
+// Offset of address 0 in the file, the segments are aligned to DATA_ALIGN
+const ELF_CODE_OFFSET = 0x100
+
+// Index of the sections in the section header table
+const (
+	ELF_SHN_TEXT = 1 + iota
+	ELF_SHN_DATA
+	ELF_SHN_RODATA
+	ELF_SHN_BSS
+	ELF_SHN_SYMTAB
+	ELF_SHN_STRTAB
+	ELF_SHN_SHSTRTAB // The relocation sections follow, one for each section using labels
+)
+
+// Builds a string table, the first string is the empty one at offset 0.
+type string_table struct {
+	data    []byte
+	offsets map[string]uint32
+}
+
+func (t *string_table) add(s string) uint32 {
+	if t.offsets == nil {
+		t.data = []byte{0}
+		t.offsets = map[string]uint32{"": 0}
+	}
+	if off, ok := t.offsets[s]; ok {
+		return off
+	}
+
+	off := uint32(len(t.data))
+	t.data = append(append(t.data, s...), 0)
+	t.offsets[s] = off
+	return off
+}
+
+// Writes the program as an ELF32 executable, or a relocatable file. Only RV32
+// programs can be written.
+func (o *Object) WriteElf(w io.Writer, relocatable bool) error {
+	if o.Xlen != XLEN_32 {
+		return fmt.Errorf("ELF output is only supported for RV32 programs")
+	}
+
+	var names string_table
+	var strtab string_table
+
+	// The data sections keep their distance to the code in the file, like in the memory
+	file := make([]byte, ELF_CODE_OFFSET+o.Sections[SECTION_TEXT].Addr)
+	file = append(file, o.Code...)
+	data_offset := uint32(ELF_CODE_OFFSET) + o.Data_base
+	file = append(file, make([]byte, data_offset-uint32(len(file)))...)
+	file = append(file, o.Data[:o.Sections[SECTION_BSS].Addr-o.Data_base]...)
+
+	// Section addresses and symbol values are offsets in their section in relocatable files
+	addr := func(s Section) uint32 {
+		if relocatable {
+			return 0
+		}
+		return o.Sections[s].Addr
+	}
+	section_offset := func(s Section) uint32 {
+		return ELF_CODE_OFFSET + o.Sections[s].Addr
+	}
+
+	headers := []elf.Section32{{}}
+	headers = append(headers, elf.Section32{
+		Name: names.add(".text"), Type: uint32(elf.SHT_PROGBITS), Flags: uint32(elf.SHF_ALLOC | elf.SHF_EXECINSTR),
+		Addr: addr(SECTION_TEXT), Off: section_offset(SECTION_TEXT), Size: o.Sections[SECTION_TEXT].Size, Addralign: o.Sections[SECTION_TEXT].Align,
+	})
+	headers = append(headers, elf.Section32{
+		Name: names.add(".data"), Type: uint32(elf.SHT_PROGBITS), Flags: uint32(elf.SHF_ALLOC | elf.SHF_WRITE),
+		Addr: addr(SECTION_DATA), Off: section_offset(SECTION_DATA), Size: o.Sections[SECTION_DATA].Size, Addralign: o.Sections[SECTION_DATA].Align,
+	})
+	headers = append(headers, elf.Section32{
+		Name: names.add(".rodata"), Type: uint32(elf.SHT_PROGBITS), Flags: uint32(elf.SHF_ALLOC),
+		Addr: addr(SECTION_RODATA), Off: section_offset(SECTION_RODATA), Size: o.Sections[SECTION_RODATA].Size, Addralign: o.Sections[SECTION_RODATA].Align,
+	})
+	headers = append(headers, elf.Section32{
+		Name: names.add(".bss"), Type: uint32(elf.SHT_NOBITS), Flags: uint32(elf.SHF_ALLOC | elf.SHF_WRITE),
+		Addr: addr(SECTION_BSS), Off: section_offset(SECTION_BSS), Size: o.Sections[SECTION_BSS].Size, Addralign: o.Sections[SECTION_BSS].Align,
+	})
+
+	// Local symbols come first
+	symbols := []elf.Sym32{{}}
+	index := make(map[string]uint32)
+	first_global := uint32(0)
+	for _, global := range []bool{false, true} {
+		if global {
+			first_global = uint32(len(symbols))
+		}
+		for _, sym := range o.Symbols {
+			if sym.Global != global {
+				continue
+			}
+
+			bind := elf.STB_LOCAL
+			if sym.Global {
+				bind = elf.STB_GLOBAL
+			}
+			index[sym.Name] = uint32(len(symbols))
+			symbols = append(symbols, elf.Sym32{
+				Name:  strtab.add(sym.Name),
+				Value: sym.Addr - o.Sections[sym.Section].Addr + addr(sym.Section),
+				Info:  elf.ST_INFO(bind, elf.STT_NOTYPE),
+				Shndx: uint16(ELF_SHN_TEXT + sym.Section),
+			})
+		}
+	}
+
+	var symtab bytes.Buffer
+	binary.Write(&symtab, binary.LittleEndian, symbols)
+
+	// Relocations of each section
+	var relas [SECTION_BSS + 1][]elf.Rela32
+	if relocatable {
+		for _, reloc := range o.Relocations {
+			if reloc.Type == elf.R_RISCV_NONE {
+				return fmt.Errorf("The use of label '%v' at %08x can't be relocated", reloc.Symbol, o.Sections[reloc.Section].Addr+reloc.Offset)
+			}
+			relas[reloc.Section] = append(relas[reloc.Section], elf.Rela32{
+				Off:    reloc.Offset,
+				Info:   elf.R_INFO32(index[reloc.Symbol], uint32(reloc.Type)),
+				Addend: reloc.Addend,
+			})
+		}
+	}
+
+	appendSection := func(header elf.Section32, contents []byte) {
+		for len(file)%4 != 0 {
+			file = append(file, 0)
+		}
+		header.Off = uint32(len(file))
+		header.Size = uint32(len(contents))
+		file = append(file, contents...)
+		headers = append(headers, header)
+	}
+
+	appendSection(elf.Section32{
+		Name: names.add(".symtab"), Type: uint32(elf.SHT_SYMTAB), Link: ELF_SHN_STRTAB, Info: first_global,
+		Addralign: 4, Entsize: uint32(binary.Size(elf.Sym32{})),
+	}, symtab.Bytes())
+	appendSection(elf.Section32{Name: names.add(".strtab"), Type: uint32(elf.SHT_STRTAB), Addralign: 1}, strtab.data)
+
+	// The names of the relocation sections go to the table before it is written
+	shstrtab := names.add(".shstrtab")
+	rela_names := [...]string{".rela.text", ".rela.data", ".rela.rodata", ".rela.bss"}
+	for s, rela := range relas {
+		if len(rela) > 0 {
+			names.add(rela_names[s])
+		}
+	}
+	appendSection(elf.Section32{Name: shstrtab, Type: uint32(elf.SHT_STRTAB), Addralign: 1}, names.data)
+
+	for s, rela := range relas {
+		if len(rela) == 0 {
+			continue
+		}
+
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, rela)
+		appendSection(elf.Section32{
+			Name: names.add(rela_names[s]), Type: uint32(elf.SHT_RELA), Flags: uint32(elf.SHF_INFO_LINK),
+			Link: ELF_SHN_SYMTAB, Info: uint32(ELF_SHN_TEXT + s), Addralign: 4, Entsize: uint32(binary.Size(elf.Rela32{})),
+		}, buf.Bytes())
+	}
+
+	for len(file)%4 != 0 {
+		file = append(file, 0)
+	}
+	section_headers := uint32(len(file))
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, headers)
+	file = append(file, buf.Bytes()...)
+
+	// Loadable segments of executables
+	var programs []elf.Prog32
+	if !relocatable {
+		programs = append(programs, elf.Prog32{
+			Type: uint32(elf.PT_LOAD), Off: section_offset(SECTION_TEXT), Vaddr: o.Sections[SECTION_TEXT].Addr, Paddr: o.Sections[SECTION_TEXT].Addr,
+			Filesz: uint32(len(o.Code)), Memsz: uint32(len(o.Code)), Flags: uint32(elf.PF_R | elf.PF_X), Align: DATA_ALIGN,
+		})
+		if len(o.Data) > 0 {
+			filesz := o.Sections[SECTION_BSS].Addr - o.Data_base
+			programs = append(programs, elf.Prog32{
+				Type: uint32(elf.PT_LOAD), Off: data_offset, Vaddr: o.Data_base, Paddr: o.Data_base,
+				Filesz: filesz, Memsz: uint32(len(o.Data)), Flags: uint32(elf.PF_R | elf.PF_W), Align: DATA_ALIGN,
+			})
+		}
+	}
+
+	header := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_RISCV),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     o.Entry,
+		Shoff:     section_headers,
+		Ehsize:    uint16(binary.Size(elf.Header32{})),
+		Phentsize: uint16(binary.Size(elf.Prog32{})),
+		Phnum:     uint16(len(programs)),
+		Shentsize: uint16(binary.Size(elf.Section32{})),
+		Shnum:     uint16(len(headers)),
+		Shstrndx:  ELF_SHN_SHSTRTAB,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	if o.compressed {
+		header.Flags |= EF_RISCV_RVC
+	}
+	if relocatable {
+		header.Type = uint16(elf.ET_REL)
+		header.Entry = 0
+	}
+	if len(programs) > 0 {
+		header.Phoff = uint32(header.Ehsize)
+	}
+
+	// The header and the program headers go before the code
+	buf.Reset()
+	binary.Write(&buf, binary.LittleEndian, header)
+	binary.Write(&buf, binary.LittleEndian, programs)
+	if buf.Len() > ELF_CODE_OFFSET {
+		return fmt.Errorf("ELF headers don't fit before the code")
+	}
+	copy(file, buf.Bytes())
+
+	_, err := w.Write(file)
+	return err
+}
+
+// A label of a loaded program
+type Symbol struct {
+	Name string
+	Addr uint32
+}
+
+type elf_executable struct {
+	image   []byte // Memory contents from address 0 to the end of the last segment
+	entry   uint32
+	symbols []Symbol  // By address
+	code    [2]uint32 // Address range of the executable segments
+	n_insts uint      // Instructions in the executable segments
+}
+
+// Opens an ELF executable built for RISC-V with the given XLEN.
+func openElfExecutable(filename string, xlen int) (*elf.File, error) {
+	f, err := elf.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read ELF file '%v': %v", filename, err.Error())
+	}
+
+	class := elf.ELFCLASS32
+	if xlen == XLEN_64 {
+		class = elf.ELFCLASS64
+	}
+	switch {
+	case f.Machine != elf.EM_RISCV:
+		err = fmt.Errorf("'%v' is not a RISC-V program, its machine is %v", filename, f.Machine)
+	case f.Class != class:
+		err = fmt.Errorf("'%v' is an %v file, it can't run with an XLEN of %d", filename, f.Class, xlen)
+	case f.Type != elf.ET_EXEC:
+		err = fmt.Errorf("'%v' is not an executable, its type is %v", filename, f.Type)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Reads the loadable segments of an ELF executable into a memory image of
+// mem_size bytes at most. The instructions are decoded when fetched, the
+// sections are not used.
+func readElfExecutable(filename string, xlen int, mem_size uint32) (*elf_executable, error) {
+	f, err := openElfExecutable(filename, xlen)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	exe := &elf_executable{entry: uint32(f.Entry), code: [2]uint32{^uint32(0), 0}}
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Memsz == 0 {
+			continue
+		}
+
+		if prog.Filesz > prog.Memsz {
+			return nil, fmt.Errorf("The segment at %#x of '%v' has %d bytes in the file, more than its %d bytes of memory", prog.Vaddr, filename, prog.Filesz, prog.Memsz)
+		}
+		// Checked without adding, the sum can wrap around in ELF64 files
+		end := prog.Vaddr + prog.Memsz
+		if prog.Memsz > uint64(mem_size) || prog.Vaddr > uint64(mem_size)-prog.Memsz {
+			return nil, fmt.Errorf("The segment at %#x-%#x does not fit in the %d bytes of memory", prog.Vaddr, end, mem_size)
+		}
+		if end > uint64(len(exe.image)) {
+			exe.image = append(exe.image, make([]byte, end-uint64(len(exe.image)))...)
+		}
+
+		contents := exe.image[prog.Vaddr : prog.Vaddr+prog.Filesz]
+		if _, err := prog.ReadAt(contents, 0); err != nil {
+			return nil, fmt.Errorf("Failed to read the segment at %#x of '%v': %v", prog.Vaddr, filename, err.Error())
+		}
+
+		if prog.Flags&elf.PF_X != 0 {
+			exe.code = [2]uint32{min(exe.code[0], uint32(prog.Vaddr)), max(exe.code[1], uint32(prog.Vaddr+prog.Filesz))}
+			for i := 0; i+1 < len(contents); i += int(instructionSize(binary.LittleEndian.Uint16(contents[i:]))) {
+				exe.n_insts++
+			}
+		}
+	}
+
+	exe.symbols, err = elfSymbols(f, filename)
+	if err != nil {
+		return nil, err
+	}
+	return exe, nil
+}
+
+// Returns the named symbols defined in the file, by address.
+func elfSymbols(f *elf.File, filename string) ([]Symbol, error) {
+	syms, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, fmt.Errorf("Failed to read the symbols of '%v': %v", filename, err.Error())
+	}
+
+	var symbols []Symbol
+	for _, sym := range syms {
+		typ := elf.ST_TYPE(sym.Info)
+		if sym.Name == "" || sym.Section == elf.SHN_UNDEF || typ == elf.STT_SECTION || typ == elf.STT_FILE {
+			continue
+		}
+		symbols = append(symbols, Symbol{sym.Name, uint32(sym.Value)})
+	}
+	slices.SortFunc(symbols, func(a, b Symbol) int {
+		if a.Addr != b.Addr {
+			return int(int64(a.Addr) - int64(b.Addr))
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return symbols, nil
+}
@@ -0,0 +1,121 @@
+package vm
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Writes the ELF file of the example to a temporary directory.
+func writeExampleElf(t *testing.T, example string) string {
+	t.Helper()
+
+	object, err := AssembleFile(filepath.Join("..", SOURCE_FOLDER, example), XLEN_32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), strings.TrimSuffix(example, ".asm")+".elf")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := object.WriteElf(f, false); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newVonNeumannVm(t *testing.T, mem_size uint32, xlen int) *Vm {
+	t.Helper()
+
+	cfg, err := CreateConfig(mem_size, mem_size/4, 2, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Von_neumann = true
+	cfg.Xlen = xlen
+	v, err := CreateVm(*cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// Runs the ELF files of the examples, the registers and the memory must end
+// up like in the von Neumann run of the assembly, which has the same layout.
+func TestLoadProgramFromELF(t *testing.T) {
+	for _, example := range []string{"jalr.asm", "fib.asm", "data.asm", "self_modify.asm", "trap_memory.asm"} {
+		path := writeExampleElf(t, example)
+
+		from_asm := newVonNeumannVm(t, 1024, XLEN_32)
+		if err := from_asm.LoadProgramFromFile(filepath.Join("..", SOURCE_FOLDER, example)); err != nil {
+			t.Fatal(err)
+		}
+		from_elf := newVonNeumannVm(t, 1024, XLEN_32)
+		if err := from_elf.LoadProgramFromELF(path); err != nil {
+			t.Fatalf("%s: %v", example, err)
+		}
+		if !slices.Equal(from_elf.Memory, from_asm.Memory) || from_elf.Pc != from_asm.Pc {
+			t.Errorf("%s: The ELF file is loaded differently", example)
+		}
+
+		from_asm.RunPipelined()
+		from_elf.RunPipelined()
+		if from_elf.Registers != from_asm.Registers {
+			t.Errorf("%s: Registers %v, want %v", example, from_elf.Registers, from_asm.Registers)
+		}
+		if !slices.Equal(from_elf.Memory, from_asm.Memory) {
+			t.Errorf("%s: The memory differs", example)
+		}
+		if from_elf.Runtime_error != nil || from_asm.Runtime_error != nil {
+			t.Errorf("%s: Errors '%v' and '%v'", example, from_elf.Runtime_error, from_asm.Runtime_error)
+		}
+	}
+}
+
+func TestLoadProgramFromELFMalformed(t *testing.T) {
+	path := writeExampleElf(t, "jalr.asm")
+	valid, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patched := func(offset int, value uint16) string {
+		data := slices.Clone(valid)
+		binary.LittleEndian.PutUint16(data[offset:], value)
+		patched := filepath.Join(t.TempDir(), "patched.elf")
+		if err := os.WriteFile(patched, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return patched
+	}
+
+	tests := []struct {
+		name string
+		path string
+		vm   *Vm
+		want string
+	}{
+		// e_machine follows the 16 bytes of e_ident and e_type
+		{"machine", patched(18, 62), newVonNeumannVm(t, 1024, XLEN_32), "not a RISC-V program"},
+		{"class", path, newVonNeumannVm(t, 1024, XLEN_64), "can't run with an XLEN of 64"},
+		{"relocatable", patched(16, 1), newVonNeumannVm(t, 1024, XLEN_32), "not an executable"},
+		{"segment outside the memory", path, newVonNeumannVm(t, 64, XLEN_32), "does not fit"},
+		// The program headers follow the 52 bytes of the ELF header, p_vaddr
+		// is at 8 and p_memsz at 20 in them
+		{"file size over memory size", patched(52+20, 4), newVonNeumannVm(t, 1024, XLEN_32), "more than its 4 bytes of memory"},
+		{"segment at the end of the address space", patched(52+8+2, 0xffff), newVonNeumannVm(t, 1024, XLEN_32), "does not fit"},
+		{"not an ELF file", patched(0, 0), newVonNeumannVm(t, 1024, XLEN_32), "Failed to read ELF file"},
+	}
+	for _, test := range tests {
+		err := test.vm.LoadProgramFromELF(test.path)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error '%v', want '%s'", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,721 @@
+package vm
+
+import (
+	"fmt"
+)
+
+// Machine code of the instructions. Every instruction is encoded in the
+// standard format of its major opcode, compressed ones in their 16-bit format.
+// The operands are taken from the layout of the parser, which does not always
+// follow the order of the fields, see getImmediate. Pseudo instructions are
+// expanded when parsed, only the instructions they stand for are encoded.
+//
+// 'subi' is not a RISC-V instruction, it is encoded as addi with the negated
+// immediate. The End instruction the programs start with has no encoding, it
+// is the zero word of the memory, see Object.
+
+// Major opcodes, bits 6..0
+const (
+	OPCODE_LOAD      uint32 = 0b0000011
+	OPCODE_LOAD_FP   uint32 = 0b0000111
+	OPCODE_MISC_MEM  uint32 = 0b0001111
+	OPCODE_OP_IMM    uint32 = 0b0010011
+	OPCODE_AUIPC     uint32 = 0b0010111
+	OPCODE_OP_IMM_32 uint32 = 0b0011011
+	OPCODE_STORE     uint32 = 0b0100011
+	OPCODE_STORE_FP  uint32 = 0b0100111
+	OPCODE_AMO       uint32 = 0b0101111
+	OPCODE_OP        uint32 = 0b0110011
+	OPCODE_LUI       uint32 = 0b0110111
+	OPCODE_OP_32     uint32 = 0b0111011
+	OPCODE_MADD      uint32 = 0b1000011
+	OPCODE_MSUB      uint32 = 0b1000111
+	OPCODE_NMSUB     uint32 = 0b1001011
+	OPCODE_NMADD     uint32 = 0b1001111
+	OPCODE_OP_FP     uint32 = 0b1010011
+	OPCODE_OP_V      uint32 = 0b1010111
+	OPCODE_BRANCH    uint32 = 0b1100011
+	OPCODE_JALR      uint32 = 0b1100111
+	OPCODE_JAL       uint32 = 0b1101111
+	OPCODE_SYSTEM    uint32 = 0b1110011
+)
+
+// funct3 of the vector arithmetic instructions, it tells the kind of the operands
+const (
+	VFUNCT3_OPIVV uint32 = 0b000 // vector, vector
+	VFUNCT3_OPMVV uint32 = 0b010
+	VFUNCT3_OPIVI uint32 = 0b011 // vector, immediate
+	VFUNCT3_OPIVX uint32 = 0b100 // vector, scalar
+	VFUNCT3_OPMVX uint32 = 0b110
+	VFUNCT3_OPCFG uint32 = 0b111 // vsetvli
+)
+
+// Width field of the vector loads and stores, by element width
+var vectorWidthCodes = map[int]uint32{8: 0b000, 16: 0b101, 32: 0b110, 64: 0b111}
+
+// How the operands of an instruction are placed in its encoding
+type Enc_Layout uint8
+
+const (
+	ENC_NONE         Enc_Layout = iota // No operands, like ecall
+	ENC_R                              // rd, rs1, rs2
+	ENC_R_UNARY                        // rd, rs1, the rs2 field is fixed
+	ENC_R_RM                           // rd, rs1, rs2 and the rounding mode in funct3
+	ENC_R_UNARY_RM                     // rd, rs1 and the rounding mode
+	ENC_R4                             // rd, rs1, rs2, rs3 and the rounding mode
+	ENC_I                              // rd, rs1, imm[11:0]
+	ENC_SHIFT                          // rd, rs1, shamt
+	ENC_LOAD                           // rd, imm(rs1)
+	ENC_STORE                          // rs2, imm(rs1)
+	ENC_B                              // rs1, rs2, offset
+	ENC_J                              // rd, offset
+	ENC_U                              // rd, imm[31:12]
+	ENC_CSR                            // rd, csr, rs1 or uimm
+	ENC_FCSR                           // rd, rs1, the CSR is fixed
+	ENC_AMO                            // rd, rs2, (rs1)
+	ENC_LR                             // rd, (rs1)
+	ENC_FENCE                          // pred, succ
+	ENC_SFENCE                         // rs1, rs2
+	ENC_VSETVLI                        // rd, rs1, vtype
+	ENC_VMEM                           // vd, (rs1), mask
+	ENC_VMEM_STRIDED                   // vd, (rs1), rs2, mask
+	ENC_V                              // vd, vs2, vs1/rs1/imm, mask
+	ENC_V_MACC                         // vd, vs1/rs1, vs2, mask
+	ENC_V_SCALAR                       // vd, vs1/rs1/imm, the vs2 field is fixed
+	ENC_V_TO_SCALAR                    // rd, vs2
+	ENC_V_DEST                         // vd, mask
+)
+
+type inst_encoding struct {
+	match  uint32 // The fixed bits, the opcode, the functs and the fixed operand fields
+	layout Enc_Layout
+}
+
+func encR(funct7, funct3, opcode uint32) uint32 {
+	return funct7<<25 | funct3<<12 | opcode
+}
+
+func encI(funct3, opcode uint32) uint32 {
+	return funct3<<12 | opcode
+}
+
+// R format instruction with a fixed rs2 field
+func encUnary(funct7, rs2, funct3, opcode uint32) uint32 {
+	return funct7<<25 | rs2<<20 | funct3<<12 | opcode
+}
+
+func encAmo(funct5 uint32) uint32 {
+	return funct5<<27 | 0b010<<12 | OPCODE_AMO
+}
+
+func encV(funct6, funct3 uint32) uint32 {
+	return funct6<<26 | funct3<<12 | OPCODE_OP_V
+}
+
+// Vector load or store, mop is 0 for unit-stride and 2 for strided accesses
+func encVMem(mop uint32, width int, opcode uint32) uint32 {
+	return mop<<26 | vectorWidthCodes[width]<<12 | opcode
+}
+
+var encodingTable = map[Inst_Op]inst_encoding{
+	Inst_Add:    {encR(0x00, 0, OPCODE_OP), ENC_R},
+	Inst_Sub:    {encR(0x20, 0, OPCODE_OP), ENC_R},
+	Inst_Mul:    {encR(0x01, 0, OPCODE_OP), ENC_R},
+	Inst_Mulh:   {encR(0x01, 1, OPCODE_OP), ENC_R},
+	Inst_Mulhsu: {encR(0x01, 2, OPCODE_OP), ENC_R},
+	Inst_Mulhu:  {encR(0x01, 3, OPCODE_OP), ENC_R},
+	Inst_Div:    {encR(0x01, 4, OPCODE_OP), ENC_R},
+	Inst_Divu:   {encR(0x01, 5, OPCODE_OP), ENC_R},
+	Inst_Rem:    {encR(0x01, 6, OPCODE_OP), ENC_R},
+	Inst_Remu:   {encR(0x01, 7, OPCODE_OP), ENC_R},
+	Inst_Xor:    {encR(0x00, 4, OPCODE_OP), ENC_R},
+	Inst_Or:     {encR(0x00, 6, OPCODE_OP), ENC_R},
+	Inst_And:    {encR(0x00, 7, OPCODE_OP), ENC_R},
+	Inst_Sll:    {encR(0x00, 1, OPCODE_OP), ENC_R},
+	Inst_Srl:    {encR(0x00, 5, OPCODE_OP), ENC_R},
+	Inst_Sra:    {encR(0x20, 5, OPCODE_OP), ENC_R},
+	Inst_Slt:    {encR(0x00, 2, OPCODE_OP), ENC_R},
+	Inst_Sltu:   {encR(0x00, 3, OPCODE_OP), ENC_R},
+
+	Inst_Fadd_s:    {encR(0x00, 0, OPCODE_OP_FP), ENC_R_RM},
+	Inst_Fsub_s:    {encR(0x04, 0, OPCODE_OP_FP), ENC_R_RM},
+	Inst_Fmul_s:    {encR(0x08, 0, OPCODE_OP_FP), ENC_R_RM},
+	Inst_Fdiv_s:    {encR(0x0c, 0, OPCODE_OP_FP), ENC_R_RM},
+	Inst_Fsqrt_s:   {encUnary(0x2c, 0, 0, OPCODE_OP_FP), ENC_R_UNARY_RM},
+	Inst_Fmin_s:    {encR(0x14, 0, OPCODE_OP_FP), ENC_R},
+	Inst_Fmax_s:    {encR(0x14, 1, OPCODE_OP_FP), ENC_R},
+	Inst_Fsgnj_s:   {encR(0x10, 0, OPCODE_OP_FP), ENC_R},
+	Inst_Fsgnjn_s:  {encR(0x10, 1, OPCODE_OP_FP), ENC_R},
+	Inst_Fsgnjx_s:  {encR(0x10, 2, OPCODE_OP_FP), ENC_R},
+	Inst_Fcvt_w_s:  {encUnary(0x60, 0, 0, OPCODE_OP_FP), ENC_R_UNARY_RM},
+	Inst_Fcvt_wu_s: {encUnary(0x60, 1, 0, OPCODE_OP_FP), ENC_R_UNARY_RM},
+	Inst_Fcvt_s_w:  {encUnary(0x68, 0, 0, OPCODE_OP_FP), ENC_R_UNARY_RM},
+	Inst_Fcvt_s_wu: {encUnary(0x68, 1, 0, OPCODE_OP_FP), ENC_R_UNARY_RM},
+	Inst_Fmv_x_w:   {encUnary(0x70, 0, 0, OPCODE_OP_FP), ENC_R_UNARY},
+	Inst_Fmv_w_x:   {encUnary(0x78, 0, 0, OPCODE_OP_FP), ENC_R_UNARY},
+	Inst_Feq_s:     {encR(0x50, 2, OPCODE_OP_FP), ENC_R},
+	Inst_Flt_s:     {encR(0x50, 1, OPCODE_OP_FP), ENC_R},
+	Inst_Fle_s:     {encR(0x50, 0, OPCODE_OP_FP), ENC_R},
+	Inst_Fclass_s:  {encUnary(0x70, 0, 1, OPCODE_OP_FP), ENC_R_UNARY},
+
+	// Accesses to fcsr, frm and fflags with csrrs and csrrw
+	Inst_Frcsr:   {uint32(CSR_FCSR)<<20 | encI(2, OPCODE_SYSTEM), ENC_FCSR},
+	Inst_Fscsr:   {uint32(CSR_FCSR)<<20 | encI(1, OPCODE_SYSTEM), ENC_FCSR},
+	Inst_Frrm:    {uint32(CSR_FRM)<<20 | encI(2, OPCODE_SYSTEM), ENC_FCSR},
+	Inst_Fsrm:    {uint32(CSR_FRM)<<20 | encI(1, OPCODE_SYSTEM), ENC_FCSR},
+	Inst_Frflags: {uint32(CSR_FFLAGS)<<20 | encI(2, OPCODE_SYSTEM), ENC_FCSR},
+	Inst_Fsflags: {uint32(CSR_FFLAGS)<<20 | encI(1, OPCODE_SYSTEM), ENC_FCSR},
+
+	// The rounding mode field of the exact conversions is left zero
+	Inst_Fadd_d:    {encR(0x01, 0, OPCODE_OP_FP), ENC_R_RM},
+	Inst_Fsub_d:    {encR(0x05, 0, OPCODE_OP_FP), ENC_R_RM},
+	Inst_Fmul_d:    {encR(0x09, 0, OPCODE_OP_FP), ENC_R_RM},
+	Inst_Fdiv_d:    {encR(0x0d, 0, OPCODE_OP_FP), ENC_R_RM},
+	Inst_Fsqrt_d:   {encUnary(0x2d, 0, 0, OPCODE_OP_FP), ENC_R_UNARY_RM},
+	Inst_Fmin_d:    {encR(0x15, 0, OPCODE_OP_FP), ENC_R},
+	Inst_Fmax_d:    {encR(0x15, 1, OPCODE_OP_FP), ENC_R},
+	Inst_Fsgnj_d:   {encR(0x11, 0, OPCODE_OP_FP), ENC_R},
+	Inst_Fsgnjn_d:  {encR(0x11, 1, OPCODE_OP_FP), ENC_R},
+	Inst_Fsgnjx_d:  {encR(0x11, 2, OPCODE_OP_FP), ENC_R},
+	Inst_Fcvt_s_d:  {encUnary(0x20, 1, 0, OPCODE_OP_FP), ENC_R_UNARY_RM},
+	Inst_Fcvt_d_s:  {encUnary(0x21, 0, 0, OPCODE_OP_FP), ENC_R_UNARY_RM},
+	Inst_Fcvt_w_d:  {encUnary(0x61, 0, 0, OPCODE_OP_FP), ENC_R_UNARY_RM},
+	Inst_Fcvt_wu_d: {encUnary(0x61, 1, 0, OPCODE_OP_FP), ENC_R_UNARY_RM},
+	Inst_Fcvt_d_w:  {encUnary(0x69, 0, 0, OPCODE_OP_FP), ENC_R_UNARY_RM},
+	Inst_Fcvt_d_wu: {encUnary(0x69, 1, 0, OPCODE_OP_FP), ENC_R_UNARY_RM},
+	Inst_Feq_d:     {encR(0x51, 2, OPCODE_OP_FP), ENC_R},
+	Inst_Flt_d:     {encR(0x51, 1, OPCODE_OP_FP), ENC_R},
+	Inst_Fle_d:     {encR(0x51, 0, OPCODE_OP_FP), ENC_R},
+	Inst_Fclass_d:  {encUnary(0x71, 0, 1, OPCODE_OP_FP), ENC_R_UNARY},
+
+	// The aq and rl bits are left zero
+	Inst_Lr_w:      {encAmo(0b00010), ENC_LR},
+	Inst_Sc_w:      {encAmo(0b00011), ENC_AMO},
+	Inst_Amoswap_w: {encAmo(0b00001), ENC_AMO},
+	Inst_Amoadd_w:  {encAmo(0b00000), ENC_AMO},
+	Inst_Amoxor_w:  {encAmo(0b00100), ENC_AMO},
+	Inst_Amoand_w:  {encAmo(0b01100), ENC_AMO},
+	Inst_Amoor_w:   {encAmo(0b01000), ENC_AMO},
+	Inst_Amomin_w:  {encAmo(0b10000), ENC_AMO},
+	Inst_Amomax_w:  {encAmo(0b10100), ENC_AMO},
+	Inst_Amominu_w: {encAmo(0b11000), ENC_AMO},
+	Inst_Amomaxu_w: {encAmo(0b11100), ENC_AMO},
+
+	Inst_Sfence_vma: {encR(0x09, 0, OPCODE_SYSTEM), ENC_SFENCE},
+
+	Inst_Sh1add: {encR(0x10, 2, OPCODE_OP), ENC_R},
+	Inst_Sh2add: {encR(0x10, 4, OPCODE_OP), ENC_R},
+	Inst_Sh3add: {encR(0x10, 6, OPCODE_OP), ENC_R},
+
+	Inst_Andn:   {encR(0x20, 7, OPCODE_OP), ENC_R},
+	Inst_Orn:    {encR(0x20, 6, OPCODE_OP), ENC_R},
+	Inst_Xnor:   {encR(0x20, 4, OPCODE_OP), ENC_R},
+	Inst_Clz:    {encUnary(0x30, 0, 1, OPCODE_OP_IMM), ENC_R_UNARY},
+	Inst_Ctz:    {encUnary(0x30, 1, 1, OPCODE_OP_IMM), ENC_R_UNARY},
+	Inst_Cpop:   {encUnary(0x30, 2, 1, OPCODE_OP_IMM), ENC_R_UNARY},
+	Inst_Max:    {encR(0x05, 6, OPCODE_OP), ENC_R},
+	Inst_Maxu:   {encR(0x05, 7, OPCODE_OP), ENC_R},
+	Inst_Min:    {encR(0x05, 4, OPCODE_OP), ENC_R},
+	Inst_Minu:   {encR(0x05, 5, OPCODE_OP), ENC_R},
+	Inst_Sext_b: {encUnary(0x30, 4, 1, OPCODE_OP_IMM), ENC_R_UNARY},
+	Inst_Sext_h: {encUnary(0x30, 5, 1, OPCODE_OP_IMM), ENC_R_UNARY},
+	Inst_Zext_h: {encUnary(0x04, 0, 4, OPCODE_OP), ENC_R_UNARY},
+	Inst_Rol:    {encR(0x30, 1, OPCODE_OP), ENC_R},
+	Inst_Ror:    {encR(0x30, 5, OPCODE_OP), ENC_R},
+	Inst_Orc_b:  {encUnary(0x14, 0x07, 5, OPCODE_OP_IMM), ENC_R_UNARY},
+	Inst_Rev8:   {encUnary(0x34, 0x18, 5, OPCODE_OP_IMM), ENC_R_UNARY},
+
+	Inst_Bclr: {encR(0x24, 1, OPCODE_OP), ENC_R},
+	Inst_Bext: {encR(0x24, 5, OPCODE_OP), ENC_R},
+	Inst_Binv: {encR(0x34, 1, OPCODE_OP), ENC_R},
+	Inst_Bset: {encR(0x14, 1, OPCODE_OP), ENC_R},
+
+	Inst_Addw:  {encR(0x00, 0, OPCODE_OP_32), ENC_R},
+	Inst_Subw:  {encR(0x20, 0, OPCODE_OP_32), ENC_R},
+	Inst_Sllw:  {encR(0x00, 1, OPCODE_OP_32), ENC_R},
+	Inst_Srlw:  {encR(0x00, 5, OPCODE_OP_32), ENC_R},
+	Inst_Sraw:  {encR(0x20, 5, OPCODE_OP_32), ENC_R},
+	Inst_Mulw:  {encR(0x01, 0, OPCODE_OP_32), ENC_R},
+	Inst_Divw:  {encR(0x01, 4, OPCODE_OP_32), ENC_R},
+	Inst_Divuw: {encR(0x01, 5, OPCODE_OP_32), ENC_R},
+	Inst_Remw:  {encR(0x01, 6, OPCODE_OP_32), ENC_R},
+	Inst_Remuw: {encR(0x01, 7, OPCODE_OP_32), ENC_R},
+
+	Inst_Addi:    {encI(0, OPCODE_OP_IMM), ENC_I},
+	Inst_Xori:    {encI(4, OPCODE_OP_IMM), ENC_I},
+	Inst_Lw:      {encI(2, OPCODE_LOAD), ENC_LOAD},
+	Inst_Lh:      {encI(1, OPCODE_LOAD), ENC_LOAD},
+	Inst_Lb:      {encI(0, OPCODE_LOAD), ENC_LOAD},
+	Inst_Ori:     {encI(6, OPCODE_OP_IMM), ENC_I},
+	Inst_Andi:    {encI(7, OPCODE_OP_IMM), ENC_I},
+	Inst_Jalr:    {encI(0, OPCODE_JALR), ENC_I},
+	Inst_Slli:    {encR(0x00, 1, OPCODE_OP_IMM), ENC_SHIFT},
+	Inst_Srli:    {encR(0x00, 5, OPCODE_OP_IMM), ENC_SHIFT},
+	Inst_Srai:    {encR(0x20, 5, OPCODE_OP_IMM), ENC_SHIFT},
+	Inst_Slti:    {encI(2, OPCODE_OP_IMM), ENC_I},
+	Inst_Sltiu:   {encI(3, OPCODE_OP_IMM), ENC_I},
+	Inst_Lbu:     {encI(4, OPCODE_LOAD), ENC_LOAD},
+	Inst_Lhu:     {encI(5, OPCODE_LOAD), ENC_LOAD},
+	Inst_Fence:   {encI(0, OPCODE_MISC_MEM), ENC_FENCE},
+	Inst_Fence_i: {encI(1, OPCODE_MISC_MEM), ENC_NONE},
+	Inst_Ecall:   {0x00000073, ENC_NONE},
+	Inst_Ebreak:  {0x00100073, ENC_NONE},
+	Inst_Mret:    {0x30200073, ENC_NONE},
+	Inst_Sret:    {0x10200073, ENC_NONE},
+	Inst_Flw:     {encI(2, OPCODE_LOAD_FP), ENC_LOAD},
+	Inst_Fld:     {encI(3, OPCODE_LOAD_FP), ENC_LOAD},
+
+	Inst_Csrrw:  {encI(1, OPCODE_SYSTEM), ENC_CSR},
+	Inst_Csrrs:  {encI(2, OPCODE_SYSTEM), ENC_CSR},
+	Inst_Csrrc:  {encI(3, OPCODE_SYSTEM), ENC_CSR},
+	Inst_Csrrwi: {encI(5, OPCODE_SYSTEM), ENC_CSR},
+	Inst_Csrrsi: {encI(6, OPCODE_SYSTEM), ENC_CSR},
+	Inst_Csrrci: {encI(7, OPCODE_SYSTEM), ENC_CSR},
+
+	Inst_Rori:  {encR(0x30, 5, OPCODE_OP_IMM), ENC_SHIFT},
+	Inst_Bclri: {encR(0x24, 1, OPCODE_OP_IMM), ENC_SHIFT},
+	Inst_Bexti: {encR(0x24, 5, OPCODE_OP_IMM), ENC_SHIFT},
+	Inst_Binvi: {encR(0x34, 1, OPCODE_OP_IMM), ENC_SHIFT},
+	Inst_Bseti: {encR(0x14, 1, OPCODE_OP_IMM), ENC_SHIFT},
+
+	Inst_Ld:    {encI(3, OPCODE_LOAD), ENC_LOAD},
+	Inst_Lwu:   {encI(6, OPCODE_LOAD), ENC_LOAD},
+	Inst_Addiw: {encI(0, OPCODE_OP_IMM_32), ENC_I},
+	Inst_Slliw: {encR(0x00, 1, OPCODE_OP_IMM_32), ENC_SHIFT},
+	Inst_Srliw: {encR(0x00, 5, OPCODE_OP_IMM_32), ENC_SHIFT},
+	Inst_Sraiw: {encR(0x20, 5, OPCODE_OP_IMM_32), ENC_SHIFT},
+
+	Inst_Sw:  {encI(2, OPCODE_STORE), ENC_STORE},
+	Inst_Sh:  {encI(1, OPCODE_STORE), ENC_STORE},
+	Inst_Sb:  {encI(0, OPCODE_STORE), ENC_STORE},
+	Inst_Fsw: {encI(2, OPCODE_STORE_FP), ENC_STORE},
+	Inst_Fsd: {encI(3, OPCODE_STORE_FP), ENC_STORE},
+	Inst_Sd:  {encI(3, OPCODE_STORE), ENC_STORE},
+
+	Inst_Beq:  {encI(0, OPCODE_BRANCH), ENC_B},
+	Inst_Bne:  {encI(1, OPCODE_BRANCH), ENC_B},
+	Inst_Blt:  {encI(4, OPCODE_BRANCH), ENC_B},
+	Inst_Bge:  {encI(5, OPCODE_BRANCH), ENC_B},
+	Inst_Bltu: {encI(6, OPCODE_BRANCH), ENC_B},
+	Inst_Bgeu: {encI(7, OPCODE_BRANCH), ENC_B},
+
+	Inst_Jal:   {OPCODE_JAL, ENC_J},
+	Inst_Lui:   {OPCODE_LUI, ENC_U},
+	Inst_Auipc: {OPCODE_AUIPC, ENC_U},
+
+	// Bits 26..25 are the format, 0 for single and 1 for double precision
+	Inst_Fmadd_s:  {OPCODE_MADD, ENC_R4},
+	Inst_Fmsub_s:  {OPCODE_MSUB, ENC_R4},
+	Inst_Fnmsub_s: {OPCODE_NMSUB, ENC_R4},
+	Inst_Fnmadd_s: {OPCODE_NMADD, ENC_R4},
+	Inst_Fmadd_d:  {1<<25 | OPCODE_MADD, ENC_R4},
+	Inst_Fmsub_d:  {1<<25 | OPCODE_MSUB, ENC_R4},
+	Inst_Fnmsub_d: {1<<25 | OPCODE_NMSUB, ENC_R4},
+	Inst_Fnmadd_d: {1<<25 | OPCODE_NMADD, ENC_R4},
+
+	Inst_Vsetvli: {encI(VFUNCT3_OPCFG, OPCODE_OP_V), ENC_VSETVLI},
+
+	Inst_Vle8_v:   {encVMem(0, 8, OPCODE_LOAD_FP), ENC_VMEM},
+	Inst_Vle16_v:  {encVMem(0, 16, OPCODE_LOAD_FP), ENC_VMEM},
+	Inst_Vle32_v:  {encVMem(0, 32, OPCODE_LOAD_FP), ENC_VMEM},
+	Inst_Vle64_v:  {encVMem(0, 64, OPCODE_LOAD_FP), ENC_VMEM},
+	Inst_Vse8_v:   {encVMem(0, 8, OPCODE_STORE_FP), ENC_VMEM},
+	Inst_Vse16_v:  {encVMem(0, 16, OPCODE_STORE_FP), ENC_VMEM},
+	Inst_Vse32_v:  {encVMem(0, 32, OPCODE_STORE_FP), ENC_VMEM},
+	Inst_Vse64_v:  {encVMem(0, 64, OPCODE_STORE_FP), ENC_VMEM},
+	Inst_Vlse8_v:  {encVMem(2, 8, OPCODE_LOAD_FP), ENC_VMEM_STRIDED},
+	Inst_Vlse16_v: {encVMem(2, 16, OPCODE_LOAD_FP), ENC_VMEM_STRIDED},
+	Inst_Vlse32_v: {encVMem(2, 32, OPCODE_LOAD_FP), ENC_VMEM_STRIDED},
+	Inst_Vlse64_v: {encVMem(2, 64, OPCODE_LOAD_FP), ENC_VMEM_STRIDED},
+	Inst_Vsse8_v:  {encVMem(2, 8, OPCODE_STORE_FP), ENC_VMEM_STRIDED},
+	Inst_Vsse16_v: {encVMem(2, 16, OPCODE_STORE_FP), ENC_VMEM_STRIDED},
+	Inst_Vsse32_v: {encVMem(2, 32, OPCODE_STORE_FP), ENC_VMEM_STRIDED},
+	Inst_Vsse64_v: {encVMem(2, 64, OPCODE_STORE_FP), ENC_VMEM_STRIDED},
+
+	Inst_Vadd_vv:  {encV(0x00, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vadd_vx:  {encV(0x00, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vadd_vi:  {encV(0x00, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vsub_vv:  {encV(0x02, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vsub_vx:  {encV(0x02, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vrsub_vx: {encV(0x03, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vrsub_vi: {encV(0x03, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vmul_vv:  {encV(0x25, VFUNCT3_OPMVV), ENC_V},
+	Inst_Vmul_vx:  {encV(0x25, VFUNCT3_OPMVX), ENC_V},
+	Inst_Vand_vv:  {encV(0x09, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vand_vx:  {encV(0x09, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vand_vi:  {encV(0x09, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vor_vv:   {encV(0x0a, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vor_vx:   {encV(0x0a, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vor_vi:   {encV(0x0a, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vxor_vv:  {encV(0x0b, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vxor_vx:  {encV(0x0b, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vxor_vi:  {encV(0x0b, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vsll_vv:  {encV(0x25, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vsll_vx:  {encV(0x25, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vsll_vi:  {encV(0x25, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vsrl_vv:  {encV(0x28, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vsrl_vx:  {encV(0x28, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vsrl_vi:  {encV(0x28, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vsra_vv:  {encV(0x29, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vsra_vx:  {encV(0x29, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vsra_vi:  {encV(0x29, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vmin_vv:  {encV(0x05, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vmin_vx:  {encV(0x05, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vminu_vv: {encV(0x04, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vminu_vx: {encV(0x04, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vmax_vv:  {encV(0x07, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vmax_vx:  {encV(0x07, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vmaxu_vv: {encV(0x06, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vmaxu_vx: {encV(0x06, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vmacc_vv: {encV(0x2d, VFUNCT3_OPMVV), ENC_V_MACC},
+	Inst_Vmacc_vx: {encV(0x2d, VFUNCT3_OPMVX), ENC_V_MACC},
+
+	Inst_Vmseq_vv:  {encV(0x18, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vmseq_vx:  {encV(0x18, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vmseq_vi:  {encV(0x18, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vmsne_vv:  {encV(0x19, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vmsne_vx:  {encV(0x19, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vmsne_vi:  {encV(0x19, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vmslt_vv:  {encV(0x1b, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vmslt_vx:  {encV(0x1b, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vmsltu_vv: {encV(0x1a, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vmsltu_vx: {encV(0x1a, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vmsle_vv:  {encV(0x1d, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vmsle_vx:  {encV(0x1d, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vmsle_vi:  {encV(0x1d, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vmsleu_vv: {encV(0x1c, VFUNCT3_OPIVV), ENC_V},
+	Inst_Vmsleu_vx: {encV(0x1c, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vmsleu_vi: {encV(0x1c, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vmsgt_vx:  {encV(0x1f, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vmsgt_vi:  {encV(0x1f, VFUNCT3_OPIVI), ENC_V},
+	Inst_Vmsgtu_vx: {encV(0x1e, VFUNCT3_OPIVX), ENC_V},
+	Inst_Vmsgtu_vi: {encV(0x1e, VFUNCT3_OPIVI), ENC_V},
+
+	Inst_Vredsum_vs:  {encV(0x00, VFUNCT3_OPMVV), ENC_V},
+	Inst_Vredand_vs:  {encV(0x01, VFUNCT3_OPMVV), ENC_V},
+	Inst_Vredor_vs:   {encV(0x02, VFUNCT3_OPMVV), ENC_V},
+	Inst_Vredxor_vs:  {encV(0x03, VFUNCT3_OPMVV), ENC_V},
+	Inst_Vredminu_vs: {encV(0x04, VFUNCT3_OPMVV), ENC_V},
+	Inst_Vredmin_vs:  {encV(0x05, VFUNCT3_OPMVV), ENC_V},
+	Inst_Vredmaxu_vs: {encV(0x06, VFUNCT3_OPMVV), ENC_V},
+	Inst_Vredmax_vs:  {encV(0x07, VFUNCT3_OPMVV), ENC_V},
+
+	Inst_Vmv_v_v: {encV(0x17, VFUNCT3_OPIVV), ENC_V_SCALAR},
+	Inst_Vmv_v_x: {encV(0x17, VFUNCT3_OPIVX), ENC_V_SCALAR},
+	Inst_Vmv_v_i: {encV(0x17, VFUNCT3_OPIVI), ENC_V_SCALAR},
+	Inst_Vmv_x_s: {encV(0x10, VFUNCT3_OPMVV), ENC_V_TO_SCALAR},
+	Inst_Vmv_s_x: {encV(0x10, VFUNCT3_OPMVX), ENC_V_SCALAR},
+	Inst_Vid_v:   {0b10001<<15 | encV(0x14, VFUNCT3_OPMVV), ENC_V_DEST},
+}
+
+// Encodings that are different in RV64
+var encodingTable64 = map[Inst_Op]inst_encoding{
+	Inst_Zext_h: {encUnary(0x04, 0, 4, OPCODE_OP_32), ENC_R_UNARY},
+	Inst_Rev8:   {encUnary(0x35, 0x18, 5, OPCODE_OP_IMM), ENC_R_UNARY},
+}
+
+// Returns the encoding of the instruction for the given XLEN.
+func lookupEncoding(op Inst_Op, xlen int) (inst_encoding, bool) {
+	if xlen == XLEN_64 {
+		if enc, ok := encodingTable64[op]; ok {
+			return enc, true
+		}
+	}
+	enc, ok := encodingTable[op]
+	return enc, ok
+}
+
+// Returns the rd, rs1 and rs2 fields.
+func regFields(rd, rs1, rs2 int32) uint32 {
+	return uint32(rd)<<7 | uint32(rs1)<<15 | uint32(rs2)<<20
+}
+
+func immI(imm int32) uint32 {
+	return uint32(imm) << 20
+}
+
+func immS(imm int32) uint32 {
+	u := uint32(imm)
+	return (u>>5&0x7f)<<25 | (u&0x1f)<<7
+}
+
+func immB(imm int32) uint32 {
+	u := uint32(imm)
+	return (u>>12&1)<<31 | (u>>5&0x3f)<<25 | (u>>1&0xf)<<8 | (u>>11&1)<<7
+}
+
+func immJ(imm int32) uint32 {
+	u := uint32(imm)
+	return (u>>20&1)<<31 | (u>>1&0x3ff)<<21 | (u>>11&1)<<20 | (u>>12&0xff)<<12
+}
+
+// Returns the bits hi..lo of v, shifted down.
+func field(v uint32, hi, lo uint) uint32 {
+	return v >> lo & (1<<(hi-lo+1) - 1)
+}
+
+// Returns the machine code of the instruction, compressed ones are in the low
+// 16 bits. Returns an error if an operand does not fit in its field.
+func encodeInstruction(inst Instruction, xlen int) (uint32, error) {
+	switch {
+	case inst.Op == Inst_End:
+		return 0, fmt.Errorf("'end' has no encoding")
+	case inst.Compressed:
+		return encodeCompressed(inst, xlen)
+	case inst.isCustom():
+		return encodeCustom(inst)
+	case inst.Op == Inst_Subi:
+		inst.Op, inst.Rs2 = Inst_Addi, -inst.Rs2
+	}
+
+	enc, ok := lookupEncoding(inst.Op, xlen)
+	if !ok {
+		return 0, fmt.Errorf("'%s' has no encoding", opcodeName(inst.Op))
+	}
+
+	code := enc.match
+	var err error
+	switch enc.layout {
+	case ENC_NONE:
+	case ENC_R:
+		code |= regFields(inst.Rd, inst.Rs1, inst.Rs2)
+	case ENC_R_UNARY:
+		code |= regFields(inst.Rd, inst.Rs1, 0)
+	case ENC_R_RM:
+		code |= regFields(inst.Rd, inst.Rs1, inst.Rs2) | uint32(inst.Rm)<<12
+	case ENC_R_UNARY_RM:
+		code |= regFields(inst.Rd, inst.Rs1, 0) | uint32(inst.Rm)<<12
+	case ENC_R4:
+		code |= regFields(inst.Rd, inst.Rs1, inst.Rs2) | uint32(inst.Rs3)<<27 | uint32(inst.Rm)<<12
+	case ENC_I:
+		err = checkCompressedImm(inst.Rs2, -2048, 2047, 1)
+		code |= regFields(inst.Rd, inst.Rs1, 0) | immI(inst.Rs2)
+	case ENC_SHIFT:
+		hi := int32(xlen - 1)
+		if code&0x7f == OPCODE_OP_IMM_32 {
+			hi = 31
+		}
+		err = checkCompressedImm(inst.Rs2, 0, hi, 1)
+		code |= regFields(inst.Rd, inst.Rs1, 0) | immI(inst.Rs2)
+	case ENC_LOAD:
+		err = checkCompressedImm(inst.Rs1, -2048, 2047, 1)
+		code |= regFields(inst.Rd, inst.Rs2, 0) | immI(inst.Rs1)
+	case ENC_STORE:
+		err = checkCompressedImm(inst.Rs1, -2048, 2047, 1)
+		code |= regFields(0, inst.Rs2, inst.Rd) | immS(inst.Rs1)
+	case ENC_B:
+		err = checkCompressedImm(inst.Rs2, -4096, 4094, 2)
+		code |= regFields(0, inst.Rd, inst.Rs1) | immB(inst.Rs2)
+	case ENC_J:
+		err = checkCompressedImm(inst.Rs1, -1<<20, 1<<20-2, 2)
+		code |= regFields(inst.Rd, 0, 0) | immJ(inst.Rs1)
+	case ENC_U:
+		// The immediate is kept shifted, see reloc.go
+		if inst.Rs1&0xfff != 0 {
+			err = fmt.Errorf("immediate '%d' is not a multiple of 4096", inst.Rs1)
+		}
+		code |= regFields(inst.Rd, 0, 0) | uint32(inst.Rs1)&^0xfff
+	case ENC_CSR:
+		err = checkCompressedImm(inst.Rs1, 0, 0xfff, 1)
+		code |= regFields(inst.Rd, inst.Rs2, 0) | immI(inst.Rs1)
+	case ENC_FCSR:
+		code |= regFields(inst.Rd, inst.Rs1, 0)
+	case ENC_AMO:
+		code |= regFields(inst.Rd, inst.Rs2, inst.Rs1)
+	case ENC_LR:
+		code |= regFields(inst.Rd, inst.Rs2, 0)
+	case ENC_FENCE:
+		code |= immI(inst.Rs2 & 0xff)
+	case ENC_SFENCE:
+		code |= regFields(0, inst.Rs1, inst.Rs2)
+	case ENC_VSETVLI:
+		code |= regFields(inst.Rd, inst.Rs1, 0) | immI(inst.Rs2&0x7ff)
+	case ENC_VMEM:
+		code |= regFields(inst.Rd, inst.Rs1, 0)
+	case ENC_VMEM_STRIDED:
+		code |= regFields(inst.Rd, inst.Rs1, inst.Rs2)
+	case ENC_V: // vs2 is in Rs1, see vecOperandTable
+		code |= regFields(inst.Rd, inst.Rs2&0x1f, inst.Rs1)
+	case ENC_V_MACC:
+		code |= regFields(inst.Rd, inst.Rs1, inst.Rs2)
+	case ENC_V_SCALAR:
+		code |= regFields(inst.Rd, inst.Rs1&0x1f, 0)
+	case ENC_V_TO_SCALAR:
+		code |= regFields(inst.Rd, 0, inst.Rs1)
+	case ENC_V_DEST:
+		code |= regFields(inst.Rd, 0, 0)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// The vm bit is set for the unmasked vector instructions
+	if inst.isVector() && inst.Op != Inst_Vsetvli && !inst.Masked {
+		code |= 1 << 25
+	}
+
+	return code, nil
+}
+
+// Encodes a custom instruction in its major opcode, see Custom_Instruction.
+func encodeCustom(inst Instruction) (uint32, error) {
+	ci := customInstruction(inst.Op)
+	code := uint32(ci.Space) | uint32(ci.Funct3)<<12 | regFields(inst.Rd, inst.Rs1, 0)
+
+	switch ci.Fmt {
+	case Fmt_I:
+		if err := checkCompressedImm(inst.Rs2, -2048, 2047, 1); err != nil {
+			return 0, err
+		}
+		code |= immI(inst.Rs2)
+	case Fmt_R4: // funct2 is in bits 26..25
+		code |= regFields(0, 0, inst.Rs2) | uint32(ci.Funct7)<<25 | uint32(inst.Rs3)<<27
+	default:
+		code |= regFields(0, 0, inst.Rs2) | uint32(ci.Funct7)<<25
+	}
+
+	return code, nil
+}
+
+// Returns the 16-bit encoding of a compressed instruction. The compressed
+// instruction is found again from the one it was expanded to, when there are
+// two of them for the same operands the smaller immediate is preferred, like
+// c.addi over c.addi16sp.
+func encodeCompressed(inst Instruction, xlen int) (uint32, error) {
+	sp := int32(abiToRegNum["sp"])
+	rd, rs1, rs2 := inst.Rd, inst.Rs1, inst.Rs2
+
+	// The 3-bit register fields hold x8-x15
+	creg := func(r int32) uint32 { return uint32(r - 8) }
+
+	var code uint32
+	var err error
+	switch inst.Op {
+	case Inst_Addi:
+		// Some operands fit in more than one form, like 'addi sp, sp, 16' in
+		// c.addi and c.addi16sp, the one written is kept
+		imm := uint32(rs2)
+		form := inst._c_op
+		switch {
+		case _Inst_C_start < form && form < _Inst_C_end:
+		case rd == rs1 && -32 <= rs2 && rs2 < 32:
+			form = Inst_C_addi
+		case rd == sp && rs1 == sp:
+			form = Inst_C_addi16sp
+		case rs1 == 0:
+			form = Inst_C_li
+		case rs1 == sp:
+			form = Inst_C_addi4spn
+		}
+
+		switch form {
+		case Inst_C_addi, Inst_C_nop:
+			code = 0b000<<13 | field(imm, 5, 5)<<12 | uint32(rd)<<7 | field(imm, 4, 0)<<2 | 0b01
+		case Inst_C_addi16sp:
+			err = checkCompressedImm(rs2, -512, 496, 16)
+			code = 0b011<<13 | field(imm, 9, 9)<<12 | uint32(sp)<<7 | field(imm, 4, 4)<<6 |
+				field(imm, 6, 6)<<5 | field(imm, 8, 7)<<3 | field(imm, 5, 5)<<2 | 0b01
+		case Inst_C_li:
+			err = checkCompressedImm(rs2, -32, 31, 1)
+			code = 0b010<<13 | field(imm, 5, 5)<<12 | uint32(rd)<<7 | field(imm, 4, 0)<<2 | 0b01
+		case Inst_C_addi4spn:
+			if err = checkCompressedRegs(rd); err == nil {
+				err = checkCompressedImm(rs2, 4, 1020, 4)
+			}
+			code = 0b000<<13 | field(imm, 5, 4)<<11 | field(imm, 9, 6)<<7 | field(imm, 2, 2)<<6 |
+				field(imm, 3, 3)<<5 | creg(rd)<<2 | 0b00
+		default:
+			err = fmt.Errorf("no compressed form of 'addi' takes these operands")
+		}
+
+	case Inst_Lui:
+		imm := uint32(rs1)
+		code = 0b011<<13 | field(imm, 17, 17)<<12 | uint32(rd)<<7 | field(imm, 16, 12)<<2 | 0b01
+
+	case Inst_Lw, Inst_Flw, Inst_Sw, Inst_Fsw:
+		funct3 := map[Inst_Op]uint32{Inst_Lw: 0b010, Inst_Flw: 0b011, Inst_Sw: 0b110, Inst_Fsw: 0b111}[inst.Op]
+		imm := uint32(rs1)
+		switch {
+		case rs2 == sp && inst.isLoad():
+			code = funct3<<13 | field(imm, 5, 5)<<12 | uint32(rd)<<7 | field(imm, 4, 2)<<4 | field(imm, 7, 6)<<2 | 0b10
+		case rs2 == sp:
+			code = funct3<<13 | field(imm, 5, 2)<<9 | field(imm, 7, 6)<<7 | uint32(rd)<<2 | 0b10
+		default:
+			err = checkCompressedRegs(rd, rs2)
+			code = funct3<<13 | field(imm, 5, 3)<<10 | creg(rs2)<<7 | field(imm, 2, 2)<<6 |
+				field(imm, 6, 6)<<5 | creg(rd)<<2 | 0b00
+		}
+
+	case Inst_Fld, Inst_Fsd, Inst_Ld, Inst_Sd: // c.ld and c.sd replace c.flw and c.fsw in RV64
+		funct3 := map[Inst_Op]uint32{Inst_Fld: 0b001, Inst_Fsd: 0b101, Inst_Ld: 0b011, Inst_Sd: 0b111}[inst.Op]
+		imm := uint32(rs1)
+		if (inst.Op == Inst_Ld || inst.Op == Inst_Sd) && xlen == XLEN_32 {
+			err = fmt.Errorf("'c.%s' is only in RV64", opcodeName(inst.Op))
+		}
+		switch {
+		case rs2 == sp && inst.isLoad():
+			code = funct3<<13 | field(imm, 5, 5)<<12 | uint32(rd)<<7 | field(imm, 4, 3)<<5 | field(imm, 8, 6)<<2 | 0b10
+		case rs2 == sp:
+			code = funct3<<13 | field(imm, 5, 3)<<10 | field(imm, 8, 6)<<7 | uint32(rd)<<2 | 0b10
+		default:
+			err = checkCompressedRegs(rd, rs2)
+			code = funct3<<13 | field(imm, 5, 3)<<10 | creg(rs2)<<7 | field(imm, 7, 6)<<5 | creg(rd)<<2 | 0b00
+		}
+
+	case Inst_Slli:
+		imm := uint32(rs2)
+		code = 0b000<<13 | field(imm, 5, 5)<<12 | uint32(rd)<<7 | field(imm, 4, 0)<<2 | 0b10
+	case Inst_Srli, Inst_Srai, Inst_Andi:
+		funct2 := map[Inst_Op]uint32{Inst_Srli: 0b00, Inst_Srai: 0b01, Inst_Andi: 0b10}[inst.Op]
+		imm := uint32(rs2)
+		err = checkCompressedRegs(rd)
+		code = 0b100<<13 | field(imm, 5, 5)<<12 | funct2<<10 | creg(rd)<<7 | field(imm, 4, 0)<<2 | 0b01
+
+	case Inst_Sub, Inst_Xor, Inst_Or, Inst_And:
+		funct2 := map[Inst_Op]uint32{Inst_Sub: 0b00, Inst_Xor: 0b01, Inst_Or: 0b10, Inst_And: 0b11}[inst.Op]
+		err = checkCompressedRegs(rd, rs2)
+		code = 0b100011<<10 | creg(rd)<<7 | funct2<<5 | creg(rs2)<<2 | 0b01
+	case Inst_Subw, Inst_Addw:
+		funct2 := map[Inst_Op]uint32{Inst_Subw: 0b00, Inst_Addw: 0b01}[inst.Op]
+		err = checkCompressedRegs(rd, rs2)
+		code = 0b100111<<10 | creg(rd)<<7 | funct2<<5 | creg(rs2)<<2 | 0b01
+	case Inst_Addiw:
+		imm := uint32(rs2)
+		code = 0b001<<13 | field(imm, 5, 5)<<12 | uint32(rd)<<7 | field(imm, 4, 0)<<2 | 0b01
+	case Inst_Add:
+		if inst._c_op == Inst_C_mv || inst._c_op != Inst_C_add && rs1 == 0 {
+			code = 0b1000<<12 | uint32(rd)<<7 | uint32(rs2)<<2 | 0b10
+		} else {
+			code = 0b1001<<12 | uint32(rd)<<7 | uint32(rs2)<<2 | 0b10
+		}
+
+	case Inst_Jal: // c.j, c.jal
+		if rd == 1 && xlen != XLEN_32 {
+			err = fmt.Errorf("'c.jal' is only in RV32")
+		}
+		off := uint32(rs1)
+		code = 0b101<<13 | field(off, 11, 11)<<12 | field(off, 4, 4)<<11 | field(off, 9, 8)<<9 |
+			field(off, 10, 10)<<8 | field(off, 6, 6)<<7 | field(off, 7, 7)<<6 | field(off, 3, 1)<<3 |
+			field(off, 5, 5)<<2 | 0b01
+		if rd == 1 {
+			code &^= 0b100 << 13
+		}
+	case Inst_Jalr: // c.jr, c.jalr
+		code = 0b1000<<12 | uint32(rd)<<12 | uint32(rs1)<<7 | 0b10
+	case Inst_Beq, Inst_Bne:
+		funct3 := map[Inst_Op]uint32{Inst_Beq: 0b110, Inst_Bne: 0b111}[inst.Op]
+		off := uint32(rs2)
+		err = checkCompressedRegs(rd)
+		code = funct3<<13 | field(off, 8, 8)<<12 | field(off, 4, 3)<<10 | creg(rd)<<7 |
+			field(off, 7, 6)<<5 | field(off, 2, 1)<<3 | field(off, 5, 5)<<2 | 0b01
+	case Inst_Ebreak:
+		code = 0x9002
+	default:
+		err = fmt.Errorf("'%s' has no compressed form", opcodeName(inst.Op))
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	return code, nil
+}
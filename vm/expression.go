@@ -0,0 +1,262 @@
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Constant expressions in operands, evaluated with 64-bit integers. The
+// operators from the lowest precedence are the comparisons '==' '!=' '<' '>'
+// '<=' '>=', which give 1 or 0, '|', '&', '<<' '>>', '+' '-', '*' '/' and the
+// unary '-' '+' '~', parentheses group. The operands are
+// decimal, hex '0x', binary '0b' and octal '0' numbers, characters like 'A'
+// or '\n', and constants defined with .equ or .set. Labels are not constants,
+// their addresses are only known once the program is parsed.
+
+// Binary operators by precedence, the lowest first. The last operator
+// matching the input is taken, so '<=' comes after '<'.
+var expressionOperators = [][]string{
+	{"==", "!=", "<", ">", "<=", ">="},
+	{"|"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+type expression_parser struct {
+	s         string
+	pos       int
+	constants map[string]int64
+}
+
+// Evaluates a constant expression, symbols are looked up in constants.
+func evalExpression(s string, constants map[string]int64) (int64, error) {
+	e := expression_parser{s: s, constants: constants}
+
+	val, err := e.parseBinary(0)
+	if err != nil {
+		return 0, err
+	}
+
+	e.skipSpace()
+	if e.pos < len(e.s) {
+		return 0, fmt.Errorf("unexpected '%s'", e.s[e.pos:])
+	}
+
+	return val, nil
+}
+
+func (e *expression_parser) skipSpace() {
+	for e.pos < len(e.s) && (e.s[e.pos] == ' ' || e.s[e.pos] == '\t') {
+		e.pos++
+	}
+}
+
+// Parses the operators of the given precedence and the higher ones.
+func (e *expression_parser) parseBinary(level int) (int64, error) {
+	if level == len(expressionOperators) {
+		return e.parseUnary()
+	}
+
+	lhs, err := e.parseBinary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		e.skipSpace()
+
+		op := ""
+		for _, candidate := range expressionOperators[level] {
+			if strings.HasPrefix(e.s[e.pos:], candidate) {
+				op = candidate
+			}
+		}
+		if op == "" {
+			return lhs, nil
+		}
+		e.pos += len(op)
+
+		rhs, err := e.parseBinary(level + 1)
+		if err != nil {
+			return 0, err
+		}
+
+		switch op {
+		case "==":
+			lhs = boolValue(lhs == rhs)
+		case "!=":
+			lhs = boolValue(lhs != rhs)
+		case "<":
+			lhs = boolValue(lhs < rhs)
+		case ">":
+			lhs = boolValue(lhs > rhs)
+		case "<=":
+			lhs = boolValue(lhs <= rhs)
+		case ">=":
+			lhs = boolValue(lhs >= rhs)
+		case "|":
+			lhs |= rhs
+		case "&":
+			lhs &= rhs
+		case "<<", ">>":
+			if rhs < 0 || rhs > 63 {
+				return 0, fmt.Errorf("shift amount '%d' must be in [0, 63]", rhs)
+			}
+			if op == "<<" {
+				lhs <<= rhs
+			} else {
+				lhs >>= rhs
+			}
+		case "+":
+			lhs += rhs
+		case "-":
+			lhs -= rhs
+		case "*":
+			lhs *= rhs
+		case "/":
+			if rhs == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			lhs /= rhs
+		}
+	}
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (e *expression_parser) parseUnary() (int64, error) {
+	e.skipSpace()
+	if e.pos >= len(e.s) {
+		return 0, fmt.Errorf("expected an operand")
+	}
+
+	switch e.s[e.pos] {
+	case '-', '+', '~':
+		op := e.s[e.pos]
+		e.pos++
+
+		val, err := e.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+
+		switch op {
+		case '-':
+			return -val, nil
+		case '~':
+			return ^val, nil
+		}
+		return val, nil
+	}
+
+	return e.parsePrimary()
+}
+
+func (e *expression_parser) parsePrimary() (int64, error) {
+	start := e.pos
+	ch := e.s[e.pos]
+
+	switch {
+	case ch == '(':
+		e.pos++
+		val, err := e.parseBinary(0)
+		if err != nil {
+			return 0, err
+		}
+
+		e.skipSpace()
+		if e.pos >= len(e.s) || e.s[e.pos] != ')' {
+			return 0, fmt.Errorf("missing ')'")
+		}
+		e.pos++
+		return val, nil
+
+	case ch == '\'':
+		e.pos++
+		for e.pos < len(e.s) && e.s[e.pos] != '\'' {
+			if e.s[e.pos] == '\\' {
+				e.pos++
+			}
+			e.pos++
+		}
+		if e.pos >= len(e.s) {
+			return 0, fmt.Errorf("unterminated character '%s'", e.s[start:])
+		}
+		e.pos++
+
+		val, ok := unescapeString(e.s[start+1 : e.pos-1])
+		if !ok || len(val) != 1 {
+			return 0, fmt.Errorf("invalid character '%s'", e.s[start:e.pos])
+		}
+		return int64(val[0]), nil
+
+	case isSymbol(ch):
+		for e.pos < len(e.s) && isSymbol(e.s[e.pos]) {
+			e.pos++
+		}
+		word := e.s[start:e.pos]
+
+		if isSymbolStart(ch) {
+			val, ok := e.constants[word]
+			if !ok {
+				return 0, fmt.Errorf("undefined constant '%s'", word)
+			}
+			return val, nil
+		}
+
+		// Base 0 takes the '0x', '0b' and '0' prefixes
+		val, err := strconv.ParseUint(word, 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number '%s'", word)
+		}
+		return int64(val), nil
+	}
+
+	return 0, fmt.Errorf("unexpected '%c'", ch)
+}
+
+// Evaluates a number, an expression or a constant name.
+func (p *Parser) evaluate(tok Token) (int64, error) {
+	if tok.Type != Tok_Number && tok.Type != Tok_Symbol {
+		return 0, fmt.Errorf("%v:%v Expected a number, got '%v'", tok.line_num, tok.start+1, tok.Value)
+	}
+
+	val, err := evalExpression(tok.Value, p.constants)
+	if err != nil {
+		return 0, fmt.Errorf("%v:%v Invalid expression '%v': %v", tok.line_num, tok.start+1, tok.Value, err)
+	}
+
+	return val, nil
+}
+
+// '.equ name, value' and '.set name, value' define a constant, or redefine it.
+func (p *Parser) parseConstant(tok Token, args []Token) error {
+	if len(args) != 2 || args[0].Type != Tok_Symbol {
+		return fmt.Errorf("%v:%v Invalid operands for '%v', expected 'name, value'", tok.line_num, tok.start+1, tok.Value)
+	}
+
+	name := args[0].Value
+	_, isReg := abiToRegNum[name]
+	_, isFpReg := fpAbiToRegNum[name]
+	_, isCode := p.symbol_table[name]
+	_, isData := p.data_symbols[name]
+	if isReg || isFpReg || isCode || isData {
+		return fmt.Errorf("%v:%v '%v' can't be a constant, it is a register or a label", args[0].line_num, args[0].start+1, name)
+	}
+
+	val, err := p.evaluate(args[1])
+	if err != nil {
+		return err
+	}
+
+	p.constants[name] = val
+	return nil
+}
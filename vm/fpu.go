@@ -0,0 +1,740 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Rounding modes, used both in the 'rm' field of instructions and in fcsr.frm
+const (
+	FRM_RNE uint8 = iota // Round to nearest, ties to even
+	FRM_RTZ              // Round towards zero
+	FRM_RDN              // Round down, towards -inf
+	FRM_RUP              // Round up, towards +inf
+	FRM_RMM              // Round to nearest, ties to max magnitude
+
+	FRM_DYN uint8 = 7 // Use the rounding mode in fcsr.frm
+)
+
+// Accrued exception flags in fcsr.fflags
+const (
+	FFLAG_NX uint32 = 1 << iota // Inexact
+	FFLAG_UF                    // Underflow
+	FFLAG_OF                    // Overflow
+	FFLAG_DZ                    // Divide by zero
+	FFLAG_NV                    // Invalid operation
+)
+
+const (
+	FCSR_FFLAGS_MASK = 0x1f
+	FCSR_FRM_SHIFT   = 5
+	FCSR_FRM_MASK    = 0x7 << FCSR_FRM_SHIFT
+	FCSR_MASK        = FCSR_FFLAGS_MASK | FCSR_FRM_MASK
+)
+
+// Precision used for intermediate results. This is enough to hold the exact
+// result of an addition or a fused multiply-add of any double precision
+// numbers, no matter how far apart their exponents are.
+const FP_EXACT_PREC = 4400
+
+// Single precision values are NaN-boxed in the 64-bit FP registers, the upper
+// 32 bits are all ones. A single precision operand that is not properly boxed
+// is read as the canonical NaN.
+const FP_NAN_BOX uint64 = 0xffffffff_00000000
+
+// Execute cycles of the FP instructions, grouped by the kind of unit they
+// would use in hardware.
+type Fp_Latency struct {
+	Add  uint8 // fadd, fsub, fmin, fmax
+	Mul  uint8
+	Fma  uint8 // Fused multiply-add
+	Div  uint8
+	Sqrt uint8
+	Cvt  uint8 // Conversions between integer and FP, and between precisions
+}
+
+func DefaultFpLatency() Fp_Latency {
+	return Fp_Latency{
+		Add:  2,
+		Mul:  3,
+		Fma:  4,
+		Div:  10,
+		Sqrt: 10,
+		Cvt:  2,
+	}
+}
+
+// Returns the number of execute cycles for each FP instruction that takes more than one.
+func (l Fp_Latency) cycleTable() map[Inst_Op]int {
+	n := func(cycles uint8) int {
+		return max(1, int(cycles))
+	}
+
+	return map[Inst_Op]int{
+		Inst_Fadd_s:    n(l.Add),
+		Inst_Fsub_s:    n(l.Add),
+		Inst_Fmin_s:    n(l.Add),
+		Inst_Fmax_s:    n(l.Add),
+		Inst_Fmul_s:    n(l.Mul),
+		Inst_Fmadd_s:   n(l.Fma),
+		Inst_Fmsub_s:   n(l.Fma),
+		Inst_Fnmsub_s:  n(l.Fma),
+		Inst_Fnmadd_s:  n(l.Fma),
+		Inst_Fdiv_s:    n(l.Div),
+		Inst_Fsqrt_s:   n(l.Sqrt),
+		Inst_Fcvt_w_s:  n(l.Cvt),
+		Inst_Fcvt_wu_s: n(l.Cvt),
+		Inst_Fcvt_s_w:  n(l.Cvt),
+		Inst_Fcvt_s_wu: n(l.Cvt),
+		Inst_Fadd_d:    n(l.Add),
+		Inst_Fsub_d:    n(l.Add),
+		Inst_Fmin_d:    n(l.Add),
+		Inst_Fmax_d:    n(l.Add),
+		Inst_Fmul_d:    n(l.Mul),
+		Inst_Fmadd_d:   n(l.Fma),
+		Inst_Fmsub_d:   n(l.Fma),
+		Inst_Fnmsub_d:  n(l.Fma),
+		Inst_Fnmadd_d:  n(l.Fma),
+		Inst_Fdiv_d:    n(l.Div),
+		Inst_Fsqrt_d:   n(l.Sqrt),
+		Inst_Fcvt_w_d:  n(l.Cvt),
+		Inst_Fcvt_wu_d: n(l.Cvt),
+		Inst_Fcvt_d_w:  n(l.Cvt),
+		Inst_Fcvt_d_wu: n(l.Cvt),
+		Inst_Fcvt_s_d:  n(l.Cvt),
+		Inst_Fcvt_d_s:  n(l.Cvt),
+	}
+}
+
+// An IEEE-754 binary format. Values are passed around as their raw bits.
+type fp_format struct {
+	width int // Total number of bits
+	prec  int // Significand bits, including the hidden bit
+	emin  int // Exponent of the smallest normal number
+	emax  int // Exponent of the largest finite number
+}
+
+var fpSingle = fp_format{width: 32, prec: 24, emin: -126, emax: 127}
+var fpDouble = fp_format{width: 64, prec: 53, emin: -1022, emax: 1023}
+
+// Returns the format of the values held by an operand of the given register file.
+func fpFormatOf(file Reg_File) fp_format {
+	if file == REG_FP_D {
+		return fpDouble
+	}
+	return fpSingle
+}
+
+// Returns the single precision value held in an FP register.
+func unboxSingle(b uint64) uint64 {
+	if b&FP_NAN_BOX != FP_NAN_BOX {
+		return fpSingle.canonicalNaN()
+	}
+	return b &^ FP_NAN_BOX
+}
+
+func (f fp_format) signBit() uint64 {
+	return 1 << (f.width - 1)
+}
+
+func (f fp_format) quietBit() uint64 {
+	return 1 << (f.prec - 2)
+}
+
+func (f fp_format) mantMask() uint64 {
+	return 1<<(f.prec-1) - 1
+}
+
+func (f fp_format) expMask() uint64 {
+	return (1<<(f.width-f.prec) - 1) << (f.prec - 1)
+}
+
+func (f fp_format) canonicalNaN() uint64 {
+	return f.expMask() | f.quietBit()
+}
+
+func (f fp_format) isNaN(b uint64) bool {
+	return b&f.expMask() == f.expMask() && b&f.mantMask() != 0
+}
+
+func (f fp_format) isSignalingNaN(b uint64) bool {
+	return f.isNaN(b) && b&f.quietBit() == 0
+}
+
+func (f fp_format) maxFinite() float64 {
+	return math.Ldexp(2-math.Ldexp(1, 1-f.prec), f.emax)
+}
+
+func (f fp_format) minNormal() float64 {
+	return math.Ldexp(1, f.emin)
+}
+
+// Every value of the supported formats is exactly representable as a float64.
+func (f fp_format) toFloat64(b uint64) float64 {
+	if f.width == 32 {
+		return float64(math.Float32frombits(uint32(b)))
+	}
+	return math.Float64frombits(b)
+}
+
+// The value must already be representable in the format.
+func (f fp_format) fromFloat64(v float64) uint64 {
+	if f.width == 32 {
+		return uint64(math.Float32bits(float32(v)))
+	}
+	return math.Float64bits(v)
+}
+
+func (f fp_format) zero(negative bool) uint64 {
+	if negative {
+		return f.signBit()
+	}
+	return 0
+}
+
+func (f fp_format) inf(negative bool) uint64 {
+	return f.zero(negative) | f.expMask()
+}
+
+// Returns the canonical NaN with the invalid flag set if any of the operands is
+// a signaling NaN. Operations that have a NaN operand always produce this.
+func (f fp_format) nanResult(ops ...uint64) (uint64, uint32) {
+	var flags uint32
+	for _, b := range ops {
+		if f.isSignalingNaN(b) {
+			flags |= FFLAG_NV
+		}
+	}
+	return f.canonicalNaN(), flags
+}
+
+func exactFloat(v float64) *big.Float {
+	return new(big.Float).SetPrec(FP_EXACT_PREC).SetFloat64(v)
+}
+
+// Returns x * 2^exp
+func scaleFloat(x *big.Float, exp int) *big.Float {
+	return new(big.Float).SetPrec(FP_EXACT_PREC).SetMantExp(x, exp)
+}
+
+// Rounds a finite value to an integer with the given rounding mode.
+// Also returns whether the value was inexact.
+func roundToInteger(x *big.Float, rm uint8) (*big.Int, bool) {
+	n, acc := x.Int(nil) // Truncates towards zero
+	if acc == big.Exact {
+		return n, false
+	}
+
+	frac := new(big.Float).SetPrec(FP_EXACT_PREC).Sub(x, new(big.Float).SetInt(n))
+	half := frac.Abs(frac).Cmp(big.NewFloat(0.5))
+	negative := x.Sign() < 0
+
+	var away bool // Round away from zero
+	switch rm {
+	case FRM_RNE:
+		away = half > 0 || (half == 0 && n.Bit(0) == 1)
+	case FRM_RMM:
+		away = half >= 0
+	case FRM_RTZ:
+		away = false
+	case FRM_RDN:
+		away = negative
+	case FRM_RUP:
+		away = !negative
+	}
+
+	if away {
+		if negative {
+			n.Sub(n, big.NewInt(1))
+		} else {
+			n.Add(n, big.NewInt(1))
+		}
+	}
+
+	return n, true
+}
+
+// Marks a truncated result as inexact by adding a bit below its last
+// significant bit, in the given direction. The value stays within the same
+// rounding interval but can no longer be mistaken for an exact or a halfway value.
+func addStickyBit(x *big.Float, dir int) *big.Float {
+	bit := new(big.Float).SetMantExp(big.NewFloat(float64(dir)), x.MantExp(nil)-int(x.Prec())-4)
+	return new(big.Float).SetPrec(x.Prec()+8).Add(x, bit)
+}
+
+// Rounds an exact value into the format with the given rounding mode, and
+// returns the result with the exception flags raised by the rounding.
+func (f fp_format) round(x *big.Float, rm uint8) (uint64, uint32) {
+	if x.Sign() == 0 {
+		return f.zero(x.Signbit()), 0
+	}
+
+	var flags uint32
+	negative := x.Signbit()
+	exp := x.MantExp(nil) // x = mant * 2^exp, 0.5 <= |mant| < 1
+
+	// Tininess is detected after rounding, as if the exponent range was unbounded.
+	tiny := false
+	if exp-1 < f.emin {
+		n, _ := roundToInteger(scaleFloat(x, f.prec-exp), rm)
+		unbounded, _ := scaleFloat(new(big.Float).SetInt(n), exp-f.prec).Float64()
+		tiny = math.Abs(unbounded) < f.minNormal()
+	}
+
+	// Exponent of the last significant bit, subnormals have less bits.
+	lsb := max(exp-f.prec, f.emin-f.prec+1)
+	n, inexact := roundToInteger(scaleFloat(x, -lsb), rm)
+	v, _ := scaleFloat(new(big.Float).SetInt(n), lsb).Float64()
+	if negative {
+		v = math.Copysign(v, -1) // Keeps the sign if rounded to zero
+	}
+
+	if inexact {
+		flags |= FFLAG_NX
+		if tiny {
+			flags |= FFLAG_UF
+		}
+	}
+
+	if math.Abs(v) > f.maxFinite() {
+		flags |= FFLAG_OF | FFLAG_NX
+
+		// Rounding modes that never round away from zero in this direction
+		// saturate to the largest finite number.
+		saturate := rm == FRM_RTZ || (rm == FRM_RDN && !negative) || (rm == FRM_RUP && negative)
+		if saturate {
+			return f.fromFloat64(math.Copysign(f.maxFinite(), v)), flags
+		}
+		return f.inf(negative), flags
+	}
+
+	return f.fromFloat64(v), flags
+}
+
+// Sign of an exact zero sum. Only adding two zeros of the same sign keeps the
+// sign, otherwise the result is +0 except when rounding down.
+func zeroSumSign(x, y float64, rm uint8) bool {
+	if x == 0 && y == 0 && math.Signbit(x) == math.Signbit(y) {
+		return math.Signbit(x)
+	}
+	return rm == FRM_RDN
+}
+
+func (f fp_format) add(a, b uint64, rm uint8) (uint64, uint32) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return f.nanResult(a, b)
+	}
+
+	x, y := f.toFloat64(a), f.toFloat64(b)
+	if math.IsInf(x, 0) || math.IsInf(y, 0) {
+		if math.IsInf(x, 0) && math.IsInf(y, 0) && x != y {
+			return f.canonicalNaN(), FFLAG_NV
+		}
+		return f.fromFloat64(x + y), 0
+	}
+
+	sum := new(big.Float).SetPrec(FP_EXACT_PREC).Add(exactFloat(x), exactFloat(y))
+	if sum.Sign() == 0 {
+		return f.zero(zeroSumSign(x, y, rm)), 0
+	}
+
+	return f.round(sum, rm)
+}
+
+func (f fp_format) sub(a, b uint64, rm uint8) (uint64, uint32) {
+	return f.add(a, b^f.signBit(), rm)
+}
+
+func (f fp_format) mul(a, b uint64, rm uint8) (uint64, uint32) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return f.nanResult(a, b)
+	}
+
+	x, y := f.toFloat64(a), f.toFloat64(b)
+	negative := math.Signbit(x) != math.Signbit(y)
+	if (math.IsInf(x, 0) && y == 0) || (x == 0 && math.IsInf(y, 0)) {
+		return f.canonicalNaN(), FFLAG_NV
+	}
+
+	if math.IsInf(x, 0) || math.IsInf(y, 0) {
+		return f.inf(negative), 0
+	}
+
+	if x == 0 || y == 0 {
+		return f.zero(negative), 0
+	}
+
+	prod := new(big.Float).SetPrec(FP_EXACT_PREC).Mul(exactFloat(x), exactFloat(y))
+	return f.round(prod, rm)
+}
+
+func (f fp_format) div(a, b uint64, rm uint8) (uint64, uint32) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return f.nanResult(a, b)
+	}
+
+	x, y := f.toFloat64(a), f.toFloat64(b)
+	negative := math.Signbit(x) != math.Signbit(y)
+	switch {
+	case (math.IsInf(x, 0) && math.IsInf(y, 0)) || (x == 0 && y == 0):
+		return f.canonicalNaN(), FFLAG_NV
+	case math.IsInf(x, 0):
+		return f.inf(negative), 0
+	case math.IsInf(y, 0):
+		return f.zero(negative), 0
+	case y == 0:
+		return f.inf(negative), FFLAG_DZ
+	case x == 0:
+		return f.zero(negative), 0
+	}
+
+	quo := new(big.Float).SetPrec(FP_EXACT_PREC).SetMode(big.ToZero).Quo(exactFloat(x), exactFloat(y))
+	if quo.Acc() != big.Exact {
+		quo = addStickyBit(quo, quo.Sign())
+	}
+
+	return f.round(quo, rm)
+}
+
+func (f fp_format) sqrt(a uint64, rm uint8) (uint64, uint32) {
+	if f.isNaN(a) {
+		return f.nanResult(a)
+	}
+
+	x := f.toFloat64(a)
+	switch {
+	case x == 0: // sqrt(-0) = -0
+		return a, 0
+	case x < 0:
+		return f.canonicalNaN(), FFLAG_NV
+	case math.IsInf(x, 1):
+		return a, 0
+	}
+
+	exact := exactFloat(x)
+	root := new(big.Float).SetPrec(FP_EXACT_PREC).SetMode(big.ToZero).Sqrt(exact)
+
+	// Sqrt does not report its accuracy, so compare the square of the result instead.
+	square := new(big.Float).SetPrec(2*FP_EXACT_PREC).Mul(root, root)
+	switch square.Cmp(exact) {
+	case -1:
+		root = addStickyBit(root, 1)
+	case 1:
+		root = addStickyBit(root, -1)
+	}
+
+	return f.round(root, rm)
+}
+
+// Computes (a * b) + c with a single rounding. The product and the addend can be negated.
+func (f fp_format) fma(a, b, c uint64, negProduct, negAddend bool, rm uint8) (uint64, uint32) {
+	x, y, z := f.toFloat64(a), f.toFloat64(b), f.toFloat64(c)
+	invalidProduct := (math.IsInf(x, 0) && y == 0) || (x == 0 && math.IsInf(y, 0))
+
+	if f.isNaN(a) || f.isNaN(b) || f.isNaN(c) {
+		nan, flags := f.nanResult(a, b, c)
+		if invalidProduct {
+			flags |= FFLAG_NV
+		}
+		return nan, flags
+	}
+
+	if invalidProduct {
+		return f.canonicalNaN(), FFLAG_NV
+	}
+
+	if negProduct {
+		x = -x
+	}
+	if negAddend {
+		z = -z
+	}
+
+	if math.IsInf(x, 0) || math.IsInf(y, 0) {
+		p := x * y
+		if math.IsInf(z, 0) && z != p {
+			return f.canonicalNaN(), FFLAG_NV
+		}
+		return f.fromFloat64(p), 0
+	}
+
+	if math.IsInf(z, 0) {
+		return f.fromFloat64(z), 0
+	}
+
+	prod := new(big.Float).SetPrec(FP_EXACT_PREC).Mul(exactFloat(x), exactFloat(y))
+	sum := new(big.Float).SetPrec(FP_EXACT_PREC).Add(prod, exactFloat(z))
+	if sum.Sign() == 0 {
+		// Only a zero product can keep its sign, otherwise this is an exact cancellation.
+		return f.zero(zeroSumSign(x*y, z, rm)), 0
+	}
+
+	return f.round(sum, rm)
+}
+
+// fmin and fmax return the non-NaN operand if only one of them is NaN.
+// -0 is considered to be less than +0.
+func (f fp_format) minMax(a, b uint64, isMax bool) (uint64, uint32) {
+	_, flags := f.nanResult(a, b)
+	switch {
+	case f.isNaN(a) && f.isNaN(b):
+		return f.canonicalNaN(), flags
+	case f.isNaN(a):
+		return b, flags
+	case f.isNaN(b):
+		return a, flags
+	}
+
+	x, y := f.toFloat64(a), f.toFloat64(b)
+	if x == y {
+		// Only differs for zeros of different signs
+		if math.Signbit(x) != isMax {
+			return a, flags
+		}
+		return b, flags
+	}
+
+	if (x < y) != isMax {
+		return a, flags
+	}
+	return b, flags
+}
+
+// feq is a quiet comparison, it only signals invalid for signaling NaNs.
+// flt and fle signal invalid for any NaN.
+func (f fp_format) compare(op Inst_Op, a, b uint64) (bool, uint32) {
+	if f.isNaN(a) || f.isNaN(b) {
+		if op == Inst_Feq_s || op == Inst_Feq_d {
+			_, flags := f.nanResult(a, b)
+			return false, flags
+		}
+		return false, FFLAG_NV
+	}
+
+	x, y := f.toFloat64(a), f.toFloat64(b)
+	switch op {
+	case Inst_Feq_s, Inst_Feq_d:
+		return x == y, 0
+	case Inst_Flt_s, Inst_Flt_d:
+		return x < y, 0
+	default:
+		return x <= y, 0
+	}
+}
+
+// Returns the 10-bit mask used by fclass.
+func (f fp_format) classify(a uint64) uint32 {
+	negative := a&f.signBit() != 0
+	exp := a & f.expMask()
+	mant := a & f.mantMask()
+
+	var bit uint
+	switch {
+	case f.isNaN(a):
+		if f.isSignalingNaN(a) {
+			return 1 << 8
+		}
+		return 1 << 9
+	case exp == f.expMask():
+		bit = 7 // Infinity
+	case exp == 0 && mant == 0:
+		bit = 4 // Zero
+	case exp == 0:
+		bit = 5 // Subnormal
+	default:
+		bit = 6 // Normal
+	}
+
+	// Negative classes mirror the positive ones
+	if negative {
+		bit = 7 - bit
+	}
+	return 1 << bit
+}
+
+// Result of fsgnj, fsgnjn and fsgnjx: the bits of 'a' with a sign taken from 'b'.
+func (f fp_format) signInject(op Inst_Op, a, b uint64) uint64 {
+	sign := b & f.signBit()
+	switch op {
+	case Inst_Fsgnjn_s, Inst_Fsgnjn_d:
+		sign ^= f.signBit()
+	case Inst_Fsgnjx_s, Inst_Fsgnjx_d:
+		sign ^= a & f.signBit()
+	}
+	return a&^f.signBit() | sign
+}
+
+// Converts to an integer in [lo, hi]. Out of range values and NaNs saturate
+// and raise the invalid flag.
+func (f fp_format) toInt(a uint64, rm uint8, lo, hi int64) (int64, uint32) {
+	if f.isNaN(a) {
+		return hi, FFLAG_NV
+	}
+
+	x := f.toFloat64(a)
+	if math.IsInf(x, 0) {
+		if x < 0 {
+			return lo, FFLAG_NV
+		}
+		return hi, FFLAG_NV
+	}
+
+	n, inexact := roundToInteger(exactFloat(x), rm)
+	if n.Cmp(big.NewInt(lo)) < 0 {
+		return lo, FFLAG_NV
+	}
+	if n.Cmp(big.NewInt(hi)) > 0 {
+		return hi, FFLAG_NV
+	}
+
+	if inexact {
+		return n.Int64(), FFLAG_NX
+	}
+	return n.Int64(), 0
+}
+
+func (f fp_format) fromInt(n int64, rm uint8) (uint64, uint32) {
+	return f.round(new(big.Float).SetInt64(n), rm)
+}
+
+// Converts a value of another format into this one.
+func (f fp_format) convert(from fp_format, a uint64, rm uint8) (uint64, uint32) {
+	if from.isNaN(a) {
+		return from.nanResult(a)
+	}
+
+	x := from.toFloat64(a)
+	if math.IsInf(x, 0) || x == 0 {
+		return f.fromFloat64(x), 0
+	}
+
+	return f.round(exactFloat(x), rm)
+}
+
+// Returns the rounding mode to use for the instruction.
+func (v *Vm) resolveRoundingMode(rm uint8) (uint8, error) {
+	if rm == FRM_DYN {
+		rm = uint8((v.Fcsr & FCSR_FRM_MASK) >> FCSR_FRM_SHIFT)
+	}
+
+	if rm > FRM_RMM {
+		return 0, fmt.Errorf("Illegal instruction: invalid rounding mode '%d'", rm)
+	}
+
+	return rm, nil
+}
+
+// Executes a floating point instruction, the result is written into inst._result.
+// Exception flags are accumulated into fcsr here, instructions reach this stage in program order.
+func (v *Vm) executeFp(inst *Instruction) {
+	rm := FRM_RNE
+	if usesRoundingMode(inst.Op) {
+		var err error
+		rm, err = v.resolveRoundingMode(inst.Rm)
+		if err != nil {
+			inst.raise(newException(CAUSE_ILLEGAL_INSTRUCTION, 0, "%v", err))
+			return
+		}
+	}
+
+	ops := fpOperandTable[inst.Op]
+	s1 := fpSourceValue(inst._s1, ops.rs1)
+	s2 := fpSourceValue(inst._s2, ops.rs2)
+	s3 := fpSourceValue(inst._s3, ops.rs3)
+
+	// Format of the operation, conversions from integer use the format of the result.
+	f := fpFormatOf(ops.rs1)
+	if !ops.rs1.isFp() {
+		f = fpFormatOf(ops.rd)
+	}
+
+	var result uint64
+	var flags uint32
+	switch inst.Op {
+	case Inst_Fadd_s, Inst_Fadd_d:
+		result, flags = f.add(s1, s2, rm)
+	case Inst_Fsub_s, Inst_Fsub_d:
+		result, flags = f.sub(s1, s2, rm)
+	case Inst_Fmul_s, Inst_Fmul_d:
+		result, flags = f.mul(s1, s2, rm)
+	case Inst_Fdiv_s, Inst_Fdiv_d:
+		result, flags = f.div(s1, s2, rm)
+	case Inst_Fsqrt_s, Inst_Fsqrt_d:
+		result, flags = f.sqrt(s1, rm)
+	case Inst_Fmin_s, Inst_Fmin_d:
+		result, flags = f.minMax(s1, s2, false)
+	case Inst_Fmax_s, Inst_Fmax_d:
+		result, flags = f.minMax(s1, s2, true)
+	case Inst_Fmadd_s, Inst_Fmadd_d:
+		result, flags = f.fma(s1, s2, s3, false, false, rm)
+	case Inst_Fmsub_s, Inst_Fmsub_d:
+		result, flags = f.fma(s1, s2, s3, false, true, rm)
+	case Inst_Fnmsub_s, Inst_Fnmsub_d:
+		result, flags = f.fma(s1, s2, s3, true, false, rm)
+	case Inst_Fnmadd_s, Inst_Fnmadd_d:
+		result, flags = f.fma(s1, s2, s3, true, true, rm)
+	case Inst_Fsgnj_s, Inst_Fsgnjn_s, Inst_Fsgnjx_s,
+		Inst_Fsgnj_d, Inst_Fsgnjn_d, Inst_Fsgnjx_d:
+		result = f.signInject(inst.Op, s1, s2)
+	case Inst_Feq_s, Inst_Flt_s, Inst_Fle_s,
+		Inst_Feq_d, Inst_Flt_d, Inst_Fle_d:
+		var res bool
+		res, flags = f.compare(inst.Op, s1, s2)
+		result = uint64(boolToInt64(res))
+	case Inst_Fclass_s, Inst_Fclass_d:
+		result = uint64(f.classify(s1))
+	case Inst_Fcvt_w_s, Inst_Fcvt_w_d:
+		var n int64
+		n, flags = f.toInt(s1, rm, math.MinInt32, math.MaxInt32)
+		result = uint64(n)
+	case Inst_Fcvt_wu_s, Inst_Fcvt_wu_d:
+		var n int64
+		n, flags = f.toInt(s1, rm, 0, math.MaxUint32)
+		result = uint64(n)
+	case Inst_Fcvt_s_w, Inst_Fcvt_d_w:
+		result, flags = f.fromInt(int64(int32(inst._s1)), rm)
+	case Inst_Fcvt_s_wu, Inst_Fcvt_d_wu:
+		result, flags = f.fromInt(int64(uint32(inst._s1)), rm)
+	case Inst_Fcvt_s_d, Inst_Fcvt_d_s:
+		result, flags = fpFormatOf(ops.rd).convert(f, s1, rm)
+	case Inst_Fmv_x_w, Inst_Fmv_w_x:
+		// Moves copy the raw bits, without checking the NaN-boxing
+		result = uint64(uint32(inst._s1))
+
+	// fcsr accesses return the old value of the field
+	case Inst_Frcsr:
+		result = uint64(v.Fcsr)
+	case Inst_Fscsr:
+		result = uint64(v.Fcsr)
+		v.Fcsr = uint32(inst._s1) & FCSR_MASK
+	case Inst_Frrm:
+		result = uint64(v.Fcsr&FCSR_FRM_MASK) >> FCSR_FRM_SHIFT
+	case Inst_Fsrm:
+		result = uint64(v.Fcsr&FCSR_FRM_MASK) >> FCSR_FRM_SHIFT
+		v.Fcsr = v.Fcsr&^FCSR_FRM_MASK | (uint32(inst._s1)<<FCSR_FRM_SHIFT)&FCSR_FRM_MASK
+	case Inst_Frflags:
+		result = uint64(v.Fcsr & FCSR_FFLAGS_MASK)
+	case Inst_Fsflags:
+		result = uint64(v.Fcsr & FCSR_FFLAGS_MASK)
+		v.Fcsr = v.Fcsr&^FCSR_FFLAGS_MASK | uint32(inst._s1)&FCSR_FFLAGS_MASK
+	}
+
+	switch ops.rd {
+	case REG_FP_S:
+		inst._result = int64(result | FP_NAN_BOX)
+	case REG_FP_D:
+		inst._result = int64(result)
+	default: // Integer results are sign-extended
+		inst._result = int64(int32(uint32(result)))
+	}
+	v.Fcsr |= flags
+}
+
+// Returns the value of an operand as seen by the FPU.
+func fpSourceValue(value int64, file Reg_File) uint64 {
+	if file == REG_FP_S {
+		return unboxSingle(uint64(value))
+	}
+	return uint64(value)
+}
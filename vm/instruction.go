@@ -3,6 +3,7 @@ package vm
 import (
 	"fmt"
 	"log"
+	"math/bits"
 	"sort"
 )
 
@@ -16,6 +17,8 @@ const (
 	Fmt_B          // branch
 	Fmt_U          // Upper immediate
 	Fmt_J
+	Fmt_R4 // Four register operands, used by fused multiply-add
+	Fmt_V  // Vector instructions
 )
 
 const (
@@ -25,11 +28,130 @@ const (
 	Inst_Add
 	Inst_Sub
 	Inst_Mul
+	Inst_Mulh   // High bits of signed x signed
+	Inst_Mulhsu // High bits of signed x unsigned
+	Inst_Mulhu  // High bits of unsigned x unsigned
 	Inst_Div
+	Inst_Divu
 	Inst_Rem
+	Inst_Remu
 	Inst_Xor
 	Inst_Or
 	Inst_And
+	Inst_Sll
+	Inst_Srl
+	Inst_Sra
+	Inst_Slt  // Set less than
+	Inst_Sltu // Set less than unsigned
+
+	// Single precision floating point
+	Inst_Fadd_s
+	Inst_Fsub_s
+	Inst_Fmul_s
+	Inst_Fdiv_s
+	Inst_Fsqrt_s
+	Inst_Fmin_s
+	Inst_Fmax_s
+	Inst_Fsgnj_s  // Sign injection
+	Inst_Fsgnjn_s // Negated sign injection
+	Inst_Fsgnjx_s // Xor sign injection
+	Inst_Fcvt_w_s
+	Inst_Fcvt_wu_s
+	Inst_Fcvt_s_w
+	Inst_Fcvt_s_wu
+	Inst_Fmv_x_w // Move the raw bits from a FP register to an integer register
+	Inst_Fmv_w_x // Move the raw bits from an integer register to a FP register
+	Inst_Feq_s
+	Inst_Flt_s
+	Inst_Fle_s
+	Inst_Fclass_s
+
+	// Floating point control and status register access
+	Inst_Frcsr
+	Inst_Fscsr
+	Inst_Frrm
+	Inst_Fsrm
+	Inst_Frflags
+	Inst_Fsflags
+
+	// Double precision floating point
+	Inst_Fadd_d
+	Inst_Fsub_d
+	Inst_Fmul_d
+	Inst_Fdiv_d
+	Inst_Fsqrt_d
+	Inst_Fmin_d
+	Inst_Fmax_d
+	Inst_Fsgnj_d
+	Inst_Fsgnjn_d
+	Inst_Fsgnjx_d
+	Inst_Fcvt_s_d // Double to single
+	Inst_Fcvt_d_s // Single to double
+	Inst_Fcvt_w_d
+	Inst_Fcvt_wu_d
+	Inst_Fcvt_d_w
+	Inst_Fcvt_d_wu
+	Inst_Feq_d
+	Inst_Flt_d
+	Inst_Fle_d
+	Inst_Fclass_d
+
+	// Atomic memory operations, rd = mem[rs2], mem[rs2] = rd op rs1
+	Inst_Lr_w // Load reserved
+	Inst_Sc_w // Store conditional
+	Inst_Amoswap_w
+	Inst_Amoadd_w
+	Inst_Amoxor_w
+	Inst_Amoand_w
+	Inst_Amoor_w
+	Inst_Amomin_w
+	Inst_Amomax_w
+	Inst_Amominu_w
+	Inst_Amomaxu_w
+
+	Inst_Sfence_vma // Orders page table updates, sfence.vma vaddr, asid
+
+	// Address generation, Zba
+	Inst_Sh1add // rd = rs2 + (rs1 << 1)
+	Inst_Sh2add
+	Inst_Sh3add
+
+	// Basic bit manipulation, Zbb. The unary ones take no rs2.
+	Inst_Andn // rd = rs1 & ~rs2
+	Inst_Orn
+	Inst_Xnor
+	Inst_Clz  // Count leading zeros
+	Inst_Ctz  // Count trailing zeros
+	Inst_Cpop // Count set bits
+	Inst_Max
+	Inst_Maxu
+	Inst_Min
+	Inst_Minu
+	Inst_Sext_b
+	Inst_Sext_h
+	Inst_Zext_h
+	Inst_Rol
+	Inst_Ror
+	Inst_Orc_b // Each byte becomes 0xff if any of its bits are set, 0 otherwise
+	Inst_Rev8  // Reverse the byte order
+
+	// Single bit instructions, Zbs. The bit index is the low 5 bits of rs2.
+	Inst_Bclr
+	Inst_Bext
+	Inst_Binv
+	Inst_Bset
+
+	// RV64 word instructions, they operate on the low 32 bits and sign-extend the result
+	Inst_Addw
+	Inst_Subw
+	Inst_Sllw
+	Inst_Srlw
+	Inst_Sraw
+	Inst_Mulw
+	Inst_Divw
+	Inst_Divuw
+	Inst_Remw
+	Inst_Remuw
 	_Inst_R_end
 
 	_Inst_I_start
@@ -45,12 +167,50 @@ const (
 	Inst_Slli
 	Inst_Srli
 	Inst_Srai
+	Inst_Slti
+	Inst_Sltiu
+	Inst_Lbu // Load byte unsigned
+	Inst_Lhu // Load half unsigned
+	Inst_Fence
+	Inst_Fence_i // Orders the stores ahead before the fetch of the instructions behind
+	Inst_Ecall
+	Inst_Ebreak
+	Inst_Mret // Return from a machine mode trap
+	Inst_Sret // Return from a supervisor mode trap
+	Inst_Flw  // Load FP word
+	Inst_Fld  // Load FP double word
+
+	// CSR accesses, rd = csr(imm), csr = rs or uimm
+	Inst_Csrrw
+	Inst_Csrrs
+	Inst_Csrrc
+	Inst_Csrrwi
+	Inst_Csrrsi
+	Inst_Csrrci
+
+	// Bit manipulation with an immediate shift amount or bit index
+	Inst_Rori
+	Inst_Bclri
+	Inst_Bexti
+	Inst_Binvi
+	Inst_Bseti
+
+	// RV64 only
+	Inst_Ld  // Load double word
+	Inst_Lwu // Load word unsigned
+	Inst_Addiw
+	Inst_Slliw
+	Inst_Srliw
+	Inst_Sraiw
 	_Inst_I_end
 
 	_Inst_S_start
-	Inst_Sw // store word
-	Inst_Sh // store half
-	Inst_Sb // store byte
+	Inst_Sw  // store word
+	Inst_Sh  // store half
+	Inst_Sb  // store byte
+	Inst_Fsw // Store FP word
+	Inst_Fsd // Store FP double word
+	Inst_Sd  // Store double word, RV64 only
 	_Inst_S_end
 
 	_Inst_B_start
@@ -58,6 +218,8 @@ const (
 	Inst_Bne
 	Inst_Blt
 	Inst_Bge
+	Inst_Bltu
+	Inst_Bgeu
 	_Inst_B_end
 
 	_Inst_J_start
@@ -69,37 +231,345 @@ const (
 	Inst_Auipc
 	_Inst_U_end
 
+	_Inst_R4_start
+	Inst_Fmadd_s  // rd = rs1 * rs2 + rs3
+	Inst_Fmsub_s  // rd = rs1 * rs2 - rs3
+	Inst_Fnmsub_s // rd = -(rs1 * rs2) + rs3
+	Inst_Fnmadd_s // rd = -(rs1 * rs2) - rs3
+	Inst_Fmadd_d
+	Inst_Fmsub_d
+	Inst_Fnmsub_d
+	Inst_Fnmadd_d
+	_Inst_R4_end
+
+	// Vector instructions, see vector.go for the operands
+	_Inst_V_start
+	Inst_Vsetvli // Sets vl and vtype, rd = vl
+
+	// Unit-stride and strided loads and stores
+	Inst_Vle8_v
+	Inst_Vle16_v
+	Inst_Vle32_v
+	Inst_Vle64_v
+	Inst_Vse8_v
+	Inst_Vse16_v
+	Inst_Vse32_v
+	Inst_Vse64_v
+	Inst_Vlse8_v
+	Inst_Vlse16_v
+	Inst_Vlse32_v
+	Inst_Vlse64_v
+	Inst_Vsse8_v
+	Inst_Vsse16_v
+	Inst_Vsse32_v
+	Inst_Vsse64_v
+
+	// Integer arithmetic, .vv takes a vector, .vx a scalar and .vi an immediate as the second source
+	Inst_Vadd_vv
+	Inst_Vadd_vx
+	Inst_Vadd_vi
+	Inst_Vsub_vv
+	Inst_Vsub_vx
+	Inst_Vrsub_vx // vd = rs1 - vs2
+	Inst_Vrsub_vi
+	Inst_Vmul_vv
+	Inst_Vmul_vx
+	Inst_Vand_vv
+	Inst_Vand_vx
+	Inst_Vand_vi
+	Inst_Vor_vv
+	Inst_Vor_vx
+	Inst_Vor_vi
+	Inst_Vxor_vv
+	Inst_Vxor_vx
+	Inst_Vxor_vi
+	Inst_Vsll_vv
+	Inst_Vsll_vx
+	Inst_Vsll_vi
+	Inst_Vsrl_vv
+	Inst_Vsrl_vx
+	Inst_Vsrl_vi
+	Inst_Vsra_vv
+	Inst_Vsra_vx
+	Inst_Vsra_vi
+	Inst_Vmin_vv
+	Inst_Vmin_vx
+	Inst_Vminu_vv
+	Inst_Vminu_vx
+	Inst_Vmax_vv
+	Inst_Vmax_vx
+	Inst_Vmaxu_vv
+	Inst_Vmaxu_vx
+	Inst_Vmacc_vv // vd = vs1 * vs2 + vd
+	Inst_Vmacc_vx
+
+	// Compares, they write a mask
+	Inst_Vmseq_vv
+	Inst_Vmseq_vx
+	Inst_Vmseq_vi
+	Inst_Vmsne_vv
+	Inst_Vmsne_vx
+	Inst_Vmsne_vi
+	Inst_Vmslt_vv
+	Inst_Vmslt_vx
+	Inst_Vmsltu_vv
+	Inst_Vmsltu_vx
+	Inst_Vmsle_vv
+	Inst_Vmsle_vx
+	Inst_Vmsle_vi
+	Inst_Vmsleu_vv
+	Inst_Vmsleu_vx
+	Inst_Vmsleu_vi
+	Inst_Vmsgt_vx
+	Inst_Vmsgt_vi
+	Inst_Vmsgtu_vx
+	Inst_Vmsgtu_vi
+
+	// Reductions, vd[0] = vs1[0] op vs2[0] op ... op vs2[vl-1]
+	Inst_Vredsum_vs
+	Inst_Vredand_vs
+	Inst_Vredor_vs
+	Inst_Vredxor_vs
+	Inst_Vredmin_vs
+	Inst_Vredminu_vs
+	Inst_Vredmax_vs
+	Inst_Vredmaxu_vs
+
+	// Moves
+	Inst_Vmv_v_v
+	Inst_Vmv_v_x
+	Inst_Vmv_v_i
+	Inst_Vmv_x_s // rd = vs2[0]
+	Inst_Vmv_s_x // vd[0] = rs1
+	Inst_Vid_v   // vd[i] = i
+	_Inst_V_end
+
 	_Inst_Pseudo_start
 	Inst_Mv
 	Inst_Not
 	Inst_Neg
 	Inst_Li
+	Inst_La
+	Inst_Lla
 	Inst_Jr
 	Inst_Ret
 	Inst_Ble
 	Inst_Bgt
 	Inst_J
 	Inst_Call
+	Inst_Tail
+	Inst_Fmv_s
+	Inst_Fabs_s
+	Inst_Fneg_s
+	Inst_Fmv_d
+	Inst_Fabs_d
+	Inst_Fneg_d
+	Inst_Csrr
+	Inst_Csrw
+	Inst_Csrs
+	Inst_Csrc
+	Inst_Csrwi
+	Inst_Csrsi
+	Inst_Csrci
+	Inst_Rdcycle
+	Inst_Rdcycleh
+	Inst_Rdtime
+	Inst_Rdtimeh
+	Inst_Rdinstret
+	Inst_Rdinstreth
+	Inst_Sext_w
+	Inst_Negw
+	Inst_Nop_pseudo // 'nop', Inst_Nop is the empty instruction of the pipeline bubbles
+	Inst_Beqz
+	Inst_Bnez
+	Inst_Blez
+	Inst_Bgez
+	Inst_Bltz
+	Inst_Bgtz
+	Inst_Bgtu
+	Inst_Bleu
+	Inst_Seqz
+	Inst_Snez
+	Inst_Sltz
+	Inst_Sgtz
 	_Inst_Pseudo_end
 
+	// Compressed instructions, expanded to the instruction they stand for
+	// when parsed. See expandCompressedInstruction for the operands.
+	_Inst_C_start
+	Inst_C_addi4spn
+	Inst_C_fld
+	Inst_C_lw
+	Inst_C_flw
+	Inst_C_fsd
+	Inst_C_sw
+	Inst_C_fsw
+	Inst_C_nop
+	Inst_C_addi
+	Inst_C_jal
+	Inst_C_li
+	Inst_C_addi16sp
+	Inst_C_lui
+	Inst_C_srli
+	Inst_C_srai
+	Inst_C_andi
+	Inst_C_sub
+	Inst_C_xor
+	Inst_C_or
+	Inst_C_and
+	Inst_C_j
+	Inst_C_beqz
+	Inst_C_bnez
+	Inst_C_slli
+	Inst_C_fldsp
+	Inst_C_lwsp
+	Inst_C_flwsp
+	Inst_C_jr
+	Inst_C_mv
+	Inst_C_ebreak
+	Inst_C_jalr
+	Inst_C_add
+	Inst_C_fsdsp
+	Inst_C_swsp
+	Inst_C_fswsp
+	_Inst_C_end
+
 	Inst_End
 	_Inst_Unknown
+
+	// Custom instructions are numbered after this as they are registered,
+	// see RegisterCustomInstruction.
+	_Inst_Custom_start
 )
 
+// Register file an operand is read from or written to
+type Reg_File uint8
+
+const (
+	REG_NONE Reg_File = iota
+	REG_INT
+	REG_FP_S // FP register holding a single precision value
+	REG_FP_D // FP register holding a double precision value
+)
+
+func (file Reg_File) isFp() bool {
+	return file == REG_FP_S || file == REG_FP_D
+}
+
+// FP registers are numbered after the integer ones, so that the hazard and
+// forwarding logic can track both register files with a single index.
+const FP_REG_OFFSET = 32
+
+// Register files of the operand fields for instructions that touch the FP
+// registers. Integer instructions are fully described by their format.
+type fp_operands struct {
+	rd, rs1, rs2, rs3 Reg_File
+}
+
+var fpOperandTable = map[Inst_Op]fp_operands{
+	Inst_Fadd_s:    {REG_FP_S, REG_FP_S, REG_FP_S, REG_NONE},
+	Inst_Fsub_s:    {REG_FP_S, REG_FP_S, REG_FP_S, REG_NONE},
+	Inst_Fmul_s:    {REG_FP_S, REG_FP_S, REG_FP_S, REG_NONE},
+	Inst_Fdiv_s:    {REG_FP_S, REG_FP_S, REG_FP_S, REG_NONE},
+	Inst_Fsqrt_s:   {REG_FP_S, REG_FP_S, REG_NONE, REG_NONE},
+	Inst_Fmin_s:    {REG_FP_S, REG_FP_S, REG_FP_S, REG_NONE},
+	Inst_Fmax_s:    {REG_FP_S, REG_FP_S, REG_FP_S, REG_NONE},
+	Inst_Fsgnj_s:   {REG_FP_S, REG_FP_S, REG_FP_S, REG_NONE},
+	Inst_Fsgnjn_s:  {REG_FP_S, REG_FP_S, REG_FP_S, REG_NONE},
+	Inst_Fsgnjx_s:  {REG_FP_S, REG_FP_S, REG_FP_S, REG_NONE},
+	Inst_Fcvt_w_s:  {REG_INT, REG_FP_S, REG_NONE, REG_NONE},
+	Inst_Fcvt_wu_s: {REG_INT, REG_FP_S, REG_NONE, REG_NONE},
+	Inst_Fcvt_s_w:  {REG_FP_S, REG_INT, REG_NONE, REG_NONE},
+	Inst_Fcvt_s_wu: {REG_FP_S, REG_INT, REG_NONE, REG_NONE},
+	Inst_Fmv_x_w:   {REG_INT, REG_FP_S, REG_NONE, REG_NONE},
+	Inst_Fmv_w_x:   {REG_FP_S, REG_INT, REG_NONE, REG_NONE},
+	Inst_Feq_s:     {REG_INT, REG_FP_S, REG_FP_S, REG_NONE},
+	Inst_Flt_s:     {REG_INT, REG_FP_S, REG_FP_S, REG_NONE},
+	Inst_Fle_s:     {REG_INT, REG_FP_S, REG_FP_S, REG_NONE},
+	Inst_Fclass_s:  {REG_INT, REG_FP_S, REG_NONE, REG_NONE},
+	Inst_Frcsr:     {REG_INT, REG_NONE, REG_NONE, REG_NONE},
+	Inst_Fscsr:     {REG_INT, REG_INT, REG_NONE, REG_NONE},
+	Inst_Frrm:      {REG_INT, REG_NONE, REG_NONE, REG_NONE},
+	Inst_Fsrm:      {REG_INT, REG_INT, REG_NONE, REG_NONE},
+	Inst_Frflags:   {REG_INT, REG_NONE, REG_NONE, REG_NONE},
+	Inst_Fsflags:   {REG_INT, REG_INT, REG_NONE, REG_NONE},
+	Inst_Fmadd_s:   {REG_FP_S, REG_FP_S, REG_FP_S, REG_FP_S},
+	Inst_Fmsub_s:   {REG_FP_S, REG_FP_S, REG_FP_S, REG_FP_S},
+	Inst_Fnmsub_s:  {REG_FP_S, REG_FP_S, REG_FP_S, REG_FP_S},
+	Inst_Fnmadd_s:  {REG_FP_S, REG_FP_S, REG_FP_S, REG_FP_S},
+
+	Inst_Fadd_d:    {REG_FP_D, REG_FP_D, REG_FP_D, REG_NONE},
+	Inst_Fsub_d:    {REG_FP_D, REG_FP_D, REG_FP_D, REG_NONE},
+	Inst_Fmul_d:    {REG_FP_D, REG_FP_D, REG_FP_D, REG_NONE},
+	Inst_Fdiv_d:    {REG_FP_D, REG_FP_D, REG_FP_D, REG_NONE},
+	Inst_Fsqrt_d:   {REG_FP_D, REG_FP_D, REG_NONE, REG_NONE},
+	Inst_Fmin_d:    {REG_FP_D, REG_FP_D, REG_FP_D, REG_NONE},
+	Inst_Fmax_d:    {REG_FP_D, REG_FP_D, REG_FP_D, REG_NONE},
+	Inst_Fsgnj_d:   {REG_FP_D, REG_FP_D, REG_FP_D, REG_NONE},
+	Inst_Fsgnjn_d:  {REG_FP_D, REG_FP_D, REG_FP_D, REG_NONE},
+	Inst_Fsgnjx_d:  {REG_FP_D, REG_FP_D, REG_FP_D, REG_NONE},
+	Inst_Fcvt_s_d:  {REG_FP_S, REG_FP_D, REG_NONE, REG_NONE},
+	Inst_Fcvt_d_s:  {REG_FP_D, REG_FP_S, REG_NONE, REG_NONE},
+	Inst_Fcvt_w_d:  {REG_INT, REG_FP_D, REG_NONE, REG_NONE},
+	Inst_Fcvt_wu_d: {REG_INT, REG_FP_D, REG_NONE, REG_NONE},
+	Inst_Fcvt_d_w:  {REG_FP_D, REG_INT, REG_NONE, REG_NONE},
+	Inst_Fcvt_d_wu: {REG_FP_D, REG_INT, REG_NONE, REG_NONE},
+	Inst_Feq_d:     {REG_INT, REG_FP_D, REG_FP_D, REG_NONE},
+	Inst_Flt_d:     {REG_INT, REG_FP_D, REG_FP_D, REG_NONE},
+	Inst_Fle_d:     {REG_INT, REG_FP_D, REG_FP_D, REG_NONE},
+	Inst_Fclass_d:  {REG_INT, REG_FP_D, REG_NONE, REG_NONE},
+	Inst_Fmadd_d:   {REG_FP_D, REG_FP_D, REG_FP_D, REG_FP_D},
+	Inst_Fmsub_d:   {REG_FP_D, REG_FP_D, REG_FP_D, REG_FP_D},
+	Inst_Fnmsub_d:  {REG_FP_D, REG_FP_D, REG_FP_D, REG_FP_D},
+	Inst_Fnmadd_d:  {REG_FP_D, REG_FP_D, REG_FP_D, REG_FP_D},
+
+	// Loads and stores keep the integer layout, only the data register is FP
+	Inst_Flw: {REG_FP_S, REG_NONE, REG_INT, REG_NONE},
+	Inst_Fsw: {REG_FP_S, REG_NONE, REG_INT, REG_NONE},
+	Inst_Fld: {REG_FP_D, REG_NONE, REG_INT, REG_NONE},
+	Inst_Fsd: {REG_FP_D, REG_NONE, REG_INT, REG_NONE},
+}
+
+// Returns the register index used by the pipeline for the given register of
+// the given file. Returns -1 if there is no register.
+func regIndex(reg int32, file Reg_File) int32 {
+	switch file {
+	case REG_INT:
+		return reg
+	case REG_FP_S, REG_FP_D:
+		return reg + FP_REG_OFFSET
+	default:
+		return -1
+	}
+}
+
 type Instruction struct {
 	Op  Inst_Op
 	Rd  int32
 	Rs1 int32
 	Rs2 int32
+	Rs3 int32
+	Rm  uint8 // Rounding mode of FP instructions
+
+	Compressed bool // Takes 2 bytes instead of 4
+	Masked     bool // Vector instruction that only updates the elements enabled in v0
 
-	_s1     int32
-	_s2     int32
+	// Operand and result values are wide enough for the FP registers,
+	// integer values are kept sign-extended.
+	_s1     int64
+	_s2     int64
+	_s3     int64
 	_imm    int32
-	_result int32
+	_result int64
 	_fmt    Inst_Fmt
+	_c_op   Inst_Op // Compressed instruction it was written or decoded as, see encodeCompressed
 
 	_ex_total     int // Total number of execute stages for this instruction
 	_ex_remaining int // Number of executions remaining
+
+	_paddr     uint32       // Physical address of loads, stores and atomics
+	_vec       *vector_exec // Elements of a vector instruction, set in execute
+	_exception *Exception   // Set if the instruction faulted, the trap is taken at writeback
 }
 
 func newInstruction(Op Inst_Op, Rd int32, Rs1 int32, Rs2 int32) Instruction {
@@ -111,81 +581,273 @@ func newInstruction(Op Inst_Op, Rd int32, Rs1 int32, Rs2 int32) Instruction {
 	}
 }
 
+// Returns the size of the instruction in bytes.
+func (inst Instruction) size() uint32 {
+	if inst.Compressed {
+		return 2
+	}
+	return 4
+}
+
+// ABI names of the registers, printed by Str
+var regNames = [32]string{
+	"zero", "ra", "sp", "gp", "tp", "t0", "t1", "t2",
+	"s0", "s1", "a0", "a1", "a2", "a3", "a4", "a5",
+	"a6", "a7", "s2", "s3", "s4", "s5", "s6", "s7",
+	"s8", "s9", "s10", "s11", "t3", "t4", "t5", "t6",
+}
+
+var fpRegNames = [32]string{
+	"ft0", "ft1", "ft2", "ft3", "ft4", "ft5", "ft6", "ft7",
+	"fs0", "fs1", "fa0", "fa1", "fa2", "fa3", "fa4", "fa5",
+	"fa6", "fa7", "fs2", "fs3", "fs4", "fs5", "fs6", "fs7",
+	"fs8", "fs9", "fs10", "fs11", "ft8", "ft9", "ft10", "ft11",
+}
+
+// Returns the ABI name of the register in the given file.
+func regName(reg int32, file Reg_File) string {
+	if reg < 0 || reg >= 32 {
+		return fmt.Sprintf("x%d", reg)
+	}
+	if file.isFp() {
+		return fpRegNames[reg]
+	}
+	return regNames[reg]
+}
+
+// Returns the fence ordering set of the 4-bit mask, the reverse of parseFenceSet.
+func fenceSetStr(set int32) string {
+	if set == 0 {
+		return "0"
+	}
+
+	s := ""
+	for i, ch := range "iorw" {
+		if set&(1<<(3-i)) != 0 {
+			s += string(ch)
+		}
+	}
+	return s
+}
+
+// Returns the instruction as assembly with the ABI register names. The
+// operands are written in the order the parser takes them, so the text
+// assembles back to the same instruction.
 func (inst Instruction) Str() string {
-	op := opcodeToStringMap[inst.Op]
+	op := opcodeName(inst.Op)
+
+	// Register files of rd, rs1, rs2 and rs3
+	files := [4]Reg_File{REG_INT, REG_INT, REG_INT, REG_INT}
+	if ops, ok := fpOperandTable[inst.Op]; ok {
+		files = [4]Reg_File{ops.rd, ops.rs1, ops.rs2, ops.rs3}
+	}
+	rd, rs1, rs2 := regName(inst.Rd, files[0]), regName(inst.Rs1, files[1]), regName(inst.Rs2, files[2])
+
+	// The rounding mode is only written if it is not the one in fcsr
+	rm := ""
+	if usesRoundingMode(inst.Op) && inst.Rm != FRM_DYN {
+		for name, mode := range roundingModeNames {
+			if mode == inst.Rm {
+				rm = ", " + name
+			}
+		}
+	}
+
+	switch {
+	case inst.Op == Inst_End, inst.isSystem(), inst.Op == Inst_Mret, inst.Op == Inst_Sret, inst.Op == Inst_Fence_i:
+		return op
+	case inst.Op == Inst_Fence:
+		return fmt.Sprintf("%s %s, %s", op, fenceSetStr(inst.Rs2>>4), fenceSetStr(inst.Rs2&0xf))
+	case inst.Op == Inst_Sfence_vma:
+		return fmt.Sprintf("%s %s, %s", op, rs1, rs2)
+
+	case inst.isCsr():
+		if inst.hasCsrImmediate() {
+			return fmt.Sprintf("%s %s, %s, %d", op, rd, csrName(uint32(inst.Rs1)), inst.Rs2)
+		}
+		return fmt.Sprintf("%s %s, %s, %s", op, rd, csrName(uint32(inst.Rs1)), rs2)
+
+	// Atomics take their address in parentheses, without an offset
+	case inst.isAtomic():
+		if inst.Op == Inst_Lr_w {
+			return fmt.Sprintf("%s %s, (%s)", op, rd, rs2)
+		}
+		return fmt.Sprintf("%s %s, %s, (%s)", op, rd, rs1, rs2)
+
+	// Loads and stores keep the offset in Rs1 and the base in Rs2
+	case inst.isLoad() || inst.isStore():
+		return fmt.Sprintf("%s %s, %d(%s)", op, rd, inst.Rs1, rs2)
+
+	// jalr keeps the base in Rs1 and the offset in Rs2
+	case inst.Op == Inst_Jalr:
+		return fmt.Sprintf("%s %s, %d(%s)", op, rd, inst.Rs2, rs1)
+	}
+
+	if ops, ok := fpOperandTable[inst.Op]; ok {
+		switch {
+		case ops.rs1 == REG_NONE: // frcsr, frrm and frflags
+			return fmt.Sprintf("%s %s", op, rd)
+		case ops.rs2 == REG_NONE:
+			return fmt.Sprintf("%s %s, %s%s", op, rd, rs1, rm)
+		}
+	}
+
+	if inst.isUnary() {
+		return fmt.Sprintf("%s %s, %s", op, rd, rs1)
+	}
 
 	format := getInstructionFmt(inst)
 	switch format {
 	case Fmt_R: // Reg, reg, reg
-		return fmt.Sprintf("%s x%d, x%d, x%d", op, inst.Rd, inst.Rs1, inst.Rs2)
+		return fmt.Sprintf("%s %s, %s, %s%s", op, rd, rs1, rs2, rm)
+	case Fmt_R4: // Reg, reg, reg, reg
+		return fmt.Sprintf("%s %s, %s, %s, %s%s", op, rd, rs1, rs2, regName(inst.Rs3, files[3]), rm)
 	case Fmt_I: // reg, reg, imm
-		return fmt.Sprintf("%s x%d, x%d, %d", op, inst.Rd, inst.Rs1, inst.Rs2)
-	case Fmt_S: // reg, imm(reg)
-		return fmt.Sprintf("%s x%d, %d(x%d)", op, inst.Rd, inst.Rs1, inst.Rs2)
+		return fmt.Sprintf("%s %s, %s, %d", op, rd, rs1, inst.Rs2)
 	case Fmt_B: // reg, reg, imm
-		return fmt.Sprintf("%s x%d, x%d, %d", op, inst.Rd, inst.Rs1, inst.Rs2)
+		return fmt.Sprintf("%s %s, %s, %d", op, rd, rs1, inst.Rs2)
 	case Fmt_U: // reg, imm
-		return fmt.Sprintf("%s x%d, %d", op, inst.Rd, inst.Rs1)
+		// The simulator keeps the whole offset of 'auipc rd, label', it is not a multiple of 4096
+		if inst.Rs1&0xfff != 0 {
+			return fmt.Sprintf("%s %s, %d", op, rd, inst.Rs1)
+		}
+		return fmt.Sprintf("%s %s, %#x", op, rd, uint32(inst.Rs1)>>12)
 	case Fmt_J: // reg, imm(for branching)
-		return fmt.Sprintf("%s x%d, %d", op, inst.Rd, inst.Rs1)
+		return fmt.Sprintf("%s %s, %d", op, rd, inst.Rs1)
+	case Fmt_V:
+		return inst.vectorStr()
 	default:
 		panic(fmt.Sprintf("unexpected vm.Inst_Fmt: %#v", format))
 	}
 }
 
+// Returns the register indexes whose values are loaded into _s1, _s2 and _s3.
+// Returns -1 for unused sources.
+//
 // @Redundant: mostly same as getAluInputRegisters, find a way to remove one of the functions
-func (inst Instruction) getSourceRegisters() (int32, int32) {
+func (inst Instruction) getSourceRegisters() (int32, int32, int32) {
+	if ops, ok := fpOperandTable[inst.Op]; ok {
+		switch {
+		case inst.isLoad():
+			return regIndex(inst.Rs2, ops.rs2), -1, -1
+		case inst.isStore():
+			return regIndex(inst.Rd, ops.rd), regIndex(inst.Rs2, ops.rs2), -1
+		default:
+			return regIndex(inst.Rs1, ops.rs1), regIndex(inst.Rs2, ops.rs2), regIndex(inst.Rs3, ops.rs3)
+		}
+	}
+
 	switch inst._fmt {
 	case Fmt_R:
-		return inst.Rs1, inst.Rs2
+		if inst.isUnary() {
+			return inst.Rs1, -1, -1
+		}
+		return inst.Rs1, inst.Rs2, -1
 
 	case Fmt_I:
-		if inst.isLoad() {
-			return inst.Rs2, -1
+		if inst.hasCsrImmediate() {
+			return -1, -1, -1
+		} else if inst.isLoad() || inst.isCsr() {
+			return inst.Rs2, -1, -1
 		} else {
-			return inst.Rs1, -1
+			return inst.Rs1, -1, -1
 		}
 
 	case Fmt_S:
-		return inst.Rd, inst.Rs2
+		return inst.Rd, inst.Rs2, -1
 
 	case Fmt_B:
-		return inst.Rd, inst.Rs1
+		return inst.Rd, inst.Rs1, -1
 
 	case Fmt_U, Fmt_J:
-		return -1, -1
+		return -1, -1, -1
+
+	case Fmt_R4: // The FP ones are handled above, these are custom instructions
+		return inst.Rs1, inst.Rs2, inst.Rs3
+
+	case Fmt_V:
+		return inst.vectorSourceRegisters()
 
 	default:
 		log.Fatalf("Unexpected vm.Inst_Fmt: %#v", inst._fmt)
-		return -1, -1
+		return -1, -1, -1
+	}
+}
+
+func (inst Instruction) getAluInputRegisters() (int32, int32, int32) {
+	rs1, rs2, rs3 := inst.getSourceRegisters()
+
+	// The data of a store is not an ALU input, it is only needed in the memory stage.
+	if inst.isStore() {
+		return -1, rs2, -1
 	}
+
+	return rs1, rs2, rs3
 }
 
-func (inst Instruction) getAluInputRegisters() (int32, int32) {
+// Returns the register index written by the instruction, or -1 if it does not
+// write a register.
+func (inst Instruction) getDestRegister() int32 {
+	if ops, ok := fpOperandTable[inst.Op]; ok {
+		if inst.isStore() {
+			return -1
+		}
+		return regIndex(inst.Rd, ops.rd)
+	}
+
 	switch inst._fmt {
-	case Fmt_R:
-		return inst.Rs1, inst.Rs2
+	case Fmt_R, Fmt_I, Fmt_U, Fmt_J, Fmt_R4:
+		return inst.Rd
+	case Fmt_V:
+		return inst.vectorDestRegister()
+	default:
+		return -1
+	}
+}
+
+// Returns the immediate operand, its position depends on the format.
+func (inst Instruction) getImmediate() int32 {
+	switch inst._fmt {
+	case Fmt_I:
+		// In load, immediate is placed in a different position
+		// CSR accesses use the same layout, with the CSR address as the immediate.
+		if inst.isLoad() || inst.isCsr() {
+			return inst.Rs1
+		}
+		return inst.Rs2
+	case Fmt_S, Fmt_U, Fmt_J:
+		return inst.Rs1
+	case Fmt_B:
+		return inst.Rs2
+	case Fmt_V:
+		return inst.vectorImmediate()
+	default:
+		return 0
+	}
+}
 
+// Sets the immediate of an instruction laid out like getImmediate, reports
+// whether it has one. The CSR address is not an immediate here.
+func (inst *Instruction) setImmediate(imm int32) bool {
+	switch inst._fmt {
 	case Fmt_I:
+		if inst.isCsr() {
+			return false
+		}
 		if inst.isLoad() {
-			return inst.Rs2, -1
+			inst.Rs1 = imm
 		} else {
-			return inst.Rs1, -1
+			inst.Rs2 = imm
 		}
-
-	case Fmt_S:
-		return -1, inst.Rs2
-
+	case Fmt_S, Fmt_U, Fmt_J:
+		inst.Rs1 = imm
 	case Fmt_B:
-		return inst.Rd, inst.Rs1
-
-	case Fmt_U, Fmt_J:
-		return -1, -1
-
+		inst.Rs2 = imm
 	default:
-		log.Fatalf("Unexpected vm.Inst_Fmt: %#v", inst._fmt)
-		return -1, -1
+		return false
 	}
+
+	return true
 }
 
 func (inst Instruction) isUnconditionalBranch() bool {
@@ -209,7 +871,8 @@ func (inst Instruction) isBranch() bool {
 }
 
 func (inst Instruction) isLoad() bool {
-	if inst.Op == Inst_Lw || inst.Op == Inst_Lh || inst.Op == Inst_Lb {
+	switch inst.Op {
+	case Inst_Lw, Inst_Lh, Inst_Lb, Inst_Lhu, Inst_Lbu, Inst_Flw, Inst_Fld, Inst_Ld, Inst_Lwu:
 		return true
 	}
 
@@ -217,14 +880,98 @@ func (inst Instruction) isLoad() bool {
 }
 
 func (inst Instruction) isStore() bool {
-	if inst.Op == Inst_Sw || inst.Op == Inst_Sh || inst.Op == Inst_Sb {
+	switch inst.Op {
+	case Inst_Sw, Inst_Sh, Inst_Sb, Inst_Fsw, Inst_Fsd, Inst_Sd:
 		return true
 	}
 
 	return false
 }
 
+// CSR access instructions, these are laid out like loads: 'csrrw rd, csr, rs'
+// has the CSR address in Rs1 and the source register or immediate in Rs2.
+func (inst Instruction) isCsr() bool {
+	return Inst_Csrrw <= inst.Op && inst.Op <= Inst_Csrrci
+}
+
+func (inst Instruction) hasCsrImmediate() bool {
+	return Inst_Csrrwi <= inst.Op && inst.Op <= Inst_Csrrci
+}
+
+// Atomic memory operations, including lr and sc.
+func (inst Instruction) isAtomic() bool {
+	return Inst_Lr_w <= inst.Op && inst.Op <= Inst_Amomaxu_w
+}
+
+// Instructions whose result is only known after the memory stage, it can't
+// be forwarded from the ALU output.
+func (inst Instruction) isMemoryResult() bool {
+	return inst.isLoad() || inst.isAtomic()
+}
+
+// Floating point instructions other than loads and stores, these are executed by the FPU.
+func (inst Instruction) isFp() bool {
+	_, ok := fpOperandTable[inst.Op]
+	return ok && !inst.isLoad() && !inst.isStore()
+}
+
+// Returns true if the instruction takes a rounding mode operand.
+func usesRoundingMode(op Inst_Op) bool {
+	switch op {
+	case Inst_Fadd_s, Inst_Fsub_s, Inst_Fmul_s, Inst_Fdiv_s, Inst_Fsqrt_s,
+		Inst_Fcvt_w_s, Inst_Fcvt_wu_s, Inst_Fcvt_s_w, Inst_Fcvt_s_wu,
+		Inst_Fmadd_s, Inst_Fmsub_s, Inst_Fnmsub_s, Inst_Fnmadd_s,
+		Inst_Fadd_d, Inst_Fsub_d, Inst_Fmul_d, Inst_Fdiv_d, Inst_Fsqrt_d,
+		Inst_Fcvt_s_d, Inst_Fcvt_w_d, Inst_Fcvt_wu_d,
+		Inst_Fmadd_d, Inst_Fmsub_d, Inst_Fnmsub_d, Inst_Fnmadd_d:
+		return true
+	}
+
+	return false
+}
+
+// Returns the virtual address accessed by a load, store or atomic, the
+// operands must be read. It is XLEN bits wide, see Vm.zext.
+func (inst Instruction) memoryAddress() int64 {
+	switch {
+	case inst.isAtomic():
+		return inst._s2
+	case inst.isStore():
+		return inst._s2 + int64(inst._imm)
+	default:
+		return inst._s1 + int64(inst._imm)
+	}
+}
+
+// Returns the kind of memory access for permission checks. Atomics other
+// than 'lr' count as stores.
+func (inst Instruction) accessType() Access_Type {
+	if inst.isLoad() || inst.Op == Inst_Lr_w {
+		return ACCESS_LOAD
+	}
+	return ACCESS_STORE
+}
+
+// Bit manipulation instructions that only read rs1.
+func (inst Instruction) isUnary() bool {
+	switch inst.Op {
+	case Inst_Clz, Inst_Ctz, Inst_Cpop, Inst_Sext_b, Inst_Sext_h, Inst_Zext_h, Inst_Orc_b, Inst_Rev8:
+		return true
+	}
+
+	return false
+}
+
+// Environment calls and breakpoints raise an exception, they stop the machine
+// if there is no trap handler.
+func (inst Instruction) isSystem() bool {
+	return inst.Op == Inst_Ecall || inst.Op == Inst_Ebreak
+}
+
 func GetInstructionStringList() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
 	insts := make([]string, 0, len(opcodeToStringMap))
 	for _, str := range opcodeToStringMap {
 		insts = append(insts, str)
@@ -234,6 +981,10 @@ func GetInstructionStringList() []string {
 }
 
 func getInstructionFmt(inst Instruction) Inst_Fmt {
+	if inst.isCustom() {
+		return customInstruction(inst.Op).Fmt
+	}
+
 	// Determine the instruction type
 	if _Inst_R_start < inst.Op && inst.Op < _Inst_R_end {
 		return Fmt_R
@@ -247,11 +998,103 @@ func getInstructionFmt(inst Instruction) Inst_Fmt {
 		return Fmt_U
 	} else if _Inst_J_start < inst.Op && inst.Op < _Inst_J_end {
 		return Fmt_J
+	} else if _Inst_R4_start < inst.Op && inst.Op < _Inst_R4_end {
+		return Fmt_R4
+	} else if _Inst_V_start < inst.Op && inst.Op < _Inst_V_end {
+		return Fmt_V
 	}
 
 	return Fmt_R
 }
 
+// Expands the pseudo instructions that can take more than one instruction,
+// returns nil for the others. With a label, the immediates are left to the
+// relocations in pseudoRelocations.
+func expandLongPseudoInstruction(ps Instruction, has_label bool) []Instruction {
+	switch ps.Op {
+	case Inst_Li, Inst_La, Inst_Lla: // Load immediate, load address
+		if !has_label {
+			return loadImmediate(ps.Rd, ps.Rs1)
+		}
+		if ps.Op == Inst_Li { // lui rd, %hi(sym); addi rd, rd, %lo(sym)
+			return []Instruction{newInstruction(Inst_Lui, ps.Rd, 0, 0), newInstruction(Inst_Addi, ps.Rd, ps.Rd, 0)}
+		}
+		// auipc rd, %pcrel_hi(sym); addi rd, rd, %pcrel_lo(sym)
+		return []Instruction{newInstruction(Inst_Auipc, ps.Rd, 0, 0), newInstruction(Inst_Addi, ps.Rd, ps.Rd, 0)}
+
+	/* Based on the risc-v manual, call and tail expand to two instructions:
+	call offset:
+		auipc x1, offset[31:12]
+		jalr x1, x1, offset[11:0]
+	tail offset:
+		auipc x6, offset[31:12]
+		jalr x0, x6, offset[11:0]
+	*/
+	case Inst_Call, Inst_Tail:
+		hi, lo := splitImmediate(ps.Rd)
+		link, tmp := int32(1), int32(1)
+		if ps.Op == Inst_Tail {
+			link, tmp = 0, 6
+		}
+		return []Instruction{newInstruction(Inst_Auipc, tmp, hi, 0), newInstruction(Inst_Jalr, link, tmp, lo)}
+	}
+
+	return nil
+}
+
+// Returns the instructions loading a 32-bit value, sign-extended in RV64: an
+// addi for 12-bit values, and a lui with an addi for the others.
+func loadImmediate(rd, val int32) []Instruction {
+	if -2048 <= val && val < 2048 {
+		return []Instruction{newInstruction(Inst_Addi, rd, 0, val)}
+	}
+
+	hi, lo := splitImmediate(val)
+	if val >= 0 && hi < 0 {
+		// Rounding up overflows the upper part, the inverse of the value is loaded and inverted back
+		insts := loadImmediate(rd, ^val)
+		return append(insts, newInstruction(Inst_Xori, rd, rd, -1))
+	}
+
+	insts := []Instruction{newInstruction(Inst_Lui, rd, hi, 0)}
+	if lo != 0 {
+		insts = append(insts, newInstruction(Inst_Addi, rd, rd, lo))
+	}
+	return insts
+}
+
+func isLoadImmediate(op Inst_Op) bool {
+	return op == Inst_Li || op == Inst_La || op == Inst_Lla
+}
+
+// Returns the instructions loading a 64-bit value in RV64. 32-bit values take
+// a lui and an addiw, which keeps the sum in 32 bits. The others load their
+// upper bits without the trailing zeros, shift them into place and add the
+// low 12 bits.
+func loadImmediate64(rd int32, val int64) []Instruction {
+	if -2048 <= val && val < 2048 {
+		return []Instruction{newInstruction(Inst_Addi, rd, 0, int32(val))}
+	}
+
+	if val == int64(int32(val)) {
+		hi, lo := splitImmediate(int32(val))
+		insts := []Instruction{newInstruction(Inst_Lui, rd, hi, 0)}
+		if lo != 0 {
+			insts = append(insts, newInstruction(Inst_Addiw, rd, rd, lo))
+		}
+		return insts
+	}
+
+	lo := val << 52 >> 52
+	hi := (val - lo) >> 12
+	shift := 12 + bits.TrailingZeros64(uint64(hi))
+	insts := append(loadImmediate64(rd, hi>>(shift-12)), newInstruction(Inst_Slli, rd, rd, int32(shift)))
+	if lo != 0 {
+		insts = append(insts, newInstruction(Inst_Addi, rd, rd, int32(lo)))
+	}
+	return insts
+}
+
 func expandPseudoInstruction(ps Instruction) Instruction {
 	switch ps.Op {
 	case Inst_Mv: //  addi rd, rs, 0 Copy register
@@ -260,31 +1103,84 @@ func expandPseudoInstruction(ps Instruction) Instruction {
 		return newInstruction(Inst_Xori, ps.Rd, ps.Rs1, -1)
 	case Inst_Neg: // sub rd, x0, rs Two’s complement
 		return newInstruction(Inst_Sub, ps.Rd, 0, ps.Rs1)
-	case Inst_Li: // addi Rd x0 imm(Rs1) Load immediate
-		return newInstruction(Inst_Addi, ps.Rd, 0, ps.Rs1)
 	case Inst_Jr: // jalr x0, rs, 0 Jump register
 		return newInstruction(Inst_Jalr, 0, ps.Rd, 0)
 	case Inst_Ret: // jalr x0, x1, 0 Return from subroutine
 		return newInstruction(Inst_Jalr, 0, 1, 0)
+	case Inst_Sext_w: // addiw rd, rs, 0
+		return newInstruction(Inst_Addiw, ps.Rd, ps.Rs1, 0)
+	case Inst_Negw: // subw rd, x0, rs
+		return newInstruction(Inst_Subw, ps.Rd, 0, ps.Rs1)
+	case Inst_Nop_pseudo: // addi x0, x0, 0
+		return newInstruction(Inst_Addi, 0, 0, 0)
+	case Inst_Beqz: // beq rs, x0, offset
+		return newInstruction(Inst_Beq, ps.Rd, 0, ps.Rs1)
+	case Inst_Bnez: // bne rs, x0, offset
+		return newInstruction(Inst_Bne, ps.Rd, 0, ps.Rs1)
+	case Inst_Blez: // bge x0, rs, offset
+		return newInstruction(Inst_Bge, 0, ps.Rd, ps.Rs1)
+	case Inst_Bgez: // bge rs, x0, offset
+		return newInstruction(Inst_Bge, ps.Rd, 0, ps.Rs1)
+	case Inst_Bltz: // blt rs, x0, offset
+		return newInstruction(Inst_Blt, ps.Rd, 0, ps.Rs1)
+	case Inst_Bgtz: // blt x0, rs, offset
+		return newInstruction(Inst_Blt, 0, ps.Rd, ps.Rs1)
+	case Inst_Bgtu: // bltu rt, rs, offset
+		return newInstruction(Inst_Bltu, ps.Rs1, ps.Rd, ps.Rs2)
+	case Inst_Bleu: // bgeu rt, rs, offset
+		return newInstruction(Inst_Bgeu, ps.Rs1, ps.Rd, ps.Rs2)
+	case Inst_Seqz: // sltiu rd, rs, 1
+		return newInstruction(Inst_Sltiu, ps.Rd, ps.Rs1, 1)
+	case Inst_Snez: // sltu rd, x0, rs
+		return newInstruction(Inst_Sltu, ps.Rd, 0, ps.Rs1)
+	case Inst_Sltz: // slt rd, rs, x0
+		return newInstruction(Inst_Slt, ps.Rd, ps.Rs1, 0)
+	case Inst_Sgtz: // slt rd, x0, rs
+		return newInstruction(Inst_Slt, ps.Rd, 0, ps.Rs1)
 	case Inst_Ble:
 		return newInstruction(Inst_Bge, ps.Rs1, ps.Rd, ps.Rs2)
 	case Inst_Bgt:
 		return newInstruction(Inst_Blt, ps.Rs1, ps.Rd, ps.Rs2)
 	case Inst_J:
 		return newInstruction(Inst_Jal, 0, ps.Rd, 0)
-
-	/* Based on the risc-v manual, call expands to two instructions:
-	call offset:
-		auipc x1, offset[31:12]
-		jalr x1, x1, offset[11:0]
-
-	And call is used for calling 'far-away' subroutines.
-
-	But in our implementation, we can just expand to 'jal ra offset',
-	since it can handle any length jumps
-	*/
-	case Inst_Call:
-		return newInstruction(Inst_Jal, 1, ps.Rd, 0)
+	case Inst_Fmv_s: // fsgnj.s rd, rs, rs
+		return newInstruction(Inst_Fsgnj_s, ps.Rd, ps.Rs1, ps.Rs1)
+	case Inst_Fabs_s: // fsgnjx.s rd, rs, rs
+		return newInstruction(Inst_Fsgnjx_s, ps.Rd, ps.Rs1, ps.Rs1)
+	case Inst_Fneg_s: // fsgnjn.s rd, rs, rs
+		return newInstruction(Inst_Fsgnjn_s, ps.Rd, ps.Rs1, ps.Rs1)
+	case Inst_Fmv_d: // fsgnj.d rd, rs, rs
+		return newInstruction(Inst_Fsgnj_d, ps.Rd, ps.Rs1, ps.Rs1)
+	case Inst_Fabs_d: // fsgnjx.d rd, rs, rs
+		return newInstruction(Inst_Fsgnjx_d, ps.Rd, ps.Rs1, ps.Rs1)
+	case Inst_Fneg_d: // fsgnjn.d rd, rs, rs
+		return newInstruction(Inst_Fsgnjn_d, ps.Rd, ps.Rs1, ps.Rs1)
+	case Inst_Csrr: // csrrs rd, csr, x0
+		return newInstruction(Inst_Csrrs, ps.Rd, ps.Rs1, 0)
+	case Inst_Csrw: // csrrw x0, csr, rs
+		return newInstruction(Inst_Csrrw, 0, ps.Rd, ps.Rs1)
+	case Inst_Csrs: // csrrs x0, csr, rs
+		return newInstruction(Inst_Csrrs, 0, ps.Rd, ps.Rs1)
+	case Inst_Csrc: // csrrc x0, csr, rs
+		return newInstruction(Inst_Csrrc, 0, ps.Rd, ps.Rs1)
+	case Inst_Csrwi: // csrrwi x0, csr, uimm
+		return newInstruction(Inst_Csrrwi, 0, ps.Rd, ps.Rs1)
+	case Inst_Csrsi: // csrrsi x0, csr, uimm
+		return newInstruction(Inst_Csrrsi, 0, ps.Rd, ps.Rs1)
+	case Inst_Csrci: // csrrci x0, csr, uimm
+		return newInstruction(Inst_Csrrci, 0, ps.Rd, ps.Rs1)
+	case Inst_Rdcycle: // csrrs rd, cycle, x0
+		return newInstruction(Inst_Csrrs, ps.Rd, int32(CSR_CYCLE), 0)
+	case Inst_Rdcycleh:
+		return newInstruction(Inst_Csrrs, ps.Rd, int32(CSR_CYCLEH), 0)
+	case Inst_Rdtime:
+		return newInstruction(Inst_Csrrs, ps.Rd, int32(CSR_TIME), 0)
+	case Inst_Rdtimeh:
+		return newInstruction(Inst_Csrrs, ps.Rd, int32(CSR_TIMEH), 0)
+	case Inst_Rdinstret:
+		return newInstruction(Inst_Csrrs, ps.Rd, int32(CSR_INSTRET), 0)
+	case Inst_Rdinstreth:
+		return newInstruction(Inst_Csrrs, ps.Rd, int32(CSR_INSTRETH), 0)
 	default:
 		return ps
 	}
@@ -1,18 +1,20 @@
 package vm
 
 type Vm_State struct {
-	Pc           uint32          `json:"pc"`
-	Cycle        int             `json:"cycle"`
-	Fetched      int             `json:"inst_fetched"`
-	Retired      int             `json:"inst_retired"`
-	Stalled      int             `json:"inst_stalled"`
-	Forwards     int             `json:"forwards"`
-	PredAccuracy int             `json:"pred_accuracy"`
-	Cpi          float32         `json:"cpi"`
-	Registers    map[uint8]int32 `json:"registers"`
-	Memory       map[uint32]byte `json:"memory"`
-	CycleInfo    Cycle_Info      `json:"cycle_info"`
-	Halt         bool            `json:"halt"`
+	Pc           uint32           `json:"pc"`
+	Cycle        int              `json:"cycle"`
+	Fetched      int              `json:"inst_fetched"`
+	Retired      int              `json:"inst_retired"`
+	Stalled      int              `json:"inst_stalled"`
+	Forwards     int              `json:"forwards"`
+	PredAccuracy int              `json:"pred_accuracy"`
+	Cpi          float32          `json:"cpi"`
+	Registers    map[uint8]int64  `json:"registers"`
+	FRegisters   map[uint8]uint64 `json:"fp_registers"`
+	Fcsr         uint32           `json:"fcsr"`
+	Memory       map[uint32]byte  `json:"memory"`
+	CycleInfo    Cycle_Info       `json:"cycle_info"`
+	Halt         bool             `json:"halt"`
 }
 
 func (v *Vm) GetState() Vm_State {
@@ -26,7 +28,9 @@ func (v *Vm) GetState() Vm_State {
 		Forwards:     int(v.Dm.N_forwards),
 		PredAccuracy: int(v.Dm.CalculatePredictionAccuracy()),
 		Cpi:          v.Dm.CalculateCpi(),
-		Registers:    map[uint8]int32{},
+		Registers:    map[uint8]int64{},
+		FRegisters:   map[uint8]uint64{},
+		Fcsr:         v.Fcsr,
 		Memory:       map[uint32]byte{},
 		CycleInfo:    v.Dm.Cycle_infos[len(v.Dm.Cycle_infos)-1],
 		Halt:         v.Halted,
@@ -41,12 +45,26 @@ func (v *Vm) GetState() Vm_State {
 		state.Registers[reg] = v.Registers[reg].Data
 	}
 
+	for _, reg := range v.FRegister_diff_idx {
+		state.FRegisters[reg] = v.FRegisters[reg].Data
+	}
+
 	return state
 }
 
+// Returns the instructions of the program, without the End instruction the
+// parser puts first. The ones in Memory are disassembled.
 func (v *Vm) GetProgramStr() []string {
 	var result []string
-	for _, inst := range v.program {
+	if v.program == nil {
+		lines, _ := v.Disassemble(v._code[0], v._code[1])
+		for _, line := range lines {
+			result = append(result, line.Text)
+		}
+		return result
+	}
+
+	for _, inst := range v.program[min(1, len(v.program)):] {
 		result = append(result, inst.Str())
 	}
 
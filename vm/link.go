@@ -0,0 +1,187 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Programs of several files. The files are parsed one after the other into
+// the same program, the code and every data section of a file follow the ones
+// of the files before it. The labels of a file are local to it, unless it
+// exports them with '.globl'. A label a file uses is its own one if it
+// declares it, the global one of that name otherwise. '.extern' declares
+// that a label comes from another file, so that it is reported if none
+// exports it. 'main' is always global, it is the entry of the program.
+//
+// A program of one file keeps the names of its labels. With more files, the
+// local labels are renamed to 'file:label', which can't clash with the labels
+// of the programs.
+
+type Source_File struct {
+	Name    string // Path of the file, for the includes and the error messages
+	Content string
+	Include bool // '.include' reads the files next to it, only for files read from the disk
+}
+
+// A label of .globl or .extern
+type global_decl struct {
+	label string
+	pos   source_pos
+}
+
+// Reads the files of a program.
+func readSourceFiles(filenames []string) ([]Source_File, error) {
+	files := make([]Source_File, 0, len(filenames))
+	for _, filename := range filenames {
+		str, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read file for parsing '%v': %v", filename, err.Error())
+		}
+		files = append(files, Source_File{filename, string(str), true})
+	}
+
+	return files, nil
+}
+
+// '.globl label' exports labels of the file, '.extern label' declares the
+// ones it uses from the other files. A '.globl' label the file doesn't
+// declare is imported too, like the compilers' output does.
+func (p *Parser) parseGlobal(tok Token, args []Token) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%v:%v '%v' expects at least one label", tok.line_num, tok.start+1, tok.Value)
+	}
+
+	for _, arg := range args {
+		if arg.Type != Tok_Symbol {
+			return fmt.Errorf("%v:%v Unexpected token '%v'", arg.line_num, arg.start+1, arg.Value)
+		}
+
+		decl := global_decl{arg.Value, arg.line_num}
+		if tok.Value == ".extern" {
+			p.imports = append(p.imports, decl)
+		} else {
+			p.exports = append(p.exports, decl)
+		}
+	}
+
+	return nil
+}
+
+// Moves the labels of the file just parsed into text and data, the tables of
+// the program. The exported labels keep their names, the local ones get the
+// scope as a prefix and so do the uses of them in the file. The instructions
+// of the file start at first_inst and its data label uses at first_use.
+func (p *Parser) linkFile(file, scope string, text map[string]uint32, data map[string]data_symbol, first_inst uint32, first_use int) error {
+	declared := func(label string) bool {
+		_, isText := p.symbol_table[label]
+		_, isData := p.data_symbols[label]
+		return isText || isData
+	}
+
+	exported := map[string]bool{"main": declared("main")}
+	for _, decl := range p.exports {
+		if declared(decl.label) {
+			exported[decl.label] = true
+		} else {
+			p.imports = append(p.imports, decl)
+		}
+	}
+
+	for label, ok := range exported {
+		if !ok {
+			continue
+		}
+		if other, ok := p.globals[label]; ok {
+			return fmt.Errorf("Global label '%v' is declared in both '%v' and '%v'", label, other, file)
+		}
+		p.globals[label] = file
+	}
+
+	// The labels of the pcrel_lo parts are unique in the program already
+	local := func(label string) bool {
+		return declared(label) && !exported[label] && !strings.HasPrefix(label, PCREL_LABEL_PREFIX)
+	}
+
+	for label, pc := range p.symbol_table {
+		if local(label) {
+			p.declareLocal(label, file)
+			label = scope + label
+		}
+		text[label] = pc
+	}
+	for label, sym := range p.data_symbols {
+		if local(label) {
+			p.declareLocal(label, file)
+			label = scope + label
+		}
+		data[label] = sym
+	}
+
+	for n := first_inst; n < uint32(len(p.Program)); n++ {
+		if ref, ok := p.insts_missing_label[n]; ok && local(ref.label) {
+			ref.label = scope + ref.label
+			p.insts_missing_label[n] = ref
+		}
+	}
+	for i := first_use; i < len(p.data_label_uses); i++ {
+		if use := &p.data_label_uses[i]; local(use.label) {
+			use.label = scope + use.label
+		}
+	}
+
+	p.symbol_table, p.data_symbols = text, data
+	return nil
+}
+
+// Keeps the first file declaring a local label, for the errors of the other
+// files using it.
+func (p *Parser) declareLocal(label, file string) {
+	if _, ok := p.locals[label]; !ok {
+		p.locals[label] = file
+	}
+}
+
+// Reports the labels imported or used that no file exports, once every file
+// is linked.
+func (p *Parser) checkUndefined() error {
+	undefined := func(label string, pos source_pos) error {
+		if _, ok := p.labelAddress(label); ok {
+			return nil
+		}
+		if file, ok := p.locals[label]; ok {
+			return fmt.Errorf("%v: Label '%v' is local to '%v', export it with '.globl'", pos, label, file)
+		}
+		return fmt.Errorf("%v: Undefined label '%v'", pos, label)
+	}
+
+	for _, decl := range p.imports {
+		_, local := p.locals[decl.label]
+		if _, ok := p.labelAddress(decl.label); !ok && !local {
+			return fmt.Errorf("%v: Label '%v' is imported, but no file exports it with '.globl'", decl.pos, decl.label)
+		}
+		if err := undefined(decl.label, decl.pos); err != nil {
+			return err
+		}
+	}
+
+	insts := make([]uint32, 0, len(p.insts_missing_label))
+	for n := range p.insts_missing_label {
+		insts = append(insts, n)
+	}
+	slices.Sort(insts)
+	for _, n := range insts {
+		if err := undefined(p.insts_missing_label[n].label, p.lines[n].pos); err != nil {
+			return err
+		}
+	}
+
+	for _, use := range p.data_label_uses {
+		if err := undefined(use.label, use.line_num); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
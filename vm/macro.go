@@ -0,0 +1,585 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The preprocessor of the assembler. It runs on the lines of the source before
+// the parser and expands the macros, repetitions, conditional blocks and
+// included files:
+//
+//	.macro push reg, size=4     ; Parameters are used as \reg and \size
+//	    addi sp, sp, -\size
+//	    sw   \reg, 0(sp)
+//	.endm
+//	    push a0                 ; Arguments are separated with commas, or
+//	    push a1 8               ; spaces when there is no comma
+//
+//	.rept 3                     ; The lines up to .endr, 3 times
+//	.if N > 4                   ; The lines up to .else or .endif when N > 4
+//	.include "io.asm"           ; Relative to the including file, only in
+//	                            ; programs read from a file
+//
+// Labels declared in a macro body are local to each expansion, they are
+// renamed with the number of the expansion, which '\@' also gives. Counts and
+// conditions are constant expressions, constants are known from the .equ and
+// .set lines before them.
+
+// Largest number of nested macro expansions and includes, deeper ones are
+// most likely recursive.
+const MAX_EXPANSION_DEPTH = 64
+
+// Largest count of '.rept'
+const MAX_REPT_COUNT = 1 << 16
+
+// Position of a line in the source files
+type source_pos struct {
+	file string // Empty for programs that are not read from a file
+	line uint32 // From 1
+}
+
+func (pos source_pos) String() string {
+	if pos.file == "" {
+		return strconv.Itoa(int(pos.line))
+	}
+	return fmt.Sprintf("%s:%d", pos.file, pos.line)
+}
+
+type source_line struct {
+	text string
+	pos  source_pos
+}
+
+type macro_param struct {
+	name        string
+	def         string // Default value
+	has_default bool
+}
+
+type macro struct {
+	params []macro_param
+	body   []source_line
+}
+
+type preprocessor struct {
+	macros     map[string]macro
+	constants  map[string]int64 // .equ and .set constants defined so far
+	expansions int              // Number of macro expansions so far, for '\@'
+	out        []source_line
+	include    bool // '.include' can read files
+}
+
+// Splits the content of a file into its lines.
+func sourceLines(content string, file string) []source_line {
+	var lines []source_line
+	for i, text := range strings.Split(content, "\n") {
+		lines = append(lines, source_line{text, source_pos{file, uint32(i + 1)}})
+	}
+	return lines
+}
+
+// Expands the program and returns its content for the lexer, with the
+// position of each of its lines. Only files read from the disk can include
+// others, see Source_File.
+func preprocess(content string, file string, include bool) (string, []source_pos, error) {
+	pp := preprocessor{macros: make(map[string]macro), constants: make(map[string]int64), include: include}
+	if err := pp.process(sourceLines(content, file), 0); err != nil {
+		return "", nil, err
+	}
+	if err := renameNumericLabels(pp.out); err != nil {
+		return "", nil, err
+	}
+
+	texts := make([]string, len(pp.out))
+	positions := make([]source_pos, len(pp.out))
+	for i, line := range pp.out {
+		texts[i] = line.text
+		positions[i] = line.pos
+	}
+
+	return strings.Join(texts, "\n"), positions, nil
+}
+
+func (pp *preprocessor) process(lines []source_line, depth int) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	if depth > MAX_EXPANSION_DEPTH {
+		return fmt.Errorf("%v: Too many nested macros or includes, is one of them recursive?", lines[0].pos)
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		label, word, rest := splitStatement(line.text)
+
+		// The label stays on its own line when the statement is expanded
+		labelLine := line
+		labelLine.text = label + ":"
+
+		switch word {
+		case ".macro":
+			end, err := blockEnd(lines, i, ".macro", ".endm", "")
+			if err != nil {
+				return err
+			}
+			if err := pp.defineMacro(line, rest, lines[i+1:end]); err != nil {
+				return err
+			}
+			i = end
+
+		case ".rept":
+			end, err := blockEnd(lines, i, ".rept", ".endr", "")
+			if err != nil {
+				return err
+			}
+
+			count, err := evalExpression(rest, pp.constants)
+			if err != nil {
+				return fmt.Errorf("%v: Invalid count '%v' for '.rept': %v", line.pos, rest, err)
+			}
+			if count < 0 || count > MAX_REPT_COUNT {
+				return fmt.Errorf("%v: Count '%v' of '.rept' must be in [0, %d]", line.pos, rest, MAX_REPT_COUNT)
+			}
+
+			if label != "" {
+				pp.out = append(pp.out, labelLine)
+			}
+			for range count {
+				if err := pp.process(lines[i+1:end], depth+1); err != nil {
+					return err
+				}
+			}
+			i = end
+
+		case ".if":
+			end, err := blockEnd(lines, i, ".if", ".endif", "")
+			if err != nil {
+				return err
+			}
+			// An .else of the same level splits the block
+			els, _ := blockEnd(lines[:end], i, ".if", ".endif", ".else")
+
+			cond, err := evalExpression(rest, pp.constants)
+			if err != nil {
+				return fmt.Errorf("%v: Invalid condition '%v' for '.if': %v", line.pos, rest, err)
+			}
+
+			if label != "" {
+				pp.out = append(pp.out, labelLine)
+			}
+
+			body := lines[i+1 : end]
+			if els > 0 {
+				body = lines[i+1 : els]
+				if cond == 0 {
+					body = lines[els+1 : end]
+				}
+			} else if cond == 0 {
+				body = nil
+			}
+			if err := pp.process(body, depth); err != nil {
+				return err
+			}
+			i = end
+
+		case ".endm", ".endr", ".else", ".endif":
+			return fmt.Errorf("%v: Unexpected '%v'", line.pos, word)
+
+		case ".include":
+			name, err := strconv.Unquote(rest)
+			if err != nil || !strings.HasPrefix(rest, "\"") {
+				return fmt.Errorf("%v: '.include' expects a quoted file name, got '%v'", line.pos, rest)
+			}
+			// Programs sent to the server can't read its files, whatever their name
+			if !pp.include {
+				return fmt.Errorf("%v: '.include' can only be used in programs read from a file", line.pos)
+			}
+			name = filepath.Join(filepath.Dir(line.pos.file), name)
+
+			content, err := os.ReadFile(name)
+			if err != nil {
+				return fmt.Errorf("%v: Failed to include '%v': %v", line.pos, name, err)
+			}
+
+			if label != "" {
+				pp.out = append(pp.out, labelLine)
+			}
+			if err := pp.process(sourceLines(string(content), name), depth+1); err != nil {
+				return err
+			}
+
+		default:
+			m, isMacro := pp.macros[word]
+			if !isMacro {
+				if word == ".equ" || word == ".set" {
+					pp.defineConstant(rest)
+				}
+				pp.out = append(pp.out, line)
+				continue
+			}
+
+			expanded, err := pp.expandMacro(line, word, m, rest)
+			if err != nil {
+				return err
+			}
+
+			if label != "" {
+				pp.out = append(pp.out, labelLine)
+			}
+			if err := pp.process(expanded, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the index of the line closing the block opened at lines[start].
+// Blocks of the same kind can be nested. With a separator like '.else', the
+// index of the separator of the block is returned instead, or 0 without one.
+func blockEnd(lines []source_line, start int, open, close, separator string) (int, error) {
+	level := 0
+	for i := start + 1; i < len(lines); i++ {
+		_, word, _ := splitStatement(lines[i].text)
+		switch {
+		case word == open:
+			level++
+		case word == close && level == 0:
+			if separator != "" {
+				return 0, nil
+			}
+			return i, nil
+		case word == close:
+			level--
+		case word == separator && separator != "" && level == 0:
+			return i, nil
+		}
+	}
+
+	if separator != "" {
+		return 0, nil
+	}
+	return 0, fmt.Errorf("%v: '%v' without '%v'", lines[start].pos, open, close)
+}
+
+// '.macro name param, param=default' followed by its body.
+func (pp *preprocessor) defineMacro(line source_line, rest string, body []source_line) error {
+	end := symbolEnd(rest)
+	name, params := rest[:end], strings.TrimLeft(rest[end:], " \t,")
+	if name == "" || !isSymbolStart(name[0]) || (end < len(rest) && !strings.ContainsRune(" \t,", rune(rest[end]))) {
+		return fmt.Errorf("%v: Invalid macro name '%v'", line.pos, name)
+	}
+
+	m := macro{body: body}
+	for _, arg := range splitArguments(params) {
+		param := macro_param{name: arg}
+		if before, after, ok := strings.Cut(arg, "="); ok {
+			param = macro_param{strings.TrimSpace(before), strings.TrimSpace(after), true}
+		}
+
+		if param.name == "" || symbolEnd(param.name) != len(param.name) {
+			return fmt.Errorf("%v: Invalid parameter '%v' of macro '%v'", line.pos, arg, name)
+		}
+		m.params = append(m.params, param)
+	}
+
+	pp.macros[name] = m
+	return nil
+}
+
+// Returns the body of the macro with the arguments in place of the
+// parameters, and its labels renamed for this expansion.
+func (pp *preprocessor) expandMacro(line source_line, name string, m macro, rest string) ([]source_line, error) {
+	args := splitArguments(rest)
+	if len(args) > len(m.params) {
+		return nil, fmt.Errorf("%v: Too many arguments for macro '%v', expected %d", line.pos, name, len(m.params))
+	}
+
+	values := make(map[string]string, len(m.params))
+	for i, param := range m.params {
+		switch {
+		case i < len(args):
+			values[param.name] = args[i]
+		case param.has_default:
+			values[param.name] = param.def
+		default:
+			return nil, fmt.Errorf("%v: Missing argument '%v' for macro '%v'", line.pos, param.name, name)
+		}
+	}
+
+	pp.expansions++
+	values["@"] = strconv.Itoa(pp.expansions)
+
+	// Labels written in the body, not the ones made from arguments
+	locals := make(map[string]string)
+	for _, body_line := range m.body {
+		if label, _, _ := splitStatement(body_line.text); label != "" {
+			locals[label] = fmt.Sprintf("%s.%d", label, pp.expansions)
+		}
+	}
+
+	expanded := make([]source_line, len(m.body))
+	for i, body_line := range m.body {
+		text := renameSymbols(body_line.text, locals)
+		expanded[i] = source_line{substituteParams(text, values), body_line.pos}
+	}
+
+	return expanded, nil
+}
+
+// Records a '.equ name, value' or '.set name, value' constant for the
+// conditions and counts. Invalid ones are left to the parser to report.
+func (pp *preprocessor) defineConstant(rest string) {
+	name, value, ok := strings.Cut(rest, ",")
+	if !ok {
+		return
+	}
+
+	if val, err := evalExpression(strings.TrimSpace(value), pp.constants); err == nil {
+		pp.constants[strings.TrimSpace(name)] = val
+	}
+}
+
+// Splits a line into the label declared at its start, its first word and the
+// rest, without the comment.
+func splitStatement(text string) (string, string, string) {
+	s := strings.TrimSpace(stripComment(text))
+
+	label := ""
+	if end := symbolEnd(s); end > 0 && isSymbolStart(s[0]) {
+		if after := strings.TrimLeft(s[end:], " \t"); strings.HasPrefix(after, ":") {
+			label = s[:end]
+			s = strings.TrimSpace(after[1:])
+		}
+	}
+
+	end := symbolEnd(s)
+	if end == 0 || !isSymbolStart(s[0]) {
+		return label, "", s
+	}
+
+	return label, s[:end], strings.TrimSpace(s[end:])
+}
+
+// Returns the length of the symbol at the start of s.
+func symbolEnd(s string) int {
+	end := 0
+	for end < len(s) && isSymbol(s[end]) {
+		end++
+	}
+	return end
+}
+
+// Returns the end of the quoted string or character starting at s[i].
+func quoteEnd(s string, i int) int {
+	quote := s[i]
+	for i++; i < len(s) && s[i] != quote; i++ {
+		if s[i] == '\\' {
+			i++
+		}
+	}
+	return min(i+1, len(s))
+}
+
+// Removes the comment at the end of the line, quotes can hold a ';' or '#'.
+func stripComment(text string) string {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"', '\'':
+			i = quoteEnd(text, i) - 1
+		case ';', '#':
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// Splits the arguments of a macro or the parameters of its definition. They
+// are separated with commas, or with spaces when there is no comma outside
+// the parentheses and quotes.
+func splitArguments(s string) []string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+
+	split := func(sep func(byte) bool) []string {
+		var args []string
+		depth, start := 0, 0
+		for i := 0; i < len(s); i++ {
+			switch ch := s[i]; {
+			case ch == '"' || ch == '\'':
+				i = quoteEnd(s, i) - 1
+			case ch == '(':
+				depth++
+			case ch == ')':
+				depth--
+			case depth == 0 && sep(ch):
+				args = append(args, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+		return append(args, strings.TrimSpace(s[start:]))
+	}
+
+	args := split(func(ch byte) bool { return ch == ',' })
+	if len(args) > 1 {
+		return args
+	}
+
+	args = nil
+	for _, arg := range split(func(ch byte) bool { return ch == ' ' || ch == '\t' }) {
+		if arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
+
+// Replaces the symbols of the line found in names, outside the quotes and
+// the comment.
+func renameSymbols(text string, names map[string]string) string {
+	if len(names) == 0 {
+		return text
+	}
+
+	return replaceWords(text, func(word string) string {
+		if name, ok := names[word]; ok {
+			return name
+		}
+		return word
+	})
+}
+
+// Puts the word replace returns in place of every word of the line, outside
+// the quotes and the comment. Words are symbols and numbers, the '\name' of
+// the macro parameters are not words.
+func replaceWords(text string, replace func(string) string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		ch := text[i]
+		switch {
+		case ch == '"' || ch == '\'':
+			end := quoteEnd(text, i)
+			b.WriteString(text[i:end])
+			i = end
+		case ch == ';' || ch == '#':
+			b.WriteString(text[i:])
+			i = len(text)
+		case ch == '\\':
+			end := i + 1 + symbolEnd(text[i+1:])
+			b.WriteString(text[i:end])
+			i = end
+		case isSymbol(ch):
+			end := i + symbolEnd(text[i:])
+			b.WriteString(replace(text[i:end]))
+			i = end
+		default:
+			b.WriteByte(ch)
+			i++
+		}
+	}
+
+	return b.String()
+}
+
+// Replaces '\name' with the value of the parameter name, and '\@' with the
+// number of the expansion. Other backslashes are kept, like the escapes in
+// strings.
+func substituteParams(text string, values map[string]string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' || i+1 == len(text) {
+			b.WriteByte(text[i])
+			continue
+		}
+
+		name := "@"
+		if text[i+1] != '@' {
+			name = text[i+1 : i+1+symbolEnd(text[i+1:])]
+		}
+
+		value, ok := values[name]
+		if name == "" || !ok {
+			b.WriteByte(text[i])
+			continue
+		}
+		b.WriteString(value)
+		i += len(name)
+	}
+
+	return b.String()
+}
+
+// Returns the number of a numeric local label declared at the start of the
+// line, like '1:', the indentation before it and the rest of the line.
+func numericLabel(text string) (string, string, string, bool) {
+	s := strings.TrimLeft(text, " \t")
+	end := 0
+	for end < len(s) && '0' <= s[end] && s[end] <= '9' {
+		end++
+	}
+
+	after := strings.TrimLeft(s[end:], " \t")
+	if end == 0 || !strings.HasPrefix(after, ":") {
+		return "", "", text, false
+	}
+	return s[:end], text[:len(text)-len(s)], after[1:], true
+}
+
+// Renames the numeric local labels like '1:' to unique labels. They can be
+// declared many times, '1b' refers to the last '1:' before it, or on the same
+// line, and '1f' to the next one.
+func renameNumericLabels(lines []source_line) error {
+	total := make(map[string]int)
+	for _, line := range lines {
+		if num, _, _, ok := numericLabel(line.text); ok {
+			total[num]++
+		}
+	}
+
+	name := func(num string, n int) string {
+		return fmt.Sprintf(".Lnum_%s_%d", num, n)
+	}
+
+	seen := make(map[string]int)
+	for i := range lines {
+		line := &lines[i]
+
+		prefix, rest := "", line.text
+		if num, indent, after, ok := numericLabel(line.text); ok {
+			seen[num]++
+			prefix, rest = indent+name(num, seen[num])+":", after
+		}
+
+		var err error
+		rest = replaceWords(rest, func(word string) string {
+			num, dir := word[:len(word)-1], word[len(word)-1]
+			if num == "" || strings.Trim(num, "0123456789") != "" || (dir != 'b' && dir != 'f') {
+				return word
+			}
+
+			n := seen[num] + 1
+			if dir == 'b' {
+				n = seen[num]
+			}
+			if n < 1 || n > total[num] {
+				err = fmt.Errorf("%v: Undeclared local label '%v'", line.pos, word)
+				return word
+			}
+			return name(num, n)
+		})
+		if err != nil {
+			return err
+		}
+
+		line.text = prefix + rest
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+package vm
+
+import (
+	"fmt"
+)
+
+// Sv32 virtual memory. Translation is active in supervisor mode when satp
+// selects Sv32, machine mode always uses physical addresses. Data addresses
+// are translated in the execute stage, right after they are computed, and
+// the pc is translated in the fetch stage. Physical code addresses index the
+// program, physical data addresses index the memory.
+
+const (
+	SATP_MODE_SV32 uint32 = 1 << 31
+	SATP_PPN_MASK  uint32 = 0x3fffff
+
+	PAGE_SHIFT            = 12
+	PAGE_SIZE             = 1 << PAGE_SHIFT
+	MEGAPAGE_SHIFT        = 22 // A leaf in the root table maps 4 MiB
+	PTE_SIZE              = 4
+	PTE_PPN_SHIFT         = 10
+	VPN_BITS              = 10
+	VPN_MASK       uint32 = 1<<VPN_BITS - 1
+)
+
+// Page table entry flags
+const (
+	PTE_V uint32 = 1 << iota // Valid
+	PTE_R                    // Readable
+	PTE_W                    // Writable
+	PTE_X                    // Executable
+	PTE_U                    // Accessible from user mode
+	PTE_G                    // Global
+	PTE_A                    // Accessed
+	PTE_D                    // Dirty
+)
+
+// Default TLB configuration
+const (
+	DEFAULT_TLB_ENTRIES      = 16
+	DEFAULT_TLB_WALK_LATENCY = 2 // Cycles per page table read
+)
+
+type Access_Type uint8
+
+const (
+	ACCESS_FETCH Access_Type = iota
+	ACCESS_LOAD
+	ACCESS_STORE // Also the atomics, except 'lr'
+)
+
+type tlb_entry struct {
+	vpn   uint32 // Virtual page number, the low VPN_BITS are zero for megapages
+	ppn   uint32
+	pte   uint32 // Flags of the leaf entry
+	mega  bool
+	valid bool
+	used  uint64 // Time of the last use, the least recently used entry is replaced
+}
+
+// Fully associative translation lookaside buffer shared by fetches and data accesses.
+type Tlb struct {
+	entries []tlb_entry
+	clock   uint64
+}
+
+func createTlb(n int) Tlb {
+	return Tlb{entries: make([]tlb_entry, n)}
+}
+
+func (e *tlb_entry) matches(vaddr uint32) bool {
+	vpn := vaddr >> PAGE_SHIFT
+	if e.mega {
+		vpn &^= VPN_MASK
+	}
+	return e.valid && e.vpn == vpn
+}
+
+// Returns the physical address, it can be wider than 32 bits.
+func (e *tlb_entry) physical(vaddr uint32) uint64 {
+	if e.mega {
+		return uint64(e.ppn>>VPN_BITS)<<MEGAPAGE_SHIFT | uint64(vaddr&(1<<MEGAPAGE_SHIFT-1))
+	}
+	return uint64(e.ppn)<<PAGE_SHIFT | uint64(vaddr&(PAGE_SIZE-1))
+}
+
+func (t *Tlb) lookup(vaddr uint32) (*tlb_entry, bool) {
+	t.clock++
+	for i := range t.entries {
+		if e := &t.entries[i]; e.matches(vaddr) {
+			e.used = t.clock
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Inserts the entry in place of an invalid or the least recently used one.
+func (t *Tlb) insert(entry tlb_entry) *tlb_entry {
+	victim := &t.entries[0]
+	for i := range t.entries {
+		e := &t.entries[i]
+		if !e.valid {
+			victim = e
+			break
+		}
+		if e.used < victim.used {
+			victim = e
+		}
+	}
+
+	entry.valid = true
+	entry.used = t.clock
+	*victim = entry
+	return victim
+}
+
+// Invalidates the entries that map the given address, or every entry if all is set.
+func (t *Tlb) flush(vaddr uint32, all bool) {
+	for i := range t.entries {
+		if all || t.entries[i].matches(vaddr) {
+			t.entries[i].valid = false
+		}
+	}
+}
+
+func pageFault(access Access_Type, vaddr uint32) *Exception {
+	switch access {
+	case ACCESS_FETCH:
+		return newException(CAUSE_FETCH_PAGE_FAULT, vaddr, "Instruction page fault at '%#x'", vaddr)
+	case ACCESS_LOAD:
+		return newException(CAUSE_LOAD_PAGE_FAULT, vaddr, "Load page fault at '%#x'", vaddr)
+	default:
+		return newException(CAUSE_STORE_PAGE_FAULT, vaddr, "Store page fault at '%#x'", vaddr)
+	}
+}
+
+func accessFault(access Access_Type, addr uint32, reason string) *Exception {
+	msg := fmt.Sprintf("%s at '%#x'", reason, addr)
+	switch access {
+	case ACCESS_FETCH:
+		return newException(CAUSE_FETCH_ACCESS, addr, "Instruction access fault: %s", msg)
+	case ACCESS_LOAD:
+		return newException(CAUSE_LOAD_ACCESS, addr, "Load access fault: %s", msg)
+	default:
+		return newException(CAUSE_STORE_ACCESS, addr, "Store access fault: %s", msg)
+	}
+}
+
+// Returns the privilege level data accesses are made with. In machine mode
+// mstatus.MPRV makes them use the privilege level in MPP instead.
+func (v *Vm) dataPrivilege() uint32 {
+	if v.Priv == PRIV_M && v.Csrs.Mstatus&MSTATUS_MPRV != 0 {
+		return (v.Csrs.Mstatus & MSTATUS_MPP) >> MSTATUS_MPP_SHIFT
+	}
+	return v.Priv
+}
+
+// Translates a virtual address for the given access. Returns the physical
+// address and the number of cycles spent walking the page table, which is
+// non-zero on a TLB miss. Returns the exception if the access faults.
+func (v *Vm) translate(vaddr uint32, access Access_Type) (uint32, int, *Exception) {
+	priv := v.Priv
+	if access != ACCESS_FETCH {
+		priv = v.dataPrivilege()
+	}
+
+	if priv == PRIV_M || v.Csrs.Satp&SATP_MODE_SV32 == 0 {
+		return vaddr, 0, nil
+	}
+
+	cycles := 0
+	entry, hit := v.Tlb.lookup(vaddr)
+	if hit {
+		v.Dm.N_tlb_hits++
+	} else {
+		v.Dm.N_tlb_misses++
+		v.Dm.N_page_walks++
+
+		walked, reads, exc := v.walkPageTable(vaddr, access)
+		cycles = reads * v.Config.Tlb_walk_latency
+		v.Dm.N_walk_cycles += uint(cycles)
+		if exc != nil {
+			return 0, cycles, exc
+		}
+		entry = v.Tlb.insert(walked)
+	}
+
+	// Permissions are checked on every access, they depend on the privilege
+	// level and mstatus which can change without a TLB flush.
+	if !pteAllows(entry.pte, access, priv, v.Csrs.Mstatus) {
+		return 0, cycles, pageFault(access, vaddr)
+	}
+
+	paddr := entry.physical(vaddr)
+	if paddr>>32 != 0 {
+		return 0, cycles, accessFault(access, vaddr, "physical address out of range")
+	}
+
+	return uint32(paddr), cycles, nil
+}
+
+// Walks the two level Sv32 page table. Returns the leaf as a TLB entry and
+// the number of page table entries read.
+func (v *Vm) walkPageTable(vaddr uint32, access Access_Type) (tlb_entry, int, *Exception) {
+	table := uint64(v.Csrs.Satp&SATP_PPN_MASK) << PAGE_SHIFT
+	vpn := vaddr >> PAGE_SHIFT
+
+	for level, reads := 1, 1; level >= 0; level, reads = level-1, reads+1 {
+		index := (vpn >> (VPN_BITS * level)) & VPN_MASK
+		pte_addr := table + uint64(index*PTE_SIZE)
+
+		// Physical addresses can be wider than the memory addresses
+		if pte_addr>>32 != 0 {
+			return tlb_entry{}, reads, accessFault(access, vaddr, "page table out of range")
+		}
+
+		data, exc := v.memoryRead(uint32(pte_addr), PTE_SIZE)
+		if exc != nil {
+			return tlb_entry{}, reads, accessFault(access, uint32(pte_addr), "page table entry out of memory")
+		}
+		pte := uint32(data)
+		ppn := pte >> PTE_PPN_SHIFT
+
+		// Writable pages must be readable
+		if pte&PTE_V == 0 || (pte&PTE_R == 0 && pte&PTE_W != 0) {
+			return tlb_entry{}, reads, pageFault(access, vaddr)
+		}
+
+		// Not a leaf, go down a level
+		if pte&(PTE_R|PTE_X) == 0 {
+			if level == 0 {
+				return tlb_entry{}, reads, pageFault(access, vaddr)
+			}
+			table = uint64(ppn) << PAGE_SHIFT
+			continue
+		}
+
+		// A megapage must be aligned to 4 MiB
+		mega := level == 1
+		if mega && ppn&VPN_MASK != 0 {
+			return tlb_entry{}, reads, pageFault(access, vaddr)
+		}
+
+		if mega {
+			vpn &^= VPN_MASK
+		}
+		return tlb_entry{vpn: vpn, ppn: ppn, pte: pte & 0xff, mega: mega}, reads, nil
+	}
+
+	panic("unreachable")
+}
+
+// Reports whether the leaf entry flags allow the access. The accessed and
+// dirty bits are not updated by the walker, an access that would need to set
+// them faults and the handler sets them.
+func pteAllows(pte uint32, access Access_Type, priv uint32, mstatus uint32) bool {
+	// Supervisor mode can only read and write user pages if SUM is set, and
+	// can never execute them.
+	if pte&PTE_U != 0 {
+		if priv == PRIV_S && (access == ACCESS_FETCH || mstatus&MSTATUS_SUM == 0) {
+			return false
+		}
+	} else if priv == PRIV_U {
+		return false
+	}
+
+	if pte&PTE_A == 0 {
+		return false
+	}
+
+	switch access {
+	case ACCESS_FETCH:
+		return pte&PTE_X != 0
+	case ACCESS_LOAD:
+		// MXR makes executable pages readable
+		return pte&PTE_R != 0 || (mstatus&MSTATUS_MXR != 0 && pte&PTE_X != 0)
+	default:
+		return pte&PTE_W != 0 && pte&PTE_D != 0
+	}
+}
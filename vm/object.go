@@ -0,0 +1,344 @@
+package vm
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Assembled programs, written as a flat binary, an ELF file or a listing.
+// The code starts at TEXT_BASE, after the End instruction the parser puts at
+// address 0. End is not encoded, the memory is zero there and a 'ret' to
+// address 0 stops like in the simulator. The data
+// sections follow the code, from the first multiple of DATA_ALIGN. The
+// simulator keeps its data at address 0 instead, so the addresses of the data
+// labels in the binaries are not the ones of a simulated run. The loads and
+// stores reach the same data in both, the values of the addresses differ,
+// Data_addresses lists the lines using them.
+
+// Address of the first instruction of the programs, the End instruction takes
+// the addresses below it
+const TEXT_BASE = 4
+
+type Object struct {
+	Xlen int
+
+	Code      []byte // Machine code of .text, from TEXT_BASE
+	Data      []byte // .data, .rodata and .bss, from Data_base
+	Data_base uint32
+	Sections  [SECTION_BSS + 1]Object_Section
+
+	Symbols     []Object_Symbol // By address
+	Relocations []Object_Reloc
+	Entry       uint32
+
+	Lines          []Listing_Line // One for each instruction
+	Data_addresses []string       // Positions of the lines using the address of a data label as a value
+	compressed     bool           // Some instructions are compressed
+}
+
+type Object_Section struct {
+	Addr  uint32
+	Size  uint32
+	Align uint32
+}
+
+type Object_Symbol struct {
+	Name    string
+	Addr    uint32
+	Section Section
+	Global  bool
+}
+
+// A label use that depends on where the sections are placed. Only the
+// relocatable ELF output keeps them, uses of .text labels relative to the
+// pc don't need one.
+type Object_Reloc struct {
+	Section Section // Section of the instruction or data value using the label
+	Offset  uint32  // In the section
+	Type    elf.R_RISCV
+	Symbol  string
+	Addend  int32
+}
+
+type Listing_Line struct {
+	Addr   uint32
+	Code   uint32 // The low 16 bits for compressed instructions
+	Inst   Instruction
+	Pos    string // Position of the source line
+	Source string
+}
+
+// Assembles a program to machine code, see Object.
+func AssembleFile(filename string, xlen int) (*Object, error) {
+	return AssembleFiles([]string{filename}, xlen)
+}
+
+func AssembleString(program_str string, xlen int) (*Object, error) {
+	return AssembleSources([]Source_File{{"", program_str, false}}, xlen)
+}
+
+// Assembles the files into one program, see link.go.
+func AssembleFiles(filenames []string, xlen int) (*Object, error) {
+	files, err := readSourceFiles(filenames)
+	if err != nil {
+		return nil, err
+	}
+
+	return AssembleSources(files, xlen)
+}
+
+func AssembleSources(files []Source_File, xlen int) (*Object, error) {
+	parser, err := assembleFiles(files, xlen, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return newObject(parser, xlen)
+}
+
+func newObject(p *Parser, xlen int) (*Object, error) {
+	o := &Object{Xlen: xlen, Data: p.image, Data_base: p.data_base, Entry: p.entry}
+
+	pcs := make([]uint32, len(p.Program))
+	pc := uint32(TEXT_BASE)
+	for n, inst := range p.Program {
+		if inst.Op == Inst_End {
+			continue
+		}
+		pcs[n] = pc
+		if ref, ok := p.insts_missing_label[uint32(n)]; ok && ref.reloc == RELOC_NONE && inst.Op == Inst_Auipc {
+			return nil, fmt.Errorf("%v: 'auipc' with the offset of label '%v' only runs in the simulator, use 'la' or '%%pcrel_hi'", p.lines[n].pos, ref.label)
+		}
+		code, err := encodeInstruction(inst, xlen)
+		if err != nil {
+			return nil, fmt.Errorf("%v: Can't encode '%s': %v", p.lines[n].pos, inst.Str(), err)
+		}
+
+		o.Code = appendValue(o.Code, uint64(code), inst.size())
+		o.Lines = append(o.Lines, Listing_Line{pc, code, inst, p.lines[n].pos.String(), strings.TrimSpace(p.lines[n].text)})
+		o.compressed = o.compressed || inst.Compressed
+		pc += inst.size()
+	}
+
+	o.Sections[SECTION_TEXT] = Object_Section{TEXT_BASE, pc - TEXT_BASE, 4}
+	if o.compressed {
+		o.Sections[SECTION_TEXT].Align = 2
+	}
+	for s := SECTION_DATA; s <= SECTION_BSS; s++ {
+		o.Sections[s] = Object_Section{p.data[s].base, uint32(len(p.data[s].bytes)), max(p.data[s].align, 1)}
+	}
+
+	for name, addr := range p.symbol_table {
+		_, global := p.globals[name]
+		if n, ok := strings.CutPrefix(name, PCREL_LABEL_PREFIX); ok {
+			name = ".Lpcrel_hi" + n
+		}
+		o.Symbols = append(o.Symbols, Object_Symbol{name, addr, SECTION_TEXT, global})
+	}
+	for name, sym := range p.data_symbols {
+		_, global := p.globals[name]
+		o.Symbols = append(o.Symbols, Object_Symbol{name, p.data[sym.section].base + sym.offset, sym.section, global})
+	}
+	slices.SortFunc(o.Symbols, func(a, b Object_Symbol) int {
+		if a.Addr != b.Addr {
+			return int(int64(a.Addr) - int64(b.Addr))
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	o.Relocations = p.relocations(pcs)
+	o.Data_addresses = p.dataAddressUses()
+	return o, nil
+}
+
+// Returns the positions of the instructions and data values using the address
+// of a data label as a value, see Object. The loads and stores only use it to
+// reach the data, like the lui or auipc of their upper bits before them.
+func (p *Parser) dataAddressUses() []string {
+	var insts []uint32
+	for n, ref := range p.insts_missing_label {
+		if _, ok := p.data_symbols[ref.label]; !ok {
+			continue
+		}
+		inst := p.Program[n]
+		if inst.isLoad() || inst.isStore() {
+			continue
+		}
+		if next := n + 1; inst._fmt == Fmt_U && int(next) < len(p.Program) && (p.Program[next].isLoad() || p.Program[next].isStore()) {
+			continue
+		}
+		insts = append(insts, n)
+	}
+	slices.Sort(insts)
+
+	var uses []string
+	for _, n := range insts {
+		uses = append(uses, p.lines[n].pos.String())
+	}
+	for _, use := range p.data_label_uses {
+		if _, ok := p.data_symbols[use.label]; ok {
+			uses = append(uses, use.line_num.String())
+		}
+	}
+	// The instructions of a pseudo instruction and the values of a directive
+	// share their line
+	return slices.Compact(uses)
+}
+
+// Returns the label uses that depend on the placement of the sections, see
+// Object_Reloc. The ones that can't be expressed with the relocations of the
+// RISC-V ELF have the type R_RISCV_NONE.
+func (p *Parser) relocations(pcs []uint32) []Object_Reloc {
+	var relocs []Object_Reloc
+
+	symbolName := func(label string) string {
+		if n, ok := strings.CutPrefix(label, PCREL_LABEL_PREFIX); ok {
+			return ".Lpcrel_hi" + n
+		}
+		return label
+	}
+	inText := func(label string) bool {
+		_, ok := p.symbol_table[label]
+		return ok
+	}
+
+	index_at := make(map[uint32]uint32, len(pcs))
+	for n, pc := range pcs {
+		index_at[pc] = uint32(n)
+	}
+
+	for n, ref := range p.insts_missing_label {
+		inst := p.Program[n]
+		reloc := Object_Reloc{Section: SECTION_TEXT, Offset: pcs[n] - TEXT_BASE, Symbol: symbolName(ref.label), Addend: ref.addend}
+
+		lo := elf.R_RISCV_LO12_I
+		if inst.isStore() {
+			lo = elf.R_RISCV_LO12_S
+		}
+
+		switch ref.reloc {
+		case RELOC_NONE:
+			switch {
+			case inst.isBranch() && inText(ref.label):
+				continue
+			case inst._fmt == Fmt_U:
+				reloc.Type = elf.R_RISCV_HI20
+			case !inst.isBranch():
+				reloc.Type = lo
+			}
+
+		case RELOC_HI:
+			if inst._fmt == Fmt_U {
+				reloc.Type = elf.R_RISCV_HI20
+			}
+		case RELOC_LO:
+			reloc.Type = lo
+
+		case RELOC_PCREL_HI:
+			if inText(ref.label) {
+				continue
+			}
+			if inst.Op == Inst_Auipc {
+				reloc.Type = elf.R_RISCV_PCREL_HI20
+			}
+		case RELOC_PCREL_LO:
+			// Relocated with its auipc, which is found by its label
+			addr, _ := p.labelAddress(ref.label)
+			if hi_ref := p.insts_missing_label[index_at[addr]]; inText(hi_ref.label) {
+				continue
+			}
+			reloc.Type = elf.R_RISCV_PCREL_LO12_I
+			if inst.isStore() {
+				reloc.Type = elf.R_RISCV_PCREL_LO12_S
+			}
+		}
+
+		relocs = append(relocs, reloc)
+	}
+
+	for _, use := range p.data_label_uses {
+		reloc := Object_Reloc{Section: use.section, Offset: use.offset, Symbol: use.label}
+		switch use.size {
+		case 4:
+			reloc.Type = elf.R_RISCV_32
+		case 8:
+			reloc.Type = elf.R_RISCV_64
+		}
+		relocs = append(relocs, reloc)
+	}
+
+	slices.SortFunc(relocs, func(a, b Object_Reloc) int {
+		if a.Section != b.Section {
+			return int(a.Section) - int(b.Section)
+		}
+		return int(int64(a.Offset) - int64(b.Offset))
+	})
+	return relocs
+}
+
+// Returns the memory image from address 0 to the end of .bss.
+func (o *Object) image() []byte {
+	bss := o.Sections[SECTION_BSS]
+	image := make([]byte, bss.Addr+bss.Size)
+	copy(image[TEXT_BASE:], o.Code)
+	copy(image[o.Data_base:], o.Data)
+	return image
+}
+
+// Writes the memory image from TEXT_BASE to the end of .rodata, .bss is left
+// out.
+func (o *Object) WriteBinary(w io.Writer) error {
+	_, err := w.Write(o.image()[TEXT_BASE:o.Sections[SECTION_BSS].Addr])
+	return err
+}
+
+// Writes the address, the machine code and the instruction of every
+// instruction next to its source line, then the data sections and the
+// symbols.
+func (o *Object) WriteListing(w io.Writer) error {
+	var b strings.Builder
+
+	last := ""
+	for _, line := range o.Lines {
+		code := fmt.Sprintf("%08x", line.Code)
+		if line.Inst.Compressed {
+			code = fmt.Sprintf("%04x    ", line.Code)
+		}
+
+		// Instructions expanded from the same line show it once
+		source := ""
+		if line.Pos != last {
+			source = fmt.Sprintf("%s  %s", line.Pos, line.Source)
+			last = line.Pos
+		}
+		fmt.Fprintf(&b, "%08x  %s  %-32s %s\n", line.Addr, code, line.Inst.Str(), source)
+	}
+
+	names := [...]string{SECTION_DATA: ".data", SECTION_RODATA: ".rodata", SECTION_BSS: ".bss"}
+	for s := SECTION_DATA; s <= SECTION_BSS; s++ {
+		sec := o.Sections[s]
+		if sec.Size == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&b, "\n%s, %d bytes at %08x\n", names[s], sec.Size, sec.Addr)
+		if s == SECTION_BSS {
+			continue
+		}
+		bytes := o.Data[sec.Addr-o.Data_base : sec.Addr-o.Data_base+sec.Size]
+		for i := 0; i < len(bytes); i += 16 {
+			fmt.Fprintf(&b, "%08x  % x\n", sec.Addr+uint32(i), bytes[i:min(i+16, len(bytes))])
+		}
+	}
+
+	b.WriteString("\nSymbols\n")
+	for _, sym := range o.Symbols {
+		fmt.Fprintf(&b, "%08x  %s\n", sym.Addr, sym.Name)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,243 @@
+package vm
+
+import (
+	"bytes"
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Encodings given by 'llvm-mc -triple=riscv32 -mattr=+m,+a,+f,+d,+c', the
+// branches go to the first instruction, main, and to the first compressed
+// one, end.
+var knownEncodings = []struct {
+	line string
+	code uint32
+}{
+	{"addi a0, zero, 42", 0x02a00513},
+	{"lui t0, 0x12345", 0x123452b7},
+	{"auipc t1, 0x1", 0x00001317},
+	{"sw a0, -4(sp)", 0xfea12e23},
+	{"lw a1, 8(sp)", 0x00812583},
+	{"slli a2, a1, 3", 0x00359613},
+	{"srai a3, a2, 31", 0x41f65693},
+	{"sub a4, a3, a2", 0x40c68733},
+	{"sltu a5, a4, a3", 0x00d737b3},
+	{"beq a0, a1, main", 0xfcb50ee3},
+	{"bge a2, a3, end", 0x04d65a63},
+	{"jal ra, main", 0xfd5ff0ef},
+	{"jalr zero, 0(ra)", 0x00008067},
+	{"mul a2, a0, a1", 0x02b50633},
+	{"div a3, a2, a0", 0x02a646b3},
+	{"remu a4, a3, a2", 0x02c6f733},
+	{"lr.w t2, (a0)", 0x100523af},
+	{"sc.w t4, t3, (a0)", 0x19c52eaf},
+	{"amoadd.w t3, a1, (a0)", 0x00b52e2f},
+	{"fadd.s ft0, ft1, ft2, rne", 0x00208053},
+	{"flw ft3, -8(sp)", 0xff812187},
+	{"fsd fs0, 24(sp)", 0x00813c27},
+	{"fmadd.d fa1, fa2, fa3, fa4, rtz", 0x72d615c3},
+	{"fcvt.w.d a0, fa1, rtz", 0xc2059553},
+	{"csrrw t0, mstatus, t1", 0x300312f3},
+	{"csrrsi t2, mie, 8", 0x304463f3},
+	{"ecall", 0x00000073},
+	{"ebreak", 0x00100073},
+	{"mret", 0x30200073},
+	{"fence rw, w", 0x0310000f},
+	{"fence.i", 0x0000100f},
+	{"c.addi a0, 1", 0x0505},
+	{"c.lw a1, 4(a0)", 0x414c},
+	{"c.sw a1, 8(a0)", 0xc50c},
+	{"c.mv s0, a1", 0x842e},
+	{"c.add s1, s0", 0x94a2},
+	{"c.slli a0, 2", 0x050a},
+	{"c.lwsp ra, 12(sp)", 0x40b2},
+	{"c.swsp ra, 12(sp)", 0xc606},
+	{"c.beqz a0, end", 0xd965},
+	{"c.j main", 0xbf8d},
+	{"c.jr ra", 0x8082},
+	{"c.addi16sp sp, -16", 0x717d},
+	{"c.addi sp, -16", 0x1141},
+	{"c.addi16sp sp, 32", 0x6105},
+}
+
+func TestEncodeKnown(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("main:\n")
+	for _, known := range knownEncodings {
+		if known.line == "c.addi a0, 1" {
+			b.WriteString("end:\n")
+		}
+		b.WriteString(known.line + "\n")
+	}
+
+	object, err := AssembleString(b.String(), XLEN_32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(object.Lines) != len(knownEncodings) {
+		t.Fatalf("%d instructions, want %d", len(object.Lines), len(knownEncodings))
+	}
+
+	var code []byte
+	for i, known := range knownEncodings {
+		line := object.Lines[i]
+		if line.Code != known.code {
+			t.Errorf("'%s' is encoded as %#08x, want %#08x", known.line, line.Code, known.code)
+		}
+		code = appendValue(code, uint64(known.code), line.Inst.size())
+	}
+	if object.Lines[0].Addr != TEXT_BASE || !bytes.Equal(object.Code, code) {
+		t.Errorf("The code at %#x is % x, want % x at %#x", object.Lines[0].Addr, object.Code, code, TEXT_BASE)
+	}
+}
+
+// Writes the executable and the relocatable ELF files of an example, reads
+// them back with debug/elf and with the readelf and objdump found in the
+// PATH.
+func TestWriteElf(t *testing.T) {
+	object, err := AssembleFile("../examples/jalr.asm", XLEN_32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, relocatable := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "jalr.o")
+		out, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := object.WriteElf(out, relocatable); err != nil {
+			t.Fatal(err)
+		}
+		out.Close()
+
+		f, err := elf.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if f.Machine != elf.EM_RISCV || f.Class != elf.ELFCLASS32 {
+			t.Errorf("Machine %v, class %v", f.Machine, f.Class)
+		}
+		text := f.Section(".text")
+		code, err := text.Data()
+		if err != nil || !bytes.Equal(code, object.Code) {
+			t.Errorf(".text is % x, want % x", code, object.Code)
+		}
+
+		symbols, err := f.Symbols()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var main *elf.Symbol
+		for i := range symbols {
+			if symbols[i].Name == "main" {
+				main = &symbols[i]
+			}
+		}
+		if main == nil || main.Section != elf.SectionIndex(ELF_SHN_TEXT) {
+			t.Errorf("main is not a symbol of .text: %v", main)
+		}
+
+		if relocatable {
+			if f.Type != elf.ET_REL || text.Addr != 0 || f.Section(".rela.data") == nil {
+				t.Errorf("Type %v, .text at %#x, .rela.data %v", f.Type, text.Addr, f.Section(".rela.data"))
+			}
+		} else {
+			if f.Type != elf.ET_EXEC || text.Addr != TEXT_BASE || f.Entry != uint64(main.Value) {
+				t.Errorf("Type %v, .text at %#x, entry %#x, main at %#x", f.Type, text.Addr, f.Entry, main.Value)
+			}
+			if len(f.Progs) == 0 || f.Progs[0].Vaddr != TEXT_BASE || f.Progs[0].Filesz != uint64(len(object.Code)) {
+				t.Errorf("The code segment is %+v", f.Progs[0].ProgHeader)
+			}
+		}
+
+		checkTool(t, path, "readelf", "-a", "-W")
+		checkTool(t, path, "llvm-readelf", "-a")
+		if out := checkTool(t, path, "llvm-objdump", "-d", "-r"); out != "" && !strings.Contains(out, "<main>:") {
+			t.Errorf("llvm-objdump doesn't find main:\n%s", out)
+		}
+	}
+}
+
+// Runs the tool on the file if it is in the PATH, it must not fail or warn.
+// Returns its output.
+func checkTool(t *testing.T, path string, tool string, args ...string) string {
+	t.Helper()
+
+	if _, err := exec.LookPath(tool); err != nil {
+		return ""
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(tool, append(args, path)...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil || stderr.Len() > 0 {
+		t.Errorf("%s %s: %v\n%s", tool, strings.Join(args, " "), err, stderr.String())
+	}
+	return stdout.String()
+}
+
+// The binary is the memory from TEXT_BASE to the end of .rodata, and the
+// listing has no line for the End instruction.
+func TestWriteBinaryListing(t *testing.T) {
+	object, err := AssembleFile("../examples/jalr.asm", XLEN_32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bin bytes.Buffer
+	if err := object.WriteBinary(&bin); err != nil {
+		t.Fatal(err)
+	}
+	data := object.Sections[SECTION_DATA]
+	if !bytes.HasPrefix(bin.Bytes(), object.Code) || uint32(bin.Len()) != object.Sections[SECTION_BSS].Addr-TEXT_BASE ||
+		!bytes.Equal(bin.Bytes()[data.Addr-TEXT_BASE:][:data.Size], object.Data[:data.Size]) {
+		t.Errorf("The binary is % x", bin.Bytes())
+	}
+
+	var listing strings.Builder
+	if err := object.WriteListing(&listing); err != nil {
+		t.Fatal(err)
+	}
+	first, _, _ := strings.Cut(listing.String(), "\n")
+	if !strings.HasPrefix(first, "00000004  ") || strings.Contains(listing.String(), " end ") {
+		t.Errorf("The listing starts with '%s'", first)
+	}
+}
+
+// Only the lines taking the address of a data label as a value are listed,
+// not the accesses to the data.
+func TestDataAddresses(t *testing.T) {
+	program := `.data
+value:  .word 1
+ptr:    .word value, main
+.text
+main:
+    la      a0, value
+    lw      a1, value
+    lui     a2, %hi(value)
+    sw      a1, %lo(value)(a2)
+    li      a3, ptr
+    la      a4, main
+    ret
+`
+	object, err := AssembleString(program, XLEN_32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"6", "10", "3"}
+	if len(object.Data_addresses) != len(want) {
+		t.Fatalf("Data addresses at %q, want lines %v", object.Data_addresses, want)
+	}
+	for i, pos := range object.Data_addresses {
+		if pos != want[i] {
+			t.Errorf("Data address at %s, want line %s", pos, want[i])
+		}
+	}
+}
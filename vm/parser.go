@@ -2,8 +2,8 @@ package vm
 
 import (
 	"fmt"
-	"os"
 	"strconv"
+	"strings"
 	"unicode"
 )
 
@@ -43,30 +43,246 @@ var abiToRegNum = map[string]int{
 	"t5": 30, "t6": 31,
 }
 
+// FP registers by their ABI names, 'f0'-'f31' are added in init()
+var fpAbiToRegNum = map[string]int{
+	// Temporaries
+	"ft0": 0, "ft1": 1, "ft2": 2, "ft3": 3,
+	"ft4": 4, "ft5": 5, "ft6": 6, "ft7": 7,
+
+	// Saved registers
+	"fs0": 8, "fs1": 9,
+
+	// Fn args/return values
+	"fa0": 10, "fa1": 11,
+
+	// Fn args
+	"fa2": 12, "fa3": 13,
+	"fa4": 14, "fa5": 15,
+	"fa6": 16, "fa7": 17,
+
+	// Saved registers
+	"fs2": 18, "fs3": 19,
+	"fs4": 20, "fs5": 21,
+	"fs6": 22, "fs7": 23,
+	"fs8": 24, "fs9": 25,
+	"fs10": 26, "fs11": 27,
+
+	// Temporaries
+	"ft8": 28, "ft9": 29,
+	"ft10": 30, "ft11": 31,
+}
+
+func init() {
+	for i := range 32 {
+		abiToRegNum[fmt.Sprintf("x%d", i)] = i
+		fpAbiToRegNum[fmt.Sprintf("f%d", i)] = i
+	}
+}
+
+// Rounding mode operands of FP instructions
+var roundingModeNames = map[string]uint8{
+	"rne": FRM_RNE,
+	"rtz": FRM_RTZ,
+	"rdn": FRM_RDN,
+	"rup": FRM_RUP,
+	"rmm": FRM_RMM,
+	"dyn": FRM_DYN,
+}
+
 var opcodeToStringMap = map[Inst_Op]string{
 	/* R-Type */
-	Inst_Add: "add",
-	Inst_Sub: "sub",
-	Inst_Mul: "mul",
-	Inst_Div: "div",
-	Inst_Rem: "rem",
-	Inst_Xor: "xor",
-	Inst_Or:  "or",
-	Inst_And: "and",
+	Inst_Add:    "add",
+	Inst_Sub:    "sub",
+	Inst_Mul:    "mul",
+	Inst_Mulh:   "mulh",
+	Inst_Mulhsu: "mulhsu",
+	Inst_Mulhu:  "mulhu",
+	Inst_Div:    "div",
+	Inst_Divu:   "divu",
+	Inst_Rem:    "rem",
+	Inst_Remu:   "remu",
+	Inst_Xor:    "xor",
+	Inst_Or:     "or",
+	Inst_And:    "and",
+	Inst_Sll:    "sll",
+	Inst_Srl:    "srl",
+	Inst_Sra:    "sra",
+	Inst_Slt:    "slt",
+	Inst_Sltu:   "sltu",
+
+	/* F-Extension */
+	Inst_Fadd_s:    "fadd.s",
+	Inst_Fsub_s:    "fsub.s",
+	Inst_Fmul_s:    "fmul.s",
+	Inst_Fdiv_s:    "fdiv.s",
+	Inst_Fsqrt_s:   "fsqrt.s",
+	Inst_Fmin_s:    "fmin.s",
+	Inst_Fmax_s:    "fmax.s",
+	Inst_Fsgnj_s:   "fsgnj.s",
+	Inst_Fsgnjn_s:  "fsgnjn.s",
+	Inst_Fsgnjx_s:  "fsgnjx.s",
+	Inst_Fcvt_w_s:  "fcvt.w.s",
+	Inst_Fcvt_wu_s: "fcvt.wu.s",
+	Inst_Fcvt_s_w:  "fcvt.s.w",
+	Inst_Fcvt_s_wu: "fcvt.s.wu",
+	Inst_Fmv_x_w:   "fmv.x.w",
+	Inst_Fmv_w_x:   "fmv.w.x",
+	Inst_Feq_s:     "feq.s",
+	Inst_Flt_s:     "flt.s",
+	Inst_Fle_s:     "fle.s",
+	Inst_Fclass_s:  "fclass.s",
+	Inst_Frcsr:     "frcsr",
+	Inst_Fscsr:     "fscsr",
+	Inst_Frrm:      "frrm",
+	Inst_Fsrm:      "fsrm",
+	Inst_Frflags:   "frflags",
+	Inst_Fsflags:   "fsflags",
+	Inst_Flw:       "flw",
+	Inst_Fsw:       "fsw",
+	Inst_Fmadd_s:   "fmadd.s",
+	Inst_Fmsub_s:   "fmsub.s",
+	Inst_Fnmsub_s:  "fnmsub.s",
+	Inst_Fnmadd_s:  "fnmadd.s",
+
+	/* D-Extension */
+	Inst_Fadd_d:    "fadd.d",
+	Inst_Fsub_d:    "fsub.d",
+	Inst_Fmul_d:    "fmul.d",
+	Inst_Fdiv_d:    "fdiv.d",
+	Inst_Fsqrt_d:   "fsqrt.d",
+	Inst_Fmin_d:    "fmin.d",
+	Inst_Fmax_d:    "fmax.d",
+	Inst_Fsgnj_d:   "fsgnj.d",
+	Inst_Fsgnjn_d:  "fsgnjn.d",
+	Inst_Fsgnjx_d:  "fsgnjx.d",
+	Inst_Fcvt_s_d:  "fcvt.s.d",
+	Inst_Fcvt_d_s:  "fcvt.d.s",
+	Inst_Fcvt_w_d:  "fcvt.w.d",
+	Inst_Fcvt_wu_d: "fcvt.wu.d",
+	Inst_Fcvt_d_w:  "fcvt.d.w",
+	Inst_Fcvt_d_wu: "fcvt.d.wu",
+	Inst_Feq_d:     "feq.d",
+	Inst_Flt_d:     "flt.d",
+	Inst_Fle_d:     "fle.d",
+	Inst_Fclass_d:  "fclass.d",
+	Inst_Fld:       "fld",
+	Inst_Fsd:       "fsd",
+	Inst_Fmadd_d:   "fmadd.d",
+	Inst_Fmsub_d:   "fmsub.d",
+	Inst_Fnmsub_d:  "fnmsub.d",
+	Inst_Fnmadd_d:  "fnmadd.d",
+
+	/* A-Extension */
+	Inst_Lr_w:      "lr.w",
+	Inst_Sc_w:      "sc.w",
+	Inst_Amoswap_w: "amoswap.w",
+	Inst_Amoadd_w:  "amoadd.w",
+	Inst_Amoxor_w:  "amoxor.w",
+	Inst_Amoand_w:  "amoand.w",
+	Inst_Amoor_w:   "amoor.w",
+	Inst_Amomin_w:  "amomin.w",
+	Inst_Amomax_w:  "amomax.w",
+	Inst_Amominu_w: "amominu.w",
+	Inst_Amomaxu_w: "amomaxu.w",
+
+	/* Supervisor */
+	Inst_Sfence_vma: "sfence.vma",
+
+	/* Bit manipulation */
+	Inst_Sh1add: "sh1add",
+	Inst_Sh2add: "sh2add",
+	Inst_Sh3add: "sh3add",
+	Inst_Andn:   "andn",
+	Inst_Orn:    "orn",
+	Inst_Xnor:   "xnor",
+	Inst_Clz:    "clz",
+	Inst_Ctz:    "ctz",
+	Inst_Cpop:   "cpop",
+	Inst_Max:    "max",
+	Inst_Maxu:   "maxu",
+	Inst_Min:    "min",
+	Inst_Minu:   "minu",
+	Inst_Sext_b: "sext.b",
+	Inst_Sext_h: "sext.h",
+	Inst_Zext_h: "zext.h",
+	Inst_Rol:    "rol",
+	Inst_Ror:    "ror",
+	Inst_Orc_b:  "orc.b",
+	Inst_Rev8:   "rev8",
+	Inst_Bclr:   "bclr",
+	Inst_Bext:   "bext",
+	Inst_Binv:   "binv",
+	Inst_Bset:   "bset",
+	Inst_Rori:   "rori",
+	Inst_Bclri:  "bclri",
+	Inst_Bexti:  "bexti",
+	Inst_Binvi:  "binvi",
+	Inst_Bseti:  "bseti",
+
+	/* RV64 */
+	Inst_Ld:     "ld",
+	Inst_Lwu:    "lwu",
+	Inst_Sd:     "sd",
+	Inst_Addiw:  "addiw",
+	Inst_Slliw:  "slliw",
+	Inst_Srliw:  "srliw",
+	Inst_Sraiw:  "sraiw",
+	Inst_Addw:   "addw",
+	Inst_Subw:   "subw",
+	Inst_Sllw:   "sllw",
+	Inst_Srlw:   "srlw",
+	Inst_Sraw:   "sraw",
+	Inst_Mulw:   "mulw",
+	Inst_Divw:   "divw",
+	Inst_Divuw:  "divuw",
+	Inst_Remw:   "remw",
+	Inst_Remuw:  "remuw",
+	Inst_Sext_w: "sext.w",
+	Inst_Negw:   "negw",
+
+	Inst_Nop_pseudo: "nop",
+	Inst_Beqz:       "beqz",
+	Inst_Bnez:       "bnez",
+	Inst_Blez:       "blez",
+	Inst_Bgez:       "bgez",
+	Inst_Bltz:       "bltz",
+	Inst_Bgtz:       "bgtz",
+	Inst_Bgtu:       "bgtu",
+	Inst_Bleu:       "bleu",
+	Inst_Seqz:       "seqz",
+	Inst_Snez:       "snez",
+	Inst_Sltz:       "sltz",
+	Inst_Sgtz:       "sgtz",
 
 	/* I-Type */
-	Inst_Addi: "addi",
-	Inst_Subi: "subi",
-	Inst_Xori: "xori",
-	Inst_Ori:  "ori",
-	Inst_Andi: "andi",
-	Inst_Jalr: "jalr",
-	Inst_Lw:   "lw",
-	Inst_Lh:   "lh",
-	Inst_Lb:   "lb",
-	Inst_Slli: "slli",
-	Inst_Srli: "srli",
-	Inst_Srai: "srai",
+	Inst_Addi:    "addi",
+	Inst_Subi:    "subi",
+	Inst_Xori:    "xori",
+	Inst_Ori:     "ori",
+	Inst_Andi:    "andi",
+	Inst_Jalr:    "jalr",
+	Inst_Lw:      "lw",
+	Inst_Lh:      "lh",
+	Inst_Lb:      "lb",
+	Inst_Slli:    "slli",
+	Inst_Srli:    "srli",
+	Inst_Srai:    "srai",
+	Inst_Lbu:     "lbu",
+	Inst_Lhu:     "lhu",
+	Inst_Slti:    "slti",
+	Inst_Sltiu:   "sltiu",
+	Inst_Fence:   "fence",
+	Inst_Fence_i: "fence.i",
+	Inst_Ecall:   "ecall",
+	Inst_Ebreak:  "ebreak",
+	Inst_Mret:    "mret",
+	Inst_Sret:    "sret",
+	Inst_Csrrw:   "csrrw",
+	Inst_Csrrs:   "csrrs",
+	Inst_Csrrc:   "csrrc",
+	Inst_Csrrwi:  "csrrwi",
+	Inst_Csrrsi:  "csrrsi",
+	Inst_Csrrci:  "csrrci",
 
 	/* S-Type */
 	Inst_Sw: "sw",
@@ -74,10 +290,12 @@ var opcodeToStringMap = map[Inst_Op]string{
 	Inst_Sb: "sb",
 
 	/* B-Type */
-	Inst_Beq: "beq",
-	Inst_Bne: "bne",
-	Inst_Blt: "blt",
-	Inst_Bge: "bge",
+	Inst_Beq:  "beq",
+	Inst_Bne:  "bne",
+	Inst_Blt:  "blt",
+	Inst_Bge:  "bge",
+	Inst_Bltu: "bltu",
+	Inst_Bgeu: "bgeu",
 
 	/* J-Type */
 	Inst_Jal: "jal",
@@ -91,26 +309,178 @@ var opcodeToStringMap = map[Inst_Op]string{
 	Inst_Not:  "not",
 	Inst_Neg:  "neg",
 	Inst_Li:   "li",
+	Inst_La:   "la",
+	Inst_Lla:  "lla",
 	Inst_Jr:   "jr",
 	Inst_Ret:  "ret",
 	Inst_Ble:  "ble",
 	Inst_Bgt:  "bgt",
 	Inst_J:    "j",
 	Inst_Call: "call",
+	Inst_Tail: "tail",
 	Inst_End:  "end",
+
+	Inst_Fmv_s:  "fmv.s",
+	Inst_Fabs_s: "fabs.s",
+	Inst_Fneg_s: "fneg.s",
+	Inst_Fmv_d:  "fmv.d",
+	Inst_Fabs_d: "fabs.d",
+	Inst_Fneg_d: "fneg.d",
+
+	Inst_Csrr:       "csrr",
+	Inst_Csrw:       "csrw",
+	Inst_Csrs:       "csrs",
+	Inst_Csrc:       "csrc",
+	Inst_Csrwi:      "csrwi",
+	Inst_Csrsi:      "csrsi",
+	Inst_Csrci:      "csrci",
+	Inst_Rdcycle:    "rdcycle",
+	Inst_Rdcycleh:   "rdcycleh",
+	Inst_Rdtime:     "rdtime",
+	Inst_Rdtimeh:    "rdtimeh",
+	Inst_Rdinstret:  "rdinstret",
+	Inst_Rdinstreth: "rdinstreth",
+
+	/* Vector */
+	Inst_Vsetvli:     "vsetvli",
+	Inst_Vle8_v:      "vle8.v",
+	Inst_Vle16_v:     "vle16.v",
+	Inst_Vle32_v:     "vle32.v",
+	Inst_Vle64_v:     "vle64.v",
+	Inst_Vse8_v:      "vse8.v",
+	Inst_Vse16_v:     "vse16.v",
+	Inst_Vse32_v:     "vse32.v",
+	Inst_Vse64_v:     "vse64.v",
+	Inst_Vlse8_v:     "vlse8.v",
+	Inst_Vlse16_v:    "vlse16.v",
+	Inst_Vlse32_v:    "vlse32.v",
+	Inst_Vlse64_v:    "vlse64.v",
+	Inst_Vsse8_v:     "vsse8.v",
+	Inst_Vsse16_v:    "vsse16.v",
+	Inst_Vsse32_v:    "vsse32.v",
+	Inst_Vsse64_v:    "vsse64.v",
+	Inst_Vadd_vv:     "vadd.vv",
+	Inst_Vadd_vx:     "vadd.vx",
+	Inst_Vadd_vi:     "vadd.vi",
+	Inst_Vsub_vv:     "vsub.vv",
+	Inst_Vsub_vx:     "vsub.vx",
+	Inst_Vrsub_vx:    "vrsub.vx",
+	Inst_Vrsub_vi:    "vrsub.vi",
+	Inst_Vmul_vv:     "vmul.vv",
+	Inst_Vmul_vx:     "vmul.vx",
+	Inst_Vand_vv:     "vand.vv",
+	Inst_Vand_vx:     "vand.vx",
+	Inst_Vand_vi:     "vand.vi",
+	Inst_Vor_vv:      "vor.vv",
+	Inst_Vor_vx:      "vor.vx",
+	Inst_Vor_vi:      "vor.vi",
+	Inst_Vxor_vv:     "vxor.vv",
+	Inst_Vxor_vx:     "vxor.vx",
+	Inst_Vxor_vi:     "vxor.vi",
+	Inst_Vsll_vv:     "vsll.vv",
+	Inst_Vsll_vx:     "vsll.vx",
+	Inst_Vsll_vi:     "vsll.vi",
+	Inst_Vsrl_vv:     "vsrl.vv",
+	Inst_Vsrl_vx:     "vsrl.vx",
+	Inst_Vsrl_vi:     "vsrl.vi",
+	Inst_Vsra_vv:     "vsra.vv",
+	Inst_Vsra_vx:     "vsra.vx",
+	Inst_Vsra_vi:     "vsra.vi",
+	Inst_Vmin_vv:     "vmin.vv",
+	Inst_Vmin_vx:     "vmin.vx",
+	Inst_Vminu_vv:    "vminu.vv",
+	Inst_Vminu_vx:    "vminu.vx",
+	Inst_Vmax_vv:     "vmax.vv",
+	Inst_Vmax_vx:     "vmax.vx",
+	Inst_Vmaxu_vv:    "vmaxu.vv",
+	Inst_Vmaxu_vx:    "vmaxu.vx",
+	Inst_Vmacc_vv:    "vmacc.vv",
+	Inst_Vmacc_vx:    "vmacc.vx",
+	Inst_Vmseq_vv:    "vmseq.vv",
+	Inst_Vmseq_vx:    "vmseq.vx",
+	Inst_Vmseq_vi:    "vmseq.vi",
+	Inst_Vmsne_vv:    "vmsne.vv",
+	Inst_Vmsne_vx:    "vmsne.vx",
+	Inst_Vmsne_vi:    "vmsne.vi",
+	Inst_Vmslt_vv:    "vmslt.vv",
+	Inst_Vmslt_vx:    "vmslt.vx",
+	Inst_Vmsltu_vv:   "vmsltu.vv",
+	Inst_Vmsltu_vx:   "vmsltu.vx",
+	Inst_Vmsle_vv:    "vmsle.vv",
+	Inst_Vmsle_vx:    "vmsle.vx",
+	Inst_Vmsle_vi:    "vmsle.vi",
+	Inst_Vmsleu_vv:   "vmsleu.vv",
+	Inst_Vmsleu_vx:   "vmsleu.vx",
+	Inst_Vmsleu_vi:   "vmsleu.vi",
+	Inst_Vmsgt_vx:    "vmsgt.vx",
+	Inst_Vmsgt_vi:    "vmsgt.vi",
+	Inst_Vmsgtu_vx:   "vmsgtu.vx",
+	Inst_Vmsgtu_vi:   "vmsgtu.vi",
+	Inst_Vredsum_vs:  "vredsum.vs",
+	Inst_Vredand_vs:  "vredand.vs",
+	Inst_Vredor_vs:   "vredor.vs",
+	Inst_Vredxor_vs:  "vredxor.vs",
+	Inst_Vredmin_vs:  "vredmin.vs",
+	Inst_Vredminu_vs: "vredminu.vs",
+	Inst_Vredmax_vs:  "vredmax.vs",
+	Inst_Vredmaxu_vs: "vredmaxu.vs",
+	Inst_Vmv_v_v:     "vmv.v.v",
+	Inst_Vmv_v_x:     "vmv.v.x",
+	Inst_Vmv_v_i:     "vmv.v.i",
+	Inst_Vmv_x_s:     "vmv.x.s",
+	Inst_Vmv_s_x:     "vmv.s.x",
+	Inst_Vid_v:       "vid.v",
+
+	/* Compressed */
+	Inst_C_addi4spn: "c.addi4spn",
+	Inst_C_fld:      "c.fld",
+	Inst_C_lw:       "c.lw",
+	Inst_C_flw:      "c.flw",
+	Inst_C_fsd:      "c.fsd",
+	Inst_C_sw:       "c.sw",
+	Inst_C_fsw:      "c.fsw",
+	Inst_C_nop:      "c.nop",
+	Inst_C_addi:     "c.addi",
+	Inst_C_jal:      "c.jal",
+	Inst_C_li:       "c.li",
+	Inst_C_addi16sp: "c.addi16sp",
+	Inst_C_lui:      "c.lui",
+	Inst_C_srli:     "c.srli",
+	Inst_C_srai:     "c.srai",
+	Inst_C_andi:     "c.andi",
+	Inst_C_sub:      "c.sub",
+	Inst_C_xor:      "c.xor",
+	Inst_C_or:       "c.or",
+	Inst_C_and:      "c.and",
+	Inst_C_j:        "c.j",
+	Inst_C_beqz:     "c.beqz",
+	Inst_C_bnez:     "c.bnez",
+	Inst_C_slli:     "c.slli",
+	Inst_C_fldsp:    "c.fldsp",
+	Inst_C_lwsp:     "c.lwsp",
+	Inst_C_flwsp:    "c.flwsp",
+	Inst_C_jr:       "c.jr",
+	Inst_C_mv:       "c.mv",
+	Inst_C_ebreak:   "c.ebreak",
+	Inst_C_jalr:     "c.jalr",
+	Inst_C_add:      "c.add",
+	Inst_C_fsdsp:    "c.fsdsp",
+	Inst_C_swsp:     "c.swsp",
+	Inst_C_fswsp:    "c.fswsp",
 }
 
-var stringToOpcodeMap map[string]Inst_Op = nil
+var stringToOpcodeMap = func() map[string]Inst_Op {
+	m := make(map[string]Inst_Op, len(opcodeToStringMap))
+	for op, str := range opcodeToStringMap {
+		m[str] = op
+	}
+	return m
+}()
 
 // Returns the corresponding 'Inst_Op' for the given string, uses the stringToOpcode lookup table.
 func stringToOpcode(s string) Inst_Op {
-	// if stringToOpcodeMap is not created, create it
-	if stringToOpcodeMap == nil {
-		stringToOpcodeMap = make(map[string]Inst_Op)
-		for op, str := range opcodeToStringMap {
-			stringToOpcodeMap[str] = op
-		}
-	}
+	registryLock.RLock()
+	defer registryLock.RUnlock()
 
 	val, ok := stringToOpcodeMap[s]
 	if !ok {
@@ -120,6 +490,14 @@ func stringToOpcode(s string) Inst_Op {
 	return val
 }
 
+// Returns the mnemonic of the opcode, custom instructions can be registered
+// meanwhile, see registryLock.
+func opcodeName(op Inst_Op) string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return opcodeToStringMap[op]
+}
+
 // ===================================
 // ============== LEXER ==============
 // ===================================
@@ -130,8 +508,10 @@ const (
 	Tok_End Token_Type = iota
 	Tok_Colon
 
-	Tok_Number
+	Tok_Number // A number or a constant expression, see evalExpression
 	Tok_Symbol
+	Tok_String     // Value is the string without the quotes, with the escapes replaced
+	Tok_Relocation // A relocation operator like '%hi(sym)', see reloc.go
 	Tok_Invalid
 )
 
@@ -139,21 +519,24 @@ type Token struct {
 	Type  Token_Type
 	Value string
 
-	// Position of the token in the file
-	line_num uint32
+	// Position of the token in the source files
+	line_num source_pos
 	start    uint32 // starting point within the line?
 
-	num uint8 // Token number in a line
+	num   uint8 // Token number in a line
+	paren bool  // Written in parentheses, like the base register in '8(sp)'
 }
 
 type Lexer struct {
-	Content string // The file that we are tokenizing
+	Content string       // The file that we are tokenizing
+	Lines   []source_pos // Position of each line of the content, see preprocess
 
 	Cursor uint32
 	Line   uint32 // Line number we are at
 	Bol    uint32 // Beginning of line
 
 	tok_num uint8 // Token count in a line
+	paren   bool  // trimSpace skipped the '(' of a register
 }
 
 func isSymbolStart(b byte) bool {
@@ -163,20 +546,139 @@ func isSymbolStart(b byte) bool {
 
 func isSymbol(b byte) bool {
 	ch := rune(b)
-	return unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '_'
+	return unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '_' || ch == '.'
 }
 
 // TODO: Check if paranthesis are valid
-// We consider params and ',' as a space
+// We consider ',' and the parentheses around a register like '(sp)' as a space,
+// other parentheses are a part of an expression. Comments start with ';' or '#'.
 func (l *Lexer) isSpace(ch rune) bool {
-	return unicode.IsSpace(ch) || ch == '(' || ch == ')' || ch == ',' || ch == ';'
+	return unicode.IsSpace(ch) || ch == ')' || ch == ',' || ch == ';' || ch == '#'
+}
+
+// Reports whether the cursor is at a '(' holding only a symbol, like the base
+// register in '8(sp)', that doesn't continue as an expression.
+func (l *Lexer) isRegisterParen() bool {
+	i := l.Cursor
+	if l.Content[i] != '(' {
+		return false
+	}
+
+	i++
+	for int(i) < len(l.Content) && (l.Content[i] == ' ' || l.Content[i] == '\t') {
+		i++
+	}
+	if int(i) >= len(l.Content) || !isSymbolStart(l.Content[i]) {
+		return false
+	}
+	for int(i) < len(l.Content) && isSymbol(l.Content[i]) {
+		i++
+	}
+	for int(i) < len(l.Content) && (l.Content[i] == ' ' || l.Content[i] == '\t') {
+		i++
+	}
+	if int(i) >= len(l.Content) || l.Content[i] != ')' {
+		return false
+	}
+
+	return !l.continuesExpression(i + 1)
+}
+
+// Reports whether a binary operator follows the operand ending at i. A '+' or
+// '-' after a space and right before an operand is its sign instead, so
+// 'addi sp sp -4' has three operands while 'addi sp, sp, N - 4' has an
+// expression.
+func (l *Lexer) continuesExpression(i uint32) bool {
+	j := i
+	for int(j) < len(l.Content) && (l.Content[j] == ' ' || l.Content[j] == '\t') {
+		j++
+	}
+	if int(j) >= len(l.Content) {
+		return false
+	}
+
+	rest := l.Content[j:]
+	switch {
+	case strings.HasPrefix(rest, "<<"), strings.HasPrefix(rest, ">>"):
+		return true
+	case rest[0] == '*' || rest[0] == '/' || rest[0] == '&' || rest[0] == '|':
+		return true
+	case rest[0] == '<' || rest[0] == '>' || strings.HasPrefix(rest, "=="), strings.HasPrefix(rest, "!="):
+		return true
+	case rest[0] == '+' || rest[0] == '-':
+		return j == i || len(rest) == 1 || rest[1] == ' ' || rest[1] == '\t'
+	}
+
+	return false
+}
+
+// Moves the cursor to the end of the expression starting at it. The
+// expression ends at a ',', a comment, the end of the line or a space that is
+// not followed by a binary operator. A '(' right after an operand holds the
+// base register, like in '(N + 4)(sp)'. Invalid expressions are reported by
+// evalExpression.
+func (l *Lexer) scanExpression() {
+	depth := 0
+	operand := false // An operand was scanned last, an operator or ')' can follow
+	for int(l.Cursor) < len(l.Content) {
+		ch := l.Content[l.Cursor]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			if operand && depth == 0 && !l.continuesExpression(l.Cursor) {
+				return
+			}
+			l.Cursor++
+		case ch == '\n' || ch == ',' || ch == ';' || ch == '#':
+			return
+		case ch == '(':
+			if operand && depth == 0 {
+				return
+			}
+			depth++
+			operand = false
+			l.Cursor++
+		case ch == ')':
+			if depth == 0 {
+				return
+			}
+			depth--
+			operand = true
+			l.Cursor++
+		case ch == '\'':
+			l.Cursor++
+			for int(l.Cursor) < len(l.Content) && l.Content[l.Cursor] != '\'' && l.Content[l.Cursor] != '\n' {
+				if l.Content[l.Cursor] == '\\' && int(l.Cursor)+1 < len(l.Content) && l.Content[l.Cursor+1] != '\n' {
+					l.Cursor++
+				}
+				l.Cursor++
+			}
+			if int(l.Cursor) < len(l.Content) && l.Content[l.Cursor] == '\'' {
+				l.Cursor++
+			}
+			operand = true
+		case isSymbol(ch):
+			for int(l.Cursor) < len(l.Content) && isSymbol(l.Content[l.Cursor]) {
+				l.Cursor++
+			}
+			operand = true
+		default:
+			// Operators, '<<', '>>' and the comparisons can be 2 characters
+			if int(l.Cursor)+1 < len(l.Content) && strings.IndexByte("<>=!", ch) >= 0 && strings.IndexByte("<>=", l.Content[l.Cursor+1]) >= 0 {
+				l.Cursor++
+			}
+			l.Cursor++
+			operand = false
+		}
+	}
 }
 
 // If cursor goes to a newline returns true, otherwise false
 func (l *Lexer) trimSpace() bool {
 	newLine := false
-	for int(l.Cursor) < len(l.Content) && l.isSpace(rune(l.Content[l.Cursor])) {
-		if l.Content[l.Cursor] == ';' {
+	l.paren = false
+	for int(l.Cursor) < len(l.Content) && (l.isSpace(rune(l.Content[l.Cursor])) || l.isRegisterParen()) {
+		l.paren = l.paren || l.Content[l.Cursor] == '('
+		if l.Content[l.Cursor] == ';' || l.Content[l.Cursor] == '#' {
 			for int(l.Cursor) < len(l.Content) && l.Content[l.Cursor] != '\n' {
 				l.Cursor++
 			}
@@ -196,6 +698,32 @@ func (l *Lexer) trimSpace() bool {
 	return newLine
 }
 
+// Moves the cursor to the end of the line and returns the text it skipped.
+func (l *Lexer) skipLine() string {
+	start := l.Cursor
+	for int(l.Cursor) < len(l.Content) && l.Content[l.Cursor] != '\n' {
+		l.Cursor++
+	}
+	return l.Content[start:l.Cursor]
+}
+
+// Returns the text of the current line.
+func (l *Lexer) lineText() string {
+	line := l.Content[l.Bol:]
+	if end := strings.IndexByte(line, '\n'); end >= 0 {
+		line = line[:end]
+	}
+	return line
+}
+
+// Returns the position of the current line in the source files.
+func (l *Lexer) position() source_pos {
+	if int(l.Line) < len(l.Lines) {
+		return l.Lines[l.Line]
+	}
+	return source_pos{line: l.Line + 1}
+}
+
 func (l Lexer) peekNextToken() Token {
 	tok := l.nextToken()
 	return tok
@@ -209,9 +737,10 @@ func (l *Lexer) nextToken() Token {
 	}
 
 	tok := Token{}
-	tok.line_num = l.Line
+	tok.line_num = l.position()
 	tok.start = l.Cursor - l.Bol
 	tok.num = l.tok_num
+	tok.paren = l.paren
 
 	// Reached the end of content
 	if int(l.Cursor) >= len(l.Content) {
@@ -227,37 +756,95 @@ func (l *Lexer) nextToken() Token {
 			l.Cursor++
 		}
 
+		// A symbol followed by an operator starts an expression, like 'N * 4'.
+		// The first token of a line is never one.
+		if l.tok_num > 0 && l.continuesExpression(l.Cursor) {
+			tok.Type = Tok_Number
+			l.Cursor = l.Bol + tok.start
+			l.scanExpression()
+		}
+
 		tok.Value = l.Content[l.Bol+tok.start : l.Cursor]
 
 		l.tok_num++
 		return tok
 	}
 
-	if unicode.IsDigit(rune(l.Content[l.Cursor])) || l.Content[l.Cursor] == '-' {
-		l.Cursor++
-
+	if strings.IndexByte("0123456789-+~'(", l.Content[l.Cursor]) >= 0 {
 		tok.Type = Tok_Number
-		for int(l.Cursor) < len(l.Content) && !l.isSpace(rune(l.Content[l.Cursor])) {
+		l.scanExpression()
+		tok.Value = l.Content[l.Bol+tok.start : l.Cursor]
 
-			// If any character after the first digit is not a digit, this is not a valid number
-			// We still want to get the whole token until a space character
-			// for reporting the whole word as an Tok_Invalid
-			if !unicode.IsDigit(rune(l.Content[l.Cursor])) {
-				tok.Type = Tok_Invalid
-			}
+		l.tok_num++
+		return tok
+	}
 
+	if l.Content[l.Cursor] == '"' {
+		l.Cursor++
+
+		tok.Type = Tok_String
+		for int(l.Cursor) < len(l.Content) && l.Content[l.Cursor] != '"' && l.Content[l.Cursor] != '\n' {
+			// Skip the escaped character, it may be a quote
+			if l.Content[l.Cursor] == '\\' && int(l.Cursor)+1 < len(l.Content) && l.Content[l.Cursor+1] != '\n' {
+				l.Cursor++
+			}
 			l.Cursor++
 		}
 
-		tok.Value = l.Content[l.Bol+tok.start : l.Cursor]
-		if tok.Value == "-" {
+		// Strings must be closed on the same line
+		if int(l.Cursor) >= len(l.Content) || l.Content[l.Cursor] != '"' {
 			tok.Type = Tok_Invalid
+			tok.Value = l.Content[l.Bol+tok.start : l.Cursor]
+
+			l.tok_num++
+			return tok
+		}
+		l.Cursor++
+
+		value, ok := unescapeString(l.Content[l.Bol+tok.start+1 : l.Cursor-1])
+		if ok {
+			tok.Value = value
+		} else {
+			tok.Type = Tok_Invalid
+			tok.Value = l.Content[l.Bol+tok.start : l.Cursor]
 		}
 
 		l.tok_num++
 		return tok
 	}
 
+	if l.Content[l.Cursor] == '%' {
+		l.Cursor++
+		for int(l.Cursor) < len(l.Content) && isSymbol(l.Content[l.Cursor]) {
+			l.Cursor++
+		}
+
+		// The operand is in parentheses, which can hold an expression
+		tok.Type = Tok_Invalid
+		depth := 0
+		for int(l.Cursor) < len(l.Content) && l.Content[l.Cursor] != '\n' {
+			ch := l.Content[l.Cursor]
+			if ch == '(' {
+				depth++
+			} else if ch == ')' {
+				depth--
+			} else if depth == 0 {
+				break
+			}
+			l.Cursor++
+
+			if depth == 0 {
+				tok.Type = Tok_Relocation
+				break
+			}
+		}
+
+		tok.Value = l.Content[l.Bol+tok.start : l.Cursor]
+
+		l.tok_num++
+		return tok
+	}
+
 	if l.Content[l.Cursor] == ':' {
 		tok.Type = Tok_Colon
 		tok.Value = ":"
@@ -274,79 +861,296 @@ func (l *Lexer) nextToken() Token {
 	return tok
 }
 
+// Replaces the escape sequences of a string literal, the ones of C and '\xHH'
+// and octal '\NNN' bytes. Reports whether the escapes are valid.
+func unescapeString(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if i >= len(s) {
+			return "", false
+		}
+
+		switch ch := s[i]; ch {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\', '"', '\'':
+			b.WriteByte(ch)
+		case 'x':
+			// One or two hex digits
+			n := 0
+			for n < 2 && i+1+n < len(s) && strings.IndexByte("0123456789abcdefABCDEF", s[i+1+n]) >= 0 {
+				n++
+			}
+			if n == 0 {
+				return "", false
+			}
+			val, _ := strconv.ParseUint(s[i+1:i+1+n], 16, 8)
+			b.WriteByte(byte(val))
+			i += n
+		default:
+			// Up to three octal digits
+			n := 0
+			for n < 3 && i+n < len(s) && '0' <= s[i+n] && s[i+n] <= '7' {
+				n++
+			}
+			if n == 0 {
+				return "", false
+			}
+			val, _ := strconv.ParseUint(s[i:i+n], 8, 16)
+			if val > 0xff {
+				return "", false
+			}
+			b.WriteByte(byte(val))
+			i += n - 1
+		}
+	}
+
+	return b.String(), true
+}
+
 // ====================================
 // ============== PARSER ==============
 // ====================================
 
 type Parser struct {
 	inst_count uint32
+	pc         uint32 // Address of the next instruction, compressed ones take 2 bytes
+	xlen       int    // li loads 64-bit values in RV64
 
-	// Symbol table holding label_str -> line_num
-	symbol_table        map[string]uint32
-	insts_missing_label map[uint32]string
+	// Value of the li being parsed, its immediate only keeps the low 32 bits
+	li_value int64
+
+	// Symbol table holding label_str -> address
+	symbol_table map[string]uint32
+
+	// Index of the instructions using a label -> the label and its relocation.
+	// They are filled once every label is known, see fillLabel.
+	insts_missing_label map[uint32]label_ref
+
+	section Section // Section the parsed lines go to
+
+	// Named constants of .equ and .set
+	constants map[string]int64
+
+	// Data sections by Section, the .text one is not used
+	data            [SECTION_BSS + 1]data_section
+	data_symbols    map[string]data_symbol
+	data_label_uses []data_label_use
+	data_base       uint32 // Address of the first data section
+	image           []byte // Initial contents of the data sections, from data_base
+
+	// Labels of .globl in the file being parsed, labels of .extern and the ones
+	// of .globl the files don't declare, and the file declaring every global
+	// and local label, see link.go
+	exports []global_decl
+	imports []global_decl
+	globals map[string]string
+	locals  map[string]string
+
+	entry uint32
 
 	Program []Instruction
+	lines   []source_line // Source line of each instruction, for the listings
+}
+
+// Returns list of instructions parsed, the initial memory contents, the default pc and an error.
+// The program is parsed for a Vm with the given XLEN.
+func ParseProgramFromFile(filename string, xlen int) ([]Instruction, []byte, uint32, error) {
+	return ParseProgramFromFiles([]string{filename}, xlen)
 }
 
-// Returns list of instructions parsed, the default pc and an error.
-func ParseProgramFromFile(filename string) ([]Instruction, uint32, error) {
-	str, err := os.ReadFile(filename)
+func ParseProgramFromString(program_str string, xlen int) ([]Instruction, []byte, uint32, error) {
+	return ParseProgramFromSources([]Source_File{{"", program_str, false}}, xlen)
+}
+
+// Parses the files into one program, see link.go.
+func ParseProgramFromFiles(filenames []string, xlen int) ([]Instruction, []byte, uint32, error) {
+	files, err := readSourceFiles(filenames)
 	if err != nil {
-		return nil, 0, fmt.Errorf("Failed to read file for parsing '%v': %v", filename, err.Error())
+		return nil, nil, 0, err
 	}
 
-	return ParseProgramFromString(string(str))
+	return ParseProgramFromSources(files, xlen)
 }
 
-func ParseProgramFromString(program_str string) ([]Instruction, uint32, error) {
-	parser := Parser{}
+func ParseProgramFromSources(files []Source_File, xlen int) ([]Instruction, []byte, uint32, error) {
+	parser, err := assembleFiles(files, xlen, false)
+	if err != nil {
+		return nil, nil, 0, err
+	}
 
-	// These, holds the **index** of instruction in the program array
-	// Multiply by 4 to convert to instruction address.
+	return parser.Program, parser.image, parser.entry, nil
+}
+
+// Parses the files into one program and links them, see link.go. The data
+// sections start at address 0, or right after the code with data_after_text,
+// see Object.
+func assembleFiles(files []Source_File, xlen int, data_after_text bool) (*Parser, error) {
+	parser := &Parser{xlen: xlen}
+
+	// Labels hold the address of the instruction or data following them.
 	parser.symbol_table = make(map[string]uint32)
-	parser.insts_missing_label = make(map[uint32]string)
+	parser.insts_missing_label = make(map[uint32]label_ref)
+	parser.data_symbols = make(map[string]data_symbol)
+	parser.globals = make(map[string]string)
+	parser.locals = make(map[string]string)
 
 	// Push End to the beginning for ret's at the end of the program.
 	parser.pushInstruction(newInstruction(Inst_End, 0, 0, 0))
+	parser.lines = append(parser.lines, source_line{})
+
+	names := make(map[string]bool, len(files))
+	for _, file := range files {
+		scope := ""
+		if len(files) > 1 {
+			if file.Name == "" {
+				return nil, fmt.Errorf("The files of a program of several files must have names")
+			}
+			if names[file.Name] {
+				return nil, fmt.Errorf("The files must have different names, '%v' is given twice", file.Name)
+			}
+			names[file.Name] = true
+			scope = file.Name + ":"
+		}
+
+		if err := parser.parseFile(file, scope); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := parser.checkUndefined(); err != nil {
+		return nil, err
+	}
+
+	if err := parser.finish(data_after_text); err != nil {
+		return nil, err
+	}
+
+	return parser, nil
+}
+
+// Parses the lines of a file into the program. Its labels are linked with
+// the ones of the files before it, see linkFile.
+func (p *Parser) parseFile(file Source_File, scope string) error {
+	content, lines, err := preprocess(file.Content, file.Name, file.Include)
+	if err != nil {
+		return err
+	}
+
+	// The labels and the constants of the file, the labels of the program
+	// are kept apart until the file is parsed
+	text, data := p.symbol_table, p.data_symbols
+	p.symbol_table = make(map[string]uint32)
+	p.data_symbols = make(map[string]data_symbol)
+	p.constants = make(map[string]int64)
+	p.section = SECTION_TEXT
+	p.exports = nil
+	first_inst, first_use := uint32(len(p.Program)), len(p.data_label_uses)
 
 	lexer := Lexer{}
-	lexer.Content = program_str
+	lexer.Content = content
+	lexer.Lines = lines
 
 	inst := Instruction{}
 	tok := lexer.nextToken()
 	for tok.Type != Tok_End {
 		if tok.Type == Tok_Invalid {
-			return nil, 0, fmt.Errorf("%v:%v Invalid token '%v'", tok.line_num, tok.start+1, tok.Value)
+			return fmt.Errorf("%v:%v Invalid token '%v'", tok.line_num, tok.start+1, tok.Value)
 		}
 
 		// First token of line MUST be a symbol
 		if tok.num == 0 && tok.Type != Tok_Symbol {
-			return nil, 0, fmt.Errorf("%v:%v Expected 'symbol', got '%v'", tok.line_num, tok.start+1, tok.Value)
+			return fmt.Errorf("%v:%v Expected 'symbol', got '%v'", tok.line_num, tok.start+1, tok.Value)
 		}
 
 		next := lexer.peekNextToken()
-		switch tok.Type {
-		case Tok_Symbol:
-			if next.Type == Tok_Colon { // If the next token is ':', this is a label declaration.
-				parser.symbol_table[tok.Value] = parser.inst_count
-			} else {
-				err := parser.fillInstructionToken(&inst, tok)
-				if err != nil {
-					return nil, 0, err
-				}
+
+		// If the next token is ':', this is a label declaration. An instruction
+		// or directive can follow it on the same line.
+		if tok.Type == Tok_Symbol && next.Type == Tok_Colon {
+			if err := p.declareLabel(tok); err != nil {
+				return err
 			}
 
-		case Tok_Number:
-			err := parser.fillInstructionToken(&inst, tok)
+			lexer.nextToken()
+			lexer.tok_num = 0
+			tok = lexer.nextToken()
+			continue
+		}
+
+		// Directives take the whole line
+		if tok.num == 0 && strings.HasPrefix(tok.Value, ".") {
+			if err := p.parseDirective(&lexer, tok); err != nil {
+				return err
+			}
+
+			tok = lexer.nextToken()
+			continue
+		}
+
+		switch tok.Type {
+		case Tok_Symbol, Tok_Number, Tok_Relocation:
+			err := p.fillInstructionToken(&inst, tok)
 			if err != nil {
-				return nil, 0, err
+				return err
 			}
+		case Tok_String:
+			return fmt.Errorf("%v:%v Unexpected string '%v'", tok.line_num, tok.start+1, tok.Value)
 		}
 
 		// Next token is in another line, push the instruction
 		if (next.num == 0 || next.Type == Tok_End) && inst != (Instruction{}) {
+			// 'fsrm rs' like short forms leave out the destination register
+			if tok.num == 1 && hasShortForm(inst.Op) {
+				inst.Rs1 = inst.Rd
+				inst.Rd = 0
+			}
+
+			// 'jal offset' and 'jalr rs' link to ra
+			if tok.num == 1 && (inst.Op == Inst_Jal || inst.Op == Inst_Jalr) {
+				inst.Rs1 = inst.Rd
+				inst.Rd = 1
+			}
+
+			if inst.isCompressed() {
+				var err error
+				inst, err = expandCompressedInstruction(inst)
+				if err != nil {
+					return fmt.Errorf("%v: %v", tok.line_num, err)
+				}
+			}
+
+			if inst.isVector() {
+				if err := checkVectorOperands(inst); err != nil {
+					return fmt.Errorf("%v: %v", tok.line_num, err)
+				}
+			}
+
 			// Push the previous instruction
-			parser.pushInstruction(inst)
+			if err := p.pushInstruction(inst); err != nil {
+				return fmt.Errorf("%v: %v", tok.line_num, err)
+			}
+			for len(p.lines) < len(p.Program) {
+				p.lines = append(p.lines, source_line{lexer.lineText(), tok.line_num})
+			}
 			inst = Instruction{}
 		}
 
@@ -355,59 +1159,121 @@ func ParseProgramFromString(program_str string) ([]Instruction, uint32, error) {
 		tok = lexer.nextToken()
 	}
 
-	// Fill the missing label calls
-	for n, label := range parser.insts_missing_label {
-		target, ok := parser.symbol_table[label]
-		if !ok {
-			return nil, 0, fmt.Errorf("Undeclared label '%v'", label)
-		}
+	return p.linkFile(file.Name, scope, text, data, first_inst, first_use)
+}
 
-		offset := (target - n) * 4
+// Lays out the data sections, fills the label uses and sets the entry.
+func (p *Parser) finish(data_after_text bool) error {
+	// Address of every instruction, to turn the labels into offsets
+	pcs := make([]uint32, 0, len(p.Program))
+	pc := uint32(0)
+	for _, inst := range p.Program {
+		pcs = append(pcs, pc)
+		pc += inst.size()
+	}
 
-		inst := &parser.Program[n]
-		// based on different control instructions, the offset is stored in different place
+	if data_after_text {
+		p.data_base = (pc + DATA_ALIGN - 1) / DATA_ALIGN * DATA_ALIGN
+	}
+	var err error
+	p.image, err = p.layoutData()
+	if err != nil {
+		return err
+	}
 
-		switch inst._fmt {
-		case Fmt_B:
-			inst.Rs2 = int32(offset)
-		case Fmt_J:
-			inst.Rs1 = int32(offset)
-		default:
-			// Inst_Jalr is an Fmt_I instruction but also a branch.
-			if inst.Op == Inst_Jalr {
-				inst.Rs2 = int32(offset)
-				break
-			}
-			return nil, 0, fmt.Errorf("Illegal label use: '%s'", label)
+	// Index of the instruction at every address, for %pcrel_lo
+	index_at := make(map[uint32]uint32, len(pcs))
+	for n, pc := range pcs {
+		index_at[pc] = uint32(n)
+	}
+
+	// Fill the label uses
+	for n, ref := range p.insts_missing_label {
+		if err := p.fillLabel(n, ref, pcs, index_at); err != nil {
+			return err
 		}
 	}
 
-	entry, ok := parser.symbol_table["main"]
+	// Start right after the End instruction if there is no main
+	entry, ok := p.symbol_table["main"]
 	if !ok {
-		entry = 1
+		entry = p.Program[0].size()
 	}
+	p.entry = entry
 
-	return parser.Program, entry, nil
+	return nil
 }
 
-// Expandes if pseudo instruction then pushes to the program
-// Returns the pushed instruction
-func (p *Parser) pushInstruction(inst Instruction) Instruction {
-	inst = expandPseudoInstruction(inst)
-	inst._fmt = getInstructionFmt(inst)
-	p.Program = append(p.Program, inst)
-	p.inst_count++
-	return inst
+// Expandes if pseudo instruction then pushes to the program. The label of a
+// pseudo instruction expanding to more than one instruction is split between
+// them, see pseudoRelocations.
+func (p *Parser) pushInstruction(inst Instruction) error {
+	// A bare 'fence' orders everything, same as 'fence iorw, iorw'
+	if inst.Op == Inst_Fence && inst.Rs2 == 0 {
+		inst.Rs2 = 0xff
+	}
+
+	// sfence.vma has no destination, its operands are the sources
+	if inst.Op == Inst_Sfence_vma {
+		inst.Rd, inst.Rs1, inst.Rs2 = 0, inst.Rd, inst.Rs1
+	}
+
+	ref, has_label := p.insts_missing_label[p.inst_count]
+	insts := expandLongPseudoInstruction(inst, has_label)
+	if isLoadImmediate(inst.Op) && !has_label && p.xlen == XLEN_64 {
+		insts = loadImmediate64(inst.Rd, p.li_value)
+	}
+	if insts == nil {
+		insts = []Instruction{expandPseudoInstruction(inst)}
+	}
+
+	if has_label && len(insts) > 1 {
+		if ref.reloc != RELOC_NONE {
+			return fmt.Errorf("Relocation operators can't be used with '%s'", opcodeName(inst.Op))
+		}
+
+		// The pcrel_lo parts find the auipc by its label
+		hi_label := fmt.Sprintf("%s%d", PCREL_LABEL_PREFIX, p.inst_count)
+		p.symbol_table[hi_label] = p.pc
+
+		for i, reloc := range pseudoRelocations[inst.Op] {
+			part := label_ref{label: ref.label, addend: ref.addend, reloc: reloc}
+			if reloc == RELOC_PCREL_LO {
+				part = label_ref{label: hi_label, reloc: reloc}
+			}
+			p.insts_missing_label[p.inst_count+uint32(i)] = part
+		}
+	}
+
+	for _, inst := range insts {
+		inst._fmt = getInstructionFmt(inst)
+		p.Program = append(p.Program, inst)
+		p.inst_count++
+		p.pc += inst.size()
+	}
+
+	return nil
 }
 
 func (p *Parser) fillInstructionToken(inst *Instruction, tok Token) error {
 	if tok.num == 0 {
 		op := stringToOpcode(tok.Value)
+		if op == _Inst_Unknown {
+			op = atomicOpcode(tok.Value)
+		}
+
 		if op == _Inst_Unknown {
 			return fmt.Errorf("%v:%v Unknown opcode '%v'\n", tok.line_num, tok.start, tok.Value)
 		}
 
+		if p.section != SECTION_TEXT {
+			return fmt.Errorf("%v:%v Instruction '%v' outside the .text section\n", tok.line_num, tok.start, tok.Value)
+		}
+
 		inst.Op = op
+		if usesRoundingMode(op) {
+			inst.Rm = FRM_DYN
+		}
 		return nil
 	}
 
@@ -415,24 +1281,124 @@ func (p *Parser) fillInstructionToken(inst *Instruction, tok Token) error {
 		return nil
 	}
 
+	// fence takes the predecessor and successor sets instead of registers.
+	// They are packed into Rs2 as 'pred << 4 | succ', where the I-type
+	// instructions keep their immediate.
+	if inst.Op == Inst_Fence {
+		set, ok := parseFenceSet(tok.Value)
+		if !ok {
+			return fmt.Errorf("%v:%v Invalid fence ordering '%v'\n", tok.line_num, tok.start, tok.Value)
+		}
+
+		switch tok.num {
+		case 1:
+			inst.Rs2 |= set << 4
+		case 2:
+			inst.Rs2 |= set
+		default:
+			return fmt.Errorf("%v:%v Unexpected token '%v'\n", tok.line_num, tok.start, tok.Value)
+		}
+		return nil
+	}
+
+	// The mask operand of vector instructions is written last, like the
+	// rounding mode. vsetvli takes the vtype fields after its registers, they
+	// are packed into the immediate.
+	if inst.isVector() {
+		if tok.Value == VECTOR_MASK_OPERAND {
+			inst.Masked = true
+			return nil
+		}
+
+		if inst.Op == Inst_Vsetvli && tok.num >= 3 && tok.Type == Tok_Symbol {
+			field, ok := vtypeFieldNames[tok.Value]
+			if !ok {
+				return fmt.Errorf("%v:%v Invalid vtype field '%v'\n", tok.line_num, tok.start, tok.Value)
+			}
+			inst.Rs2 |= int32(field)
+			return nil
+		}
+	}
+
+	// The rounding mode can only be the last operand, so it is not counted as
+	// a positional one.
+	if rm, ok := roundingModeNames[tok.Value]; ok && usesRoundingMode(inst.Op) {
+		inst.Rm = rm
+		return nil
+	}
+
 	var val int32
 	switch tok.Type {
 	case Tok_Symbol: // Register name or label call
 		reg, ok := abiToRegNum[tok.Value]
+		if !ok {
+			reg, ok = fpAbiToRegNum[tok.Value]
+		}
+		if !ok && inst.isVector() {
+			reg, ok = vecRegNum[tok.Value]
+		}
+
+		csr, isCsr := csrNames[tok.Value]
+		constant, isConstant := p.constants[tok.Value]
 		if ok {
 			val = int32(reg)
-		} else { // Then this is a label call
-			l, ok := p.symbol_table[tok.Value]
-			if ok {
-				val = int32(l-p.inst_count) * 4
-			} else {
-				// Add a record to the inst missing label
-				p.insts_missing_label[p.inst_count] = tok.Value
+		} else if isCsr && takesCsrOperand(inst.Op) {
+			val = int32(csr)
+		} else if isConstant {
+			var err error
+			if val, err = immediateOperand(inst, tok, constant, p.xlen); err != nil {
+				return err
 			}
+			p.li_value = constant
+		} else { // Then this is a label call, filled once every label is known
+			p.insts_missing_label[p.inst_count] = label_ref{label: tok.Value}
 		}
 	case Tok_Number:
-		num, _ := strconv.Atoi(tok.Value)
-		val = int32(num)
+		num, err := p.evaluate(tok)
+		if err != nil {
+			return err
+		}
+		if val, err = immediateOperand(inst, tok, num, p.xlen); err != nil {
+			return err
+		}
+		p.li_value = num
+	case Tok_Relocation:
+		ref, err := p.parseRelocation(tok)
+		if err != nil {
+			return err
+		}
+
+		constant, isConstant := p.constants[ref.label]
+		if !isConstant {
+			p.insts_missing_label[p.inst_count] = ref
+			break
+		}
+
+		// Parts of constants are known already
+		hi, lo := splitImmediate(int32(constant) + ref.addend)
+		switch ref.reloc {
+		case RELOC_HI:
+			val, err = immediateOperand(inst, tok, int64(uint32(hi)>>12), p.xlen)
+		case RELOC_LO:
+			val, err = immediateOperand(inst, tok, int64(lo), p.xlen)
+		default:
+			err = fmt.Errorf("%v:%v '%v' takes a label, '%v' is a constant", tok.line_num, tok.start+1, tok.Value, ref.label)
+		}
+		if err != nil {
+			return err
+		}
+		p.li_value = int64(val)
+	}
+
+	if inst.isAtomic() {
+		return fillAtomicOperand(inst, tok, val)
+	}
+
+	// 'jalr rd, offset(rs1)' writes the offset before the base register,
+	// which goes to Rs1 like in 'jalr rd, rs1, offset'
+	if inst.Op == Inst_Jalr && tok.paren && tok.num == 3 {
+		inst.Rs1, inst.Rs2 = val, inst.Rs1
+		return nil
 	}
 
 	switch tok.num {
@@ -442,9 +1408,102 @@ func (p *Parser) fillInstructionToken(inst *Instruction, tok Token) error {
 		inst.Rs1 = val
 	case 3: // Rs2
 		inst.Rs2 = val
+	case 4: // Rs3
+		inst.Rs3 = val
 	default:
 		return fmt.Errorf("%v:%v Unexpected token '%v'\n", tok.line_num, tok.start, tok.Value)
 	}
 
 	return nil
 }
+
+// Atomics are written as 'amoadd.w rd, rs2, (rs1)' and 'lr.w rd, (rs1)'.
+// The data register goes into Rs1 and the address register into Rs2, like
+// the base register of loads and stores. The address can also be written as
+// '0(rs1)', the offset is not counted as an operand.
+func fillAtomicOperand(inst *Instruction, tok Token, val int32) error {
+	if tok.Type == Tok_Number {
+		if val != 0 {
+			return fmt.Errorf("%v:%v Atomic memory operations take no offset, got '%v'\n", tok.line_num, tok.start, tok.Value)
+		}
+		return nil
+	}
+
+	switch {
+	case tok.num == 1:
+		inst.Rd = val
+	case tok.num == 2 && inst.Op != Inst_Lr_w:
+		inst.Rs1 = val
+	case tok.num <= 4:
+		inst.Rs2 = val
+	default:
+		return fmt.Errorf("%v:%v Unexpected token '%v'\n", tok.line_num, tok.start, tok.Value)
+	}
+
+	return nil
+}
+
+// Returns the atomic instruction for mnemonics with an ordering suffix like
+// 'amoadd.w.aqrl'. Memory accesses are already performed in program order,
+// so the ordering bits have no effect.
+func atomicOpcode(s string) Inst_Op {
+	for _, suffix := range []string{".aqrl", ".aq", ".rl"} {
+		base, ok := strings.CutSuffix(s, suffix)
+		if !ok {
+			continue
+		}
+
+		op := stringToOpcode(base)
+		if (Instruction{Op: op}).isAtomic() {
+			return op
+		}
+	}
+
+	return _Inst_Unknown
+}
+
+// Parses a fence ordering set like "rw" or "iorw" into its 4-bit mask, "0"
+// is the empty set.
+func parseFenceSet(s string) (int32, bool) {
+	if len(s) == 0 {
+		return 0, false
+	}
+	if s == "0" {
+		return 0, true
+	}
+
+	var set int32
+	for _, ch := range s {
+		switch ch {
+		case 'i':
+			set |= 1 << 3
+		case 'o':
+			set |= 1 << 2
+		case 'r':
+			set |= 1 << 1
+		case 'w':
+			set |= 1 << 0
+		default:
+			return 0, false
+		}
+	}
+
+	return set, true
+}
+
+// Instructions that take a CSR name as an operand.
+func takesCsrOperand(op Inst_Op) bool {
+	switch op {
+	case Inst_Csrrw, Inst_Csrrs, Inst_Csrrc, Inst_Csrrwi, Inst_Csrrsi, Inst_Csrrci,
+		Inst_Csrr, Inst_Csrw, Inst_Csrs, Inst_Csrc, Inst_Csrwi, Inst_Csrsi, Inst_Csrci:
+		return true
+	}
+
+	return false
+}
+
+// Instructions whose destination register can be left out, 'fsrm a0' is the
+// same as 'fsrm zero, a0'.
+func hasShortForm(op Inst_Op) bool {
+	return op == Inst_Fscsr || op == Inst_Fsrm || op == Inst_Fsflags
+}
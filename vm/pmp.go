@@ -0,0 +1,157 @@
+package vm
+
+// Physical memory protection. Each entry guards a region of the physical
+// address space, the lowest numbered entry that matches an access decides
+// whether it is allowed. Entries apply to user and supervisor mode, and to
+// machine mode too once they are locked.
+//
+// While no entry is enabled nothing is restricted, so programs that never
+// set up PMP run as before.
+
+const PMP_ENTRIES = 16
+
+const (
+	CSR_PMPCFG0  uint32 = 0x3a0 // Up to pmpcfg3, four entries per register
+	CSR_PMPADDR0 uint32 = 0x3b0 // Up to pmpaddr15, bits 33..2 of the address
+)
+
+// Fields of a pmpcfg entry
+const (
+	PMP_R       uint8 = 1 << 0
+	PMP_W       uint8 = 1 << 1
+	PMP_X       uint8 = 1 << 2
+	PMP_A_SHIFT       = 3
+	PMP_A       uint8 = 3 << PMP_A_SHIFT
+	PMP_L       uint8 = 1 << 7 // Locked until reset, also applies to machine mode
+)
+
+// Address matching modes, the A field of a pmpcfg entry
+const (
+	PMP_OFF   uint8 = 0
+	PMP_TOR   uint8 = 1 // Top of range, from the previous entry's address up to this one
+	PMP_NA4   uint8 = 2 // Naturally aligned four bytes
+	PMP_NAPOT uint8 = 3 // Naturally aligned power of two, at least eight bytes
+)
+
+func pmpMode(cfg uint8) uint8 {
+	return (cfg & PMP_A) >> PMP_A_SHIFT
+}
+
+// Returns the entry number for a pmpcfg CSR address and whether it is one.
+func pmpCfgIndex(addr uint32) (int, bool) {
+	i := int(addr - CSR_PMPCFG0)
+	return i * 4, addr >= CSR_PMPCFG0 && i < PMP_ENTRIES/4
+}
+
+// Returns the entry number for a pmpaddr CSR address and whether it is one.
+func pmpAddrIndex(addr uint32) (int, bool) {
+	i := int(addr - CSR_PMPADDR0)
+	return i, addr >= CSR_PMPADDR0 && i < PMP_ENTRIES
+}
+
+// Reads four entries of the configuration, starting at entry i.
+func (c *Csr_File) pmpcfgRead(i int) uint32 {
+	var value uint32
+	for j := range 4 {
+		value |= uint32(c.Pmpcfg[i+j]) << (j * 8)
+	}
+	return value
+}
+
+// Writes four entries of the configuration, starting at entry i. Locked
+// entries keep their value.
+func (c *Csr_File) pmpcfgWrite(i int, data uint32) {
+	for j := range 4 {
+		if c.Pmpcfg[i+j]&PMP_L != 0 {
+			continue
+		}
+
+		cfg := uint8(data >> (j * 8))
+		cfg &= PMP_R | PMP_W | PMP_X | PMP_A | PMP_L
+
+		// Writable but not readable is reserved
+		if cfg&PMP_R == 0 {
+			cfg &^= PMP_W
+		}
+		c.Pmpcfg[i+j] = cfg
+	}
+}
+
+// Writes the address of entry i. The address is locked along with the entry,
+// and also when the next entry is a locked top of range entry using it.
+func (c *Csr_File) pmpaddrWrite(i int, data uint32) {
+	if c.Pmpcfg[i]&PMP_L != 0 {
+		return
+	}
+	if i+1 < PMP_ENTRIES && c.Pmpcfg[i+1]&PMP_L != 0 && pmpMode(c.Pmpcfg[i+1]) == PMP_TOR {
+		return
+	}
+	c.Pmpaddr[i] = data
+}
+
+// Returns the byte range [lo, hi) entry i matches. Physical addresses are
+// 34 bits wide, so the bounds do not fit in 32 bits.
+func (c *Csr_File) pmpRange(i int) (uint64, uint64) {
+	addr := uint64(c.Pmpaddr[i])
+	switch pmpMode(c.Pmpcfg[i]) {
+	case PMP_TOR:
+		var lo uint64
+		if i > 0 {
+			lo = uint64(c.Pmpaddr[i-1]) << 2
+		}
+		return lo, addr << 2
+	case PMP_NA4:
+		return addr << 2, addr<<2 + 4
+	case PMP_NAPOT:
+		// The number of trailing ones encodes the size
+		ones := 0
+		for addr>>ones&1 != 0 {
+			ones++
+		}
+		lo := (addr &^ (1<<ones - 1)) << 2
+		return lo, lo + 8<<ones
+	}
+	return 0, 0
+}
+
+// Reports whether PMP allows an access of n bytes at the physical address
+// addr from the given privilege level.
+func (v *Vm) pmpAllows(addr uint32, n uint8, access Access_Type, priv uint32) bool {
+	c := &v.Csrs
+	lo, hi := uint64(addr), uint64(addr)+uint64(n)
+
+	active := false
+	for i := range PMP_ENTRIES {
+		cfg := c.Pmpcfg[i]
+		if pmpMode(cfg) == PMP_OFF {
+			continue
+		}
+		active = true
+
+		start, end := c.pmpRange(i)
+		if hi <= start || end <= lo {
+			continue
+		}
+
+		// An access that is only partly inside the region fails
+		if lo < start || end < hi {
+			return false
+		}
+
+		if priv == PRIV_M && cfg&PMP_L == 0 {
+			return true
+		}
+
+		switch access {
+		case ACCESS_FETCH:
+			return cfg&PMP_X != 0
+		case ACCESS_LOAD:
+			return cfg&PMP_R != 0
+		default:
+			return cfg&PMP_W != 0
+		}
+	}
+
+	// Nothing matched, only machine mode has access
+	return priv == PRIV_M || !active
+}
@@ -0,0 +1,218 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Relocation operators, they take a part of the address of a label as an
+// immediate. Together '%hi' and '%lo' build an absolute address, like in
+//
+//	lui  a0, %hi(table)
+//	lw   a1, %lo(table)(a0)
+//
+// and '%pcrel_hi' and '%pcrel_lo' build one relative to the auipc, whose
+// label '%pcrel_lo' takes:
+//
+//	1: auipc a0, %pcrel_hi(table)
+//	   addi  a0, a0, %pcrel_lo(1b)
+//
+// The upper parts are rounded up when the lower part is negative, which
+// the sign-extended 12-bit immediates subtract. A label can be followed by an
+// offset like '%hi(table + 8)'.
+//
+// Instructions of the U format keep their immediate shifted, 'lui a0, 1'
+// has 4096 as its immediate.
+
+type Reloc_Kind uint8
+
+const (
+	RELOC_NONE     Reloc_Kind = iota // A label without an operator, see ParseProgramFromString
+	RELOC_HI                         // %hi(sym)
+	RELOC_LO                         // %lo(sym)
+	RELOC_PCREL_HI                   // %pcrel_hi(sym)
+	RELOC_PCREL_LO                   // %pcrel_lo(label of the auipc)
+)
+
+var relocOperators = map[string]Reloc_Kind{
+	"%hi":       RELOC_HI,
+	"%lo":       RELOC_LO,
+	"%pcrel_hi": RELOC_PCREL_HI,
+	"%pcrel_lo": RELOC_PCREL_LO,
+}
+
+// A label used by an instruction, filled once every label is known
+type label_ref struct {
+	label  string
+	addend int32
+	reloc  Reloc_Kind
+}
+
+// Labels the pcrel_lo parts of the pseudo instructions refer to, one at the
+// auipc of each of them. They can't be written in programs.
+const PCREL_LABEL_PREFIX = "%pcrel."
+
+// The relocations of the instructions a pseudo instruction with a label
+// expands to, pseudo instructions with one instruction keep their label.
+var pseudoRelocations = map[Inst_Op][]Reloc_Kind{
+	Inst_Li:   {RELOC_HI, RELOC_LO},
+	Inst_La:   {RELOC_PCREL_HI, RELOC_PCREL_LO},
+	Inst_Lla:  {RELOC_PCREL_HI, RELOC_PCREL_LO},
+	Inst_Call: {RELOC_PCREL_HI, RELOC_PCREL_LO},
+	Inst_Tail: {RELOC_PCREL_HI, RELOC_PCREL_LO},
+}
+
+// Parses a relocation operand like '%hi(sym + 4)', its value is the part of
+// the address of sym plus the constant addend.
+func (p *Parser) parseRelocation(tok Token) (label_ref, error) {
+	name, rest, _ := strings.Cut(tok.Value, "(")
+	reloc, ok := relocOperators[name]
+	if !ok {
+		return label_ref{}, fmt.Errorf("%v:%v Unknown relocation operator '%v'", tok.line_num, tok.start+1, name)
+	}
+
+	inner := strings.TrimSpace(strings.TrimSuffix(rest, ")"))
+	end := 0
+	for end < len(inner) && isSymbol(inner[end]) {
+		end++
+	}
+	if end == 0 || !isSymbolStart(inner[0]) {
+		return label_ref{}, fmt.Errorf("%v:%v Expected a label in '%v'", tok.line_num, tok.start+1, tok.Value)
+	}
+
+	ref := label_ref{label: inner[:end], reloc: reloc}
+	if offset := strings.TrimSpace(inner[end:]); offset != "" {
+		if reloc == RELOC_PCREL_LO || (offset[0] != '+' && offset[0] != '-') {
+			return label_ref{}, fmt.Errorf("%v:%v Invalid offset in '%v'", tok.line_num, tok.start+1, tok.Value)
+		}
+
+		addend, err := evalExpression(offset, p.constants)
+		if err != nil {
+			return label_ref{}, fmt.Errorf("%v:%v Invalid offset in '%v': %v", tok.line_num, tok.start+1, tok.Value, err)
+		}
+		ref.addend = int32(addend)
+	}
+
+	return ref, nil
+}
+
+// Returns the upper part of the value, shifted like the immediates of the U
+// format, and the lower part. Their sum is the value.
+func splitImmediate(val int32) (int32, int32) {
+	hi := int32(uint32(val)+0x800) &^ 0xfff
+	return hi, val - hi
+}
+
+// Checks the range of the immediates of li, la, lui and auipc, which are not
+// truncated to 12 bits, and shifts the immediates of lui and auipc. li takes
+// any 64-bit value in RV64, the parser keeps it whole, see loadImmediate64.
+func immediateOperand(inst *Instruction, tok Token, num int64, xlen int) (int32, error) {
+	switch inst.Op {
+	case Inst_Li, Inst_La, Inst_Lla:
+		if xlen == XLEN_32 && (num < math.MinInt32 || num > math.MaxUint32) {
+			return 0, fmt.Errorf("%v:%v Immediate '%v' does not fit in 32 bits", tok.line_num, tok.start+1, tok.Value)
+		}
+	case Inst_Lui, Inst_Auipc:
+		if num < 0 || num >= 1<<20 {
+			return 0, fmt.Errorf("%v:%v Immediate '%v' must be in [0, 0xfffff]", tok.line_num, tok.start+1, tok.Value)
+		}
+		return int32(num << 12), nil
+	}
+
+	return int32(num), nil
+}
+
+// Fills the immediate of the instruction at index n with the label it uses.
+// pcs are the addresses of the instructions and index_at the index of the
+// instruction at an address.
+func (p *Parser) fillLabel(n uint32, ref label_ref, pcs []uint32, index_at map[uint32]uint32) error {
+	inst := &p.Program[n]
+
+	addr, ok := p.labelAddress(ref.label)
+	if !ok {
+		return fmt.Errorf("Undeclared label '%v'", ref.label)
+	}
+	target := int32(addr) + ref.addend
+
+	if ref.reloc == RELOC_NONE {
+		return p.fillPlainLabel(inst, ref.label, target-int32(pcs[n]))
+	}
+
+	var imm int32
+	switch ref.reloc {
+	case RELOC_HI:
+		imm, _ = splitImmediate(target)
+	case RELOC_LO:
+		_, imm = splitImmediate(target)
+	case RELOC_PCREL_HI:
+		imm, _ = splitImmediate(target - int32(pcs[n]))
+	case RELOC_PCREL_LO:
+		// The offset is the one of the auipc at the label
+		h, ok := index_at[addr]
+		hi_ref := p.insts_missing_label[h]
+		if !ok || hi_ref.reloc != RELOC_PCREL_HI {
+			return fmt.Errorf("'%%pcrel_lo(%v)' must use the label of an auipc with '%%pcrel_hi'", ref.label)
+		}
+
+		hi_addr, ok := p.labelAddress(hi_ref.label)
+		if !ok {
+			return fmt.Errorf("Undeclared label '%v'", hi_ref.label)
+		}
+		_, imm = splitImmediate(int32(hi_addr) + hi_ref.addend - int32(pcs[h]))
+	}
+
+	// Only the U format keeps the upper part shifted
+	if (ref.reloc == RELOC_HI || ref.reloc == RELOC_PCREL_HI) && inst._fmt != Fmt_U {
+		imm = int32(uint32(imm) >> 12)
+	}
+
+	jump := inst._fmt == Fmt_B || inst._fmt == Fmt_J
+	if jump || inst.Compressed || !inst.setImmediate(imm) {
+		return fmt.Errorf("Illegal label use: '%s'", ref.label)
+	}
+
+	return nil
+}
+
+// Fills a label used without a relocation operator. Jumps, branches and auipc
+// take the offset to the label, other instructions take the address of a
+// data label.
+func (p *Parser) fillPlainLabel(inst *Instruction, label string, offset int32) error {
+	jump := inst._fmt == Fmt_B || inst._fmt == Fmt_J
+	if jump && inst.Compressed && !compressedOffsetFits(inst.Op, offset) {
+		return fmt.Errorf("Label '%v' is out of range for a compressed instruction", label)
+	}
+
+	// based on different control instructions, the offset is stored in different place
+	switch {
+	case inst._fmt == Fmt_B:
+		inst.Rs2 = offset
+		return nil
+	case inst._fmt == Fmt_J:
+		inst.Rs1 = offset
+		return nil
+	case inst.Op == Inst_Jalr: // Inst_Jalr is an Fmt_I instruction but also a branch.
+		inst.Rs2 = offset
+		return nil
+	case inst.Op == Inst_Auipc:
+		inst.Rs1 = offset
+		return nil
+	}
+
+	// Data labels are the address itself, in the immediate
+	sym, ok := p.data_symbols[label]
+	if !ok || inst.isBranch() || inst.Compressed {
+		return fmt.Errorf("Illegal label use: '%s'", label)
+	}
+
+	addr := int32(p.data[sym.section].base + sym.offset)
+	if inst._fmt != Fmt_U && (addr < -2048 || addr >= 2048) {
+		return fmt.Errorf("Address of label '%v' does not fit in the immediate, use 'la' or '%%lo'", label)
+	}
+	if !inst.setImmediate(addr) {
+		return fmt.Errorf("Illegal label use: '%s'", label)
+	}
+
+	return nil
+}
@@ -0,0 +1,467 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Sections and data directives of the assembler. Instructions go to .text,
+// which is kept in the program slice apart from the memory. The other sections
+// are laid out in the memory from address 0 when the program is loaded, in the
+// order .data, .rodata, .bss, each one aligned to the largest alignment used
+// in it. Their labels are memory addresses, loaded with la or the relocations
+// of reloc.go, other instructions using them as an immediate get the address
+// itself. Nothing protects .rodata from stores.
+//
+// Compilers name their sections like '.rodata.str1.4' or '.sdata', they go
+// to the section their name starts with. Sections like the debug information
+// are discarded with everything in them.
+
+type Section uint8
+
+const (
+	SECTION_TEXT Section = iota
+	SECTION_DATA
+	SECTION_RODATA
+	SECTION_BSS
+	SECTION_DISCARD // Unknown sections of the compilers' output
+)
+
+var sectionNames = map[string]Section{
+	".text":   SECTION_TEXT,
+	".data":   SECTION_DATA,
+	".rodata": SECTION_RODATA,
+	".bss":    SECTION_BSS,
+}
+
+// Sections of '.section name' by the prefix of the name
+var sectionPrefixes = map[string]Section{
+	".text":    SECTION_TEXT,
+	".data":    SECTION_DATA,
+	".sdata":   SECTION_DATA,
+	".rodata":  SECTION_RODATA,
+	".srodata": SECTION_RODATA,
+	".bss":     SECTION_BSS,
+	".sbss":    SECTION_BSS,
+}
+
+// Directives of the compilers' output that don't change the program, their
+// operands are not parsed. The '.cfi_' directives are ignored too.
+var ignoredDirectives = map[string]bool{
+	".file":        true,
+	".local":       true,
+	".weak":        true,
+	".hidden":      true,
+	".protected":   true,
+	".type":        true,
+	".size":        true,
+	".ident":       true,
+	".option":      true,
+	".attribute":   true,
+	".loc":         true,
+	".addrsig":     true,
+	".addrsig_sym": true,
+}
+
+// Sizes of the values of the data directives, in bytes
+var dataValueSizes = map[string]uint32{
+	".byte":  1,
+	".half":  2,
+	".2byte": 2,
+	".word":  4,
+	".4byte": 4,
+	".dword": 8,
+	".8byte": 8,
+	".quad":  8,
+}
+
+// Largest '.align' argument, the alignment is 2^n bytes
+const MAX_ALIGN = 16
+
+// Alignment of the data following the code in the binaries, see Object
+const DATA_ALIGN = 16
+
+type data_section struct {
+	bytes []byte // All zero in .bss
+	align uint32 // Largest alignment used in the section, in bytes
+	base  uint32 // Address of the section, set once every section is parsed
+}
+
+// A label declared in a data section
+type data_symbol struct {
+	section Section
+	offset  uint32
+}
+
+// A label used as the value of a data directive, written once the labels are known
+type data_label_use struct {
+	section  Section
+	offset   uint32
+	size     uint32
+	label    string
+	line_num source_pos
+}
+
+// Declares a label at the current address of the current section. Labels of
+// the discarded sections are not declared.
+func (p *Parser) declareLabel(tok Token) error {
+	_, isCode := p.symbol_table[tok.Value]
+	_, isData := p.data_symbols[tok.Value]
+	_, isConstant := p.constants[tok.Value]
+	if isCode || isData || isConstant {
+		return fmt.Errorf("%v:%v Label '%v' is already declared", tok.line_num, tok.start+1, tok.Value)
+	}
+
+	if p.section == SECTION_TEXT {
+		p.symbol_table[tok.Value] = p.pc
+	} else if p.section != SECTION_DISCARD {
+		p.data_symbols[tok.Value] = data_symbol{p.section, uint32(len(p.data[p.section].bytes))}
+	}
+
+	return nil
+}
+
+// Parses a directive, its operands are the rest of the line.
+func (p *Parser) parseDirective(lexer *Lexer, tok Token) error {
+	_, isSection := sectionNames[tok.Value]
+	discarded := p.section == SECTION_DISCARD && !isSection && tok.Value != ".section"
+	if ignoredDirectives[tok.Value] || strings.HasPrefix(tok.Value, ".cfi_") || discarded {
+		lexer.skipLine()
+		return nil
+	}
+
+	// '.section name, flags, type', only the name is used
+	if tok.Value == ".section" {
+		name, _, _ := strings.Cut(stripComment(lexer.skipLine()), ",")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("%v:%v '.section' expects a section name", tok.line_num, tok.start+1)
+		}
+
+		p.section = SECTION_DISCARD
+		for prefix, section := range sectionPrefixes {
+			if name == prefix || strings.HasPrefix(name, prefix+".") {
+				p.section = section
+			}
+		}
+		return nil
+	}
+
+	var args []Token
+	for next := lexer.peekNextToken(); next.num != 0 && next.Type != Tok_End; next = lexer.peekNextToken() {
+		arg := lexer.nextToken()
+		if arg.Type == Tok_Invalid {
+			return fmt.Errorf("%v:%v Invalid token '%v'", arg.line_num, arg.start+1, arg.Value)
+		}
+		args = append(args, arg)
+	}
+
+	if section, ok := sectionNames[tok.Value]; ok {
+		if len(args) > 0 {
+			return fmt.Errorf("%v:%v Unexpected token '%v'", args[0].line_num, args[0].start+1, args[0].Value)
+		}
+		p.section = section
+		return nil
+	}
+
+	switch tok.Value {
+	case ".byte", ".half", ".2byte", ".word", ".4byte", ".dword", ".8byte", ".quad":
+		return p.parseDataValues(tok, args)
+	case ".ascii", ".asciz", ".string":
+		return p.parseDataStrings(tok, args)
+	case ".space", ".zero":
+		return p.parseDataSpace(tok, args)
+	case ".align", ".p2align", ".balign":
+		return p.parseAlign(tok, args)
+	case ".comm", ".lcomm":
+		return p.parseCommon(tok, args)
+	case ".equ", ".set":
+		return p.parseConstant(tok, args)
+	case ".globl", ".global", ".extern":
+		return p.parseGlobal(tok, args)
+	}
+
+	return fmt.Errorf("%v:%v Unknown directive '%v'", tok.line_num, tok.start+1, tok.Value)
+}
+
+// Returns the section a data directive goes to. Data can't be placed in
+// .text, and only zeros can be placed in .bss.
+func (p *Parser) currentDataSection(tok Token, zero bool) (*data_section, error) {
+	switch {
+	case p.section == SECTION_TEXT:
+		return nil, fmt.Errorf("%v:%v '%v' can't be used in the .text section", tok.line_num, tok.start+1, tok.Value)
+	case p.section == SECTION_BSS && !zero:
+		return nil, fmt.Errorf("%v:%v '%v' can't be used in the .bss section, it only holds zeros", tok.line_num, tok.start+1, tok.Value)
+	}
+
+	return &p.data[p.section], nil
+}
+
+// '.byte', '.half' and '.word', a list of numbers or labels. .bss only takes
+// zeros, compilers write them for variables initialized to 0.
+func (p *Parser) parseDataValues(tok Token, args []Token) error {
+	sec, err := p.currentDataSection(tok, true)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%v:%v '%v' expects at least one value", tok.line_num, tok.start+1, tok.Value)
+	}
+
+	size := dataValueSizes[tok.Value]
+	for _, arg := range args {
+		_, isConstant := p.constants[arg.Value]
+		lo, hi := int64(-1)<<(8*size-1), int64(math.MaxInt64)
+		if size < 8 {
+			hi = 1<<(8*size) - 1
+		}
+
+		switch {
+		case arg.Type == Tok_Number || isConstant:
+			val, err := p.directiveNumber(arg, lo, hi)
+			if err != nil {
+				return err
+			}
+			if val != 0 {
+				if _, err := p.currentDataSection(tok, false); err != nil {
+					return err
+				}
+			}
+			sec.bytes = appendValue(sec.bytes, uint64(val), size)
+		case arg.Type == Tok_Symbol:
+			if _, err := p.currentDataSection(tok, false); err != nil {
+				return err
+			}
+			p.data_label_uses = append(p.data_label_uses, data_label_use{
+				section:  p.section,
+				offset:   uint32(len(sec.bytes)),
+				size:     size,
+				label:    arg.Value,
+				line_num: arg.line_num,
+			})
+			sec.bytes = appendValue(sec.bytes, 0, size)
+		default:
+			return fmt.Errorf("%v:%v Unexpected token '%v'", arg.line_num, arg.start+1, arg.Value)
+		}
+	}
+
+	return nil
+}
+
+// '.ascii' and its NUL terminated forms '.asciz' and '.string'.
+func (p *Parser) parseDataStrings(tok Token, args []Token) error {
+	sec, err := p.currentDataSection(tok, false)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%v:%v '%v' expects at least one string", tok.line_num, tok.start+1, tok.Value)
+	}
+
+	for _, arg := range args {
+		if arg.Type != Tok_String {
+			return fmt.Errorf("%v:%v Expected a string, got '%v'", arg.line_num, arg.start+1, arg.Value)
+		}
+
+		sec.bytes = append(sec.bytes, arg.Value...)
+		if tok.Value != ".ascii" {
+			sec.bytes = append(sec.bytes, 0)
+		}
+	}
+
+	return nil
+}
+
+// '.space n, fill' and '.zero n', n bytes of the fill value or zero.
+func (p *Parser) parseDataSpace(tok Token, args []Token) error {
+	if len(args) == 0 || len(args) > 2 || (tok.Value == ".zero" && len(args) > 1) {
+		return fmt.Errorf("%v:%v Invalid operands for '%v', expected 'size' or '.space size, fill'", tok.line_num, tok.start+1, tok.Value)
+	}
+
+	n, err := p.directiveNumber(args[0], 0, 1<<24)
+	if err != nil {
+		return err
+	}
+
+	var fill int64
+	if len(args) == 2 {
+		if fill, err = p.directiveNumber(args[1], -128, 255); err != nil {
+			return err
+		}
+	}
+
+	sec, err := p.currentDataSection(tok, fill == 0)
+	if err != nil {
+		return err
+	}
+
+	for range n {
+		sec.bytes = append(sec.bytes, byte(fill))
+	}
+
+	return nil
+}
+
+// '.align n' and '.p2align n' align the next data or instruction to 2^n
+// bytes, '.balign n' to n bytes. Data sections are padded with zeros and .text
+// with nops. The fill value and the limit of '.p2align n, fill, max' are not
+// supported, GCC leaves them out.
+func (p *Parser) parseAlign(tok Token, args []Token) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%v:%v '%v' expects one value", tok.line_num, tok.start+1, tok.Value)
+	}
+
+	var align uint32
+	if tok.Value == ".balign" {
+		n, err := p.directiveNumber(args[0], 1, 1<<MAX_ALIGN)
+		if err != nil {
+			return err
+		}
+		if n&(n-1) != 0 {
+			return fmt.Errorf("%v:%v Alignment '%v' must be a power of 2", args[0].line_num, args[0].start+1, args[0].Value)
+		}
+		align = uint32(n)
+	} else {
+		n, err := p.directiveNumber(args[0], 0, MAX_ALIGN)
+		if err != nil {
+			return err
+		}
+		align = uint32(1) << n
+	}
+
+	if p.section == SECTION_TEXT {
+		for p.pc%align != 0 {
+			if p.pc%4 != 0 {
+				nop, _ := expandCompressedInstruction(newInstruction(Inst_C_nop, 0, 0, 0))
+				p.pushInstruction(nop)
+			} else {
+				p.pushInstruction(newInstruction(Inst_Addi, 0, 0, 0))
+			}
+		}
+		return nil
+	}
+
+	sec := &p.data[p.section]
+	for uint32(len(sec.bytes))%align != 0 {
+		sec.bytes = append(sec.bytes, 0)
+	}
+	sec.align = max(sec.align, align)
+
+	return nil
+}
+
+// '.comm name, size, align' and '.lcomm name, size, align' reserve size
+// bytes in .bss, aligned to align bytes.
+func (p *Parser) parseCommon(tok Token, args []Token) error {
+	if len(args) < 2 || len(args) > 3 || args[0].Type != Tok_Symbol {
+		return fmt.Errorf("%v:%v Invalid operands for '%v', expected 'name, size, align'", tok.line_num, tok.start+1, tok.Value)
+	}
+
+	size, err := p.directiveNumber(args[1], 0, 1<<24)
+	if err != nil {
+		return err
+	}
+
+	align := int64(1)
+	if len(args) == 3 {
+		if align, err = p.directiveNumber(args[2], 1, 1<<MAX_ALIGN); err != nil {
+			return err
+		}
+		if align&(align-1) != 0 {
+			return fmt.Errorf("%v:%v Alignment '%v' must be a power of 2", args[2].line_num, args[2].start+1, args[2].Value)
+		}
+	}
+
+	section := p.section
+	defer func() { p.section = section }()
+	p.section = SECTION_BSS
+
+	sec := &p.data[SECTION_BSS]
+	for uint32(len(sec.bytes))%uint32(align) != 0 {
+		sec.bytes = append(sec.bytes, 0)
+	}
+	sec.align = max(sec.align, uint32(align))
+
+	if err := p.declareLabel(args[0]); err != nil {
+		return err
+	}
+	sec.bytes = append(sec.bytes, make([]byte, size)...)
+
+	return nil
+}
+
+// Evaluates a number operand of a directive, it must be in [lo, hi].
+func (p *Parser) directiveNumber(tok Token, lo, hi int64) (int64, error) {
+	val, err := p.evaluate(tok)
+	if err != nil {
+		return 0, err
+	}
+
+	if val < lo || val > hi {
+		return 0, fmt.Errorf("%v:%v Value '%v' must be in [%d, %d]", tok.line_num, tok.start+1, tok.Value, lo, hi)
+	}
+
+	return val, nil
+}
+
+// Lays out the data sections and returns their initial contents, from
+// data_base to the end of .bss. Labels used in data directives are written.
+func (p *Parser) layoutData() ([]byte, error) {
+	end := p.data_base
+	for s := SECTION_DATA; s <= SECTION_BSS; s++ {
+		sec := &p.data[s]
+		align := max(sec.align, 1)
+		sec.base = (end + align - 1) / align * align
+		end = sec.base + uint32(len(sec.bytes))
+	}
+
+	image := make([]byte, end-p.data_base)
+	for s := SECTION_DATA; s <= SECTION_BSS; s++ {
+		copy(image[p.data[s].base-p.data_base:], p.data[s].bytes)
+	}
+
+	for _, use := range p.data_label_uses {
+		addr, ok := p.labelAddress(use.label)
+		if !ok {
+			return nil, fmt.Errorf("%v: Undeclared label '%v'", use.line_num, use.label)
+		}
+		if use.size < 4 && uint64(addr) >= 1<<(8*use.size) {
+			return nil, fmt.Errorf("%v: Address of label '%v' does not fit in %d bytes", use.line_num, use.label, use.size)
+		}
+
+		putValue(image[p.data[use.section].base-p.data_base+use.offset:], uint64(addr), use.size)
+	}
+
+	return image, nil
+}
+
+// Returns the address of a label, the pc of an instruction or a memory
+// address. Data addresses are only known after layoutData.
+func (p *Parser) labelAddress(label string) (uint32, bool) {
+	if pc, ok := p.symbol_table[label]; ok {
+		return pc, true
+	}
+
+	sym, ok := p.data_symbols[label]
+	if !ok {
+		return 0, false
+	}
+
+	return p.data[sym.section].base + sym.offset, true
+}
+
+// Appends the low size bytes of val, little-endian.
+func appendValue(b []byte, val uint64, size uint32) []byte {
+	for i := range size {
+		b = append(b, byte(val>>(8*i)))
+	}
+	return b
+}
+
+// Writes the low size bytes of val to the start of b, little-endian.
+func putValue(b []byte, val uint64, size uint32) {
+	for i := range size {
+		b[i] = byte(val >> (8 * i))
+	}
+}
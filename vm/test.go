@@ -1,6 +1,7 @@
 package vm
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io/fs"
@@ -11,11 +12,28 @@ import (
 )
 
 type Saved_State struct {
-	Config    Vm_Config
+	Config    Saved_Config
 	Registers [32]Register
 	Memory    []byte
 }
 
+// Part of the Vm_Config that is stored in the saved states. This has a fixed
+// layout, so new config fields don't invalidate existing saved states. New
+// fields go at the end, the saved states written before them are told apart
+// by their length, see readSavedState.
+type Saved_Config struct {
+	Mem_size           uint32
+	Stack_size         uint32
+	Bp_nbit            uint8
+	Forwarding_enabled bool
+	Bp_enabled         bool
+	Xlen               uint8
+	Von_neumann        bool // Not in the saved states written before it
+}
+
+// Size of the Saved_Config of the saved states written before Von_neumann
+const SAVED_CONFIG_XLEN_SIZE = 12
+
 const (
 	SAVE_FOLDER   = "tests"
 	SOURCE_FOLDER = "examples"
@@ -25,7 +43,15 @@ const (
 func (v Vm) SaveTestState(src_path string) error {
 	var state Saved_State
 
-	state.Config = v.Config
+	state.Config = Saved_Config{
+		Mem_size:           v.Config.Mem_size,
+		Stack_size:         v.Config.Stack_size,
+		Bp_nbit:            v.Config.Bp_nbit,
+		Forwarding_enabled: v.Config.Forwarding_enabled,
+		Bp_enabled:         v.Config.Bp_enabled,
+		Xlen:               uint8(v.Config.Xlen),
+		Von_neumann:        v.Config.Von_neumann,
+	}
 	state.Registers = v.Registers
 	state.Memory = make([]byte, v.Config.Mem_size)
 	copy(state.Memory, v.Memory)
@@ -55,6 +81,53 @@ func (v Vm) SaveTestState(src_path string) error {
 	return nil
 }
 
+// Returns the files of an example, 'name.asm' is linked with the files of the
+// 'name' folder next to it if there is one.
+func exampleFiles(src_name string) []string {
+	files := []string{fmt.Sprintf("%s/%s", SOURCE_FOLDER, src_name)}
+	linked, _ := filepath.Glob(fmt.Sprintf("%s/%s/*.asm", SOURCE_FOLDER, strings.TrimSuffix(src_name, ".asm")))
+	return append(files, linked...)
+}
+
+// Reads a saved state written by SaveTestState. The ones written before the
+// last fields of Saved_Config have a shorter config, which is found from the
+// length of the file. The missing fields are zero.
+func readSavedState(path string) (Saved_State, error) {
+	var saved_state Saved_State
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return saved_state, err
+	}
+
+	config_size := binary.Size(saved_state.Config)
+	registers_size := binary.Size(saved_state.Registers)
+	if len(data) < SAVED_CONFIG_XLEN_SIZE {
+		return saved_state, fmt.Errorf("Failed to read 'saved_state.config' from '%v': The file has only %d bytes", path, len(data))
+	}
+	mem_size := int(binary.LittleEndian.Uint32(data))
+	if len(data) == SAVED_CONFIG_XLEN_SIZE+registers_size+mem_size {
+		config_size = SAVED_CONFIG_XLEN_SIZE
+	} else if len(data) != config_size+registers_size+mem_size {
+		return saved_state, fmt.Errorf("Failed to read '%v': %d bytes, not the size of a saved state with %d bytes of memory", path, len(data), mem_size)
+	}
+
+	config := make([]byte, binary.Size(saved_state.Config))
+	copy(config, data[:config_size])
+	err = binary.Read(bytes.NewReader(config), binary.LittleEndian, &saved_state.Config)
+	if err != nil {
+		return saved_state, fmt.Errorf("Failed to read 'saved_state.config' from '%v': %v", path, err.Error())
+	}
+
+	err = binary.Read(bytes.NewReader(data[config_size:]), binary.LittleEndian, &saved_state.Registers)
+	if err != nil {
+		return saved_state, fmt.Errorf("Failed to read 'saved_state.registers' from '%v': %v", path, err.Error())
+	}
+
+	saved_state.Memory = data[config_size+registers_size:]
+	return saved_state, nil
+}
+
 func TestAllExamples() error {
 	err := filepath.WalkDir(SAVE_FOLDER, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -71,33 +144,12 @@ func TestAllExamples() error {
 			return nil
 		}
 
-		var saved_state Saved_State
-		f, err := os.Open(path)
+		saved_state, err := readSavedState(path)
 		if err != nil {
-			return err
-		}
-
-		err = binary.Read(f, binary.LittleEndian, &saved_state.Config)
-		if err != nil {
-			fmt.Printf("Failed to read 'saved_state.config' from '%v': %v\n", path, err.Error())
+			fmt.Println(err.Error())
 			return nil
 		}
 
-		err = binary.Read(f, binary.LittleEndian, &saved_state.Registers)
-		if err != nil {
-			fmt.Printf("Failed to read 'saved_state.registers' from '%v': %v\n", path, err.Error())
-			return nil
-		}
-
-		saved_state.Memory = make([]byte, saved_state.Config.Mem_size)
-		_, err = f.Read(saved_state.Memory)
-		if err != nil {
-			fmt.Printf("Failed to read 'saved_state.memory' from '%v': %v\n", path, err.Error())
-			return nil
-		}
-
-		f.Close()
-
 		// Different combinations for forwarding and Branch prediction configs
 		forwardingAndBpConfigs := [][2]bool{{false, false}, {false, true}, {true, false}, {true, true}}
 
@@ -108,12 +160,14 @@ func TestAllExamples() error {
 
 			forwarding, bp := combination[0], combination[1]
 			cfg, _ := CreateConfig(saved_state.Config.Mem_size, saved_state.Config.Stack_size, saved_state.Config.Bp_nbit, forwarding, bp)
+			cfg.Xlen = int(saved_state.Config.Xlen)
+			cfg.Von_neumann = saved_state.Config.Von_neumann
 			vm, err := CreateVm(*cfg)
 			if err != nil {
 				return err
 			}
 
-			err = vm.LoadProgramFromFile(fmt.Sprintf("%s/%s", SOURCE_FOLDER, src_name))
+			err = vm.LoadProgramFromFiles(exampleFiles(src_name))
 			if err != nil {
 				fmt.Printf("\tFailed to load program '%v' for testing. '%v'\n", src_name, err.Error())
 				return nil
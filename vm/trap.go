@@ -0,0 +1,247 @@
+package vm
+
+import (
+	"fmt"
+)
+
+// Exception causes, as written to mcause
+const (
+	CAUSE_MISALIGNED_FETCH    uint32 = 0
+	CAUSE_FETCH_ACCESS        uint32 = 1
+	CAUSE_ILLEGAL_INSTRUCTION uint32 = 2
+	CAUSE_BREAKPOINT          uint32 = 3
+	CAUSE_MISALIGNED_LOAD     uint32 = 4
+	CAUSE_LOAD_ACCESS         uint32 = 5
+	CAUSE_MISALIGNED_STORE    uint32 = 6 // Also raised by the atomics
+	CAUSE_STORE_ACCESS        uint32 = 7 // Also raised by the atomics
+	CAUSE_ECALL_U             uint32 = 8
+	CAUSE_ECALL_S             uint32 = 9
+	CAUSE_ECALL_M             uint32 = 11
+	CAUSE_FETCH_PAGE_FAULT    uint32 = 12
+	CAUSE_LOAD_PAGE_FAULT     uint32 = 13
+	CAUSE_STORE_PAGE_FAULT    uint32 = 15 // Also raised by the atomics
+)
+
+// Privilege levels, as encoded in mstatus.MPP
+const (
+	PRIV_U uint32 = 0
+	PRIV_S uint32 = 1
+	PRIV_M uint32 = 3
+)
+
+func privName(priv uint32) string {
+	switch priv {
+	case PRIV_U:
+		return "user"
+	case PRIV_S:
+		return "supervisor"
+	default:
+		return "machine"
+	}
+}
+
+// mstatus fields
+const (
+	MSTATUS_SIE       uint32 = 1 << 1 // Supervisor interrupt enable
+	MSTATUS_MIE       uint32 = 1 << 3 // Machine interrupt enable
+	MSTATUS_SPIE      uint32 = 1 << 5 // SIE before the trap
+	MSTATUS_MPIE      uint32 = 1 << 7 // MIE before the trap
+	MSTATUS_SPP_SHIFT        = 8
+	MSTATUS_SPP       uint32 = 1 << MSTATUS_SPP_SHIFT // Privilege level before a supervisor trap, U or S
+	MSTATUS_MPP_SHIFT        = 11
+	MSTATUS_MPP       uint32 = 3 << MSTATUS_MPP_SHIFT // Privilege level before the trap
+	MSTATUS_MPRV      uint32 = 1 << 17                // Machine mode loads and stores use the privilege in MPP
+	MSTATUS_SUM       uint32 = 1 << 18                // Supervisor mode may access user pages
+	MSTATUS_MXR       uint32 = 1 << 19                // Executable pages are readable
+)
+
+// Low bits of mtvec and stvec select the mode, the rest is the handler address
+const (
+	MTVEC_MODE_MASK     uint32 = 3
+	MTVEC_MODE_DIRECT   uint32 = 0
+	MTVEC_MODE_VECTORED uint32 = 1 // Interrupts jump to base + 4 * cause
+)
+
+// An exception raised by an instruction. It is carried down the pipeline with
+// the instruction and the trap is taken when the instruction reaches writeback,
+// so that everything older has completed and nothing younger has taken effect.
+type Exception struct {
+	Cause uint32
+	Tval  uint32 // Faulting address, or 0 if the cause has none
+	Msg   string
+}
+
+func (e *Exception) Error() string {
+	return e.Msg
+}
+
+func (e *Exception) isInterrupt() bool {
+	return e.Cause&CAUSE_INTERRUPT != 0
+}
+
+func newException(cause, tval uint32, format string, a ...any) *Exception {
+	return &Exception{
+		Cause: cause,
+		Tval:  tval,
+		Msg:   fmt.Sprintf(format, a...),
+	}
+}
+
+// Raised by jumps and taken branches to an odd address.
+func misalignedFetch(target uint32) *Exception {
+	return newException(CAUSE_MISALIGNED_FETCH, target, "Jump to unaligned instruction address '%v'", target)
+}
+
+// Marks the instruction as faulting, only the first exception is kept.
+func (inst *Instruction) raise(exc *Exception) {
+	if inst._exception == nil {
+		inst._exception = exc
+	}
+}
+
+// Instructions that redirect the pc when they reach writeback. Everything
+// younger is squashed at that point.
+func (inst Instruction) redirectsAtWriteback() bool {
+	switch inst.Op {
+	case Inst_Mret, Inst_Sret, Inst_Sfence_vma:
+		return true
+	}
+	return inst._exception != nil
+}
+
+// Reports whether the instruction that went through the memory stage this
+// cycle is going to trap or return from a trap. The instruction in execute
+// is younger and will be squashed, so it must not have any side effects.
+func (v *Vm) olderRedirectPending() bool {
+	return v._mw_buff[0].valid && v._mw_buff[0].inst.redirectsAtWriteback()
+}
+
+// Reports whether the trap goes to supervisor mode. Traps from user and
+// supervisor mode go there if their bit is set in medeleg, or in mideleg for
+// interrupts. Traps never go to a lower privilege level.
+func (v *Vm) isDelegated(exc *Exception) bool {
+	deleg := v.Csrs.Medeleg
+	if exc.isInterrupt() {
+		deleg = v.Csrs.Mideleg
+	}
+	return v.Priv <= PRIV_S && deleg&(1<<(exc.Cause&^CAUSE_INTERRUPT)) != 0
+}
+
+// Takes the trap of an instruction at writeback. If no handler is installed
+// the machine stops instead.
+func (v *Vm) takeTrap(exc *Exception, pc uint32) {
+	v.squashYounger()
+
+	supervisor := v.isDelegated(exc)
+	tvec := v.Csrs.Mtvec
+	if supervisor {
+		tvec = v.Csrs.Stvec
+	}
+
+	if tvec&^MTVEC_MODE_MASK == 0 {
+		// ecall and ebreak are the usual way for a program to stop, anything
+		// else is a runtime error.
+		if !isEnvironmentCause(exc.Cause) {
+			v.Runtime_error = exc
+		}
+		v._halt = true
+		return
+	}
+
+	v.Dm.N_traps++
+	if exc.isInterrupt() {
+		v.Dm.N_interrupts++
+	}
+
+	// Save the interrupt enable and the privilege level, then disable interrupts
+	c := &v.Csrs
+	if supervisor {
+		c.Sepc = pc
+		c.Scause = exc.Cause
+		c.Stval = exc.Tval
+
+		c.Mstatus &^= MSTATUS_SPIE | MSTATUS_SPP
+		if c.Mstatus&MSTATUS_SIE != 0 {
+			c.Mstatus |= MSTATUS_SPIE
+		}
+		c.Mstatus |= v.Priv << MSTATUS_SPP_SHIFT
+		c.Mstatus &^= MSTATUS_SIE
+		v.Priv = PRIV_S
+	} else {
+		c.Mepc = pc
+		c.Mcause = exc.Cause
+		c.Mtval = exc.Tval
+
+		c.Mstatus &^= MSTATUS_MPIE | MSTATUS_MPP
+		if c.Mstatus&MSTATUS_MIE != 0 {
+			c.Mstatus |= MSTATUS_MPIE
+		}
+		c.Mstatus |= v.Priv << MSTATUS_MPP_SHIFT
+		c.Mstatus &^= MSTATUS_MIE
+		v.Priv = PRIV_M
+	}
+
+	// Exceptions always go to the base address, interrupts go to their own
+	// entry in vectored mode.
+	v.Pc = tvec &^ MTVEC_MODE_MASK
+	if exc.isInterrupt() && tvec&MTVEC_MODE_MASK == MTVEC_MODE_VECTORED {
+		v.Pc += 4 * (exc.Cause &^ CAUSE_INTERRUPT)
+	}
+}
+
+// Executes 'mret' at writeback, restoring the interrupt enable and the
+// privilege level and jumping back to mepc.
+func (v *Vm) returnFromTrap() {
+	v.squashYounger()
+
+	c := &v.Csrs
+	c.Mstatus &^= MSTATUS_MIE
+	if c.Mstatus&MSTATUS_MPIE != 0 {
+		c.Mstatus |= MSTATUS_MIE
+	}
+	c.Mstatus |= MSTATUS_MPIE
+
+	// MPP is left at the least privileged level
+	v.Priv = (c.Mstatus & MSTATUS_MPP) >> MSTATUS_MPP_SHIFT
+	c.Mstatus &^= MSTATUS_MPP
+	if v.Priv != PRIV_M {
+		c.Mstatus &^= MSTATUS_MPRV
+	}
+
+	v.Pc = c.Mepc
+}
+
+// Executes 'sret' at writeback, the supervisor mode version of 'mret'.
+func (v *Vm) returnFromSupervisorTrap() {
+	v.squashYounger()
+
+	c := &v.Csrs
+	c.Mstatus &^= MSTATUS_SIE
+	if c.Mstatus&MSTATUS_SPIE != 0 {
+		c.Mstatus |= MSTATUS_SIE
+	}
+	c.Mstatus |= MSTATUS_SPIE
+
+	v.Priv = (c.Mstatus & MSTATUS_SPP) >> MSTATUS_SPP_SHIFT
+	c.Mstatus &^= MSTATUS_SPP | MSTATUS_MPRV
+
+	v.Pc = c.Sepc
+}
+
+// Executes 'sfence.vma' at writeback. The TLB entries are dropped and the
+// younger instructions are fetched again, since their fetch used the old
+// translations.
+func (v *Vm) fenceVma(inst Instruction, pc uint32) {
+	v.squashYounger()
+	v.Tlb.flush(uint32(inst._s1), inst.Rs1 == 0)
+	v.Pc = pc + inst.size()
+}
+
+// ecall and ebreak causes, they are how a program asks to stop.
+func isEnvironmentCause(cause uint32) bool {
+	switch cause {
+	case CAUSE_ECALL_U, CAUSE_ECALL_S, CAUSE_ECALL_M, CAUSE_BREAKPOINT:
+		return true
+	}
+	return false
+}
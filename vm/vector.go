@@ -0,0 +1,850 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A subset of the vector extension(RVV 1.0). There are 32 vector registers of
+// VLEN bits, vsetvli picks the element width(SEW) and how many registers are
+// grouped together(LMUL), which gives the number of elements an instruction
+// works on(vl). Elements can be 8, 16, 32 or 64 bits wide and LMUL can be 1,
+// 2, 4 or 8, other settings make vtype illegal.
+//
+// Masked instructions only update the elements whose bit is set in v0. The
+// masked-off elements and the ones past vl are left undisturbed, which is
+// allowed under both the agnostic and the undisturbed policies.
+//
+// The vector unit processes Vector_lanes elements per cycle, so an instruction
+// stays in the execute stage for ceil(vl / lanes) cycles. Loads and stores
+// translate the address of each element there, then access all of them in
+// the memory stage. The register file is written at writeback, and it is
+// tracked as a single register by the hazard logic. Vector results are never
+// forwarded.
+
+const (
+	DEFAULT_VLEN         = 128 // In bits
+	DEFAULT_VECTOR_LANES = 4
+
+	VLEN_MIN = 64 // Elements can be 64 bits wide
+	VLEN_MAX = 65536
+)
+
+// Register index of the whole vector register file for the hazard logic, see
+// FP_REG_OFFSET. Every vector instruction but vsetvli reads it.
+const VECTOR_REG_INDEX = 64
+
+const (
+	CSR_VL    uint32 = 0xc20
+	CSR_VTYPE uint32 = 0xc21
+	CSR_VLENB uint32 = 0xc22 // VLEN in bytes
+)
+
+// Fields of vtype
+const (
+	VTYPE_VLMUL      uint32 = 0x7 // log2(LMUL), the fractional values are not supported
+	VTYPE_VSEW_SHIFT        = 3
+	VTYPE_VSEW       uint32 = 0x7 << VTYPE_VSEW_SHIFT // log2(SEW / 8)
+	VTYPE_VTA        uint32 = 1 << 6                  // Tail agnostic
+	VTYPE_VMA        uint32 = 1 << 7                  // Mask agnostic
+	VTYPE_VILL       uint32 = 1 << 31                 // Illegal vtype, every vector instruction but vsetvli traps
+)
+
+// Kind of the value an operand field of a vector instruction holds
+type Vec_Operand uint8
+
+const (
+	VOP_NONE Vec_Operand = iota
+	VOP_VEC              // Vector register
+	VOP_INT              // Integer register
+	VOP_IMM              // 5-bit immediate
+)
+
+type vec_operands struct {
+	rd, rs1, rs2 Vec_Operand
+}
+
+// Operands of the vector instructions, in the order they are written. The
+// sources of '.vv', '.vx' and '.vi' are written as 'vd, vs2, vs1/rs1/imm',
+// vs2 goes into Rs1. Loads and stores are written as 'vd, (rs1)' and the
+// strided ones as 'vd, (rs1), rs2', the data register of a store is in Rd.
+var vecOperandTable = map[Inst_Op]vec_operands{
+	Inst_Vsetvli: {VOP_INT, VOP_INT, VOP_IMM}, // rd, rs1, vtype
+
+	Inst_Vle8_v:   {VOP_VEC, VOP_INT, VOP_NONE},
+	Inst_Vle16_v:  {VOP_VEC, VOP_INT, VOP_NONE},
+	Inst_Vle32_v:  {VOP_VEC, VOP_INT, VOP_NONE},
+	Inst_Vle64_v:  {VOP_VEC, VOP_INT, VOP_NONE},
+	Inst_Vse8_v:   {VOP_VEC, VOP_INT, VOP_NONE},
+	Inst_Vse16_v:  {VOP_VEC, VOP_INT, VOP_NONE},
+	Inst_Vse32_v:  {VOP_VEC, VOP_INT, VOP_NONE},
+	Inst_Vse64_v:  {VOP_VEC, VOP_INT, VOP_NONE},
+	Inst_Vlse8_v:  {VOP_VEC, VOP_INT, VOP_INT},
+	Inst_Vlse16_v: {VOP_VEC, VOP_INT, VOP_INT},
+	Inst_Vlse32_v: {VOP_VEC, VOP_INT, VOP_INT},
+	Inst_Vlse64_v: {VOP_VEC, VOP_INT, VOP_INT},
+	Inst_Vsse8_v:  {VOP_VEC, VOP_INT, VOP_INT},
+	Inst_Vsse16_v: {VOP_VEC, VOP_INT, VOP_INT},
+	Inst_Vsse32_v: {VOP_VEC, VOP_INT, VOP_INT},
+	Inst_Vsse64_v: {VOP_VEC, VOP_INT, VOP_INT},
+
+	Inst_Vadd_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vadd_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vadd_vi:  {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vsub_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vsub_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vrsub_vx: {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vrsub_vi: {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vmul_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vmul_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vand_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vand_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vand_vi:  {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vor_vv:   {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vor_vx:   {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vor_vi:   {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vxor_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vxor_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vxor_vi:  {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vsll_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vsll_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vsll_vi:  {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vsrl_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vsrl_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vsrl_vi:  {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vsra_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vsra_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vsra_vi:  {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vmin_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vmin_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vminu_vv: {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vminu_vx: {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vmax_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vmax_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vmaxu_vv: {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vmaxu_vx: {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vmacc_vv: {VOP_VEC, VOP_VEC, VOP_VEC}, // vd, vs1, vs2
+	Inst_Vmacc_vx: {VOP_VEC, VOP_INT, VOP_VEC}, // vd, rs1, vs2
+
+	Inst_Vmseq_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vmseq_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vmseq_vi:  {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vmsne_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vmsne_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vmsne_vi:  {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vmslt_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vmslt_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vmsltu_vv: {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vmsltu_vx: {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vmsle_vv:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vmsle_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vmsle_vi:  {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vmsleu_vv: {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vmsleu_vx: {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vmsleu_vi: {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vmsgt_vx:  {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vmsgt_vi:  {VOP_VEC, VOP_VEC, VOP_IMM},
+	Inst_Vmsgtu_vx: {VOP_VEC, VOP_VEC, VOP_INT},
+	Inst_Vmsgtu_vi: {VOP_VEC, VOP_VEC, VOP_IMM},
+
+	Inst_Vredsum_vs:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vredand_vs:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vredor_vs:   {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vredxor_vs:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vredmin_vs:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vredminu_vs: {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vredmax_vs:  {VOP_VEC, VOP_VEC, VOP_VEC},
+	Inst_Vredmaxu_vs: {VOP_VEC, VOP_VEC, VOP_VEC},
+
+	Inst_Vmv_v_v: {VOP_VEC, VOP_VEC, VOP_NONE},
+	Inst_Vmv_v_x: {VOP_VEC, VOP_INT, VOP_NONE},
+	Inst_Vmv_v_i: {VOP_VEC, VOP_IMM, VOP_NONE},
+	Inst_Vmv_x_s: {VOP_INT, VOP_VEC, VOP_NONE},
+	Inst_Vmv_s_x: {VOP_VEC, VOP_INT, VOP_NONE},
+	Inst_Vid_v:   {VOP_VEC, VOP_NONE, VOP_NONE},
+}
+
+// The element operation of the '.vx' and '.vi' forms is the one of the '.vv' form.
+var vecBaseOp = map[Inst_Op]Inst_Op{
+	Inst_Vadd_vx:   Inst_Vadd_vv,
+	Inst_Vadd_vi:   Inst_Vadd_vv,
+	Inst_Vsub_vx:   Inst_Vsub_vv,
+	Inst_Vrsub_vi:  Inst_Vrsub_vx,
+	Inst_Vmul_vx:   Inst_Vmul_vv,
+	Inst_Vand_vx:   Inst_Vand_vv,
+	Inst_Vand_vi:   Inst_Vand_vv,
+	Inst_Vor_vx:    Inst_Vor_vv,
+	Inst_Vor_vi:    Inst_Vor_vv,
+	Inst_Vxor_vx:   Inst_Vxor_vv,
+	Inst_Vxor_vi:   Inst_Vxor_vv,
+	Inst_Vsll_vx:   Inst_Vsll_vv,
+	Inst_Vsll_vi:   Inst_Vsll_vv,
+	Inst_Vsrl_vx:   Inst_Vsrl_vv,
+	Inst_Vsrl_vi:   Inst_Vsrl_vv,
+	Inst_Vsra_vx:   Inst_Vsra_vv,
+	Inst_Vsra_vi:   Inst_Vsra_vv,
+	Inst_Vmin_vx:   Inst_Vmin_vv,
+	Inst_Vminu_vx:  Inst_Vminu_vv,
+	Inst_Vmax_vx:   Inst_Vmax_vv,
+	Inst_Vmaxu_vx:  Inst_Vmaxu_vv,
+	Inst_Vmacc_vx:  Inst_Vmacc_vv,
+	Inst_Vmseq_vx:  Inst_Vmseq_vv,
+	Inst_Vmseq_vi:  Inst_Vmseq_vv,
+	Inst_Vmsne_vx:  Inst_Vmsne_vv,
+	Inst_Vmsne_vi:  Inst_Vmsne_vv,
+	Inst_Vmslt_vx:  Inst_Vmslt_vv,
+	Inst_Vmsltu_vx: Inst_Vmsltu_vv,
+	Inst_Vmsle_vx:  Inst_Vmsle_vv,
+	Inst_Vmsle_vi:  Inst_Vmsle_vv,
+	Inst_Vmsleu_vx: Inst_Vmsleu_vv,
+	Inst_Vmsleu_vi: Inst_Vmsleu_vv,
+	Inst_Vmsgt_vi:  Inst_Vmsgt_vx,
+	Inst_Vmsgtu_vi: Inst_Vmsgtu_vx,
+}
+
+func vecElementOp(op Inst_Op) Inst_Op {
+	if base, ok := vecBaseOp[op]; ok {
+		return base
+	}
+	return op
+}
+
+// Names of the vtype fields in vsetvli, 'vsetvli rd, rs1, e32, m1, ta, ma'.
+// The policies default to undisturbed.
+var vtypeFieldNames = map[string]uint32{
+	"e8":  0 << VTYPE_VSEW_SHIFT,
+	"e16": 1 << VTYPE_VSEW_SHIFT,
+	"e32": 2 << VTYPE_VSEW_SHIFT,
+	"e64": 3 << VTYPE_VSEW_SHIFT,
+	"m1":  0,
+	"m2":  1,
+	"m4":  2,
+	"m8":  3,
+	"tu":  0,
+	"ta":  VTYPE_VTA,
+	"mu":  0,
+	"ma":  VTYPE_VMA,
+}
+
+// Vector registers by name, 'v0'-'v31' are added in init()
+var vecRegNum = map[string]int{}
+
+func init() {
+	for i := range 32 {
+		vecRegNum[fmt.Sprintf("v%d", i)] = i
+	}
+}
+
+// The operand that makes an instruction masked, written last.
+const VECTOR_MASK_OPERAND = "v0.t"
+
+// State of a vector instruction between the execute and writeback stages.
+// It is only set once the instruction reaches execute.
+type vector_exec struct {
+	vl     int
+	sew    int // In bits
+	lmul   int
+	cycles int // Execute cycles spent on the elements
+
+	active []bool   // Whether each element below vl is updated, from the mask
+	addrs  []uint32 // Physical address of each active element of a load or store
+	data   []byte   // New contents of the destination register group, or the data of a store
+}
+
+func (inst Instruction) isVector() bool {
+	return _Inst_V_start < inst.Op && inst.Op < _Inst_V_end
+}
+
+func (inst Instruction) isVectorLoad() bool {
+	return Inst_Vle8_v <= inst.Op && inst.Op <= Inst_Vle64_v || Inst_Vlse8_v <= inst.Op && inst.Op <= Inst_Vlse64_v
+}
+
+func (inst Instruction) isVectorStore() bool {
+	return Inst_Vse8_v <= inst.Op && inst.Op <= Inst_Vse64_v || Inst_Vsse8_v <= inst.Op && inst.Op <= Inst_Vsse64_v
+}
+
+func (inst Instruction) isVectorStrided() bool {
+	return Inst_Vlse8_v <= inst.Op && inst.Op <= Inst_Vsse64_v
+}
+
+func (inst Instruction) isVectorCompare() bool {
+	return Inst_Vmseq_vv <= inst.Op && inst.Op <= Inst_Vmsgtu_vi
+}
+
+func (inst Instruction) isVectorReduction() bool {
+	return Inst_Vredsum_vs <= inst.Op && inst.Op <= Inst_Vredmaxu_vs
+}
+
+// Returns the width of the elements a vector load or store accesses, in bits.
+func (inst Instruction) vectorMemoryWidth() int {
+	op := inst.Op
+	switch {
+	case op >= Inst_Vsse8_v:
+		op -= Inst_Vsse8_v
+	case op >= Inst_Vlse8_v:
+		op -= Inst_Vlse8_v
+	case op >= Inst_Vse8_v:
+		op -= Inst_Vse8_v
+	default:
+		op -= Inst_Vle8_v
+	}
+	return 8 << op
+}
+
+// Returns the sources of a vector instruction for getSourceRegisters, the
+// vector register file is the third one.
+func (inst Instruction) vectorSourceRegisters() (int32, int32, int32) {
+	ops := vecOperandTable[inst.Op]
+	rs1, rs2, rs3 := int32(-1), int32(-1), int32(VECTOR_REG_INDEX)
+	if ops.rs1 == VOP_INT {
+		rs1 = inst.Rs1
+	}
+	if ops.rs2 == VOP_INT {
+		rs2 = inst.Rs2
+	}
+	if inst.Op == Inst_Vsetvli {
+		rs3 = -1
+	}
+	return rs1, rs2, rs3
+}
+
+func (inst Instruction) vectorDestRegister() int32 {
+	switch {
+	case inst.isVectorStore():
+		return -1
+	case vecOperandTable[inst.Op].rd == VOP_INT:
+		return inst.Rd
+	default:
+		return VECTOR_REG_INDEX
+	}
+}
+
+func (inst Instruction) vectorImmediate() int32 {
+	ops := vecOperandTable[inst.Op]
+	switch {
+	case ops.rs1 == VOP_IMM:
+		return inst.Rs1
+	case ops.rs2 == VOP_IMM:
+		return inst.Rs2
+	default:
+		return 0
+	}
+}
+
+// Returns the vtype in the form vsetvli takes it, like 'e32, m1, ta, ma'.
+// The ones that can't be written with vtypeFieldNames are given as a number.
+func vtypeStr(vtype uint32) string {
+	if vtype&^(VTYPE_VLMUL|VTYPE_VSEW|VTYPE_VTA|VTYPE_VMA) != 0 || vtype&VTYPE_VSEW > 3<<VTYPE_VSEW_SHIFT || vtype&VTYPE_VLMUL > 3 {
+		return fmt.Sprintf("%d", vtype)
+	}
+
+	sew := 8 << ((vtype & VTYPE_VSEW) >> VTYPE_VSEW_SHIFT)
+	lmul := 1 << (vtype & VTYPE_VLMUL)
+	ta, ma := "tu", "mu"
+	if vtype&VTYPE_VTA != 0 {
+		ta = "ta"
+	}
+	if vtype&VTYPE_VMA != 0 {
+		ma = "ma"
+	}
+	return fmt.Sprintf("e%d, m%d, %s, %s", sew, lmul, ta, ma)
+}
+
+func (inst Instruction) vectorStr() string {
+	op := opcodeName(inst.Op)
+
+	var str string
+	switch {
+	case inst.Op == Inst_Vsetvli:
+		str = fmt.Sprintf("%s %s, %s, %s", op, regName(inst.Rd, REG_INT), regName(inst.Rs1, REG_INT), vtypeStr(uint32(inst.Rs2)))
+	case inst.isVectorStrided():
+		str = fmt.Sprintf("%s v%d, (%s), %s", op, inst.Rd, regName(inst.Rs1, REG_INT), regName(inst.Rs2, REG_INT))
+	case inst.isVectorLoad() || inst.isVectorStore():
+		str = fmt.Sprintf("%s v%d, (%s)", op, inst.Rd, regName(inst.Rs1, REG_INT))
+	default:
+		ops := vecOperandTable[inst.Op]
+		operands := []string{}
+		for i, kind := range [3]Vec_Operand{ops.rd, ops.rs1, ops.rs2} {
+			reg := [3]int32{inst.Rd, inst.Rs1, inst.Rs2}[i]
+			switch kind {
+			case VOP_VEC:
+				operands = append(operands, fmt.Sprintf("v%d", reg))
+			case VOP_INT:
+				operands = append(operands, regName(reg, REG_INT))
+			case VOP_IMM:
+				operands = append(operands, fmt.Sprintf("%d", reg))
+			}
+		}
+		str = fmt.Sprintf("%s %s", op, strings.Join(operands, ", "))
+	}
+
+	if inst.Masked {
+		str += ", " + VECTOR_MASK_OPERAND
+	}
+	return str
+}
+
+// Returns an error if the operands of a vector instruction can't be encoded.
+// The register groups depend on vtype, they are checked when executed.
+func checkVectorOperands(inst Instruction) error {
+	ops := vecOperandTable[inst.Op]
+	var err error
+
+	if imm := inst.vectorImmediate(); ops.rs1 == VOP_IMM || ops.rs2 == VOP_IMM {
+		lo, hi := int32(-16), int32(15)
+		switch vecElementOp(inst.Op) {
+		case Inst_Vsetvli:
+			lo, hi = 0, 1<<11-1
+		case Inst_Vsll_vv, Inst_Vsrl_vv, Inst_Vsra_vv: // Shift amounts are unsigned
+			lo, hi = 0, 31
+		}
+		if imm < lo || imm > hi {
+			err = fmt.Errorf("immediate '%d' must be in [%d, %d]", imm, lo, hi)
+		}
+	}
+
+	if err == nil && inst.Masked {
+		switch {
+		case inst.Op == Inst_Vsetvli || Inst_Vmv_v_v <= inst.Op && inst.Op <= Inst_Vmv_s_x:
+			err = fmt.Errorf("the instruction can't be masked")
+		case inst.Rd == 0 && ops.rd == VOP_VEC && !inst.isVectorStore() && !inst.isVectorCompare() && !inst.isVectorReduction():
+			// Only a mask or a single element can be written over the mask
+			err = fmt.Errorf("the destination of a masked instruction can't be v0")
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("Invalid operands for '%s': %v", opcodeName(inst.Op), err)
+	}
+	return nil
+}
+
+// Returns SEW, LMUL and VLMAX for the vtype, ok is false if it is not supported.
+func (v *Vm) vtypeSettings(vtype uint32) (sew, lmul, vlmax int, ok bool) {
+	if vtype&VTYPE_VILL != 0 || vtype&^(VTYPE_VLMUL|VTYPE_VSEW|VTYPE_VTA|VTYPE_VMA) != 0 {
+		return 0, 0, 0, false
+	}
+
+	vsew := (vtype & VTYPE_VSEW) >> VTYPE_VSEW_SHIFT
+	vlmul := vtype & VTYPE_VLMUL
+	if vsew > 3 || vlmul > 3 {
+		return 0, 0, 0, false
+	}
+
+	sew, lmul = 8<<vsew, 1<<vlmul
+	return sew, lmul, v.Config.Vlen * lmul / sew, true
+}
+
+// Sets vl and vtype. Unsupported vtypes set vill and make vl zero.
+func (v *Vm) executeVsetvli(inst *Instruction) {
+	vtype := uint32(inst._imm)
+	_, _, vlmax, ok := v.vtypeSettings(vtype)
+	if !ok {
+		v.Vtype, v.Vl = VTYPE_VILL, 0
+		inst._result = 0
+		return
+	}
+
+	// x0 as the source asks for VLMAX, or keeps vl if rd is x0 too
+	var avl uint64
+	switch {
+	case inst.Rs1 != 0:
+		avl = v.zext(inst._s1)
+	case inst.Rd != 0:
+		avl = uint64(vlmax)
+	default:
+		avl = uint64(v.Vl)
+	}
+
+	v.Vtype = vtype
+	v.Vl = uint32(min(avl, uint64(vlmax)))
+	inst._result = int64(v.Vl)
+}
+
+// Returns the bytes of the register group starting at vector register reg.
+func (v *Vm) vectorGroup(reg int32, n int) []byte {
+	vlenb := v.Config.Vlen / 8
+	return v.VRegisters[int(reg)*vlenb : (int(reg)+n)*vlenb]
+}
+
+// Reads element i of the given width from a register group, sign-extended.
+func readElement(group []byte, i, sew int) int64 {
+	n := sew / 8
+	var u uint64
+	for j := range n {
+		u |= uint64(group[i*n+j]) << (j * 8)
+	}
+	return sextElement(int64(u), sew)
+}
+
+// Writes the low sew bits of x into element i of a register group.
+func writeElement(group []byte, i, sew int, x int64) {
+	n := sew / 8
+	for j := range n {
+		group[i*n+j] = byte(x >> (j * 8))
+	}
+}
+
+func sextElement(x int64, sew int) int64 {
+	shift := 64 - sew
+	return x << shift >> shift
+}
+
+func zextElement(x int64, sew int) uint64 {
+	return uint64(x) << (64 - sew) >> (64 - sew)
+}
+
+func maskBit(mask []byte, i int) bool {
+	return mask[i/8]>>(i%8)&1 != 0
+}
+
+func setMaskBit(mask []byte, i int, b bool) {
+	if b {
+		mask[i/8] |= 1 << (i % 8)
+	} else {
+		mask[i/8] &^= 1 << (i % 8)
+	}
+}
+
+// Checks vtype and the register groups of a vector instruction, and sets up
+// its execution in the first execute cycle. The elements keep the instruction
+// in execute for ceil(vl / lanes) cycles, loads and stores also translate the
+// address of each element here.
+func (v *Vm) issueVector(inst *Instruction) {
+	if inst.Op == Inst_Vsetvli {
+		return
+	}
+
+	illegal := func(format string, args ...any) {
+		msg := fmt.Sprintf(format, args...)
+		inst.raise(newException(CAUSE_ILLEGAL_INSTRUCTION, 0, "Illegal instruction: '%s' %s", opcodeName(inst.Op), msg))
+	}
+
+	sew, lmul, _, ok := v.vtypeSettings(v.Vtype)
+	if !ok {
+		illegal("with an illegal vtype, vsetvli must be executed first")
+		return
+	}
+
+	vec := &vector_exec{vl: int(v.Vl), sew: sew, lmul: lmul}
+
+	// Loads and stores have their own element width, their register group
+	// grows or shrinks with it.
+	emul := lmul
+	if inst.isVectorLoad() || inst.isVectorStore() {
+		vec.sew = inst.vectorMemoryWidth()
+		if lmul*vec.sew/sew > 8 {
+			illegal("needs more than 8 registers for SEW=%d and LMUL=%d", sew, lmul)
+			return
+		}
+		emul = max(1, lmul*vec.sew/sew)
+	}
+
+	// Register groups must start at a multiple of their size. The mask
+	// results, the scalars and the reduction operands other than vs2 are single registers.
+	ops := vecOperandTable[inst.Op]
+	for i, kind := range [3]Vec_Operand{ops.rd, ops.rs1, ops.rs2} {
+		reg := [3]int32{inst.Rd, inst.Rs1, inst.Rs2}[i]
+		single := (i == 0 && inst.isVectorCompare()) || (i != 1 && inst.isVectorReduction()) ||
+			inst.Op == Inst_Vmv_x_s || inst.Op == Inst_Vmv_s_x
+		if kind == VOP_VEC && !single && reg%int32(emul) != 0 {
+			illegal("register 'v%d' is not aligned to LMUL=%d", reg, emul)
+			return
+		}
+	}
+
+	mask := v.vectorGroup(0, 1)
+	vec.active = make([]bool, vec.vl)
+	for i := range vec.active {
+		vec.active[i] = !inst.Masked || maskBit(mask, i)
+	}
+
+	vec.cycles = max(1, (vec.vl+v.Config.Vector_lanes-1)/v.Config.Vector_lanes)
+	inst._ex_remaining += vec.cycles - 1
+	inst._vec = vec
+
+	if !inst.isVectorLoad() && !inst.isVectorStore() {
+		return
+	}
+
+	// The data of a store is read now, a load starts from the destination so
+	// that the inactive elements are left undisturbed.
+	vec.data = append([]byte{}, v.vectorGroup(inst.Rd, emul)...)
+
+	stride := int64(vec.sew / 8)
+	if inst.isVectorStrided() {
+		stride = inst._s2
+	}
+
+	access := ACCESS_LOAD
+	if inst.isVectorStore() {
+		access = ACCESS_STORE
+	}
+
+	vec.addrs = make([]uint32, vec.vl)
+	for i, active := range vec.active {
+		if !active {
+			continue
+		}
+
+		vaddr := v.zext(inst._s1 + int64(i)*stride)
+		if vaddr>>32 != 0 {
+			inst.raise(addressOutOfRange(access, vaddr))
+			return
+		}
+		paddr, walk, exc := v.translate(uint32(vaddr), access)
+		if exc != nil {
+			inst.raise(exc)
+			return
+		}
+		vec.addrs[i] = paddr
+		inst._ex_remaining += walk
+	}
+}
+
+// Executes a vector instruction other than a load or a store, in the last
+// execute cycle. The new contents of the destination group are kept in the
+// instruction until writeback.
+func (v *Vm) executeVector(inst *Instruction) {
+	if inst.Op == Inst_Vsetvli {
+		v.executeVsetvli(inst)
+		return
+	}
+
+	// Nothing is set up if the instruction faulted in its first cycle
+	vec := inst._vec
+	if inst._exception != nil || inst.isVectorLoad() || inst.isVectorStore() {
+		return
+	}
+
+	sew := vec.sew
+	ops := vecOperandTable[inst.Op]
+
+	// The scalar or immediate operand, sign-extended from SEW like the elements
+	var scalar int64
+	switch {
+	case ops.rs1 == VOP_INT:
+		scalar = inst._s1
+	case ops.rs2 == VOP_INT:
+		scalar = inst._s2
+	default:
+		scalar = int64(inst._imm)
+	}
+	scalar = sextElement(scalar, sew)
+
+	switch {
+	case inst.Op == Inst_Vmv_x_s:
+		// Performed even when vl is zero
+		inst._result = v.sext(readElement(v.vectorGroup(inst.Rs1, 1), 0, sew))
+		return
+
+	case inst.Op == Inst_Vmv_s_x:
+		vec.data = append([]byte{}, v.vectorGroup(inst.Rd, 1)...)
+		if vec.vl > 0 {
+			writeElement(vec.data, 0, sew, scalar)
+		}
+		return
+
+	case inst.isVectorReduction():
+		vec.data = append([]byte{}, v.vectorGroup(inst.Rd, 1)...)
+		if vec.vl == 0 {
+			return
+		}
+
+		src := v.vectorGroup(inst.Rs1, vec.lmul)
+		acc := readElement(v.vectorGroup(inst.Rs2, 1), 0, sew)
+		for i, active := range vec.active {
+			if active {
+				acc = vectorReduce(inst.Op, acc, readElement(src, i, sew), sew)
+			}
+		}
+		writeElement(vec.data, 0, sew, acc)
+		return
+
+	case inst.isVectorCompare():
+		vec.data = append([]byte{}, v.vectorGroup(inst.Rd, 1)...)
+		a := v.vectorGroup(inst.Rs1, vec.lmul)
+		for i, active := range vec.active {
+			if !active {
+				continue
+			}
+
+			b := scalar
+			if ops.rs2 == VOP_VEC {
+				b = readElement(v.vectorGroup(inst.Rs2, vec.lmul), i, sew)
+			}
+			setMaskBit(vec.data, i, vectorCompare(inst.Op, readElement(a, i, sew), b, sew))
+		}
+		return
+	}
+
+	vec.data = append([]byte{}, v.vectorGroup(inst.Rd, vec.lmul)...)
+	for i, active := range vec.active {
+		if !active {
+			continue
+		}
+
+		var result int64
+		switch inst.Op {
+		case Inst_Vmv_v_v:
+			result = readElement(v.vectorGroup(inst.Rs1, vec.lmul), i, sew)
+		case Inst_Vmv_v_x, Inst_Vmv_v_i:
+			result = scalar
+		case Inst_Vid_v:
+			result = int64(i)
+		case Inst_Vmacc_vv, Inst_Vmacc_vx:
+			a := scalar
+			if ops.rs1 == VOP_VEC {
+				a = readElement(v.vectorGroup(inst.Rs1, vec.lmul), i, sew)
+			}
+			b := readElement(v.vectorGroup(inst.Rs2, vec.lmul), i, sew)
+			result = a*b + readElement(vec.data, i, sew)
+		default:
+			b := scalar
+			if ops.rs2 == VOP_VEC {
+				b = readElement(v.vectorGroup(inst.Rs2, vec.lmul), i, sew)
+			}
+			result = vectorArith(inst.Op, readElement(v.vectorGroup(inst.Rs1, vec.lmul), i, sew), b, sew)
+		}
+		writeElement(vec.data, i, sew, result)
+	}
+}
+
+// Returns the result of an element operation on the sign-extended elements
+// a and b. a is the element of vs2, b the one of vs1 or the scalar.
+func vectorArith(op Inst_Op, a, b int64, sew int) int64 {
+	ua, ub := zextElement(a, sew), zextElement(b, sew)
+	shamt := ub & uint64(sew-1)
+
+	switch vecElementOp(op) {
+	case Inst_Vadd_vv:
+		return a + b
+	case Inst_Vsub_vv:
+		return a - b
+	case Inst_Vrsub_vx:
+		return b - a
+	case Inst_Vmul_vv:
+		return a * b
+	case Inst_Vand_vv:
+		return a & b
+	case Inst_Vor_vv:
+		return a | b
+	case Inst_Vxor_vv:
+		return a ^ b
+	case Inst_Vsll_vv:
+		return a << shamt
+	case Inst_Vsrl_vv:
+		return int64(ua >> shamt)
+	case Inst_Vsra_vv:
+		return a >> shamt
+	case Inst_Vmin_vv:
+		return min(a, b)
+	case Inst_Vminu_vv:
+		return int64(min(ua, ub))
+	case Inst_Vmax_vv:
+		return max(a, b)
+	case Inst_Vmaxu_vv:
+		return int64(max(ua, ub))
+	}
+	return 0
+}
+
+// Returns the result of a compare on the sign-extended elements a and b.
+func vectorCompare(op Inst_Op, a, b int64, sew int) bool {
+	ua, ub := zextElement(a, sew), zextElement(b, sew)
+
+	switch vecElementOp(op) {
+	case Inst_Vmseq_vv:
+		return a == b
+	case Inst_Vmsne_vv:
+		return a != b
+	case Inst_Vmslt_vv:
+		return a < b
+	case Inst_Vmsltu_vv:
+		return ua < ub
+	case Inst_Vmsle_vv:
+		return a <= b
+	case Inst_Vmsleu_vv:
+		return ua <= ub
+	case Inst_Vmsgt_vx:
+		return a > b
+	case Inst_Vmsgtu_vx:
+		return ua > ub
+	}
+	return false
+}
+
+// Folds the element x into the accumulator of a reduction.
+func vectorReduce(op Inst_Op, acc, x int64, sew int) int64 {
+	switch op {
+	case Inst_Vredsum_vs:
+		return sextElement(acc+x, sew)
+	case Inst_Vredand_vs:
+		return acc & x
+	case Inst_Vredor_vs:
+		return acc | x
+	case Inst_Vredxor_vs:
+		return acc ^ x
+	case Inst_Vredmin_vs:
+		return min(acc, x)
+	case Inst_Vredminu_vs:
+		return sextElement(int64(min(zextElement(acc, sew), zextElement(x, sew))), sew)
+	case Inst_Vredmax_vs:
+		return max(acc, x)
+	case Inst_Vredmaxu_vs:
+		return sextElement(int64(max(zextElement(acc, sew), zextElement(x, sew))), sew)
+	}
+	return acc
+}
+
+// Performs the element accesses of a vector load or store in the memory
+// stage. A store checks every element first, so that a fault leaves memory
+// unchanged. A faulting load does not write its destination.
+func (v *Vm) vectorMemoryAccess(inst *Instruction) *Exception {
+	vec := inst._vec
+	n := uint8(vec.sew / 8)
+
+	if inst.isVectorStore() {
+		for i, active := range vec.active {
+			if active {
+				if exc := v.checkAccess(vec.addrs[i], n, ACCESS_STORE); exc != nil {
+					return exc
+				}
+			}
+		}
+		for i, active := range vec.active {
+			if active {
+				v.memoryWrite(readElement(vec.data, i, vec.sew), vec.addrs[i], n)
+			}
+		}
+		return nil
+	}
+
+	for i, active := range vec.active {
+		if !active {
+			continue
+		}
+		data, exc := v.memoryRead(vec.addrs[i], n)
+		if exc != nil {
+			return exc
+		}
+		writeElement(vec.data, i, vec.sew, int64(data))
+	}
+	return nil
+}
+
+// Writes the destination group of a vector instruction at writeback.
+func (v *Vm) writeVectorResult(inst Instruction) {
+	vlenb := v.Config.Vlen / 8
+	copy(v.VRegisters[int(inst.Rd)*vlenb:], inst._vec.data)
+}
+
+// Counts the elements and the execute cycles of a retired vector instruction.
+func (dm *Diagnostics_Manager) countVector(inst Instruction) {
+	if inst._vec == nil {
+		return
+	}
+	dm.N_vector_insts++
+	dm.N_vector_elements += uint(inst._vec.vl)
+	dm.N_vector_cycles += uint(inst._vec.cycles)
+}
@@ -0,0 +1,192 @@
+package vm
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// The width of the integer registers. RV32 keeps 32-bit values sign-extended
+// in the 64-bit registers, so most instructions are executed the same way for
+// both and only the result is truncated. The ones that depend on the width go
+// through the helpers below.
+//
+// The address space of RV64 is 64 bits wide, but the memory and the program
+// occupy its lowest 4 GiB. Accesses and jumps above that raise access faults.
+// There is no Sv39, so RV64 only runs with physical addresses.
+
+const (
+	XLEN_32      = 32
+	XLEN_64      = 64
+	DEFAULT_XLEN = XLEN_32
+)
+
+// Returns the value truncated to XLEN bits and sign-extended.
+func (v *Vm) sext(x int64) int64 {
+	if v.Config.Xlen == XLEN_32 {
+		return int64(int32(x))
+	}
+	return x
+}
+
+// Returns the value truncated to XLEN bits and zero-extended.
+func (v *Vm) zext(x int64) uint64 {
+	if v.Config.Xlen == XLEN_32 {
+		return uint64(uint32(x))
+	}
+	return uint64(x)
+}
+
+// Returns the shift amount or bit index in x, its low log2(XLEN) bits.
+func (v *Vm) shamt(x int64) int {
+	return int(x) & (v.Config.Xlen - 1)
+}
+
+// Returns the high XLEN bits of the 2*XLEN bit product. The signed operands
+// are taken as two's complement values.
+func (v *Vm) mulh(s1, s2 int64, signed1, signed2 bool) int64 {
+	if v.Config.Xlen == XLEN_32 {
+		if !signed1 && !signed2 {
+			return int64((uint64(uint32(s1)) * uint64(uint32(s2))) >> 32)
+		}
+		a, b := int64(uint32(s1)), int64(uint32(s2))
+		if signed1 {
+			a = int64(int32(s1))
+		}
+		if signed2 {
+			b = int64(int32(s2))
+		}
+		return (a * b) >> 32
+	}
+
+	hi, _ := bits.Mul64(uint64(s1), uint64(s2))
+	// The unsigned product is off by the other operand for each negative one
+	if signed1 && s1 < 0 {
+		hi -= uint64(s2)
+	}
+	if signed2 && s2 < 0 {
+		hi -= uint64(s1)
+	}
+	return int64(hi)
+}
+
+func (v *Vm) clz(x int64) int64 {
+	if v.Config.Xlen == XLEN_32 {
+		return int64(bits.LeadingZeros32(uint32(x)))
+	}
+	return int64(bits.LeadingZeros64(uint64(x)))
+}
+
+func (v *Vm) ctz(x int64) int64 {
+	if v.Config.Xlen == XLEN_32 {
+		return int64(bits.TrailingZeros32(uint32(x)))
+	}
+	return int64(bits.TrailingZeros64(uint64(x)))
+}
+
+func (v *Vm) rev8(x int64) int64 {
+	if v.Config.Xlen == XLEN_32 {
+		return int64(bits.ReverseBytes32(uint32(x)))
+	}
+	return int64(bits.ReverseBytes64(uint64(x)))
+}
+
+// Rotates left by n, a negative n rotates right.
+func (v *Vm) rotate(x int64, n int) int64 {
+	if v.Config.Xlen == XLEN_32 {
+		return int64(bits.RotateLeft32(uint32(x), n))
+	}
+	return int64(bits.RotateLeft64(uint64(x), n))
+}
+
+// Sets every bit of each byte that has any bit set.
+func (v *Vm) orcB(x int64) int64 {
+	u := v.zext(x)
+	var result uint64
+	for i := 0; i < v.Config.Xlen; i += 8 {
+		if u>>i&0xff != 0 {
+			result |= 0xff << i
+		}
+	}
+	return int64(result)
+}
+
+// Instructions that only exist in RV64.
+func (inst Instruction) isRv64() bool {
+	switch inst.Op {
+	case Inst_Ld, Inst_Lwu, Inst_Sd, Inst_Addiw, Inst_Slliw, Inst_Srliw, Inst_Sraiw, Inst_Addw, Inst_Subw,
+		Inst_Sllw, Inst_Srlw, Inst_Sraw, Inst_Mulw, Inst_Divw, Inst_Divuw, Inst_Remw, Inst_Remuw:
+		return true
+	}
+
+	return false
+}
+
+// Executes the RV64 word instructions. They operate on the low 32 bits of
+// their operands, the result is sign-extended from 32 bits.
+func executeWord(inst Instruction) int64 {
+	s1, s2 := int32(inst._s1), int32(inst._s2)
+	var result int32
+
+	switch inst.Op {
+	case Inst_Addw:
+		result = s1 + s2
+	case Inst_Subw:
+		result = s1 - s2
+	case Inst_Sllw:
+		result = int32(uint32(s1) << (s2 & 0x1f))
+	case Inst_Srlw:
+		result = int32(uint32(s1) >> (s2 & 0x1f))
+	case Inst_Sraw:
+		result = s1 >> (s2 & 0x1f)
+	case Inst_Mulw:
+		result = s1 * s2
+	case Inst_Divw:
+		if s2 == 0 {
+			result = -1
+		} else {
+			result = s1 / s2 // Overflows to s1 for 'INT_MIN / -1'
+		}
+	case Inst_Divuw:
+		if s2 == 0 {
+			result = -1
+		} else {
+			result = int32(uint32(s1) / uint32(s2))
+		}
+	case Inst_Remw:
+		if s2 == 0 {
+			result = s1
+		} else {
+			result = s1 % s2
+		}
+	case Inst_Remuw:
+		if s2 == 0 {
+			result = s1
+		} else {
+			result = int32(uint32(s1) % uint32(s2))
+		}
+	case Inst_Addiw:
+		result = s1 + inst._imm
+	case Inst_Slliw:
+		result = int32(uint32(s1) << (inst._imm & 0x1f))
+	case Inst_Srliw:
+		result = int32(uint32(s1) >> (inst._imm & 0x1f))
+	case Inst_Sraiw:
+		result = s1 >> (inst._imm & 0x1f)
+	}
+
+	return int64(result)
+}
+
+// Returns the access fault for an address above the lowest 4 GiB. The trap
+// value registers are 32 bits wide, so the trap value is zero.
+func addressOutOfRange(access Access_Type, addr uint64) *Exception {
+	msg := fmt.Sprintf("address '%#x' out of range", addr)
+	switch access {
+	case ACCESS_FETCH:
+		return newException(CAUSE_FETCH_ACCESS, 0, "Instruction access fault: %s", msg)
+	case ACCESS_LOAD:
+		return newException(CAUSE_LOAD_ACCESS, 0, "Load access fault: %s", msg)
+	default:
+		return newException(CAUSE_STORE_ACCESS, 0, "Store access fault: %s", msg)
+	}
+}